@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gopkg.in/hraban/opus.v2"
+)
+
+// Replays a voice capture written with VOICE_CAPTURE through the receive
+// pipeline offline: decryption, a jitter buffer and Opus decoding, writing
+// one WAV file per speaker.
+//
+//	go build -o capture-replay ./capture_replay.go
+//	./capture-replay -keys voice.pcap.keys voice.pcap
+
+const (
+	replaySampleRate = 48000
+	replayFrameSize  = 960 // 20ms
+)
+
+type replayPacket struct {
+	arrival   time.Time
+	sequence  uint16
+	timestamp int64 // relative to the first packet, in samples
+	opus      []byte
+}
+
+func main() {
+	keysPath := flag.String("keys", "", "secret keys file; without it the decrypted packets are replayed")
+	outDir := flag.String("out", ".", "directory for the WAV files")
+	delay := flag.Duration("delay", 60*time.Millisecond, "jitter buffer delay; packets arriving later are treated as lost")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] capture.pcap\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var keys []discordgo.CaptureKey
+	if *keysPath != "" {
+		f, err := os.Open(*keysPath)
+		if err != nil {
+			log.Fatalf("Failed to open keys: %v", err)
+		}
+		keys, err = discordgo.ReadCaptureKeys(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read keys: %v", err)
+		}
+		if keys == nil {
+			log.Fatalf("No keys in %s", *keysPath)
+		}
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+
+	streams := map[uint32][]replayPacket{}
+	firstTimestamp := map[uint32]uint32{}
+	err = discordgo.ReplayCapture(f, keys, func(arrival time.Time, p *discordgo.Packet) {
+		first, ok := firstTimestamp[p.SSRC]
+		if !ok {
+			first = p.Timestamp
+			firstTimestamp[p.SSRC] = first
+		}
+		streams[p.SSRC] = append(streams[p.SSRC], replayPacket{
+			arrival:   arrival,
+			sequence:  p.Sequence,
+			timestamp: int64(int32(p.Timestamp - first)),
+			opus:      append([]byte(nil), p.Opus...),
+		})
+		p.Release()
+	})
+	if err != nil {
+		log.Fatalf("Failed to replay capture: %v", err)
+	}
+	if len(streams) == 0 {
+		log.Println("No audio packets in capture.")
+		return
+	}
+
+	for ssrc, packets := range streams {
+		name := filepath.Join(*outDir, fmt.Sprintf("ssrc-%d.wav", ssrc))
+		st, err := replayStream(name, packets, *delay)
+		if err != nil {
+			log.Fatalf("Failed to replay SSRC %d: %v", ssrc, err)
+		}
+		log.Printf("SSRC %d: %d packets, %d late, %d lost, %d duplicate, %d decode errors -> %s\n",
+			ssrc, len(packets), st.late, st.lost, st.duplicate, st.decodeErrors, name)
+	}
+}
+
+type replayStats struct {
+	late, lost, duplicate, decodeErrors int
+}
+
+// replayStream plays packets out through a fixed delay jitter buffer and
+// writes the decoded audio to name. Gaps are concealed by the decoder.
+func replayStream(name string, packets []replayPacket, delay time.Duration) (replayStats, error) {
+	var st replayStats
+
+	// Packets are played out delay after the first one arrived, at their
+	// RTP timestamp. Those arriving after their playout time are discarded,
+	// as a live jitter buffer would.
+	base := packets[0].arrival.Add(delay)
+	var kept []replayPacket
+	for _, p := range packets {
+		playout := base.Add(time.Duration(p.timestamp) * time.Second / replaySampleRate)
+		if p.arrival.After(playout) {
+			st.late++
+			continue
+		}
+		kept = append(kept, p)
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].timestamp < kept[j].timestamp })
+
+	dec, err := opus.NewDecoder(replaySampleRate, 1)
+	if err != nil {
+		return st, err
+	}
+
+	var pcm []int16
+	frame := make([]int16, replayFrameSize*6) // up to 120ms
+	next := int64(0)
+	if len(kept) > 0 {
+		next = kept[0].timestamp
+	}
+	for i, p := range kept {
+		if i > 0 && p.timestamp == kept[i-1].timestamp {
+			st.duplicate++
+			continue
+		}
+		for next < p.timestamp {
+			if err := dec.DecodePLC(frame[:replayFrameSize]); err != nil {
+				return st, err
+			}
+			pcm = append(pcm, frame[:replayFrameSize]...)
+			next += replayFrameSize
+			st.lost++
+		}
+
+		n, err := dec.Decode(p.opus, frame)
+		if err != nil {
+			st.decodeErrors++
+			n = replayFrameSize
+			for i := range frame[:n] {
+				frame[i] = 0
+			}
+		}
+		pcm = append(pcm, frame[:n]...)
+		next = p.timestamp + int64(n)
+	}
+
+	return st, writeWAV(name, pcm)
+}
+
+// writeWAV writes 16-bit mono PCM at replaySampleRate.
+func writeWAV(name string, pcm []int16) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	dataSize := uint32(len(pcm) * 2)
+	hdr := make([]byte, 44)
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], 36+dataSize)
+	copy(hdr[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(hdr[16:], 16)
+	binary.LittleEndian.PutUint16(hdr[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(hdr[22:], 1) // mono
+	binary.LittleEndian.PutUint32(hdr[24:], replaySampleRate)
+	binary.LittleEndian.PutUint32(hdr[28:], replaySampleRate*2)
+	binary.LittleEndian.PutUint16(hdr[32:], 2)
+	binary.LittleEndian.PutUint16(hdr[34:], 16)
+	copy(hdr[36:], "data")
+	binary.LittleEndian.PutUint32(hdr[40:], dataSize)
+
+	if _, err := f.Write(hdr); err != nil {
+		f.Close()
+		return err
+	}
+	if err := binary.Write(f, binary.LittleEndian, pcm); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
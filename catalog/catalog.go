@@ -0,0 +1,71 @@
+// Package catalog lists directories of media files by name, for the slash
+// commands that play them.
+//
+// A file's name is its file name without the extension. Extensions are
+// matched ignoring case, and names are offered to autocompletion by Match.
+package catalog
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Names returns the sorted names of the regular files in dir with one of
+// extensions, each given in lower case with its leading dot.
+func Names(dir string, extensions []string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var names []string
+	for _, f := range files {
+		if !f.Mode().IsRegular() || Extension(f.Name(), extensions) < 0 {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Extension returns the index in extensions of a file name's extension,
+// or -1.
+func Extension(name string, extensions []string) int {
+	ext := strings.ToLower(filepath.Ext(name))
+	for i, e := range extensions {
+		if ext == e {
+			return i
+		}
+	}
+	return -1
+}
+
+// Match returns up to max of names containing query, ignoring case, with
+// those starting with it first.
+func Match(names []string, query string, max int) []string {
+	query = strings.ToLower(query)
+	var prefix, contains []string
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, query) {
+			prefix = append(prefix, name)
+		} else if strings.Contains(lower, query) {
+			contains = append(contains, name)
+		}
+	}
+
+	matches := append(prefix, contains...)
+	if len(matches) > max {
+		matches = matches[:max]
+	}
+	return matches
+}
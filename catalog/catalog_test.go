@@ -0,0 +1,46 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.OGG", "a.opus", "a.dca", "c.txt", ".opus"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "d.opus"), 0755)
+
+	names, err := Names(dir, []string{".opus", ".ogg", ".dca"})
+	if want := []string{"a", "b"}; err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("Names incorrect: got %v, %v, want %v", names, err, want)
+	}
+	if _, err := Names(filepath.Join(dir, "missing"), nil); err == nil {
+		t.Error("Names of missing directory returned nil error")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	names := []string{"Bell", "airhorn", "bee", "jingle"}
+	tests := []struct {
+		query string
+		max   int
+		want  []string
+	}{
+		{"b", 25, []string{"Bell", "bee"}},
+		{"EE", 1, []string{"bee"}},
+		{"e", 25, []string{"Bell", "bee", "jingle"}},
+		{"x", 25, nil},
+	}
+	for _, tt := range tests {
+		if got := Match(names, tt.query, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q, %d) incorrect: got %v, want %v", tt.query, tt.max, got, tt.want)
+		}
+	}
+}
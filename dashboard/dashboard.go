@@ -0,0 +1,549 @@
+// Package dashboard serves a web page for the people in the room with a
+// bridge, so that they can see who is in its voice channel and who is
+// speaking, mute its mic, set its speaker volume, choose its sound devices
+// and join or leave the channel without needing rights on Discord.
+//
+// The page is embedded in the bot and kept up to date with Server-Sent
+// Events, while its buttons post JSON to a small API which a Controller
+// carries out.
+package dashboard
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+//go:embed static
+var static embed.FS
+
+// levelHalfLife is the time a level meter takes to fall by half once the
+// audio stops, and speakingHold the time a speaker is shown as speaking
+// after their last packet.
+const (
+	levelHalfLife = 150 * time.Millisecond
+	speakingHold  = 300 * time.Millisecond
+)
+
+// MaxVolume is the highest speaker volume, twice the received level.
+const MaxVolume = 2
+
+// ErrNotJoined is returned for actions which need a voice channel while
+// the bot is in none.
+var ErrNotJoined = errors.New("not in a voice channel")
+
+// A Controller carries out the actions of the page for a bot.
+type Controller interface {
+	// Join joins the voice channel channelID, leaving any other.
+	Join(channelID string) error
+	// Leave leaves the voice channel.
+	Leave() error
+	// Devices returns the sound devices which can be chosen.
+	Devices() ([]Device, error)
+	// SetDevices switches the mic and speaker to the devices named, where
+	// "" is the default device.
+	SetDevices(input, output string) error
+}
+
+// A Device is a sound device.
+type Device struct {
+	Name   string `json:"name"`
+	Input  bool   `json:"input"`
+	Output bool   `json:"output"`
+}
+
+// A Channel is a voice channel the bot can join.
+type Channel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// A Member is a user in the bot's voice channel.
+type Member struct {
+	UserID   string  `json:"id"`
+	Name     string  `json:"name"`
+	Speaking bool    `json:"speaking"`
+	Level    float64 `json:"level"` // peak level of their audio, from 0 to 1
+	Muted    bool    `json:"muted"`
+	Deafened bool    `json:"deafened"`
+}
+
+// State is what the page shows.
+type State struct {
+	Guild    string    `json:"guild"`
+	Channel  *Channel  `json:"channel"` // nil when not in a voice channel
+	Channels []Channel `json:"channels"`
+	Members  []Member  `json:"members"`
+	MicLevel float64   `json:"micLevel"`
+	MicMuted bool      `json:"micMuted"`
+	Volume   float64   `json:"volume"`
+	Input    string    `json:"input"`
+	Output   string    `json:"output"`
+}
+
+// A meter follows the peak level of some audio.
+type meter struct {
+	level float64
+	at    time.Time
+}
+
+// set records audio whose peak level is peak.
+func (m *meter) set(peak float64, now time.Time) {
+	if l := m.get(now); l > peak {
+		peak = l
+	}
+	m.level, m.at = peak, now
+}
+
+// get returns the level, falling since the last audio.
+func (m *meter) get(now time.Time) float64 {
+	if m.at.IsZero() {
+		return 0
+	}
+	return m.level * math.Exp2(-float64(now.Sub(m.at))/float64(levelHalfLife))
+}
+
+// A speaker is the audio received with an SSRC.
+type speaker struct {
+	meter
+	active time.Time // of their last packet or start of speech
+}
+
+// A Dashboard serves the page of a bot in a guild.
+type Dashboard struct {
+	// Password, if set, is asked for by the browser before showing the
+	// page, with any user name.
+	Password string
+
+	// Interval is the time between updates sent to each page.
+	Interval time.Duration
+
+	// OnAction, if set, is called after each action of the page, such as
+	// "mute" or "join", with its error if it failed.
+	OnAction func(r *http.Request, action string, err error)
+
+	s     *discordgo.Session
+	ctl   Controller
+	files http.Handler
+
+	sync.Mutex
+	handlers      map[string]http.Handler // by path
+	guildID       string
+	channelID     string
+	users         map[uint32]string // by SSRC
+	speakers      map[uint32]*speaker
+	mic           meter
+	micMuted      bool
+	volume        float64
+	input, output string
+}
+
+// New returns a Dashboard of the bot of s, which ctl controls.
+func New(s *discordgo.Session, ctl Controller) *Dashboard {
+	files, _ := fs.Sub(static, "static")
+	return &Dashboard{
+		Interval: 100 * time.Millisecond,
+		s:        s,
+		ctl:      ctl,
+		files:    http.FileServer(http.FS(files)),
+		handlers: map[string]http.Handler{},
+		users:    map[uint32]string{},
+		speakers: map[uint32]*speaker{},
+		volume:   1,
+	}
+}
+
+// Handle serves path with h, behind the Password of the page.
+func (d *Dashboard) Handle(path string, h http.Handler) {
+	d.Lock()
+	defer d.Unlock()
+	d.handlers[path] = h
+}
+
+// SetChannel records the guild of the bot and the voice channel it is in,
+// or "" if it left.
+func (d *Dashboard) SetChannel(guildID, channelID string) {
+	d.Lock()
+	defer d.Unlock()
+	d.guildID, d.channelID = guildID, channelID
+	d.users = map[uint32]string{}
+	d.speakers = map[uint32]*speaker{}
+}
+
+// SpeakingUpdate records the user of an SSRC and whether they are
+// speaking. It can be added as a handler of the voice connection.
+func (d *Dashboard) SpeakingUpdate(vc *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+	d.speakingUpdate(uint32(vs.SSRC), vs.UserID, vs.Speaking, time.Now())
+}
+
+func (d *Dashboard) speakingUpdate(ssrc uint32, userID string, speaking bool, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if userID != "" {
+		d.users[ssrc] = userID
+	}
+	sp := d.speaker(ssrc)
+	if speaking {
+		sp.active = now
+	} else {
+		sp.active = time.Time{}
+	}
+}
+
+// Received records decoded audio received with ssrc, for its speaker's
+// level meter.
+func (d *Dashboard) Received(ssrc uint32, pcm []int16) {
+	d.received(ssrc, pcm, time.Now())
+}
+
+func (d *Dashboard) received(ssrc uint32, pcm []int16, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	sp := d.speaker(ssrc)
+	sp.set(peak(pcm), now)
+	sp.active = now
+}
+
+func (d *Dashboard) speaker(ssrc uint32) *speaker {
+	sp := d.speakers[ssrc]
+	if sp == nil {
+		sp = &speaker{}
+		d.speakers[ssrc] = sp
+	}
+	return sp
+}
+
+// Captured records audio read from the mic, for its level meter.
+func (d *Dashboard) Captured(pcm []int16) {
+	d.Lock()
+	defer d.Unlock()
+	d.mic.set(peak(pcm), time.Now())
+}
+
+// MicMuted reports whether the mic is muted.
+func (d *Dashboard) MicMuted() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.micMuted
+}
+
+// SetMicMuted mutes or unmutes the mic.
+func (d *Dashboard) SetMicMuted(muted bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.micMuted = muted
+}
+
+// Volume returns the speaker volume, from 0 to MaxVolume.
+func (d *Dashboard) Volume() float64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.volume
+}
+
+// SetVolume sets the speaker volume, limited to between 0 and MaxVolume.
+func (d *Dashboard) SetVolume(v float64) {
+	d.Lock()
+	defer d.Unlock()
+	d.volume = math.Max(0, math.Min(v, MaxVolume))
+}
+
+// ApplyVolume scales pcm by the speaker volume, clipping it.
+func (d *Dashboard) ApplyVolume(pcm []int16) {
+	v := d.Volume()
+	if v == 1 {
+		return
+	}
+	for i, s := range pcm {
+		pcm[i] = clip(float64(s) * v)
+	}
+}
+
+// SetDevices records the devices the bot opened, where "" is the default
+// device.
+func (d *Dashboard) SetDevices(input, output string) {
+	d.Lock()
+	defer d.Unlock()
+	d.input, d.output = input, output
+}
+
+// State returns what the page shows.
+func (d *Dashboard) State() *State {
+	return d.state(time.Now())
+}
+
+func (d *Dashboard) state(now time.Time) *State {
+	st := &State{Channels: []Channel{}, Members: []Member{}}
+	var botID string
+	var voiceStates []*discordgo.VoiceState
+
+	d.Lock()
+	guildID, channelID := d.guildID, d.channelID
+	d.Unlock()
+	g, err := d.s.State.Guild(guildID)
+	d.s.State.RLock()
+	if d.s.State.User != nil {
+		botID = d.s.State.User.ID
+	}
+	if err == nil {
+		st.Guild = g.Name
+		for _, c := range g.Channels {
+			if c.Type != discordgo.ChannelTypeGuildVoice && c.Type != discordgo.ChannelTypeGuildStageVoice {
+				continue
+			}
+			st.Channels = append(st.Channels, Channel{c.ID, c.Name})
+			if c.ID == channelID {
+				st.Channel = &Channel{c.ID, c.Name}
+			}
+		}
+		for _, v := range g.VoiceStates {
+			if channelID != "" && v.ChannelID == channelID && v.UserID != botID {
+				voiceStates = append(voiceStates, v)
+			}
+		}
+	}
+	d.s.State.RUnlock()
+	if st.Channel == nil && channelID != "" {
+		st.Channel = &Channel{ID: channelID, Name: channelID}
+	}
+
+	for _, v := range voiceStates {
+		st.Members = append(st.Members, Member{
+			UserID:   v.UserID,
+			Name:     d.memberName(v),
+			Muted:    v.Mute || v.SelfMute,
+			Deafened: v.Deaf || v.SelfDeaf,
+		})
+	}
+	sort.Slice(st.Members, func(i, j int) bool { return st.Members[i].Name < st.Members[j].Name })
+
+	d.Lock()
+	defer d.Unlock()
+	levels := map[string]float64{}
+	speaking := map[string]bool{}
+	for ssrc, sp := range d.speakers {
+		userID := d.users[ssrc]
+		if userID == "" {
+			continue
+		}
+		levels[userID] = math.Max(levels[userID], sp.get(now))
+		if now.Sub(sp.active) < speakingHold {
+			speaking[userID] = true
+		}
+	}
+	for i := range st.Members {
+		m := &st.Members[i]
+		m.Level = round(levels[m.UserID])
+		m.Speaking = speaking[m.UserID]
+	}
+	st.MicLevel = round(d.mic.get(now))
+	st.MicMuted = d.micMuted
+	st.Volume = d.volume
+	st.Input, st.Output = d.input, d.output
+	return st
+}
+
+// memberName returns the name shown for the user of a voice state.
+func (d *Dashboard) memberName(v *discordgo.VoiceState) string {
+	m := v.Member
+	if m == nil {
+		m, _ = d.s.State.Member(v.GuildID, v.UserID)
+	}
+	switch {
+	case m == nil || m.User == nil:
+		return v.UserID
+	case m.Nick != "":
+		return m.Nick
+	case m.User.GlobalName != "":
+		return m.User.GlobalName
+	}
+	return m.User.Username
+}
+
+// ServeHTTP serves the page, its events at /events and its API under
+// /api/.
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.Password != "" {
+		_, password, _ := r.BasicAuth()
+		if subtle.ConstantTimeCompare([]byte(password), []byte(d.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="discord-audio-stream"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch r.URL.Path {
+	case "/events":
+		d.serveEvents(w, r)
+	case "/api/state":
+		writeJSON(w, d.State())
+	case "/api/devices":
+		if r.Method == http.MethodPost {
+			d.serveAction(w, r)
+			return
+		}
+		devices, err := d.ctl.Devices()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if devices == nil {
+			devices = []Device{}
+		}
+		writeJSON(w, devices)
+	case "/api/mute", "/api/volume", "/api/join", "/api/leave":
+		d.serveAction(w, r)
+	default:
+		d.Lock()
+		h := d.handlers[r.URL.Path]
+		d.Unlock()
+		if h == nil {
+			h = d.files
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// serveEvents sends the State to the page whenever it changes.
+func (d *Dashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	var last []byte
+	idle := 0
+	for {
+		b, _ := json.Marshal(d.State())
+		if string(b) != string(last) {
+			last, idle = b, 0
+			if _, err := w.Write([]byte("data: " + string(b) + "\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		} else if idle++; time.Duration(idle)*d.Interval >= 15*time.Second {
+			// Keep proxies from closing an idle stream.
+			idle = 0
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// An action is the body posted by a button of the page.
+type action struct {
+	Muted   bool    `json:"muted"`
+	Volume  float64 `json:"volume"`
+	Channel string  `json:"channel"`
+	Input   string  `json:"input"`
+	Output  string  `json:"output"`
+}
+
+// serveAction carries out an action posted to /api/name.
+func (d *Dashboard) serveAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Browsers only post JSON across origins after asking, so other sites
+	// can't use the browser of an operator to work the bridge.
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var a action
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&a); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.URL.Path[len("/api/"):]
+	var err error
+	switch name {
+	case "mute":
+		d.SetMicMuted(a.Muted)
+	case "volume":
+		d.SetVolume(a.Volume)
+	case "join":
+		err = d.ctl.Join(a.Channel)
+	case "leave":
+		err = d.ctl.Leave()
+	case "devices":
+		if err = d.ctl.SetDevices(a.Input, a.Output); err == nil {
+			d.SetDevices(a.Input, a.Output)
+		}
+	}
+	if d.OnAction != nil {
+		d.OnAction(r, name, err)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+// peak returns the peak level of pcm, from 0 to 1.
+func peak(pcm []int16) float64 {
+	var max int
+	for _, s := range pcm {
+		v := int(s)
+		if v < 0 {
+			v = -v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return math.Min(float64(max)/32767, 1)
+}
+
+// round rounds a level to what a meter can show, so that a page is only
+// sent changes it can see.
+func round(level float64) float64 {
+	if level < 0.001 {
+		return 0
+	}
+	return math.Round(level*1000) / 1000
+}
+
+func clip(v float64) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
@@ -0,0 +1,295 @@
+package dashboard
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeController records the actions of the page.
+type fakeController struct {
+	joined        string
+	input, output string
+}
+
+func (c *fakeController) Join(channelID string) error {
+	if channelID == "" {
+		return errors.New("no channel")
+	}
+	c.joined = channelID
+	return nil
+}
+
+func (c *fakeController) Leave() error {
+	if c.joined == "" {
+		return ErrNotJoined
+	}
+	c.joined = ""
+	return nil
+}
+
+func (c *fakeController) Devices() ([]Device, error) {
+	return []Device{{Name: "USB mic", Input: true}, {Name: "Speakers", Output: true}}, nil
+}
+
+func (c *fakeController) SetDevices(input, output string) error {
+	c.input, c.output = input, output
+	return nil
+}
+
+// newDashboard returns a Dashboard of a guild with two voice channels and
+// three users in the first, one of them the bot.
+func newDashboard(t *testing.T) (*Dashboard, *fakeController) {
+	t.Helper()
+	s, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	s.State.User = &discordgo.User{ID: "bot"}
+	err = s.State.GuildAdd(&discordgo.Guild{
+		ID:   "g",
+		Name: "Studio",
+		Channels: []*discordgo.Channel{
+			{ID: "c1", GuildID: "g", Name: "Room", Type: discordgo.ChannelTypeGuildVoice},
+			{ID: "c2", GuildID: "g", Name: "Lounge", Type: discordgo.ChannelTypeGuildVoice},
+			{ID: "t", GuildID: "g", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		},
+		Members: []*discordgo.Member{
+			{GuildID: "g", User: &discordgo.User{ID: "u1", Username: "zed"}, Nick: "Ann"},
+			{GuildID: "g", User: &discordgo.User{ID: "u2", Username: "bob"}},
+		},
+		VoiceStates: []*discordgo.VoiceState{
+			{GuildID: "g", ChannelID: "c1", UserID: "bot"},
+			{GuildID: "g", ChannelID: "c1", UserID: "u1"},
+			{GuildID: "g", ChannelID: "c1", UserID: "u2", SelfMute: true},
+			{GuildID: "g", ChannelID: "c2", UserID: "u3"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("GuildAdd returned error: %v", err)
+	}
+	ctl := &fakeController{}
+	d := New(s, ctl)
+	d.SetChannel("g", "")
+	return d, ctl
+}
+
+func TestState(t *testing.T) {
+	d, _ := newDashboard(t)
+	if st := d.State(); st.Guild != "Studio" || st.Channel != nil || len(st.Channels) != 2 || len(st.Members) != 0 {
+		t.Errorf("State before joining incorrect: got %+v", st)
+	}
+
+	d.SetChannel("g", "c1")
+	now := time.Now()
+	d.speakingUpdate(1, "u1", true, now)
+	d.received(1, []int16{100, -16384, 200}, now)
+	d.received(2, []int16{32767}, now) // no user yet
+
+	st := d.state(now)
+	if st.Channel == nil || *st.Channel != (Channel{"c1", "Room"}) {
+		t.Errorf("Channel incorrect: got %+v", st.Channel)
+	}
+	want := []Member{
+		{UserID: "u1", Name: "Ann", Speaking: true, Level: 0.5},
+		{UserID: "u2", Name: "bob", Muted: true},
+	}
+	if len(st.Members) != len(want) {
+		t.Fatalf("Members incorrect: got %+v, want %+v", st.Members, want)
+	}
+	for i := range want {
+		if st.Members[i] != want[i] {
+			t.Errorf("Members[%d] incorrect: got %+v, want %+v", i, st.Members[i], want[i])
+		}
+	}
+
+	// Levels fall by half every levelHalfLife, and speakers stop speaking
+	// once their packets do.
+	st = d.state(now.Add(2 * levelHalfLife))
+	if m := st.Members[0]; m.Level != 0.125 || m.Speaking {
+		t.Errorf("Member after silence incorrect: got %+v", m)
+	}
+	d.speakingUpdate(1, "u1", false, now)
+	if d.state(now).Members[0].Speaking {
+		t.Error("Member speaking after speaking update")
+	}
+
+	d.SetChannel("g", "")
+	if st := d.State(); st.Channel != nil || len(st.Members) != 0 {
+		t.Errorf("State after leaving incorrect: got %+v", st)
+	}
+}
+
+func TestVolume(t *testing.T) {
+	d, _ := newDashboard(t)
+	pcm := []int16{1000, -1000}
+	d.ApplyVolume(pcm)
+	if pcm[0] != 1000 {
+		t.Errorf("sample at full volume incorrect: got %d, want 1000", pcm[0])
+	}
+	d.SetVolume(0.5)
+	d.ApplyVolume(pcm)
+	if pcm[0] != 500 || pcm[1] != -500 {
+		t.Errorf("samples at half volume incorrect: got %v, want [500 -500]", pcm)
+	}
+	d.SetVolume(10)
+	if v := d.Volume(); v != MaxVolume {
+		t.Errorf("Volume incorrect: got %v, want %v", v, MaxVolume)
+	}
+	pcm = []int16{30000, -30000}
+	d.ApplyVolume(pcm)
+	if pcm[0] != 32767 || pcm[1] != -32768 {
+		t.Errorf("clipped samples incorrect: got %v", pcm)
+	}
+}
+
+func post(t *testing.T, h http.Handler, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestActions(t *testing.T) {
+	d, ctl := newDashboard(t)
+	var actions []string
+	d.OnAction = func(r *http.Request, action string, err error) {
+		actions = append(actions, action)
+	}
+
+	if rec := post(t, d, "/api/mute", `{"muted":true}`); rec.Code != http.StatusNoContent || !d.MicMuted() {
+		t.Errorf("mute incorrect: got %d, muted %t", rec.Code, d.MicMuted())
+	}
+	if rec := post(t, d, "/api/volume", `{"volume":0.7}`); rec.Code != http.StatusNoContent || d.Volume() != 0.7 {
+		t.Errorf("volume incorrect: got %d, volume %v", rec.Code, d.Volume())
+	}
+	if rec := post(t, d, "/api/join", `{"channel":"c2"}`); rec.Code != http.StatusNoContent || ctl.joined != "c2" {
+		t.Errorf("join incorrect: got %d, joined %q", rec.Code, ctl.joined)
+	}
+	if rec := post(t, d, "/api/devices", `{"input":"USB mic"}`); rec.Code != http.StatusNoContent || ctl.input != "USB mic" || d.State().Input != "USB mic" {
+		t.Errorf("devices incorrect: got %d, input %q", rec.Code, ctl.input)
+	}
+	if rec := post(t, d, "/api/leave", `{}`); rec.Code != http.StatusNoContent {
+		t.Errorf("leave incorrect: got %d", rec.Code)
+	}
+	rec := post(t, d, "/api/leave", `{}`)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), ErrNotJoined.Error()) {
+		t.Errorf("second leave incorrect: got %d %q", rec.Code, rec.Body)
+	}
+	if got := strings.Join(actions, ","); got != "mute,volume,join,devices,leave,leave" {
+		t.Errorf("actions incorrect: got %q", got)
+	}
+
+	if rec := post(t, d, "/api/mute", `{"muted":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid body incorrect: got %d, want 400", rec.Code)
+	}
+	r := httptest.NewRequest("POST", "/api/mute", strings.NewReader(`{"muted":false}`))
+	r.Header.Set("Content-Type", "text/plain")
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, r)
+	if rec.Code != http.StatusUnsupportedMediaType || !d.MicMuted() {
+		t.Errorf("plain text post incorrect: got %d, muted %t", rec.Code, d.MicMuted())
+	}
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/api/mute", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("get of action incorrect: got %d, want 405", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/api/devices", nil))
+	var devices []Device
+	if err := json.Unmarshal(rec.Body.Bytes(), &devices); err != nil || len(devices) != 2 {
+		t.Errorf("devices incorrect: got %q, %v", rec.Body, err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	d, _ := newDashboard(t)
+	d.Password = "secret"
+	d.Interval = 10 * time.Millisecond
+	d.SetChannel("g", "c1")
+	d.Handle("/api/extra", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("extra"))
+	}))
+	srv := httptest.NewServer(d)
+	defer srv.Close()
+
+	for _, path := range []string{"/", "/api/extra"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status of %s without password incorrect: got %d, want 401", path, resp.StatusCode)
+		}
+	}
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		r, _ := http.NewRequest("GET", srv.URL+path, nil)
+		r.SetBasicAuth("", "secret")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status of %s incorrect: got %d", path, resp.StatusCode)
+		}
+		return resp
+	}
+
+	for _, path := range []string{"/", "/app.js", "/style.css"} {
+		resp := get(path)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if len(b) == 0 {
+			t.Errorf("%s is empty", path)
+		}
+	}
+
+	resp := get("/api/extra")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "extra" {
+		t.Errorf("body of /api/extra incorrect: got %q, want %q", b, "extra")
+	}
+
+	resp = get("/events")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type incorrect: got %q", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	next := func() *State {
+		t.Helper()
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString returned error: %v", err)
+		}
+		events.ReadString('\n')
+		var st State
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &st); err != nil {
+			t.Fatalf("event %q invalid: %v", line, err)
+		}
+		return &st
+	}
+	if st := next(); st.Channel == nil || st.Channel.Name != "Room" || st.MicMuted {
+		t.Errorf("first event incorrect: got %+v", st)
+	}
+	d.SetMicMuted(true)
+	if st := next(); !st.MicMuted {
+		t.Errorf("event after muting incorrect: got %+v", st)
+	}
+}
@@ -0,0 +1,113 @@
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+let state = null;
+let errorUntil = 0; // errors stay shown for a while, despite updates
+
+// width shows a peak level from 0 to 1 on a meter from -60 dBFS to 0.
+function width(level) {
+  if (level <= 0) return "0%";
+  const db = 20 * Math.log10(level);
+  return Math.max(0, Math.min(100, (db + 60) / 60 * 100)) + "%";
+}
+
+function showError(text) {
+  errorUntil = Date.now() + 5000;
+  $("status").textContent = text;
+  $("status").className = "status error";
+}
+
+async function post(action, body) {
+  try {
+    const res = await fetch("api/" + action, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(body || {}),
+    });
+    if (!res.ok) showError(action + " failed: " + (await res.text()).trim());
+  } catch (err) {
+    showError(action + " failed: " + err);
+  }
+}
+
+function setOptions(select, options, selected) {
+  const values = options.map((o) => o.value).join("\n");
+  if (select.dataset.values !== values) {
+    select.replaceChildren(...options.map((o) => new Option(o.label, o.value)));
+    select.dataset.values = values;
+  }
+  if (selected !== undefined && document.activeElement !== select) select.value = selected;
+}
+
+function render(st) {
+  const joined = st.channel !== null;
+  $("guild").textContent = st.guild || "Discord audio bridge";
+  if (Date.now() > errorUntil) {
+    $("status").textContent = joined ? "Connected" : "Not in a voice channel";
+    $("status").className = "status";
+  }
+  $("channel").textContent = joined ? "🔊 " + st.channel.name : "Not in a voice channel";
+  const moved = !state || state.channel?.id !== st.channel?.id;
+  setOptions($("channels"), st.channels.map((c) => ({ value: c.id, label: c.name })),
+    joined && moved ? st.channel.id : undefined);
+  $("leave").disabled = !joined;
+
+  const list = $("members");
+  list.replaceChildren(...st.members.map((m) => {
+    const li = document.createElement("li");
+    li.className = m.speaking ? "speaking" : "";
+    const avatar = document.createElement("span");
+    avatar.className = "avatar";
+    const name = document.createElement("span");
+    name.className = "name";
+    name.textContent = m.name;
+    const flags = document.createElement("span");
+    flags.className = "flags";
+    flags.textContent = [m.muted && "muted", m.deafened && "deafened"].filter(Boolean).join(", ");
+    const meter = document.createElement("div");
+    meter.className = "meter";
+    const bar = document.createElement("div");
+    bar.style.width = width(m.level);
+    meter.append(bar);
+    li.append(avatar, name, flags, meter);
+    return li;
+  }));
+  $("empty").hidden = st.members.length > 0;
+
+  $("mute").textContent = st.micMuted ? "Unmute mic" : "Mute mic";
+  $("mute").classList.toggle("on", st.micMuted);
+  $("micLevel").style.width = width(st.micMuted ? 0 : st.micLevel);
+  if (document.activeElement !== $("volume")) $("volume").value = Math.round(st.volume * 100);
+  $("volumeValue").textContent = $("volume").value + "%";
+
+  if (!state || state.input !== st.input) $("input").value = st.input;
+  if (!state || state.output !== st.output) $("output").value = st.output;
+  state = st;
+}
+
+async function loadDevices() {
+  try {
+    const res = await fetch("api/devices");
+    if (!res.ok) throw new Error((await res.text()).trim());
+    const devices = await res.json();
+    const options = (kind) => [{ value: "", label: "Default" }].concat(
+      devices.filter((d) => d[kind]).map((d) => ({ value: d.name, label: d.name })));
+    setOptions($("input"), options("input"), state ? state.input : "");
+    setOptions($("output"), options("output"), state ? state.output : "");
+  } catch (err) {
+    showError("Listing devices failed: " + err.message);
+  }
+}
+
+$("join").onclick = () => post("join", { channel: $("channels").value });
+$("leave").onclick = () => post("leave");
+$("mute").onclick = () => post("mute", { muted: !(state && state.micMuted) });
+$("volume").oninput = () => { $("volumeValue").textContent = $("volume").value + "%"; };
+$("volume").onchange = () => post("volume", { volume: $("volume").value / 100 });
+$("devices").onclick = () => post("devices", { input: $("input").value, output: $("output").value });
+$("refresh").onclick = loadDevices;
+
+const events = new EventSource("events");
+events.onmessage = (e) => render(JSON.parse(e.data));
+events.onerror = () => showError("Disconnected from the bot, reconnecting…");
+loadDevices();
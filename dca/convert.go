@@ -0,0 +1,144 @@
+package dca
+
+import (
+	"io"
+
+	"discord-audio-stream/oggopus"
+)
+
+// vendor is the Ogg Opus vendor string of converted files.
+const vendor = "discord-audio-stream dca"
+
+// Info summarises a DCA file, see Validate.
+type Info struct {
+	Version  int
+	Metadata *Metadata
+	Frames   int
+	Samples  int64 // duration at 48kHz
+	Channels int   // coded in the first frame
+}
+
+// Validate reads a whole DCA file, checking that each frame is a valid Opus
+// packet.
+func Validate(r io.Reader) (*Info, error) {
+
+	dr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Version: dr.Version, Metadata: dr.Metadata}
+	for {
+		frame, err := dr.ReadFrame()
+		if err == io.EOF {
+			return info, nil
+		}
+		if err != nil {
+			return info, err
+		}
+
+		samples, err := oggopus.PacketSamples(frame)
+		if err != nil {
+			return info, err
+		}
+		if info.Frames == 0 {
+			info.Channels = oggopus.PacketChannels(frame)
+		}
+		info.Frames++
+		info.Samples += int64(samples)
+	}
+}
+
+// ToOgg converts the DCA file r to an Ogg Opus stream written to w. The
+// channel count is taken from the first frame, and the metadata title and
+// artist, if any, are kept as tags.
+func ToOgg(w io.Writer, r io.Reader, serial uint32) error {
+
+	dr, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	frame, err := dr.ReadFrame()
+	if err == io.EOF {
+		return ErrFormat
+	}
+	if err != nil {
+		return err
+	}
+
+	head := oggopus.Head{Version: 1, Channels: uint8(oggopus.PacketChannels(frame)), InputSampleRate: oggopus.SampleRate}
+	tags := oggopus.Tags{Vendor: vendor}
+	if m := dr.Metadata; m != nil && m.Info != nil {
+		if m.Info.Title != "" {
+			tags.Comments = append(tags.Comments, "TITLE="+m.Info.Title)
+		}
+		if m.Info.Artist != "" {
+			tags.Comments = append(tags.Comments, "ARTIST="+m.Info.Artist)
+		}
+	}
+
+	ow, err := oggopus.NewWriter(w, serial, head, tags)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ow.WritePacket(frame); err != nil {
+			return err
+		}
+		frame, err = dr.ReadFrame()
+		if err == io.EOF {
+			return ow.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// FromOgg converts the Ogg Opus stream r to a DCA file written to w. If
+// metadata is not nil a DCA1 file is written, with its Opus section filled
+// in from the stream. DCA has no pre-skip, so the encoder delay at the start
+// of the stream is played.
+func FromOgg(w io.Writer, r io.Reader, metadata *Metadata) error {
+
+	or, err := oggopus.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	packet, err := or.ReadPacket()
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if metadata != nil && metadata.Opus == nil {
+		metadata.Opus = &OpusMetadata{
+			SampleRate: oggopus.SampleRate,
+			Channels:   int(or.Head.Channels),
+		}
+		if packet != nil {
+			if n, err := oggopus.PacketSamples(packet); err == nil {
+				metadata.Opus.FrameSize = n
+			}
+		}
+	}
+
+	dw, err := NewWriter(w, metadata)
+	if err != nil {
+		return err
+	}
+	for packet != nil {
+		if err := dw.WriteFrame(packet); err != nil {
+			return err
+		}
+		packet, err = or.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
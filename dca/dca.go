@@ -0,0 +1,213 @@
+// Package dca reads and writes DCA audio files, a sequence of Opus packets
+// each prefixed by its length, as produced by the dca encoder and played by
+// Discord bots.
+//
+// DCA0 files are the bare packet sequence. DCA1 files start with the magic
+// "DCA1" and a JSON metadata header.
+package dca
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// magic starts a DCA1 file.
+const magic = "DCA1"
+
+// maxMetadataSize limits the size of the JSON metadata header.
+const maxMetadataSize = 1 << 20
+
+// MaxFrameSize is the largest frame a DCA file can hold.
+const MaxFrameSize = 32767
+
+// Errors returned when reading and writing files.
+var (
+	ErrFormat    = errors.New("not a DCA file")
+	ErrFrameSize = errors.New("invalid DCA frame size")
+)
+
+// Metadata is the JSON header of a DCA1 file. Fields the file does not set
+// are nil.
+type Metadata struct {
+	DCA    *DCAMetadata           `json:"dca"`
+	Opus   *OpusMetadata          `json:"opus"`
+	Info   *InfoMetadata          `json:"info,omitempty"`
+	Origin *OriginMetadata        `json:"origin,omitempty"`
+	Extra  map[string]interface{} `json:"extra"`
+}
+
+// DCAMetadata describes the file format and the tool which wrote it.
+type DCAMetadata struct {
+	Version int64         `json:"version"`
+	Tool    *ToolMetadata `json:"tool"`
+}
+
+// ToolMetadata describes the tool which wrote a file.
+type ToolMetadata struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URL     string `json:"url,omitempty"`
+	Author  string `json:"author,omitempty"`
+}
+
+// OpusMetadata describes the encoding of the Opus packets.
+type OpusMetadata struct {
+	Mode       string `json:"mode,omitempty"` // voip, music or lowdelay
+	SampleRate int    `json:"sample_rate"`
+	FrameSize  int    `json:"frame_size"` // samples per channel
+	Bitrate    int    `json:"abr,omitempty"`
+	VBR        bool   `json:"vbr"`
+	Channels   int    `json:"channels"`
+}
+
+// InfoMetadata describes the audio.
+type InfoMetadata struct {
+	Title    string `json:"title,omitempty"`
+	Artist   string `json:"artist,omitempty"`
+	Album    string `json:"album,omitempty"`
+	Genre    string `json:"genre,omitempty"`
+	Comments string `json:"comments,omitempty"`
+	Cover    string `json:"cover,omitempty"` // base64 encoded image
+}
+
+// OriginMetadata describes the source the audio was encoded from.
+type OriginMetadata struct {
+	Source   string `json:"source,omitempty"`
+	Bitrate  int    `json:"abr,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// A Reader reads the frames of a DCA file as they are needed.
+type Reader struct {
+	// Version is 1 for DCA1 files and 0 otherwise.
+	Version int
+
+	// Metadata is the header of a DCA1 file, or nil.
+	Metadata *Metadata
+
+	r     *bufio.Reader
+	frame []byte
+}
+
+// NewReader returns a Reader for the DCA file r, reading its metadata if
+// it has any.
+func NewReader(r io.Reader) (*Reader, error) {
+
+	dr := &Reader{r: bufio.NewReader(r)}
+
+	m, err := dr.r.Peek(len(magic))
+	if err != nil && len(m) == 0 {
+		return nil, ErrFormat
+	}
+	if string(m) != magic {
+		return dr, nil
+	}
+
+	var hdr struct {
+		Magic [4]byte
+		Size  int32
+	}
+	if err := binary.Read(dr.r, binary.LittleEndian, &hdr); err != nil {
+		return nil, ErrFormat
+	}
+	if hdr.Size < 0 || hdr.Size > maxMetadataSize {
+		return nil, ErrFormat
+	}
+	data := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(dr.r, data); err != nil {
+		return nil, ErrFormat
+	}
+
+	dr.Version = 1
+	dr.Metadata = &Metadata{}
+	if err := json.Unmarshal(data, dr.Metadata); err != nil {
+		return nil, ErrFormat
+	}
+
+	return dr, nil
+}
+
+// ReadFrame returns the next Opus packet, valid until the following call.
+// It returns io.EOF at the end of the file and ErrFrameSize for a frame
+// with an invalid or truncated length.
+func (dr *Reader) ReadFrame() ([]byte, error) {
+	var size [2]byte
+	if n, err := io.ReadFull(dr.r, size[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrFrameSize
+	}
+
+	n := int16(binary.LittleEndian.Uint16(size[:]))
+	if n <= 0 {
+		return nil, ErrFrameSize
+	}
+	if cap(dr.frame) < int(n) {
+		dr.frame = make([]byte, n)
+	}
+	dr.frame = dr.frame[:n]
+	if _, err := io.ReadFull(dr.r, dr.frame); err != nil {
+		return nil, ErrFrameSize
+	}
+
+	return dr.frame, nil
+}
+
+// A Writer writes the frames of a DCA file.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter returns a Writer writing a DCA1 file with metadata to w, or a
+// DCA0 file if metadata is nil. DCA.Version is set if unset.
+func NewWriter(w io.Writer, metadata *Metadata) (*Writer, error) {
+
+	dw := &Writer{w: w}
+	if metadata == nil {
+		return dw, nil
+	}
+
+	if metadata.DCA == nil {
+		metadata.DCA = &DCAMetadata{}
+	}
+	if metadata.DCA.Version == 0 {
+		metadata.DCA.Version = 1
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMetadataSize {
+		return nil, errors.New("dca metadata too large")
+	}
+
+	hdr := make([]byte, 8, 8+len(data))
+	copy(hdr, magic)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(data)))
+	if _, err := w.Write(append(hdr, data...)); err != nil {
+		return nil, err
+	}
+
+	return dw, nil
+}
+
+// WriteFrame writes an Opus packet.
+func (dw *Writer) WriteFrame(frame []byte) error {
+	if len(frame) == 0 || len(frame) > MaxFrameSize {
+		return ErrFrameSize
+	}
+
+	dw.buf = append(dw.buf[:0], 0, 0)
+	binary.LittleEndian.PutUint16(dw.buf, uint16(len(frame)))
+	dw.buf = append(dw.buf, frame...)
+	_, err := dw.w.Write(dw.buf)
+	return err
+}
@@ -0,0 +1,180 @@
+package dca
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"discord-audio-stream/oggopus"
+)
+
+var testFrames = [][]byte{{0xFC, 1}, {0xFC, 2, 2}, {0xFC, 3, 3, 3}}
+
+func writeTestFile(t *testing.T, metadata *Metadata) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	w, err := NewWriter(&b, metadata)
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+	for _, f := range testFrames {
+		if err := w.WriteFrame(f); err != nil {
+			t.Fatalf("WriteFrame returned error: %v", err)
+		}
+	}
+	return b.Bytes()
+}
+
+func readTestFile(t *testing.T, data []byte) (*Reader, [][]byte) {
+	t.Helper()
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	var frames [][]byte
+	for {
+		f, err := r.ReadFrame()
+		if err == io.EOF {
+			return r, frames
+		}
+		if err != nil {
+			t.Fatalf("ReadFrame returned error: %v", err)
+		}
+		frames = append(frames, append([]byte(nil), f...))
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	r, frames := readTestFile(t, writeTestFile(t, nil))
+	if r.Version != 0 || r.Metadata != nil || !reflect.DeepEqual(frames, testFrames) {
+		t.Errorf("DCA0 incorrect: version %d, metadata %v, frames %v", r.Version, r.Metadata, frames)
+	}
+
+	metadata := &Metadata{
+		Opus: &OpusMetadata{SampleRate: 48000, FrameSize: 960, Channels: 2},
+		Info: &InfoMetadata{Title: "airhorn"},
+	}
+	r, frames = readTestFile(t, writeTestFile(t, metadata))
+	if r.Version != 1 || !reflect.DeepEqual(frames, testFrames) {
+		t.Errorf("DCA1 incorrect: version %d, frames %v", r.Version, frames)
+	}
+	if m := r.Metadata; m == nil || m.DCA.Version != 1 || m.Opus.Channels != 2 || m.Info.Title != "airhorn" {
+		t.Errorf("DCA1 metadata incorrect: %+v", m)
+	}
+
+	var b bytes.Buffer
+	w, _ := NewWriter(&b, nil)
+	if err := w.WriteFrame(make([]byte, MaxFrameSize+1)); err != ErrFrameSize {
+		t.Errorf("WriteFrame of large frame error incorrect: got %v, want %v", err, ErrFrameSize)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	valid := writeTestFile(t, nil)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated frame", valid[:len(valid)-1]},
+		{"truncated length", append(valid, 1)},
+		{"negative length", append(valid, 0x00, 0x80)},
+	}
+
+	for _, tt := range tests {
+		r, err := NewReader(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: NewReader returned error: %v", tt.name, err)
+		}
+		for err == nil {
+			_, err = r.ReadFrame()
+		}
+		if err != ErrFrameSize {
+			t.Errorf("%s: error incorrect: got %v, want %v", tt.name, err, ErrFrameSize)
+		}
+	}
+
+	for _, data := range [][]byte{nil, []byte("DCA1\xFF\xFF\xFF\xFF"), []byte("DCA1\x02\x00\x00\x00{")} {
+		if _, err := NewReader(bytes.NewReader(data)); err != ErrFormat {
+			t.Errorf("NewReader(%q) error incorrect: got %v, want %v", data, err, ErrFormat)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	info, err := Validate(bytes.NewReader(writeTestFile(t, nil)))
+	if err != nil || info.Frames != 3 || info.Samples != 3*960 || info.Channels != 2 {
+		t.Errorf("Validate incorrect: got %+v, %v", info, err)
+	}
+
+	var b bytes.Buffer
+	w, _ := NewWriter(&b, nil)
+	w.WriteFrame([]byte{0xFC})
+	w.WriteFrame([]byte{0x03})
+	if _, err := Validate(&b); err != oggopus.ErrPacket {
+		t.Errorf("Validate of invalid packet error incorrect: got %v, want %v", err, oggopus.ErrPacket)
+	}
+}
+
+func TestOggConversion(t *testing.T) {
+	var ogg bytes.Buffer
+	err := ToOgg(&ogg, bytes.NewReader(writeTestFile(t, &Metadata{Info: &InfoMetadata{Title: "t"}})), 7)
+	if err != nil {
+		t.Fatalf("ToOgg returned error: %v", err)
+	}
+
+	r, err := oggopus.NewReader(bytes.NewReader(ogg.Bytes()))
+	if err != nil {
+		t.Fatalf("oggopus.NewReader returned error: %v", err)
+	}
+	if r.Head.Channels != 2 || !reflect.DeepEqual(r.Tags.Comments, []string{"TITLE=t"}) {
+		t.Errorf("Ogg headers incorrect: %+v %+v", r.Head, r.Tags)
+	}
+
+	var dca bytes.Buffer
+	metadata := &Metadata{}
+	if err := FromOgg(&dca, bytes.NewReader(ogg.Bytes()), metadata); err != nil {
+		t.Fatalf("FromOgg returned error: %v", err)
+	}
+	if metadata.Opus == nil || metadata.Opus.Channels != 2 || metadata.Opus.FrameSize != 960 {
+		t.Errorf("FromOgg metadata incorrect: %+v", metadata.Opus)
+	}
+	if _, frames := readTestFile(t, dca.Bytes()); !reflect.DeepEqual(frames, testFrames) {
+		t.Errorf("round trip frames incorrect: got %v, want %v", frames, testFrames)
+	}
+}
+
+func TestOggConversionFile(t *testing.T) {
+	// air.dca in the repository root is an Ogg Opus file.
+	data, err := ioutil.ReadFile("../air.dca")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	var dca, ogg bytes.Buffer
+	if err := FromOgg(&dca, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("FromOgg returned error: %v", err)
+	}
+	info, err := Validate(bytes.NewReader(dca.Bytes()))
+	if err != nil || info.Frames == 0 {
+		t.Fatalf("Validate incorrect: got %+v, %v", info, err)
+	}
+	if err := ToOgg(&ogg, bytes.NewReader(dca.Bytes()), 1); err != nil {
+		t.Fatalf("ToOgg returned error: %v", err)
+	}
+
+	r, err := oggopus.NewReader(&ogg)
+	if err != nil {
+		t.Fatalf("oggopus.NewReader returned error: %v", err)
+	}
+	n := 0
+	for ; err == nil; n++ {
+		_, err = r.ReadPacket()
+	}
+	if err != io.EOF || n-1 != info.Frames {
+		t.Errorf("converted packets incorrect: got %d, %v, want %d", n-1, err, info.Frames)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"discord-audio-stream/dca"
+	"discord-audio-stream/oggopus"
+)
+
+// Produces and validates soundboard files.
+//
+//	go build -o dca-tool ./dca_tool.go
+//	./dca-tool info air.dca
+//	./dca-tool from-ogg -title "Air horn" air.opus air.dca
+//	./dca-tool to-ogg air.dca air.opus
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		dcaToolUsage()
+	}
+
+	switch os.Args[1] {
+	case "info":
+		if len(os.Args) != 3 {
+			dcaToolUsage()
+		}
+		dcaInfo(os.Args[2])
+
+	case "to-ogg":
+		if len(os.Args) != 4 {
+			dcaToolUsage()
+		}
+		convertFile(os.Args[2], os.Args[3], func(out *os.File, in *os.File) error {
+			return dca.ToOgg(out, in, rand.Uint32())
+		})
+
+	case "from-ogg":
+		fs := flag.NewFlagSet("from-ogg", flag.ExitOnError)
+		title := fs.String("title", "", "title to store in the metadata")
+		dca0 := fs.Bool("dca0", false, "write a DCA0 file without metadata")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 2 {
+			dcaToolUsage()
+		}
+
+		var metadata *dca.Metadata
+		if !*dca0 {
+			metadata = &dca.Metadata{
+				DCA:    &dca.DCAMetadata{Version: 1, Tool: &dca.ToolMetadata{Name: "dca-tool", Version: "1.0.0"}},
+				Origin: &dca.OriginMetadata{Source: "file", Encoding: "Ogg Opus"},
+			}
+			if *title != "" {
+				metadata.Info = &dca.InfoMetadata{Title: *title}
+			}
+		}
+		convertFile(fs.Arg(0), fs.Arg(1), func(out *os.File, in *os.File) error {
+			return dca.FromOgg(out, in, metadata)
+		})
+
+	default:
+		dcaToolUsage()
+	}
+}
+
+func dcaToolUsage() {
+	fmt.Fprintf(os.Stderr, "usage:\n  %[1]s info file.dca\n  %[1]s to-ogg in.dca out.opus\n  %[1]s from-ogg [-title title] [-dca0] in.opus out.dca\n", os.Args[0])
+	os.Exit(2)
+}
+
+// dcaInfo validates a DCA file and prints a summary.
+func dcaInfo(name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", name, err)
+	}
+	defer f.Close()
+
+	info, err := dca.Validate(f)
+	if err != nil {
+		if info != nil {
+			log.Fatalf("%s: invalid after %d frames: %v", name, info.Frames, err)
+		}
+		log.Fatalf("%s: %v", name, err)
+	}
+
+	fmt.Printf("%s: DCA%d, %d frames, %d channels, %s\n", name, info.Version, info.Frames, info.Channels,
+		time.Duration(info.Samples)*time.Second/oggopus.SampleRate)
+	if m := info.Metadata; m != nil {
+		if m.DCA != nil && m.DCA.Tool != nil {
+			fmt.Printf("  tool: %s %s\n", m.DCA.Tool.Name, m.DCA.Tool.Version)
+		}
+		if m.Opus != nil {
+			fmt.Printf("  opus: %d Hz, %d channels, frame size %d, mode %q\n", m.Opus.SampleRate, m.Opus.Channels, m.Opus.FrameSize, m.Opus.Mode)
+			if m.Opus.Channels != 0 && m.Opus.Channels != info.Channels {
+				fmt.Printf("  warning: metadata says %d channels, frames have %d\n", m.Opus.Channels, info.Channels)
+			}
+		}
+		if m.Info != nil && m.Info.Title != "" {
+			fmt.Printf("  title: %s\n", m.Info.Title)
+		}
+	}
+}
+
+// convertFile converts in to out, removing out on failure.
+func convertFile(inName, outName string, convert func(out *os.File, in *os.File) error) {
+	in, err := os.Open(inName)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", inName, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(outName)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", outName, err)
+	}
+
+	err = convert(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outName)
+		log.Fatalf("Failed to convert %s: %v", inName, err)
+	}
+}
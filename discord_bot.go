@@ -1,26 +1,41 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"discord-audio-stream/dashboard"
+	"discord-audio-stream/guilds"
+	"discord-audio-stream/health"
+	"discord-audio-stream/livestream"
+	"discord-audio-stream/metrics"
+	"discord-audio-stream/mixer"
+	"discord-audio-stream/oggopus"
+	"discord-audio-stream/queue"
+	"discord-audio-stream/relay"
+	"discord-audio-stream/soundboard"
+	"discord-audio-stream/stt"
+	"discord-audio-stream/tts"
+
 	"github.com/bwmarrin/discordgo"
 	"github.com/gordonklaus/portaudio"
 	"github.com/joho/godotenv"
 	"gopkg.in/hraban/opus.v2"
 )
 
-var (
-	currentCombinedVC       *discordgo.VoiceConnection
-	stopCombinedAudioStream chan struct{}
-	currentLogLevel         logLevel = logLevelInfo
-)
+var currentLogLevel logLevel = logLevelInfo
 
 type logLevel int
 
@@ -75,6 +90,133 @@ func outputFramesFromEnv() int {
 	return n
 }
 
+func recvBufferFromEnv() int {
+	raw := strings.TrimSpace(os.Getenv("RECV_BUFFER_PACKETS"))
+	if raw == "" {
+		return 50
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		logWarnf("Invalid RECV_BUFFER_PACKETS=%q, defaulting to 50", raw)
+		return 50
+	}
+	return n
+}
+
+func sendBufferFromEnv() int {
+	raw := strings.TrimSpace(os.Getenv("SEND_BUFFER_FRAMES"))
+	if raw == "" {
+		return 5
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		logWarnf("Invalid SEND_BUFFER_FRAMES=%q, defaulting to 5", raw)
+		return 5
+	}
+	return n
+}
+
+func soundboardModeFromEnv() soundboard.Mode {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("SOUNDBOARD_MODE"))) {
+	case "duck", "":
+		return soundboard.Duck
+	case "mix":
+		return soundboard.Mix
+	default:
+		logWarnf("Invalid SOUNDBOARD_MODE=%q, defaulting to duck", os.Getenv("SOUNDBOARD_MODE"))
+		return soundboard.Duck
+	}
+}
+
+func relayModeFromEnv() relay.Mode {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("RELAY_MODE"))) {
+	case "auto", "":
+		return relay.Auto
+	case "passthrough":
+		return relay.Passthrough
+	case "mix":
+		return relay.Mix
+	default:
+		logWarnf("Invalid RELAY_MODE=%q, defaulting to auto", os.Getenv("RELAY_MODE"))
+		return relay.Auto
+	}
+}
+
+func duckGainFromEnv() float64 {
+	raw := strings.TrimSpace(os.Getenv("SOUNDBOARD_DUCK_GAIN"))
+	if raw == "" {
+		return 0.3
+	}
+	g, err := strconv.ParseFloat(raw, 64)
+	if err != nil || g < 0 || g > 1 {
+		logWarnf("Invalid SOUNDBOARD_DUCK_GAIN=%q, defaulting to 0.3", raw)
+		return 0.3
+	}
+	return g
+}
+
+var playCommand = &discordgo.ApplicationCommand{
+	Name:        "play",
+	Description: "Play a sound into the voice channel",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:         discordgo.ApplicationCommandOptionString,
+			Name:         "name",
+			Description:  "Sound to play",
+			Required:     true,
+			Autocomplete: true,
+		},
+	},
+}
+
+// handlePlayCommand answers /play and its autocomplete requests.
+func handlePlayCommand(s *discordgo.Session, i *discordgo.InteractionCreate, library *soundboard.Library, player *soundboard.Player) {
+	if i.Type != discordgo.InteractionApplicationCommand && i.Type != discordgo.InteractionApplicationCommandAutocomplete {
+		return
+	}
+	data := i.ApplicationCommandData()
+	if data.Name != playCommand.Name || len(data.Options) == 0 {
+		return
+	}
+	name := data.Options[0].StringValue()
+
+	if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		choices := []*discordgo.ApplicationCommandOptionChoice{}
+		for _, match := range library.Match(name, 25) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: match, Value: match})
+		}
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+			Data: &discordgo.InteractionResponseData{Choices: choices},
+		})
+		if err != nil {
+			logWarnf("Error sending /play autocomplete: %v", err)
+		}
+		return
+	}
+
+	content := "Playing " + name + "."
+	src, err := library.Open(name)
+	if err != nil {
+		logWarnf("Error opening sound %q: %v", name, err)
+		content = "Can't play " + name + ": " + err.Error()
+	} else {
+		player.Play(src)
+		logInfof("Playing sound %q.", name)
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		logWarnf("Error responding to /play: %v", err)
+	}
+}
+
 func main() {
 	logFile, err := os.OpenFile("discord_bot.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
@@ -98,12 +240,7 @@ func main() {
 		return
 	}
 
-	voiceChannelName := os.Getenv("VOICE_CHANNEL_NAME")
-	if voiceChannelName == "" {
-		logWarnf("VOICE_CHANNEL_NAME not found in .env file. Bot will not join a specific channel automatically.")
-	}
 	targetGuildID := os.Getenv("GUILD_ID")
-	voiceChannelID := os.Getenv("VOICE_CHANNEL_ID")
 
 	dg, err := discordgo.New("Bot " + token)
 	if err != nil {
@@ -114,56 +251,349 @@ func main() {
 
 	dg.AddHandler(readyCombined)
 
-	var joined bool
-	dg.AddHandler(func(s *discordgo.Session, event *discordgo.GuildCreate) {
-		if joined {
+	// Join the voice channel of a guild as it becomes available.
+	// GUILDS_FILE configures guilds individually; the .env settings are the
+	// default for the others. The mic and speaker are single devices, so
+	// the bot is in one channel at a time, which the dashboard can move.
+	var configs []*guilds.Config
+	if path := os.Getenv("GUILDS_FILE"); path != "" {
+		configs, err = guilds.LoadConfigs(path)
+		if err != nil {
+			logWarnf("Error loading guilds file: %v", err)
 			return
 		}
+	}
+	defaultConfig := guilds.ConfigFromEnv()
+	defaultConfig.SendDepth = sendBufferFromEnv()
+	defaultConfig.RecvDepth = recvBufferFromEnv()
+	if defaultConfig.ChannelID == "" && defaultConfig.ChannelName == "" && len(configs) == 0 {
+		logWarnf("VOICE_CHANNEL_NAME or VOICE_CHANNEL_ID not found in .env file. Bot will not join a voice channel until the dashboard moves it.")
+	}
+	manager := guilds.NewManager(dg, defaultConfig, configs)
+	manager.Max = 1
 
-		if targetGuildID != "" && event.Guild.ID != targetGuildID {
-			return
+	// Sounds from SOUNDBOARD_DIR are mixed into the mic feed by /play.
+	player := soundboard.NewPlayer(soundboardModeFromEnv())
+	player.DuckGain = duckGainFromEnv()
+	if dir := strings.TrimSpace(os.Getenv("SOUNDBOARD_DIR")); dir != "" {
+		library := &soundboard.Library{
+			Dir: dir,
+			NewDecoder: func() (soundboard.OpusDecoder, error) {
+				return opus.NewDecoder(48000, 1)
+			},
 		}
 
-		if voiceChannelID == "" && voiceChannelName == "" {
-			logWarnf("VOICE_CHANNEL_NAME or VOICE_CHANNEL_ID not found in .env file. Bot will not join a voice channel.")
+		dg.AddHandler(func(s *discordgo.Session, event *discordgo.Ready) {
+			if _, err := s.ApplicationCommandCreate(s.State.User.ID, targetGuildID, playCommand); err != nil {
+				logWarnf("Error registering /play command: %v", err)
+				return
+			}
+			logInfof("Registered /play command for sounds in %s.", dir)
+		})
+		dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			handlePlayCommand(s, i, library, player)
+		})
+	}
+
+	// Tracks from MUSIC_DIR are queued by /queue and played instead of the
+	// mic while they last, with the soundboard and announcements on top.
+	var music *queue.Manager
+	if dir := strings.TrimSpace(os.Getenv("MUSIC_DIR")); dir != "" {
+		music = queue.NewManager(dg)
+		music.Dir = dir
+		music.OnEvent = func(e *queue.Event) {
+			switch {
+			case e.Type == queue.TrackStart:
+				logInfof("Playing track %q.", e.Track.Title)
+			case e.Reason == queue.Failed:
+				logWarnf("Error playing track %q: %v", e.Track.Title, e.Err)
+			default:
+				logDebugf("Track %q ended.", e.Track.Title)
+			}
+		}
+
+		dg.AddHandler(func(s *discordgo.Session, event *discordgo.Ready) {
+			if _, err := s.ApplicationCommandCreate(s.State.User.ID, targetGuildID, queue.Command); err != nil {
+				logWarnf("Error registering /queue command: %v", err)
+				return
+			}
+			logInfof("Registered /queue command for tracks in %s.", dir)
+		})
+		dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			if err := music.HandleInteraction(s, i); err != nil {
+				logWarnf("Error responding to /queue: %v", err)
+			}
+		})
+	}
+
+	// MIX_FILE keeps each user's gain, mute and solo, set by /mix or the
+	// dashboard's /api/mix, for the audio played through the speaker.
+	mixFile := strings.TrimSpace(os.Getenv("MIX_FILE"))
+	if mixFile == "" {
+		mixFile = "mix.json"
+	}
+	mix, err := mixer.Load(mixFile)
+	if err != nil {
+		// A broken file is left for the user to fix rather than being
+		// overwritten, and the mix starts without settings.
+		logWarnf("Error loading mix settings, starting without them and not saving changes: %v", err)
+		mix = mixer.New()
+	}
+	if raw := strings.TrimSpace(os.Getenv("LOUDNESS_TARGET")); raw != "" {
+		if target, err := strconv.ParseFloat(raw, 64); err != nil || target > 0 {
+			logWarnf("Invalid LOUDNESS_TARGET=%q, defaulting to %d LUFS", raw, mixer.DefaultTarget)
+		} else {
+			mix.Target = target
+		}
+	}
+	dg.AddHandler(func(s *discordgo.Session, event *discordgo.Ready) {
+		if _, err := s.ApplicationCommandCreate(s.State.User.ID, targetGuildID, mixer.Command); err != nil {
+			logWarnf("Error registering /mix command: %v", err)
 			return
 		}
+		logInfof("Registered /mix command, settings in %s.", mixFile)
+	})
+	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if err := mix.HandleInteraction(s, i); err != nil {
+			logWarnf("Error responding to /mix: %v", err)
+		}
+	})
 
-		for _, c := range event.Guild.Channels {
-			if c.Type != discordgo.ChannelTypeGuildVoice {
-				continue
+	// The dashboard moves the bot and switches its devices through
+	// controls.
+	controls := &combinedControls{
+		manager:        manager,
+		guildID:        targetGuildID,
+		input:          strings.TrimSpace(os.Getenv("INPUT_DEVICE")),
+		output:         strings.TrimSpace(os.Getenv("OUTPUT_DEVICE")),
+		devicesChanged: make(chan struct{}, 1),
+	}
+
+	// Users leaving the channel take their SSRCs and loudness with them.
+	dg.AddHandler(func(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+		channelID := controls.channelID()
+		if channelID != "" && v.BeforeUpdate != nil && v.BeforeUpdate.ChannelID == channelID && v.ChannelID != channelID {
+			mix.RemoveUser(v.UserID)
+		}
+	})
+
+	// TTS_COMMAND speaks joins, leaves and recording into the channel.
+	var announcer *tts.Announcer
+	if line := strings.TrimSpace(os.Getenv("TTS_COMMAND")); line != "" {
+		synth, err := tts.ParseCommand(line)
+		if err != nil {
+			logWarnf("Invalid TTS_COMMAND: %v", err)
+		} else {
+			announcer = tts.NewAnnouncer(synth)
+			announcer.Player.DuckGain = duckGainFromEnv()
+			announcer.OnError = func(text string, err error) {
+				logWarnf("Error synthesizing %q: %v", text, err)
 			}
-			if voiceChannelID != "" && c.ID != voiceChannelID {
-				continue
+			defer announcer.Close()
+
+			dg.AddHandler(func(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+				channelID := controls.channelID()
+				if channelID == "" || v.UserID == s.State.User.ID {
+					return
+				}
+				wasHere := v.BeforeUpdate != nil && v.BeforeUpdate.ChannelID == channelID
+				isHere := v.ChannelID == channelID
+				switch {
+				case isHere && !wasHere:
+					announcer.Announce(voiceMemberName(s, v.VoiceState) + " joined")
+				case wasHere && !isHere:
+					announcer.Announce(voiceMemberName(s, v.VoiceState) + " left")
+				}
+			})
+		}
+	}
+	if music != nil {
+		music.Mix = (&musicMixer{player: player, announcer: announcer}).mix
+	}
+
+	// STT_COMMAND transcribes each speaker, posting to TRANSCRIPT_CHANNEL_ID
+	// and appending JSON lines to TRANSCRIPT_FILE.
+	var transcriber *stt.Pipeline
+	if line := strings.TrimSpace(os.Getenv("STT_COMMAND")); line != "" {
+		cmd, err := stt.ParseCommand(line)
+		if err != nil {
+			logWarnf("Invalid STT_COMMAND: %v", err)
+		} else {
+			var transcripts *stt.Log
+			if path := strings.TrimSpace(os.Getenv("TRANSCRIPT_FILE")); path != "" {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+				if err != nil {
+					logWarnf("Error opening transcript file: %v", err)
+				} else {
+					defer f.Close()
+					transcripts = stt.NewLog(f)
+				}
 			}
-			if voiceChannelID == "" && c.Name != voiceChannelName {
-				continue
+			channelID := strings.TrimSpace(os.Getenv("TRANSCRIPT_CHANNEL_ID"))
+
+			transcriber = stt.NewPipeline(cmd, func() (stt.OpusDecoder, error) {
+				return opus.NewDecoder(48000, 1)
+			})
+			transcriber.OnTranscript = func(t *stt.Transcript) {
+				logDebugf("Transcript: %s", t.Message())
+				if channelID != "" {
+					if _, err := dg.ChannelMessageSend(channelID, t.Message()); err != nil {
+						logWarnf("Error posting transcript: %v", err)
+					}
+				}
+				if transcripts != nil {
+					if err := transcripts.Write(t); err != nil {
+						logWarnf("Error writing transcript: %v", err)
+					}
+				}
+			}
+			transcriber.OnError = func(err error) {
+				logWarnf("Error transcribing: %v", err)
 			}
+			defer transcriber.Close()
+		}
+	}
+
+	// DASHBOARD_ADDR serves a page for the people in the room, showing who
+	// is speaking and working the mic, speaker and channel without rights
+	// on Discord. The audio stream follows its mute and volume either way.
+	// Without DASHBOARD_PASSWORD it is only served on a loopback address,
+	// as anyone reaching it could move the bot and switch its devices.
+	dashboardAddr := strings.TrimSpace(os.Getenv("DASHBOARD_ADDR"))
+	if dashboardAddr != "" && os.Getenv("DASHBOARD_PASSWORD") == "" && !loopbackAddr(dashboardAddr) {
+		logWarnf("Not serving the dashboard on %s without DASHBOARD_PASSWORD; set it, or listen on a loopback address such as 127.0.0.1:8000", dashboardAddr)
+		dashboardAddr = ""
+	}
+	dash := dashboard.New(dg, controls)
+	dash.Password = os.Getenv("DASHBOARD_PASSWORD")
+	dash.SetChannel(targetGuildID, "")
+	dash.SetDevices(controls.devices())
+	dash.Handle("/api/mix", mix)
+	dash.OnAction = func(r *http.Request, action string, err error) {
+		if err != nil {
+			logWarnf("Dashboard %s from %s failed: %v", action, r.RemoteAddr, err)
+			return
+		}
+		logInfof("Dashboard %s from %s.", action, r.RemoteAddr)
+	}
 
-			vc, err := s.ChannelVoiceJoin(event.Guild.ID, c.ID, false, false)
+	// METRICS_ADDR serves the state of the gateway, the voice connections
+	// and the sound devices to Prometheus at /metrics, and HEALTH_ADDR
+	// whether they work at /healthz and /readyz, as does systemd.
+	registry := metrics.NewRegistry()
+	registry.Register(metrics.Session(dg))
+	audio := &metrics.Audio{}
+	checker := health.NewChecker()
+	checker.Live("gateway heartbeat", health.Heartbeat(dg, 5*time.Minute))
+	checker.Ready("gateway", health.Gateway(dg))
+	metricsAddr := strings.TrimSpace(os.Getenv("METRICS_ADDR"))
+	healthAddr := strings.TrimSpace(os.Getenv("HEALTH_ADDR"))
+	statusServers := serveStatus([]statusRoute{
+		{metricsAddr, "/metrics", registry},
+		{healthAddr, "/healthz", checker.Handler(false)},
+		{healthAddr, "/readyz", checker.Handler(true)},
+		{dashboardAddr, "/", dash},
+	})
+	systemdStop := make(chan struct{})
+	go checker.Systemd(systemdStop)
+
+	// VOICE_CAPTURE records received packets for offline replay, see
+	// capture_replay.go.
+	var capture *discordgo.VoiceCapture
+	if path := strings.TrimSpace(os.Getenv("VOICE_CAPTURE")); path != "" {
+		c, err := discordgo.CreateVoiceCapture(path)
+		if err != nil {
+			logWarnf("Error creating voice capture: %v", err)
+		} else {
+			capture = c
+			logInfof("Capturing voice packets to %s (keys in %s.keys).", path, path)
+		}
+	}
+
+	// Each channel joined streams the mic to it, until the bot leaves or
+	// is moved.
+	manager.Run = func(vc *discordgo.VoiceConnection, cfg *guilds.Config, stop <-chan struct{}) {
+		if capture != nil {
+			vc.SetCapture(capture)
+		}
+		if transcriber != nil {
+			vc.AddHandler(transcriber.SpeakingUpdate)
+		}
+		if announcer != nil && (os.Getenv("RECORD_DIR") != "" || capture != nil || transcriber != nil) {
+			announcer.Announce("Recording started")
+		}
+
+		// RELAY_CHANNEL_ID connects this channel with another.
+		var voiceRelay *voiceRelay
+		if channelID := strings.TrimSpace(os.Getenv("RELAY_CHANNEL_ID")); channelID != "" {
+			r, err := startVoiceRelay(dg, vc.GuildID, channelID)
 			if err != nil {
-				logWarnf("Error joining voice channel: %v", err)
-				return
-			}
-			if voiceChannelID != "" {
-				logInfof("Successfully joined voice channel ID '%s'.", c.ID)
+				logWarnf("Error starting voice relay: %v", err)
 			} else {
-				logInfof("Successfully joined voice channel '%s' (%s).", voiceChannelName, c.ID)
+				voiceRelay = r
+				defer func() {
+					logInfof("Disconnecting voice relay.")
+					r.close()
+				}()
+				defer registry.Register(metrics.Voice(r.vc))()
+				logInfof("Relaying voice to channel %s in guild %s (%s).", channelID, r.vc.GuildID, r.out.Mode)
 			}
+		}
 
-			joined = true
-			currentCombinedVC = vc
-			stopCombinedAudioStream = make(chan struct{})
-			go streamCombinedAudio(vc, stopCombinedAudioStream)
-			return
+		vc.AddHandler(dash.SpeakingUpdate)
+		vc.AddHandler(mix.SpeakingUpdate)
+		// The mic is read continuously, so a stalled read means the
+		// device is stuck.
+		mic := &health.Probe{}
+		defer registry.Register(metrics.Voice(vc))()
+		defer registry.Register(func(w *metrics.Writer) { audio.Collect(w, "guild", vc.GuildID) })()
+		defer checker.Live("microphone", mic.Check(5*time.Second))()
+		defer checker.Ready("voice "+vc.GuildID, health.Voice(vc, 10*time.Second))()
+
+		// Switching devices restarts the audio stream on the same
+		// connection, waiting for it to close the old ones first. A
+		// switch made before joining is already read.
+		select {
+		case <-controls.devicesChanged:
+		default:
 		}
+		for {
+			input, output := controls.devices()
+			audioStop, audioDone := make(chan struct{}), make(chan struct{})
+			go func() {
+				streamCombinedAudio(vc, audioStop, input, output, outputFramesFromEnv(), player, music, announcer, transcriber, voiceRelay, audio, mic, dash, mix)
+				close(audioDone)
+			}()
 
-		if voiceChannelID != "" {
-			logWarnf("Voice channel ID '%s' not found in guild '%s'.", voiceChannelID, event.Guild.Name)
-			return
+			restart := false
+			select {
+			case <-stop:
+			case <-controls.devicesChanged:
+				restart = true
+			}
+			close(audioStop)
+			select {
+			case <-audioDone:
+			case <-time.After(2 * time.Second):
+				logWarnf("Audio stream did not stop in time.")
+			}
+			if !restart {
+				return
+			}
 		}
-		logWarnf("Voice channel '%s' not found in guild '%s'.", voiceChannelName, event.Guild.Name)
-	})
+	}
+	manager.OnJoin = func(cfg *guilds.Config, c *discordgo.Channel) {
+		controls.setGuild(cfg.GuildID)
+		dash.SetChannel(cfg.GuildID, c.ID)
+		logInfof("Successfully joined voice channel '%s' (%s) in guild %s.", c.Name, c.ID, cfg.GuildID)
+	}
+	manager.OnLeave = func(guildID string) {
+		dash.SetChannel(guildID, "")
+		logInfof("Left voice channel in guild %s.", guildID)
+	}
+	manager.OnError = func(guildID string, err error) {
+		logWarnf("Error joining voice channel in guild %s: %v", guildID, err)
+	}
 
 	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
 		if m.Author.ID == s.State.User.ID {
@@ -191,26 +621,448 @@ func main() {
 	<-sc
 
 	logInfof("Closing Discord session.")
+	close(systemdStop)
 
-	if stopCombinedAudioStream != nil {
-		close(stopCombinedAudioStream)
-		time.Sleep(1 * time.Second)
+	// Stop the audio stream and disconnect from the voice channel.
+	manager.Close()
+
+	if capture != nil {
+		if err := capture.Close(); err != nil {
+			logWarnf("Error writing voice capture: %v", err)
+		}
 	}
 
-	if currentCombinedVC != nil && currentCombinedVC.Ready {
-		logInfof("Disconnecting from voice channel.")
-		currentCombinedVC.Disconnect()
+	for _, srv := range statusServers {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		srv.Shutdown(ctx)
+		cancel()
 	}
 
 	dg.Close()
 }
 
+// A statusRoute is a handler of the status servers, for a pattern such
+// as "/metrics" on an address, which is not served if it is "".
+type statusRoute struct {
+	addr, pattern string
+	handler       http.Handler
+}
+
+// serveStatus serves each route, sharing a server between those on the
+// same address.
+func serveStatus(routes []statusRoute) []*http.Server {
+	muxes := map[string]*http.ServeMux{}
+	for _, r := range routes {
+		if r.addr == "" {
+			continue
+		}
+		if muxes[r.addr] == nil {
+			muxes[r.addr] = http.NewServeMux()
+		}
+		muxes[r.addr].Handle(r.pattern, r.handler)
+	}
+
+	var servers []*http.Server
+	for addr, mux := range muxes {
+		srv := &http.Server{Addr: addr, Handler: mux}
+		servers = append(servers, srv)
+		go func() {
+			logInfof("Serving status on %s", addr)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logWarnf("Error serving status: %v", err)
+			}
+		}()
+	}
+	return servers
+}
+
+// loopbackAddr reports whether addr only listens on the loopback interface,
+// as 127.0.0.1:8000, [::1]:8000 or localhost:8000 do and :8000 does not.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// combinedControls carries out the dashboard's actions on the bot.
+type combinedControls struct {
+	manager *guilds.Manager
+
+	sync.Mutex
+	guildID       string // of the channel last joined, or GUILD_ID
+	input, output string // the sound devices, "" for the defaults
+
+	// devicesChanged restarts the audio stream after SetDevices.
+	devicesChanged chan struct{}
+}
+
+func (c *combinedControls) setGuild(guildID string) {
+	c.Lock()
+	c.guildID = guildID
+	c.Unlock()
+}
+
+// devices returns the input and output device names.
+func (c *combinedControls) devices() (input, output string) {
+	c.Lock()
+	defer c.Unlock()
+	return c.input, c.output
+}
+
+// channelID returns the voice channel the bot is in, or "".
+func (c *combinedControls) channelID() string {
+	c.Lock()
+	guildID := c.guildID
+	c.Unlock()
+	vc := c.manager.VoiceConnection(guildID)
+	if vc == nil {
+		return ""
+	}
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.ChannelID
+}
+
+func (c *combinedControls) Join(channelID string) error {
+	c.Lock()
+	guildID := c.guildID
+	c.Unlock()
+	if guildID == "" {
+		return fmt.Errorf("no guild to join channel %s in; set GUILD_ID", channelID)
+	}
+	return c.manager.JoinChannel(guildID, channelID)
+}
+
+func (c *combinedControls) Leave() error {
+	c.Lock()
+	guildID := c.guildID
+	c.Unlock()
+	if !c.manager.Leave(guildID) {
+		return dashboard.ErrNotJoined
+	}
+	return nil
+}
+
+func (c *combinedControls) Devices() ([]dashboard.Device, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return nil, err
+	}
+	defer portaudio.Terminate()
+	infos, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	var devices []dashboard.Device
+	for _, d := range infos {
+		devices = append(devices, dashboard.Device{Name: d.Name, Input: d.MaxInputChannels > 0, Output: d.MaxOutputChannels > 0})
+	}
+	return devices, nil
+}
+
+func (c *combinedControls) SetDevices(input, output string) error {
+	if err := portaudio.Initialize(); err != nil {
+		return err
+	}
+	defer portaudio.Terminate()
+	if input != "" {
+		if _, err := findAudioDevice(input, true); err != nil {
+			return err
+		}
+	}
+	if output != "" {
+		if _, err := findAudioDevice(output, false); err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	c.input, c.output = input, output
+	c.Unlock()
+	select {
+	case c.devicesChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// openAudioStream opens a 48kHz mono input or output stream on the device
+// named, or on the default device if name is "".
+func openAudioStream(name string, input bool, buf []int16) (*portaudio.Stream, error) {
+	if name == "" {
+		if input {
+			return portaudio.OpenDefaultStream(1, 0, 48000, len(buf), buf)
+		}
+		return portaudio.OpenDefaultStream(0, 1, 48000, len(buf), buf)
+	}
+	dev, err := findAudioDevice(name, input)
+	if err != nil {
+		return nil, err
+	}
+	var p portaudio.StreamParameters
+	if input {
+		p = portaudio.LowLatencyParameters(dev, nil)
+		p.Input.Channels = 1
+	} else {
+		p = portaudio.LowLatencyParameters(nil, dev)
+		p.Output.Channels = 1
+	}
+	p.SampleRate = 48000
+	p.FramesPerBuffer = len(buf)
+	return portaudio.OpenStream(p, buf)
+}
+
+// findAudioDevice returns the input or output device named. PortAudio must
+// be initialized.
+func findAudioDevice(name string, input bool) (*portaudio.DeviceInfo, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if d.Name == name && (input && d.MaxInputChannels > 0 || !input && d.MaxOutputChannels > 0) {
+			return d, nil
+		}
+	}
+	if input {
+		return nil, fmt.Errorf("no input device %q", name)
+	}
+	return nil, fmt.Errorf("no output device %q", name)
+}
+
+// voiceRecorder writes each speaker's received audio, unmodified, to an Ogg
+// Opus file of its own in dir.
+type voiceRecorder struct {
+	dir   string
+	files map[uint32]*os.File
+	recs  map[uint32]*oggopus.Recorder
+}
+
+func newVoiceRecorder(dir string) *voiceRecorder {
+	return &voiceRecorder{dir: dir, files: map[uint32]*os.File{}, recs: map[uint32]*oggopus.Recorder{}}
+}
+
+func (r *voiceRecorder) write(p *discordgo.Packet) {
+	rec, ok := r.recs[p.SSRC]
+	if !ok {
+		name := filepath.Join(r.dir, fmt.Sprintf("%s-ssrc-%d.opus", time.Now().Format("20060102-150405"), p.SSRC))
+		f, err := os.Create(name)
+		if err != nil {
+			logWarnf("Error creating recording: %v", err)
+			r.recs[p.SSRC] = nil
+			return
+		}
+		rec, err = oggopus.NewRecorder(f, p.SSRC, oggopus.PacketChannels(p.Opus), oggopus.Tags{})
+		if err != nil {
+			logWarnf("Error writing recording: %v", err)
+			f.Close()
+			r.recs[p.SSRC] = nil
+			return
+		}
+		logInfof("Recording SSRC %d to %s.", p.SSRC, name)
+		r.files[p.SSRC] = f
+		r.recs[p.SSRC] = rec
+	}
+	if rec == nil {
+		return
+	}
+	if err := rec.WritePacket(p.Timestamp, p.Opus); err != nil {
+		logDebugf("Error recording packet from SSRC %d: %v", p.SSRC, err)
+	}
+}
+
+func (r *voiceRecorder) close() {
+	for ssrc, rec := range r.recs {
+		if rec == nil {
+			continue
+		}
+		if err := rec.Close(); err != nil {
+			logWarnf("Error writing recording: %v", err)
+		}
+		r.files[ssrc].Close()
+	}
+}
+
+// musicMixer mixes the soundboard and announcements on top of queued
+// tracks. Tracks are sent as they are while neither plays, and decoded to
+// mono and re-encoded while one does.
+type musicMixer struct {
+	player    *soundboard.Player
+	announcer *tts.Announcer
+
+	sync.Mutex
+	dec *opus.Decoder
+	enc *opus.Encoder
+	pcm []int16
+}
+
+func (m *musicMixer) mix(guildID string, packet []byte) []byte {
+	if !m.player.Playing() && (m.announcer == nil || !m.announcer.Pending()) {
+		return packet
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.dec == nil {
+		dec, err := opus.NewDecoder(48000, 1)
+		if err != nil {
+			logWarnf("Error creating Opus decoder: %v", err)
+			return packet
+		}
+		enc, err := opus.NewEncoder(48000, 1, opus.AppAudio)
+		if err != nil {
+			logWarnf("Error creating Opus encoder: %v", err)
+			return packet
+		}
+		m.dec, m.enc, m.pcm = dec, enc, make([]int16, soundboard.FrameSize)
+	}
+
+	// Only 20ms packets fit the soundboard's frames.
+	n, err := m.dec.Decode(packet, m.pcm)
+	if err != nil || n != len(m.pcm) {
+		return packet
+	}
+	m.player.Mix(m.pcm)
+	if m.announcer != nil {
+		m.announcer.Mix(m.pcm)
+	}
+
+	// The queue copies the packet before the next one is mixed.
+	mixed := make([]byte, 1000)
+	n, err = m.enc.Encode(m.pcm, mixed)
+	if err != nil {
+		logDebugf("Error encoding mixed track: %v", err)
+		return packet
+	}
+	return mixed[:n]
+}
+
+// voiceRelay forwards audio both ways between the bot's channel and a
+// second one, which may be in another guild. A bot can only be in one voice
+// channel per guild, so a channel in the same guild is joined by a second
+// bot with RELAY_BOT_TOKEN.
+type voiceRelay struct {
+	vc      *discordgo.VoiceConnection
+	session *discordgo.Session // the second bot's session, if any
+	out     *relay.Forwarder   // to the relayed channel
+	in      *relay.Forwarder   // from the relayed channel, mixed into the mic
+	stop    chan struct{}
+}
+
+func startVoiceRelay(s *discordgo.Session, guildID, channelID string) (*voiceRelay, error) {
+	r := &voiceRelay{stop: make(chan struct{})}
+	relayGuildID := strings.TrimSpace(os.Getenv("RELAY_GUILD_ID"))
+	if relayGuildID == "" {
+		relayGuildID = guildID
+	}
+
+	if token := strings.TrimSpace(os.Getenv("RELAY_BOT_TOKEN")); token != "" {
+		rs, err := discordgo.New("Bot " + token)
+		if err != nil {
+			return nil, err
+		}
+		rs.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildVoiceStates
+		if err := rs.Open(); err != nil {
+			return nil, err
+		}
+		r.session = rs
+		s = rs
+	} else if relayGuildID == guildID {
+		return nil, fmt.Errorf("channel %s is in the bot's own guild; set RELAY_BOT_TOKEN to join it with a second bot", channelID)
+	}
+
+	vc, err := s.ChannelVoiceJoin(relayGuildID, channelID, false, false,
+		discordgo.WithOpusSendDepth(sendBufferFromEnv()),
+		discordgo.WithOpusRecv(recvBufferFromEnv(), discordgo.RecvOverflowDropOldest))
+	if err != nil {
+		if r.session != nil {
+			r.session.Close()
+		}
+		return nil, err
+	}
+	r.vc = vc
+
+	encoder, err := opus.NewEncoder(48000, 1, opus.AppAudio)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	newDecoder := func() (relay.OpusDecoder, error) {
+		return opus.NewDecoder(48000, 1)
+	}
+	r.out = relay.NewForwarder(newDecoder)
+	r.out.Mode = relayModeFromEnv()
+	r.in = relay.NewForwarder(newDecoder)
+	r.in.Mode = relay.Mix
+
+	go r.out.Run(vc, encoder, r.stop)
+	go func() {
+		for {
+			select {
+			case <-r.stop:
+				return
+			case p, ok := <-vc.OpusRecv:
+				if !ok {
+					logWarnf("Relay OpusRecv channel closed.")
+					return
+				}
+				if err := r.in.WritePacket(p); err != nil {
+					logDebugf("Error decoding relayed packet from SSRC %d: %v", p.SSRC, err)
+				}
+				p.Release()
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *voiceRelay) write(p *discordgo.Packet) {
+	if err := r.out.WritePacket(p); err != nil {
+		logDebugf("Error decoding relayed packet from SSRC %d: %v", p.SSRC, err)
+	}
+}
+
+func (r *voiceRelay) close() {
+	close(r.stop)
+	if r.vc != nil {
+		r.vc.Disconnect()
+	}
+	if r.session != nil {
+		r.session.Close()
+	}
+}
+
+// voiceMemberName returns the name to announce for the user of a voice
+// state.
+func voiceMemberName(s *discordgo.Session, v *discordgo.VoiceState) string {
+	m := v.Member
+	if m == nil {
+		m, _ = s.State.Member(v.GuildID, v.UserID)
+	}
+	if m == nil || m.User == nil {
+		return "Someone"
+	}
+	if m.Nick != "" {
+		return m.Nick
+	}
+	if m.User.GlobalName != "" {
+		return m.User.GlobalName
+	}
+	return m.User.Username
+}
+
 func readyCombined(s *discordgo.Session, event *discordgo.Ready) {
 	logInfof("Discord bot is ready!")
 	s.UpdateGameStatus(0, "Streaming Audio")
 }
 
-func streamCombinedAudio(vc *discordgo.VoiceConnection, stopChan <-chan struct{}) {
+func streamCombinedAudio(vc *discordgo.VoiceConnection, stopChan <-chan struct{}, inputDevice, outputDevice string, outputFrames int, player *soundboard.Player, music *queue.Manager, announcer *tts.Announcer, transcriber *stt.Pipeline, voiceRelay *voiceRelay, audio *metrics.Audio, mic *health.Probe, dash *dashboard.Dashboard, mix *mixer.Mixer) {
 	logInfof("Starting audio stream.")
 	vc.Speaking(true)
 	defer vc.Speaking(false)
@@ -220,18 +1072,19 @@ func streamCombinedAudio(vc *discordgo.VoiceConnection, stopChan <-chan struct{}
 	defer portaudio.Terminate()
 
 	in := make([]int16, 960)
-	micStream, err := portaudio.OpenDefaultStream(1, 0, 48000, len(in), in)
+	micStream, err := openAudioStream(inputDevice, true, in)
 	if err != nil {
 		logWarnf("Error opening PortAudio input stream: %v", err)
+		mic.Fail(err)
 		return
 	}
 	defer micStream.Close()
 
-	outputFrames := outputFramesFromEnv()
 	out := make([]int16, outputFrames)
-	speakerStream, err := portaudio.OpenDefaultStream(0, 1, 48000, len(out), out)
+	speakerStream, err := openAudioStream(outputDevice, false, out)
 	if err != nil {
 		logWarnf("Error opening PortAudio output stream: %v", err)
+		mic.Fail(err)
 		return
 	}
 	defer speakerStream.Close()
@@ -239,18 +1092,51 @@ func streamCombinedAudio(vc *discordgo.VoiceConnection, stopChan <-chan struct{}
 	opusEncoder, err := opus.NewEncoder(48000, 1, opus.AppAudio)
 	if err != nil {
 		logWarnf("Error creating Opus encoder: %v", err)
+		mic.Fail(err)
 		return
 	}
 
-	opusDecoder, err := opus.NewDecoder(48000, 1)
-	if err != nil {
-		logWarnf("Error creating Opus decoder: %v", err)
-		return
+	// Each speaker is decoded on their own, set to their level in the mix
+	// and summed with the others into 20ms frames for the speaker.
+	speakers := relay.NewForwarder(func() (relay.OpusDecoder, error) {
+		return opus.NewDecoder(48000, 1)
+	})
+	speakers.Mode = relay.Mix
+	speakers.Process = func(ssrc uint32, pcm []int16) {
+		dash.Received(ssrc, pcm)
+		mix.Process(ssrc, pcm)
+	}
+	pending := make([]int16, 0, outputFrames+relay.FrameSize)
+	writeSpeaker := func(pcm []int16) error {
+		pending = append(pending, pcm...)
+		for len(pending) >= outputFrames {
+			copy(out, pending[:outputFrames])
+			pending = append(pending[:0], pending[outputFrames:]...)
+			dash.ApplyVolume(out)
+			err := speakerStream.Write()
+			if err == portaudio.OutputUnderflowed {
+				audio.Underruns.Inc()
+			} else if err != nil {
+				logWarnf("Error writing to PortAudio output stream: %v", err)
+				return err
+			}
+		}
+		return nil
 	}
 
+	// The speaker is closed once the receive goroutine stops decoding
+	// into it, and the mix goroutine writing to it.
+	recvDone := make(chan struct{})
+	defer func() { <-recvDone }()
 	go func() {
-		decodeBuf := make([]int16, 960)
-		pending := make([]int16, 0, outputFrames*2)
+		defer close(recvDone)
+
+		// RECORD_DIR keeps each speaker's audio as an Ogg Opus file.
+		var recorder *voiceRecorder
+		if dir := strings.TrimSpace(os.Getenv("RECORD_DIR")); dir != "" {
+			recorder = newVoiceRecorder(dir)
+			defer recorder.close()
+		}
 
 		for {
 			select {
@@ -270,29 +1156,33 @@ func streamCombinedAudio(vc *discordgo.VoiceConnection, stopChan <-chan struct{}
 					time.Sleep(200 * time.Millisecond)
 					continue
 				}
-				p, ok := <-vc.OpusRecv
+				var p *discordgo.Packet
+				var ok bool
+				select {
+				case <-stopChan:
+					logInfof("Stopping audio receive goroutine.")
+					return
+				case p, ok = <-vc.OpusRecv:
+				}
 				if !ok {
 					logWarnf("OpusRecv channel closed, returning from receive goroutine.")
 					return
 				}
 
-				n, err := opusDecoder.Decode(p.Opus, decodeBuf)
-				if err != nil {
-					logWarnf("Error decoding Opus data: %v", err)
-					continue
+				if recorder != nil {
+					recorder.write(p)
 				}
-
-				pending = append(pending, decodeBuf[:n]...)
-				for len(pending) >= outputFrames {
-					copy(out, pending[:outputFrames])
-					pending = pending[outputFrames:]
-					if speakerStream != nil {
-						err = speakerStream.Write()
-						if err != nil {
-							logWarnf("Error writing to PortAudio output stream: %v", err)
-						}
-					}
+				if transcriber != nil {
+					transcriber.WritePacket(p)
+				}
+				if voiceRelay != nil {
+					voiceRelay.write(p)
 				}
+				if err := speakers.WritePacket(p); err != nil {
+					audio.DecodeErrors.Inc()
+					logWarnf("Error decoding Opus data: %v", err)
+				}
+				p.Release()
 			}
 		}
 	}()
@@ -300,13 +1190,26 @@ func streamCombinedAudio(vc *discordgo.VoiceConnection, stopChan <-chan struct{}
 	err = micStream.Start()
 	if err != nil {
 		logWarnf("Error starting PortAudio input stream: %v", err)
+		mic.Fail(err)
 		return
 	}
 	err = speakerStream.Start()
 	if err != nil {
 		logWarnf("Error starting PortAudio output stream: %v", err)
+		mic.Fail(err)
 		return
 	}
+	speakerDone := make(chan struct{})
+	defer func() { <-speakerDone }()
+	go func() {
+		defer close(speakerDone)
+		livestream.Run(speakers, stopChan, writeSpeaker)
+	}()
+
+	// Encoded frames are queued on OpusSend, so rotate through enough
+	// buffers to cover the queue plus the frame being sent.
+	opusBufs := make([][1000]byte, vc.SendStats().Capacity+2)
+	opusNext := 0
 
 	for {
 		select {
@@ -318,18 +1221,52 @@ func streamCombinedAudio(vc *discordgo.VoiceConnection, stopChan <-chan struct{}
 		default:
 			err = micStream.Read()
 			if err != nil {
+				if err == portaudio.InputOverflowed {
+					audio.Overruns.Inc()
+					mic.Beat()
+				} else {
+					mic.Fail(err)
+				}
 				continue
 			}
+			mic.Beat()
+			dash.Captured(in)
 
-			opusData := make([]byte, 1000)
+			// Queued tracks are sent instead of the mic, and carry the
+			// soundboard and announcements themselves.
+			if music != nil && music.Playing(vc.GuildID) {
+				continue
+			}
+			// A muted mic still carries the soundboard and announcements.
+			if dash.MicMuted() {
+				for i := range in {
+					in[i] = 0
+				}
+			}
+			player.Mix(in)
+			if announcer != nil {
+				announcer.Mix(in)
+			}
+			if voiceRelay != nil {
+				voiceRelay.in.Mix(in)
+			}
+
+			opusData := opusBufs[opusNext][:]
+			opusNext = (opusNext + 1) % len(opusBufs)
 			n, err := opusEncoder.Encode(in, opusData)
 			if err != nil {
+				audio.EncodeErrors.Inc()
 				logWarnf("Error encoding Opus data: %v", err)
 				continue
 			}
 
 			if vc.Ready {
-				vc.OpusSend <- opusData[:n]
+				// Never block capture on the network; drop the frame instead.
+				if err := vc.SendOpus(opusData[:n], time.Time{}); err != nil {
+					audio.Dropped.Inc()
+					st := vc.SendStats()
+					logDebugf("Dropped opus frame: %v (queued %d/%d, rejected %d, late %d)", err, st.Queued, st.Capacity, st.Rejected, st.Late)
+				}
 			}
 		}
 	}
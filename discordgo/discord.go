@@ -52,6 +52,7 @@ func New(token string) (s *Session, err error) {
 		sequence:                           new(int64),
 		LastHeartbeatAck:                   time.Now().UTC(),
 	}
+	s.heartbeatAck = s.LastHeartbeatAck.UnixNano()
 
 	// Initialize the Identify Package with defaults
 	// These can be modified prior to calling Open()
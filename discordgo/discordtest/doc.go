@@ -0,0 +1,10 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package discordtest provides in-process fakes of the Discord servers, so
+// that code using discordgo can be tested without a network connection.
+package discordtest
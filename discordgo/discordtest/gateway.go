@@ -0,0 +1,287 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains the gateway websocket of the fake Discord server.
+
+package discordtest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Gateway opcodes.
+const (
+	GatewayOpDispatch         = 0
+	GatewayOpHeartbeat        = 1
+	GatewayOpIdentify         = 2
+	GatewayOpVoiceStateUpdate = 4
+	GatewayOpResume           = 6
+	GatewayOpReconnect        = 7
+	GatewayOpInvalidSession   = 9
+	GatewayOpHello            = 10
+	GatewayOpHeartbeatAck     = 11
+)
+
+// Gateway close codes.
+const (
+	GatewayCloseAuthenticationFailed = 4004
+)
+
+// A GatewayOp is a message received on the gateway websocket.
+type GatewayOp struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+var gatewayUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Connections returns the number of gateway connections accepted so far.
+func (s *Server) Connections() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.connections
+}
+
+// SessionID returns the ID of the current gateway session, or an empty
+// string before Identify.
+func (s *Server) SessionID() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.sessionID
+}
+
+// Dispatch sends an event to the client.
+func (s *Server) Dispatch(eventType string, data interface{}) error {
+	s.Lock()
+	s.sequence++
+	msg := map[string]interface{}{"op": GatewayOpDispatch, "t": eventType, "s": s.sequence, "d": data}
+	s.Unlock()
+
+	return s.writeGateway(msg)
+}
+
+// SendOp sends a non-dispatch message to the client, for example
+// GatewayOpReconnect or GatewayOpInvalidSession.
+func (s *Server) SendOp(op int, data interface{}) error {
+	return s.writeGateway(map[string]interface{}{"op": op, "d": data})
+}
+
+// Disconnect closes the gateway connection with the given close code, or
+// without a close frame if code is 0.
+func (s *Server) Disconnect(code int) error {
+
+	s.Lock()
+	c := s.wsConn
+	s.wsConn = nil
+	s.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	if code != 0 {
+		s.wsMutex.Lock()
+		err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+		s.wsMutex.Unlock()
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	return c.Close()
+}
+
+// writeGateway writes a message on the current gateway connection.
+func (s *Server) writeGateway(msg interface{}) error {
+
+	s.Lock()
+	c := s.wsConn
+	s.Unlock()
+
+	if c == nil {
+		return errors.New("gateway client not connected")
+	}
+
+	s.wsMutex.Lock()
+	defer s.wsMutex.Unlock()
+	return c.WriteJSON(msg)
+}
+
+// serveGateway handles a gateway websocket connection.
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+
+	c, err := gatewayUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	s.Lock()
+	if s.wsConn != nil {
+		s.wsConn.Close()
+	}
+	s.wsConn = c
+	s.connections++
+	interval := s.HeartbeatInterval
+	s.Unlock()
+
+	s.SendOp(GatewayOpHello, map[string]interface{}{
+		"heartbeat_interval": int64(interval / time.Millisecond),
+	})
+
+	for {
+		messageType, message, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var op GatewayOp
+		if err := json.Unmarshal(message, &op); err != nil {
+			continue
+		}
+
+		select {
+		case s.Ops <- op:
+		default:
+		}
+
+		switch op.Op {
+		case GatewayOpHeartbeat:
+			s.SendOp(GatewayOpHeartbeatAck, nil)
+
+		case GatewayOpIdentify:
+			if !s.identify(op.Data) {
+				s.Disconnect(GatewayCloseAuthenticationFailed)
+				return
+			}
+
+		case GatewayOpResume:
+			s.resume(op.Data)
+
+		case GatewayOpVoiceStateUpdate:
+			s.voiceStateUpdate(op.Data)
+		}
+	}
+}
+
+// identify starts a new session, sending Ready and a Guild Create event
+// for each guild. It returns false if the token is invalid.
+func (s *Server) identify(data json.RawMessage) bool {
+
+	var identify struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(data, &identify)
+
+	s.Lock()
+	if s.Token != "" && identify.Token != s.Token {
+		s.Unlock()
+		return false
+	}
+	s.sequence = 0
+	s.Unlock()
+
+	sessionID := s.NewID()
+
+	s.Lock()
+	s.sessionID = sessionID
+	user := s.User
+	guilds := append([]Guild{}, s.Guilds...)
+	s.Unlock()
+
+	unavailable := make([]map[string]interface{}, len(guilds))
+	for i, g := range guilds {
+		unavailable[i] = map[string]interface{}{"id": g.ID, "unavailable": true}
+	}
+
+	s.Dispatch("READY", map[string]interface{}{
+		"v":                  9,
+		"user":               user,
+		"session_id":         sessionID,
+		"resume_gateway_url": s.URL(),
+		"guilds":             unavailable,
+	})
+
+	for _, g := range guilds {
+		g.Channels = append([]Channel{}, g.Channels...)
+		for i := range g.Channels {
+			g.Channels[i].GuildID = g.ID
+		}
+		s.Dispatch("GUILD_CREATE", g)
+	}
+
+	return true
+}
+
+// resume continues the current session, or invalidates it if the session
+// ID does not match.
+func (s *Server) resume(data json.RawMessage) {
+
+	var resume struct {
+		SessionID string `json:"session_id"`
+	}
+	json.Unmarshal(data, &resume)
+
+	if resume.SessionID == "" || resume.SessionID != s.SessionID() {
+		s.SendOp(GatewayOpInvalidSession, false)
+		return
+	}
+
+	s.Dispatch("RESUMED", map[string]interface{}{})
+}
+
+// voiceStateUpdate answers a request to join or leave a voice channel,
+// directing joins to the voice server.
+func (s *Server) voiceStateUpdate(data json.RawMessage) {
+
+	var update struct {
+		GuildID   string  `json:"guild_id"`
+		ChannelID *string `json:"channel_id"`
+		SelfMute  bool    `json:"self_mute"`
+		SelfDeaf  bool    `json:"self_deaf"`
+	}
+	if err := json.Unmarshal(data, &update); err != nil {
+		return
+	}
+
+	s.Lock()
+	user := s.User
+	sessionID := s.sessionID
+	voice := s.Voice
+	if v, ok := s.GuildVoice[update.GuildID]; ok {
+		voice = v
+	}
+	s.Unlock()
+
+	s.Dispatch("VOICE_STATE_UPDATE", map[string]interface{}{
+		"guild_id":   update.GuildID,
+		"channel_id": update.ChannelID,
+		"user_id":    user.ID,
+		"session_id": "voice-" + sessionID,
+		"self_mute":  update.SelfMute,
+		"self_deaf":  update.SelfDeaf,
+	})
+
+	if update.ChannelID != nil && voice != nil {
+		s.Dispatch("VOICE_SERVER_UPDATE", map[string]interface{}{
+			"token":    "voice-token",
+			"guild_id": update.GuildID,
+			"endpoint": voice.Endpoint(),
+		})
+	}
+}
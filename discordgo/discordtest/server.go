@@ -0,0 +1,399 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains a fake Discord REST API server.
+
+package discordtest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Channel types used by the fake servers.
+const (
+	ChannelTypeGuildText  = 0
+	ChannelTypeGuildVoice = 2
+)
+
+// A User is a Discord user.
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Bot      bool   `json:"bot"`
+}
+
+// A Channel is a guild channel.
+type Channel struct {
+	ID      string `json:"id"`
+	GuildID string `json:"guild_id"`
+	Name    string `json:"name"`
+	Type    int    `json:"type"`
+}
+
+// A Guild is a guild sent to clients in Guild Create.
+type Guild struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Channels []Channel `json:"channels"`
+}
+
+// A RESTRequest is a request received by the REST API.
+type RESTRequest struct {
+	Method string
+	Path   string // relative to the API root, e.g. /channels/1/messages
+	Body   []byte
+}
+
+// A Server is an in-process Discord gateway and REST API, with a
+// VoiceServer that voice connections are directed to.
+//
+// Sessions are pointed at it by setting their Client and Dialer, and
+// allowing its voice endpoint:
+//
+//	s.Client = srv.Client()
+//	s.Dialer = srv.Dialer()
+//	s.VoiceEndpointAllowlist = []string{"127.0.0.1"}
+//
+// The exported fields may be changed before a client connects.
+type Server struct {
+	// Token, if set, must be sent in Identify.
+	Token string
+
+	// User is the bot user sent in Ready.
+	User User
+
+	// Guilds are sent in Guild Create events after Ready.
+	Guilds []Guild
+
+	// HeartbeatInterval is sent in Hello.
+	HeartbeatInterval time.Duration
+
+	// Voice is the voice server sent in Voice Server Update events, and
+	// GuildVoice that of particular guilds. A VoiceServer serves one
+	// connection at a time.
+	Voice      *VoiceServer
+	GuildVoice map[string]*VoiceServer
+
+	// Ops receives the gateway messages sent by clients, and Requests the
+	// REST requests. Messages are dropped when the channels are full.
+	Ops      chan GatewayOp
+	Requests chan RESTRequest
+
+	http *httptest.Server
+
+	sync.Mutex
+	routes      []route
+	nextID      int
+	wsConn      *websocket.Conn
+	wsMutex     sync.Mutex
+	sequence    int64
+	sessionID   string
+	connections int
+}
+
+// A route is a REST API handler registered with HandleFunc.
+type route struct {
+	method  string
+	pattern *regexp.Regexp
+	handler http.HandlerFunc
+}
+
+// apiPrefix matches the versioned API root of request paths.
+var apiPrefix = regexp.MustCompile(`^/api(/v[0-9]+)?`)
+
+// NewServer starts a Server listening on the loopback interface.
+func NewServer() (*Server, error) {
+
+	voice, err := NewVoiceServer()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		User:              User{ID: "1000", Username: "discordtest", Bot: true},
+		HeartbeatInterval: 41250 * time.Millisecond,
+		Voice:             voice,
+		Ops:               make(chan GatewayOp, 256),
+		Requests:          make(chan RESTRequest, 256),
+		nextID:            2000,
+	}
+	s.http = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	s.defaultRoutes()
+
+	return s, nil
+}
+
+// Close shuts down the server and its voice server.
+func (s *Server) Close() {
+	s.Disconnect(0)
+	s.http.Close()
+	if s.Voice != nil {
+		s.Voice.Close()
+	}
+}
+
+// URL returns the gateway URL.
+func (s *Server) URL() string {
+	return "wss://" + s.http.Listener.Addr().String() + "/"
+}
+
+// Client returns an HTTP client which sends every request to the server,
+// whatever its host, so the default discordgo endpoints can be used.
+func (s *Server) Client() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &rewriteTransport{
+			host: s.http.Listener.Addr().String(),
+			rt:   s.http.Client().Transport,
+		},
+	}
+}
+
+// Dialer returns a websocket dialer which trusts the certificates of the
+// server and its voice server.
+func (s *Server) Dialer() *websocket.Dialer {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.http.Certificate())
+	if s.Voice != nil {
+		pool.AddCert(s.Voice.http.Certificate())
+	}
+
+	return &websocket.Dialer{
+		TLSClientConfig:  &tls.Config{RootCAs: pool},
+		HandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// NewID returns a new unique snowflake ID.
+func (s *Server) NewID() string {
+	s.Lock()
+	defer s.Unlock()
+	s.nextID++
+	return strconv.Itoa(s.nextID)
+}
+
+// HandleFunc registers a REST API handler, which takes precedence over
+// those registered before it. pattern is a path relative to the API root
+// in which * matches a single path segment, e.g. /channels/*/messages.
+func (s *Server) HandleFunc(method, pattern string, handler http.HandlerFunc) {
+	expr := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, `[^/]+`, -1) + "$"
+
+	s.Lock()
+	defer s.Unlock()
+	s.routes = append(s.routes, route{method, regexp.MustCompile(expr), handler})
+}
+
+// WriteJSON writes v as the JSON response to a REST request.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// rewriteTransport sends requests to a fixed host.
+type rewriteTransport struct {
+	host string
+	rt   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = "https"
+	r.URL.Host = t.host
+	r.Host = t.host
+	return t.rt.RoundTrip(r)
+}
+
+// serveHTTP handles gateway connections and REST requests.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveGateway(w, r)
+		return
+	}
+
+	path := apiPrefix.ReplaceAllString(r.URL.Path, "")
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	select {
+	case s.Requests <- RESTRequest{r.Method, path, body}:
+	default:
+	}
+
+	s.Lock()
+	routes := s.routes
+	s.Unlock()
+
+	for i := len(routes) - 1; i >= 0; i-- {
+		if routes[i].method == r.Method && routes[i].pattern.MatchString(path) {
+			r.URL.Path = path
+			routes[i].handler(w, r)
+			return
+		}
+	}
+
+	WriteJSON(w, http.StatusNotFound, map[string]interface{}{"message": "404: Not Found", "code": 0})
+}
+
+// pathSegment returns the i'th segment of a request path.
+func pathSegment(r *http.Request, i int) string {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if i < len(parts) {
+		return parts[i]
+	}
+	return ""
+}
+
+// guild returns the guild with the given ID.
+func (s *Server) guild(id string) (Guild, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, g := range s.Guilds {
+		if g.ID == id {
+			return g, true
+		}
+	}
+	return Guild{}, false
+}
+
+// channel returns the guild channel with the given ID.
+func (s *Server) channel(id string) (Channel, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, g := range s.Guilds {
+		for _, c := range g.Channels {
+			if c.ID == id {
+				c.GuildID = g.ID
+				return c, true
+			}
+		}
+	}
+	return Channel{}, false
+}
+
+// defaultRoutes registers the REST endpoints used by the gateway and bots.
+func (s *Server) defaultRoutes() {
+
+	notFound := func(w http.ResponseWriter) {
+		WriteJSON(w, http.StatusNotFound, map[string]interface{}{"message": "Unknown", "code": 10000})
+	}
+
+	s.HandleFunc("GET", "/gateway", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"url": s.URL()})
+	})
+
+	s.HandleFunc("GET", "/gateway/bot", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]interface{}{
+			"url":    s.URL(),
+			"shards": 1,
+			"session_start_limit": map[string]int{
+				"total":           1000,
+				"remaining":       1000,
+				"reset_after":     0,
+				"max_concurrency": 1,
+			},
+		})
+	})
+
+	s.HandleFunc("GET", "/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		u := s.User
+		s.Unlock()
+		WriteJSON(w, http.StatusOK, u)
+	})
+
+	s.HandleFunc("GET", "/guilds/*", func(w http.ResponseWriter, r *http.Request) {
+		g, ok := s.guild(pathSegment(r, 1))
+		if !ok {
+			notFound(w)
+			return
+		}
+		WriteJSON(w, http.StatusOK, g)
+	})
+
+	s.HandleFunc("GET", "/guilds/*/channels", func(w http.ResponseWriter, r *http.Request) {
+		g, ok := s.guild(pathSegment(r, 1))
+		if !ok {
+			notFound(w)
+			return
+		}
+		WriteJSON(w, http.StatusOK, g.Channels)
+	})
+
+	s.HandleFunc("GET", "/channels/*", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := s.channel(pathSegment(r, 1))
+		if !ok {
+			notFound(w)
+			return
+		}
+		WriteJSON(w, http.StatusOK, c)
+	})
+
+	s.HandleFunc("POST", "/channels/*/messages", func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "Invalid JSON", "code": 50109})
+			return
+		}
+
+		s.Lock()
+		u := s.User
+		s.Unlock()
+
+		m["id"] = s.NewID()
+		m["channel_id"] = pathSegment(r, 1)
+		m["author"] = u
+		m["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+		WriteJSON(w, http.StatusOK, m)
+	})
+
+	s.HandleFunc("PUT", "/applications/*/commands", func(w http.ResponseWriter, r *http.Request) {
+		var commands []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&commands); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "Invalid JSON", "code": 50109})
+			return
+		}
+		for _, c := range commands {
+			c["id"] = s.NewID()
+			c["application_id"] = pathSegment(r, 1)
+		}
+		WriteJSON(w, http.StatusOK, commands)
+	})
+
+	s.HandleFunc("POST", "/applications/*/commands", func(w http.ResponseWriter, r *http.Request) {
+		var c map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "Invalid JSON", "code": 50109})
+			return
+		}
+		c["id"] = s.NewID()
+		c["application_id"] = pathSegment(r, 1)
+		WriteJSON(w, http.StatusCreated, c)
+	})
+
+	s.HandleFunc("POST", "/interactions/*/*/callback", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,556 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains a fake Discord voice server.
+
+package discordtest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Voice gateway opcodes.
+const (
+	VoiceOpIdentify           = 0
+	VoiceOpSelectProtocol     = 1
+	VoiceOpReady              = 2
+	VoiceOpHeartbeat          = 3
+	VoiceOpSessionDescription = 4
+	VoiceOpSpeaking           = 5
+	VoiceOpHeartbeatAck       = 6
+	VoiceOpResume             = 7
+	VoiceOpHello              = 8
+	VoiceOpResumed            = 9
+)
+
+// Voice gateway close codes.
+const (
+	VoiceCloseDisconnected      = 4014
+	VoiceCloseUnknownEncryption = 4016
+)
+
+// VoiceModes are the encryption modes offered by a VoiceServer by default.
+var VoiceModes = []string{
+	"aead_aes256_gcm_rtpsize",
+	"aead_xchacha20_poly1305_rtpsize",
+	"xsalsa20_poly1305_lite",
+	"xsalsa20_poly1305_suffix",
+	"xsalsa20_poly1305",
+}
+
+// A VoiceOp is a message received on the voice websocket.
+type VoiceOp struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+// A VoicePacket is a decrypted RTP audio packet.
+type VoicePacket struct {
+	SSRC      uint32
+	Sequence  uint16
+	Timestamp uint32
+	Opus      []byte
+}
+
+// A VoiceServer is an in-process Discord voice server. It speaks the voice
+// websocket protocol over TLS, answers UDP IP discovery and exchanges
+// encrypted RTP audio, so that voice connections can be tested offline.
+//
+// The exported fields may be changed before a client connects.
+type VoiceServer struct {
+	// Modes are the encryption modes offered in Ready.
+	Modes []string
+
+	// SSRC is assigned to the client in Ready.
+	SSRC uint32
+
+	// SecretKey is sent in Session Description.
+	SecretKey [32]byte
+
+	// HeartbeatInterval is sent in Hello.
+	HeartbeatInterval time.Duration
+
+	// Ops receives the messages sent by clients, and Audio the audio
+	// packets. Messages are dropped when the channels are full.
+	Ops   chan VoiceOp
+	Audio chan VoicePacket
+
+	http *httptest.Server
+	udp  *net.UDPConn
+
+	sync.Mutex
+	wsConn     *websocket.Conn
+	wsMutex    sync.Mutex
+	version    int
+	sequence   int
+	sessions   int
+	mode       string
+	clientAddr *net.UDPAddr
+	nonce      uint32
+}
+
+// NewVoiceServer starts a VoiceServer listening on the loopback interface.
+func NewVoiceServer() (*VoiceServer, error) {
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &VoiceServer{
+		Modes:             VoiceModes,
+		SSRC:              1,
+		HeartbeatInterval: 41250 * time.Millisecond,
+		Ops:               make(chan VoiceOp, 256),
+		Audio:             make(chan VoicePacket, 256),
+		udp:               udp,
+	}
+	if _, err := rand.Read(s.SecretKey[:]); err != nil {
+		udp.Close()
+		return nil, err
+	}
+
+	s.http = httptest.NewTLSServer(http.HandlerFunc(s.serveWS))
+	go s.serveUDP()
+
+	return s, nil
+}
+
+// Endpoint returns the endpoint to send in a Voice Server Update.
+func (s *VoiceServer) Endpoint() string {
+	return s.http.Listener.Addr().String()
+}
+
+// Dialer returns a websocket dialer which trusts the server's certificate.
+func (s *VoiceServer) Dialer() *websocket.Dialer {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.http.Certificate())
+
+	return &websocket.Dialer{
+		TLSClientConfig:  &tls.Config{RootCAs: pool},
+		HandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// Mode returns the encryption mode selected by the client, or an empty
+// string before Select Protocol.
+func (s *VoiceServer) Mode() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.mode
+}
+
+// Sessions returns the number of websocket connections accepted so far.
+func (s *VoiceServer) Sessions() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.sessions
+}
+
+// Close shuts down the server and any open connections.
+func (s *VoiceServer) Close() {
+	s.Disconnect(0)
+	s.http.Close()
+	s.udp.Close()
+}
+
+// Disconnect closes the current websocket connection with the given close
+// code, or without a close frame if code is 0.
+func (s *VoiceServer) Disconnect(code int) error {
+
+	s.Lock()
+	c := s.wsConn
+	s.wsConn = nil
+	s.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	if code != 0 {
+		s.wsMutex.Lock()
+		err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+		s.wsMutex.Unlock()
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	return c.Close()
+}
+
+// SendSpeaking sends a Speaking event for another user to the client.
+func (s *VoiceServer) SendSpeaking(userID string, ssrc uint32, speaking int) error {
+	return s.write(VoiceOpSpeaking, map[string]interface{}{
+		"user_id":  userID,
+		"ssrc":     ssrc,
+		"speaking": speaking,
+	})
+}
+
+// SendAudio encrypts an audio packet with the selected mode and sends it
+// to the client's UDP address.
+func (s *VoiceServer) SendAudio(p VoicePacket) error {
+
+	s.Lock()
+	addr := s.clientAddr
+	mode := s.mode
+	key := s.SecretKey
+	s.nonce++
+	nonce := s.nonce
+	s.Unlock()
+
+	if addr == nil || mode == "" {
+		return errors.New("voice client not connected")
+	}
+
+	header := make([]byte, 12)
+	header[0] = 0x80
+	header[1] = 0x78
+	binary.BigEndian.PutUint16(header[2:], p.Sequence)
+	binary.BigEndian.PutUint32(header[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(header[8:], p.SSRC)
+
+	packet, err := sealAudio(mode, &key, nonce, header, p.Opus)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.udp.WriteToUDP(packet, addr)
+	return err
+}
+
+var voiceUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveWS handles a voice websocket connection.
+func (s *VoiceServer) serveWS(w http.ResponseWriter, r *http.Request) {
+
+	c, err := voiceUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	version, _ := strconv.Atoi(r.URL.Query().Get("v"))
+
+	s.Lock()
+	if s.wsConn != nil {
+		s.wsConn.Close()
+	}
+	s.wsConn = c
+	s.version = version
+	s.sequence = 0
+	s.sessions++
+	interval := s.HeartbeatInterval
+	s.Unlock()
+
+	s.write(VoiceOpHello, map[string]interface{}{
+		"heartbeat_interval": float64(interval / time.Millisecond),
+	})
+
+	for {
+		messageType, message, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var op VoiceOp
+		if err := json.Unmarshal(message, &op); err != nil {
+			continue
+		}
+
+		select {
+		case s.Ops <- op:
+		default:
+		}
+
+		switch op.Op {
+		case VoiceOpIdentify:
+			s.Lock()
+			ready := map[string]interface{}{
+				"ssrc":               s.SSRC,
+				"ip":                 "127.0.0.1",
+				"port":               s.udp.LocalAddr().(*net.UDPAddr).Port,
+				"modes":              s.Modes,
+				"heartbeat_interval": float64(s.HeartbeatInterval / time.Millisecond),
+			}
+			s.Unlock()
+			s.write(VoiceOpReady, ready)
+
+		case VoiceOpSelectProtocol:
+			var sp struct {
+				Data struct {
+					Mode string `json:"mode"`
+				} `json:"data"`
+			}
+			json.Unmarshal(op.Data, &sp)
+
+			if !s.offers(sp.Data.Mode) {
+				s.Disconnect(VoiceCloseUnknownEncryption)
+				return
+			}
+
+			s.Lock()
+			s.mode = sp.Data.Mode
+			s.nonce = 0
+			key := make([]int, len(s.SecretKey))
+			for i, b := range s.SecretKey {
+				key[i] = int(b)
+			}
+			s.Unlock()
+
+			s.write(VoiceOpSessionDescription, map[string]interface{}{
+				"mode":       sp.Data.Mode,
+				"secret_key": key,
+			})
+
+		case VoiceOpHeartbeat:
+			s.write(VoiceOpHeartbeatAck, op.Data)
+
+		case VoiceOpResume:
+			s.write(VoiceOpResumed, nil)
+		}
+	}
+}
+
+// offers reports whether mode is one of the offered encryption modes.
+func (s *VoiceServer) offers(mode string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, m := range s.Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// write sends a message on the current websocket connection, with a
+// sequence number for version 8 clients.
+func (s *VoiceServer) write(op int, data interface{}) error {
+
+	s.Lock()
+	c := s.wsConn
+	msg := map[string]interface{}{"op": op, "d": data}
+	if s.version >= 8 && op != VoiceOpHello && op != VoiceOpHeartbeatAck {
+		s.sequence++
+		msg["seq"] = s.sequence
+	}
+	s.Unlock()
+
+	if c == nil {
+		return errors.New("voice client not connected")
+	}
+
+	s.wsMutex.Lock()
+	defer s.wsMutex.Unlock()
+	return c.WriteJSON(msg)
+}
+
+// serveUDP answers IP discovery and decrypts received audio packets.
+func (s *VoiceServer) serveUDP() {
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+
+		switch {
+		case n == 74 && binary.BigEndian.Uint16(b) == 1:
+			s.Lock()
+			s.clientAddr = addr
+			s.Unlock()
+
+			reply := make([]byte, 74)
+			binary.BigEndian.PutUint16(reply, 2)
+			binary.BigEndian.PutUint16(reply[2:], 70)
+			copy(reply[4:], b[4:8])
+			copy(reply[8:], addr.IP.String())
+			binary.BigEndian.PutUint16(reply[72:], uint16(addr.Port))
+			s.udp.WriteToUDP(reply, addr)
+
+		case n >= 12 && b[0]>>6 == 2 && b[1]&0x7F == 0x78:
+			s.Lock()
+			mode := s.mode
+			key := s.SecretKey
+			s.Unlock()
+
+			p, err := openAudio(mode, &key, b)
+			if err != nil {
+				continue
+			}
+
+			select {
+			case s.Audio <- p:
+			default:
+			}
+		}
+	}
+}
+
+// isRTPSizeMode reports whether the extension header is sent in the clear.
+func isRTPSizeMode(mode string) bool {
+	return mode == "aead_aes256_gcm_rtpsize" || mode == "aead_xchacha20_poly1305_rtpsize"
+}
+
+// newAEAD returns the cipher for one of the rtpsize modes.
+func newAEAD(mode string, key *[32]byte) (cipher.AEAD, error) {
+	if mode == "aead_xchacha20_poly1305_rtpsize" {
+		return chacha20poly1305.NewX(key[:])
+	}
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAudio encrypts an RTP payload the way Discord does for mode.
+func sealAudio(mode string, key *[32]byte, counter uint32, header, payload []byte) ([]byte, error) {
+
+	var nonce [24]byte
+	packet := append([]byte{}, header...)
+
+	switch mode {
+	case "aead_aes256_gcm_rtpsize", "aead_xchacha20_poly1305_rtpsize":
+		aead, err := newAEAD(mode, key)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(nonce[:], counter)
+		packet = aead.Seal(packet, nonce[:aead.NonceSize()], payload, header)
+		return append(packet, nonce[:4]...), nil
+
+	case "xsalsa20_poly1305_lite":
+		binary.BigEndian.PutUint32(nonce[:], counter)
+		packet = secretbox.Seal(packet, payload, &nonce, key)
+		return append(packet, nonce[:4]...), nil
+
+	case "xsalsa20_poly1305_suffix":
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return nil, err
+		}
+		packet = secretbox.Seal(packet, payload, &nonce, key)
+		return append(packet, nonce[:]...), nil
+
+	case "xsalsa20_poly1305":
+		copy(nonce[:], header)
+		return secretbox.Seal(packet, payload, &nonce, key), nil
+	}
+
+	return nil, fmt.Errorf("unsupported encryption mode %q", mode)
+}
+
+// openAudio decrypts an RTP packet encrypted with mode.
+func openAudio(mode string, key *[32]byte, b []byte) (VoicePacket, error) {
+
+	p := VoicePacket{
+		Sequence:  binary.BigEndian.Uint16(b[2:]),
+		Timestamp: binary.BigEndian.Uint32(b[4:]),
+		SSRC:      binary.BigEndian.Uint32(b[8:]),
+	}
+
+	n := 12 + int(b[0]&0x0F)*4
+	extension := b[0]&0x10 != 0
+	if extension && isRTPSizeMode(mode) {
+		n += 4
+	}
+	if len(b) < n {
+		return p, errors.New("rtp packet too small")
+	}
+	header, encrypted := b[:n], b[n:]
+
+	var nonce [24]byte
+	var plaintext []byte
+	var ok bool
+
+	switch mode {
+	case "aead_aes256_gcm_rtpsize", "aead_xchacha20_poly1305_rtpsize":
+		if len(encrypted) < 4 {
+			return p, errors.New("packet too small for nonce")
+		}
+		aead, err := newAEAD(mode, key)
+		if err != nil {
+			return p, err
+		}
+		copy(nonce[:], encrypted[len(encrypted)-4:])
+		plaintext, err = aead.Open(nil, nonce[:aead.NonceSize()], encrypted[:len(encrypted)-4], header)
+		ok = err == nil
+
+	case "xsalsa20_poly1305_lite":
+		if len(encrypted) < 4 {
+			return p, errors.New("packet too small for nonce")
+		}
+		copy(nonce[:], encrypted[len(encrypted)-4:])
+		plaintext, ok = secretbox.Open(nil, encrypted[:len(encrypted)-4], &nonce, key)
+
+	case "xsalsa20_poly1305_suffix":
+		if len(encrypted) < 24 {
+			return p, errors.New("packet too small for nonce")
+		}
+		copy(nonce[:], encrypted[len(encrypted)-24:])
+		plaintext, ok = secretbox.Open(nil, encrypted[:len(encrypted)-24], &nonce, key)
+
+	case "xsalsa20_poly1305":
+		copy(nonce[:], header)
+		plaintext, ok = secretbox.Open(nil, encrypted, &nonce, key)
+
+	default:
+		return p, fmt.Errorf("unsupported encryption mode %q", mode)
+	}
+	if !ok {
+		return p, errors.New("failed to decrypt audio packet")
+	}
+
+	if extension {
+		extHeader := header[len(header)-4:]
+		if !isRTPSizeMode(mode) {
+			if len(plaintext) < 4 {
+				return p, errors.New("payload too small for extension header")
+			}
+			extHeader = plaintext[:4]
+			plaintext = plaintext[4:]
+		}
+		l := int(binary.BigEndian.Uint16(extHeader[2:])) * 4
+		if len(plaintext) < l {
+			return p, errors.New("payload too small for extension body")
+		}
+		plaintext = plaintext[l:]
+	}
+
+	p.Opus = plaintext
+	return p, nil
+}
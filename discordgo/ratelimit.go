@@ -19,6 +19,11 @@ type customRateLimit struct {
 
 // RateLimiter holds all ratelimit buckets
 type RateLimiter struct {
+	// Wait counters, accessed atomically. They are the first fields so
+	// that they are 64-bit aligned on 32-bit platforms.
+	waits  uint64
+	waited int64 // nanoseconds
+
 	sync.Mutex
 	global           *int64
 	buckets          map[string]*Bucket
@@ -95,6 +100,7 @@ func (r *RateLimiter) LockBucketObject(b *Bucket) *Bucket {
 	b.Lock()
 
 	if wait := r.GetWaitTime(b, 1); wait > 0 {
+		r.addWait(wait)
 		time.Sleep(wait)
 	}
 
@@ -102,6 +108,27 @@ func (r *RateLimiter) LockBucketObject(b *Bucket) *Bucket {
 	return b
 }
 
+// RateLimitStats holds statistics about requests held back by a
+// RateLimiter, see Stats.
+type RateLimitStats struct {
+	Waits  uint64        // requests which waited for a bucket or a 429 to reset
+	Waited time.Duration // total time waited
+}
+
+// Stats returns statistics about the waits of r.
+func (r *RateLimiter) Stats() RateLimitStats {
+	return RateLimitStats{
+		Waits:  atomic.LoadUint64(&r.waits),
+		Waited: time.Duration(atomic.LoadInt64(&r.waited)),
+	}
+}
+
+// addWait counts a request waiting for wait.
+func (r *RateLimiter) addWait(wait time.Duration) {
+	atomic.AddUint64(&r.waits, 1)
+	atomic.AddInt64(&r.waited, int64(wait))
+}
+
 // Bucket represents a ratelimit bucket, each bucket gets ratelimited individually (-global ratelimits)
 type Bucket struct {
 	sync.Mutex
@@ -25,6 +25,15 @@ import (
 
 // A Session represents a connection to the Discord API.
 type Session struct {
+	// Reconnect counter and copies of LastHeartbeatAck, LastHeartbeatSent
+	// (as Unix nanoseconds) and DataReady, accessed atomically so that
+	// they can be read while Open holds the lock. They are the first
+	// fields so that they are 64-bit aligned on 32-bit platforms.
+	reconnects    uint64
+	heartbeatAck  int64
+	heartbeatSent int64
+	dataReady     int32
+
 	sync.RWMutex
 
 	// General configurable settings.
@@ -96,6 +105,11 @@ type Session struct {
 	// The dialer used for WebSocket connection
 	Dialer *websocket.Dialer
 
+	// The domains voice connections may be opened to. Entries starting
+	// with a dot match any subdomain, others must match the host exactly.
+	// Defaults to VoiceEndpointDomains when nil.
+	VoiceEndpointAllowlist []string
+
 	// The user agent used for REST APIs
 	UserAgent string
 
@@ -10,9 +10,12 @@
 package discordgo
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -32,6 +35,18 @@ import (
 
 // A VoiceConnection struct holds all the data and functions related to a Discord Voice Connection.
 type VoiceConnection struct {
+	// Packet counters, accessed atomically. They are the first fields so
+	// that they are 64-bit aligned on 32-bit platforms.
+	packetsDropped uint64 // received packets dropped, OpusRecv full
+	packetsSent    uint64
+	packetsLate    uint64
+	framesRejected uint64 // frames refused by SendOpus, OpusSend full
+	packetsRecv    uint64 // received packets decrypted
+	decryptErrors  uint64 // received packets which failed to decrypt
+	reconnects     uint64
+	lastSent       int64 // UnixNano of the last packet sent
+	lastRecv       int64 // UnixNano of the last packet received
+
 	sync.RWMutex
 
 	Debug        bool // If true, print extra logging -- DEPRECATED
@@ -48,6 +63,21 @@ type VoiceConnection struct {
 	OpusSend chan []byte  // Chan for sending opus audio
 	OpusRecv chan *Packet // Chan for receiving opus audio
 
+	// OpusSendDepth is the capacity of the OpusSend channel. The default is
+	// 2. It is set with the WithOpusSendDepth option of ChannelVoiceJoin,
+	// and only takes effect when OpusSend is created on first connecting.
+	OpusSendDepth int
+
+	// OpusRecvDepth and OpusRecvPolicy are the capacity of the OpusRecv
+	// channel and what to do with received packets once it is full. The
+	// default is a capacity of 2 and RecvOverflowBlock. They are set with
+	// the WithOpusRecv option of ChannelVoiceJoin; the depth only takes
+	// effect when OpusRecv is created on first connecting.
+	OpusRecvDepth  int
+	OpusRecvPolicy RecvOverflowPolicy
+	packetHandler  func(*Packet)
+	capture        *VoiceCapture
+
 	wsConn  *websocket.Conn
 	wsMutex sync.Mutex
 	udpConn *net.UDPConn
@@ -67,9 +97,28 @@ type VoiceConnection struct {
 	op2 voiceOP2
 
 	voiceSpeakingUpdateHandlers []VoiceSpeakingUpdateHandler
+	voiceRTCPHandlers           []VoiceRTCPHandler
+
+	// RTCPReportInterval is how often RTCP receiver reports are sent to
+	// Discord. It is set with the WithRTCPReportInterval option of
+	// ChannelVoiceJoin and takes effect each time the connection connects.
+	// Statistics are always available from ReceiveStats.
+	RTCPReportInterval time.Duration
+	rtpStats           rtpReceiveStats
 
 	encryptionMode string
 	nonce          uint32
+
+	// DAVE enables the DAVE end-to-end encryption protocol when set before
+	// joining. It performs the MLS group operations, see DAVESession;
+	// discordgo does not provide one, so DAVE stays off while this is nil.
+	DAVE DAVESession
+	dave daveState
+
+	// Voice gateway version, 0 for the unversioned gateway.
+	gatewayVersion    int
+	heartbeatInterval time.Duration // in milliseconds, from OP8 Hello
+	lastSequence      int64         // last sequence number received, version 8+
 }
 
 // VoiceSpeakingUpdateHandler type provides a function definition for the
@@ -98,7 +147,27 @@ func (v *VoiceConnection) Speaking(b bool) (err error) {
 		return fmt.Errorf("no VoiceConnection websocket")
 	}
 
-	data := voiceSpeakingOp{5, voiceSpeakingData{b, 0}}
+	// Version 8 of the voice gateway expects a bitmask of speaking flags.
+	type voiceSpeakingFlagsData struct {
+		Speaking int    `json:"speaking"`
+		Delay    int    `json:"delay"`
+		SSRC     uint32 `json:"ssrc"`
+	}
+
+	type voiceSpeakingFlagsOp struct {
+		Op   int                    `json:"op"` // Always 5
+		Data voiceSpeakingFlagsData `json:"d"`
+	}
+
+	var data interface{} = voiceSpeakingOp{5, voiceSpeakingData{b, 0}}
+	if v.voiceGatewayVersion() >= 8 {
+		flags := 0
+		if b {
+			flags = 1
+		}
+		data = voiceSpeakingFlagsOp{5, voiceSpeakingFlagsData{flags, 0, v.op2.SSRC}}
+	}
+
 	v.wsMutex.Lock()
 	err = v.wsConn.WriteJSON(data)
 	v.wsMutex.Unlock()
@@ -230,6 +299,32 @@ type VoiceSpeakingUpdate struct {
 	Speaking bool   `json:"speaking"`
 }
 
+// UnmarshalJSON is a helper function to unmarshal a VoiceSpeakingUpdate,
+// where newer voice gateway versions send speaking as a bitmask.
+func (vs *VoiceSpeakingUpdate) UnmarshalJSON(data []byte) error {
+	var v struct {
+		UserID   string          `json:"user_id"`
+		SSRC     int             `json:"ssrc"`
+		Speaking json.RawMessage `json:"speaking"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	vs.UserID = v.UserID
+	vs.SSRC = v.SSRC
+
+	var flags int
+	if err := json.Unmarshal(v.Speaking, &vs.Speaking); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(v.Speaking, &flags); err != nil {
+		return err
+	}
+	vs.Speaking = flags != 0
+	return nil
+}
+
 // ------------------------------------------------------------------------------------------------
 // Unexported Internal Functions Below.
 // ------------------------------------------------------------------------------------------------
@@ -237,8 +332,9 @@ type VoiceSpeakingUpdate struct {
 // A voiceOP4 stores the data for the voice operation 4 websocket event
 // which provides us with the NaCl SecretBox encryption key
 type voiceOP4 struct {
-	SecretKey [32]byte `json:"secret_key"`
-	Mode      string   `json:"mode"`
+	SecretKey           [32]byte `json:"secret_key"`
+	Mode                string   `json:"mode"`
+	DAVEProtocolVersion int      `json:"dave_protocol_version"`
 }
 
 // A voiceOP2 stores the data for the voice operation 2 websocket event
@@ -275,6 +371,37 @@ func (v *VoiceConnection) waitUntilConnected() error {
 	}
 }
 
+// VoiceEndpointDomains are the domains voice connections may be opened to,
+// unless Session.VoiceEndpointAllowlist is set.
+var VoiceEndpointDomains = []string{
+	".discord.media",          // Voice servers
+	".discord.gg",             // Invite shortlinks
+	".discordapp.com",         // Old domain
+	".discord.com",            // Main domain
+	".discordpartygames.com",  // Voice channels
+	".discord-activities.com", // Voice channels
+	".discordactivities.com",  // Voice channels
+	".discordsays.com",        // Voice channels
+}
+
+// validVoiceEndpoint reports whether the host of endpoint is allowed. An
+// allowed domain starting with a dot matches any host with that suffix,
+// otherwise the host must match exactly.
+func validVoiceEndpoint(endpoint string, allowed []string) bool {
+
+	host := endpoint
+	if strings.Contains(host, ":") {
+		host = strings.Split(host, ":")[0]
+	}
+
+	for _, domain := range allowed {
+		if strings.HasPrefix(domain, ".") && strings.HasSuffix(host, domain) || host == domain {
+			return true
+		}
+	}
+	return false
+}
+
 // Open opens a voice connection.  This should be called
 // after VoiceChannelJoin is used and the data VOICE websocket events
 // are captured.
@@ -312,35 +439,26 @@ func (v *VoiceConnection) open() (err error) {
 	// modified by darui3018823
 	// because Uncontrolled data used in network request (v.session.Dialer.Dial(vg, nil))
 
-	allowedDomains := []string{
-		".discord.media",          // Voice servers
-		".discord.gg",             // Invite shortlinks
-		".discordapp.com",         // Old domain
-		".discord.com",            // Main domain
-		".discordpartygames.com",  // Voice channels
-		".discord-activities.com", // Voice channels
-		".discordactivities.com",  // Voice channels
-		".discordsays.com",        // Voice channels
+	allowedDomains := VoiceEndpointDomains
+	if v.session != nil && v.session.VoiceEndpointAllowlist != nil {
+		allowedDomains = v.session.VoiceEndpointAllowlist
 	}
 
-	host := v.endpoint
-	if strings.Contains(host, ":") {
-		host = strings.Split(host, ":")[0]
+	if !validVoiceEndpoint(v.endpoint, allowedDomains) {
+		return fmt.Errorf("invalid voice endpoint: %s", v.endpoint)
 	}
 
-	isValid := false
-	for _, domain := range allowedDomains {
-		if strings.HasSuffix(host, domain) {
-			isValid = true
-			break
-		}
-	}
+	vg := "wss://" + strings.TrimSuffix(v.endpoint, ":80")
 
-	if !isValid {
-		return fmt.Errorf("invalid voice endpoint: %s", v.endpoint)
+	// DAVE requires version 8 of the voice gateway.
+	v.gatewayVersion = 0
+	if v.DAVE != nil {
+		v.gatewayVersion = 8
+		vg += "/?v=8"
 	}
+	atomic.StoreInt64(&v.lastSequence, -1)
+	v.heartbeatInterval = 0
 
-	vg := "wss://" + strings.TrimSuffix(v.endpoint, ":80")
 	v.log(LogInformational, "connecting to voice endpoint %s", vg)
 	v.wsConn, _, err = v.session.Dialer.Dial(vg, nil)
 	if err != nil {
@@ -350,16 +468,20 @@ func (v *VoiceConnection) open() (err error) {
 	}
 
 	type voiceHandshakeData struct {
-		ServerID  string `json:"server_id"`
-		UserID    string `json:"user_id"`
-		SessionID string `json:"session_id"`
-		Token     string `json:"token"`
+		ServerID               string `json:"server_id"`
+		UserID                 string `json:"user_id"`
+		SessionID              string `json:"session_id"`
+		Token                  string `json:"token"`
+		MaxDAVEProtocolVersion int    `json:"max_dave_protocol_version,omitempty"`
 	}
 	type voiceHandshakeOp struct {
 		Op   int                `json:"op"` // Always 0
 		Data voiceHandshakeData `json:"d"`
 	}
-	data := voiceHandshakeOp{0, voiceHandshakeData{v.GuildID, v.UserID, v.sessionID, v.token}}
+	data := voiceHandshakeOp{0, voiceHandshakeData{v.GuildID, v.UserID, v.sessionID, v.token, 0}}
+	if v.DAVE != nil {
+		data.Data.MaxDAVEProtocolVersion = DAVEProtocolVersion
+	}
 
 	v.wsMutex.Lock()
 	err = v.wsConn.WriteJSON(data)
@@ -386,7 +508,7 @@ func (v *VoiceConnection) wsListen(wsConn *websocket.Conn, close <-chan struct{}
 	v.log(LogInformational, "called")
 
 	for {
-		_, message, err := v.wsConn.ReadMessage()
+		messageType, message, err := wsConn.ReadMessage()
 		if err != nil {
 			// 4014 indicates a manual disconnection by someone in the guild;
 			// we shouldn't reconnect.
@@ -447,11 +569,43 @@ func (v *VoiceConnection) wsListen(wsConn *websocket.Conn, close <-chan struct{}
 		case <-close:
 			return
 		default:
-			go v.onEvent(message)
 		}
+
+		// DAVE messages depend on each other, so handle them in order.
+		if messageType == websocket.BinaryMessage {
+			v.onDAVEBinaryEvent(message)
+			continue
+		}
+		if v.DAVE != nil {
+			var op struct {
+				Operation int `json:"op"`
+			}
+			// OP8 HELLO carries the heartbeat interval needed by OP2 READY,
+			// and OP4 SESSION DESCRIPTION resets the DAVE session, which
+			// must happen before the external sender that follows it.
+			if json.Unmarshal(message, &op) == nil && (isDAVEOp(op.Operation) || op.Operation == 8 || op.Operation == 2 || op.Operation == 4) {
+				v.onEvent(message)
+				continue
+			}
+		}
+
+		go v.onEvent(message)
 	}
 }
 
+// voiceGatewayVersion returns the version of the connected voice gateway.
+func (v *VoiceConnection) voiceGatewayVersion() int {
+	v.RLock()
+	defer v.RUnlock()
+	return v.gatewayVersion
+}
+
+// setLastSequence records the last sequence number received from a version
+// 8 voice gateway, which is acknowledged in heartbeats.
+func (v *VoiceConnection) setLastSequence(seq int64) {
+	atomic.StoreInt64(&v.lastSequence, seq)
+}
+
 // wsEvent handles any voice websocket events. This is only called by the
 // wsListen() function.
 func (v *VoiceConnection) onEvent(message []byte) {
@@ -464,17 +618,39 @@ func (v *VoiceConnection) onEvent(message []byte) {
 		return
 	}
 
+	if v.voiceGatewayVersion() >= 8 {
+		var seq struct {
+			Sequence *int64 `json:"seq"`
+		}
+		if json.Unmarshal(message, &seq) == nil && seq.Sequence != nil {
+			v.setLastSequence(*seq.Sequence)
+		}
+	}
+
+	if isDAVEOp(e.Operation) {
+		v.onDAVEEvent(&e)
+		return
+	}
+
 	switch e.Operation {
 
 	case 2: // READY
 
+		v.Lock()
 		if err := json.Unmarshal(e.RawData, &v.op2); err != nil {
+			v.Unlock()
 			v.log(LogError, "OP2 unmarshall error, %s, %s", err, string(e.RawData))
 			return
 		}
 
 		// Start the voice websocket heartbeat to keep the connection alive
-		go v.wsHeartbeat(v.wsConn, v.close, v.op2.HeartbeatInterval)
+		interval := v.op2.HeartbeatInterval
+		if v.heartbeatInterval > 0 {
+			interval = v.heartbeatInterval
+		}
+		wsConn, close := v.wsConn, v.close
+		v.Unlock()
+		go v.wsHeartbeat(wsConn, close, interval)
 		// TODO monitor a chan/bool to verify this was successful
 
 		// Start the UDP connection
@@ -484,20 +660,36 @@ func (v *VoiceConnection) onEvent(message []byte) {
 			return
 		}
 
-		// Start the opusSender.
-		// TODO: Should we allow 48000/960 values to be user defined?
+		// Create the audio channels before the opusSender marks the
+		// connection ready.
+		v.Lock()
 		if v.OpusSend == nil {
-			v.OpusSend = make(chan []byte, 2)
+			depth := v.OpusSendDepth
+			if depth <= 0 {
+				depth = 2
+			}
+			v.OpusSend = make(chan []byte, depth)
 		}
-		go v.opusSender(v.udpConn, v.close, v.OpusSend, 48000, 960)
-
-		// Start the opusReceiver
-		if !v.deaf {
-			if v.OpusRecv == nil {
-				v.OpusRecv = make(chan *Packet, 2)
+		if !v.deaf && v.OpusRecv == nil {
+			depth := v.OpusRecvDepth
+			if depth <= 0 {
+				depth = 2
 			}
+			v.OpusRecv = make(chan *Packet, depth)
+		}
+		udpConn, close := v.udpConn, v.close
+		opusSend, opusRecv, deaf := v.OpusSend, v.OpusRecv, v.deaf
+		policy, reportInterval := v.OpusRecvPolicy, v.RTCPReportInterval
+		v.Unlock()
 
-			go v.opusReceiver(v.udpConn, v.close, v.OpusRecv)
+		// Start the opusSender.
+		// TODO: Should we allow 48000/960 values to be user defined?
+		go v.opusSender(udpConn, close, opusSend, 48000, 960)
+
+		// Start the opusReceiver
+		if !deaf {
+			go v.opusReceiver(udpConn, close, opusRecv, policy)
+			go v.rtcpReporter(udpConn, close, reportInterval)
 		}
 
 		return
@@ -508,10 +700,9 @@ func (v *VoiceConnection) onEvent(message []byte) {
 
 	case 4: // udp encryption secret key
 		v.Lock()
-		defer v.Unlock()
-
 		v.op4 = voiceOP4{}
 		if err := json.Unmarshal(e.RawData, &v.op4); err != nil {
+			v.Unlock()
 			v.log(LogError, "OP4 unmarshall error, %s, %s", err, string(e.RawData))
 			return
 		}
@@ -519,23 +710,45 @@ func (v *VoiceConnection) onEvent(message []byte) {
 			v.encryptionMode = v.op4.Mode
 			v.nonce = 0
 		}
-		return
+		if v.capture != nil {
+			v.capture.writeKey(time.Now(), v.encryptionMode, &v.op4.SecretKey)
+		}
+		daveVersion := v.op4.DAVEProtocolVersion
+		v.Unlock()
 
-	case 5:
-		if len(v.voiceSpeakingUpdateHandlers) == 0 {
-			return
+		// Media stays unencrypted until the first DAVE transition executes.
+		if v.DAVE != nil {
+			v.daveInit(daveVersion)
 		}
+		return
 
+	case 5:
 		voiceSpeakingUpdate := &VoiceSpeakingUpdate{}
 		if err := json.Unmarshal(e.RawData, voiceSpeakingUpdate); err != nil {
 			v.log(LogError, "OP5 unmarshall error, %s, %s", err, string(e.RawData))
 			return
 		}
 
+		if voiceSpeakingUpdate.UserID != "" {
+			v.daveSetSSRCUser(uint32(voiceSpeakingUpdate.SSRC), voiceSpeakingUpdate.UserID)
+		}
+
 		for _, h := range v.voiceSpeakingUpdateHandlers {
 			h(v, voiceSpeakingUpdate)
 		}
 
+	case 8: // HELLO
+		var hello struct {
+			HeartbeatInterval float64 `json:"heartbeat_interval"`
+		}
+		if err := json.Unmarshal(e.RawData, &hello); err != nil {
+			v.log(LogError, "OP8 unmarshall error, %s, %s", err, string(e.RawData))
+			return
+		}
+		v.Lock()
+		v.heartbeatInterval = time.Duration(hello.HeartbeatInterval)
+		v.Unlock()
+
 	default:
 		v.log(LogDebug, "unknown voice operation, %d, %s", e.Operation, string(e.RawData))
 	}
@@ -546,6 +759,16 @@ type voiceHeartbeatOp struct {
 	Data int `json:"d"`
 }
 
+type voiceHeartbeatData struct {
+	Nonce       int64 `json:"t"`
+	SequenceAck int64 `json:"seq_ack"`
+}
+
+type voiceHeartbeatAckOp struct {
+	Op   int                `json:"op"` // Always 3
+	Data voiceHeartbeatData `json:"d"`
+}
+
 // NOTE :: When a guild voice server changes how do we shut this down
 // properly, so a new connection can be setup without fuss?
 //
@@ -563,8 +786,12 @@ func (v *VoiceConnection) wsHeartbeat(wsConn *websocket.Conn, close <-chan struc
 	defer ticker.Stop()
 	for {
 		v.log(LogDebug, "sending heartbeat packet")
+		var data interface{} = voiceHeartbeatOp{3, int(time.Now().Unix())}
+		if v.voiceGatewayVersion() >= 8 {
+			data = voiceHeartbeatAckOp{3, voiceHeartbeatData{time.Now().UnixNano() / int64(time.Millisecond), atomic.LoadInt64(&v.lastSequence)}}
+		}
 		v.wsMutex.Lock()
-		err = wsConn.WriteJSON(voiceHeartbeatOp{3, int(time.Now().Unix())})
+		err = wsConn.WriteJSON(data)
 		v.wsMutex.Unlock()
 		if err != nil {
 			v.log(LogError, "error sending heartbeat to voice endpoint %s, %s", v.endpoint, err)
@@ -600,7 +827,12 @@ type voiceUDPOp struct {
 	Data voiceUDPD `json:"d"`
 }
 
+// preferredEncryptionModes lists the supported transport encryption modes,
+// most preferred first. Discord recommends AES-256-GCM, which is hardware
+// accelerated on most platforms, and requires XChaCha20-Poly1305 support.
+// The xsalsa20 modes are deprecated.
 var preferredEncryptionModes = [...]string{
+	"aead_aes256_gcm_rtpsize",
 	"aead_xchacha20_poly1305_rtpsize",
 	"xsalsa20_poly1305_lite",
 	"xsalsa20_poly1305_suffix",
@@ -609,13 +841,9 @@ var preferredEncryptionModes = [...]string{
 
 const defaultEncryptionMode = "xsalsa20_poly1305"
 
+// selectEncryptionMode picks the most preferred encryption mode offered by
+// the voice server, failing if none of them is supported.
 func (v *VoiceConnection) selectEncryptionMode() (string, error) {
-	for _, mode := range v.op2.Modes {
-		if mode == "xsalsa20_poly1305" {
-			return mode, nil
-		}
-	}
-
 	for _, pref := range preferredEncryptionModes {
 		for _, mode := range v.op2.Modes {
 			if mode == pref {
@@ -624,11 +852,10 @@ func (v *VoiceConnection) selectEncryptionMode() (string, error) {
 		}
 	}
 
-	if len(v.op2.Modes) > 0 {
-		return v.op2.Modes[0], nil
+	if len(v.op2.Modes) == 0 {
+		return "", fmt.Errorf("no encryption modes provided by server")
 	}
-
-	return "", fmt.Errorf("no encryption modes provided by server")
+	return "", fmt.Errorf("no supported encryption mode offered by server: %s", strings.Join(v.op2.Modes, ", "))
 }
 
 // udpOpen opens a UDP connection to the voice server and completes the
@@ -779,93 +1006,127 @@ func (v *VoiceConnection) getAndIncrementNonce() uint32 {
 	return next - 1
 }
 
-func (v *VoiceConnection) encryptAudioPacket(mode string, header, payload []byte, key [32]byte) ([]byte, error) {
+// maxUDPPacketSize is the largest voice datagram read from the UDP connection.
+const maxUDPPacketSize = 1500
+
+// An audioCipher holds the transport encryption state for one direction of
+// a voice connection, so packets can be sealed and opened without
+// allocating. It must not be used concurrently.
+type audioCipher struct {
+	mode  string
+	key   [32]byte
+	aead  cipher.AEAD
+	nonce [24]byte
+	ready bool
+}
+
+// setup prepares the cipher for a mode and key, reusing the existing state
+// if neither changed.
+func (c *audioCipher) setup(mode string, key *[32]byte) error {
 	if mode == "" {
 		mode = defaultEncryptionMode
 	}
+	if c.ready && c.mode == mode && c.key == *key {
+		return nil
+	}
 
+	c.ready = false
+	c.aead = nil
+	if mode == "aead_aes256_gcm_rtpsize" || mode == "aead_xchacha20_poly1305_rtpsize" {
+		aead, err := newAudioAEAD(mode, key[:])
+		if err != nil {
+			return err
+		}
+		c.aead = aead
+	}
+
+	c.mode = mode
+	c.key = *key
+	c.ready = true
+	return nil
+}
+
+// newAudioAEAD returns the AEAD cipher for one of the rtpsize encryption modes.
+func newAudioAEAD(mode string, key []byte) (cipher.AEAD, error) {
 	switch mode {
-	case "aead_xchacha20_poly1305_rtpsize":
-		aead, err := chacha20poly1305.NewX(key[:])
+	case "aead_aes256_gcm_rtpsize":
+		block, err := aes.NewCipher(key)
 		if err != nil {
 			return nil, err
 		}
+		return cipher.NewGCM(block)
+
+	case "aead_xchacha20_poly1305_rtpsize":
+		return chacha20poly1305.NewX(key)
+	}
+
+	return nil, fmt.Errorf("unsupported aead encryption mode %s", mode)
+}
 
-		nonce := make([]byte, chacha20poly1305.NonceSizeX)
-		// Discord's RTPSIZE mode uses a 4-byte incrementing nonce; the remaining 20 bytes stay zeroed.
-		binary.BigEndian.PutUint32(nonce, v.getAndIncrementNonce())
+// seal appends the header and the encrypted payload to dst. header and
+// payload must not overlap dst.
+func (c *audioCipher) seal(dst []byte, counter uint32, header, payload []byte) ([]byte, error) {
+	for i := range c.nonce {
+		c.nonce[i] = 0
+	}
+
+	dst = append(dst, header...)
 
-		ciphertext := aead.Seal(nil, nonce, payload, header)
+	switch c.mode {
+	case "aead_aes256_gcm_rtpsize", "aead_xchacha20_poly1305_rtpsize":
+		// Discord's RTPSIZE modes use a 4-byte incrementing nonce; the remaining bytes stay zeroed.
+		nonce := c.nonce[:c.aead.NonceSize()]
+		binary.BigEndian.PutUint32(nonce, counter)
 
-		result := make([]byte, len(header), len(header)+len(ciphertext)+4)
-		copy(result, header)
-		result = append(result, ciphertext...)
-		result = append(result, nonce[:4]...)
-		return result, nil
+		dst = c.aead.Seal(dst, nonce, payload, header)
+		return append(dst, nonce[:4]...), nil
 
 	case "xsalsa20_poly1305_lite":
-		var nonce [24]byte
-		binary.BigEndian.PutUint32(nonce[:], v.getAndIncrementNonce())
+		binary.BigEndian.PutUint32(c.nonce[:], counter)
 
-		sealed := secretbox.Seal(append([]byte{}, header...), payload, &nonce, &key)
-		return append(sealed, nonce[:4]...), nil
+		dst = secretbox.Seal(dst, payload, &c.nonce, &c.key)
+		return append(dst, c.nonce[:4]...), nil
 
 	case "xsalsa20_poly1305_suffix":
-		var nonce [24]byte
-		if _, err := rand.Read(nonce[:]); err != nil {
+		if _, err := rand.Read(c.nonce[:]); err != nil {
 			return nil, err
 		}
 
-		sealed := secretbox.Seal(append([]byte{}, header...), payload, &nonce, &key)
-		return append(sealed, nonce[:]...), nil
+		dst = secretbox.Seal(dst, payload, &c.nonce, &c.key)
+		return append(dst, c.nonce[:]...), nil
+
 	default:
-		var nonce [24]byte
-		copy(nonce[:], header)
-		sealed := secretbox.Seal(append([]byte{}, header...), payload, &nonce, &key)
-		return sealed, nil
+		copy(c.nonce[:], header)
+		return secretbox.Seal(dst, payload, &c.nonce, &c.key), nil
 	}
 }
 
-func (v *VoiceConnection) decryptAudioPacket(mode string, header, packet []byte) ([]byte, error) {
-	if mode == "" {
-		mode = defaultEncryptionMode
+// open appends the decrypted packet to dst, which must not overlap packet.
+func (c *audioCipher) open(dst []byte, header, packet []byte) ([]byte, error) {
+	for i := range c.nonce {
+		c.nonce[i] = 0
 	}
 
-	switch mode {
-	case "aead_xchacha20_poly1305_rtpsize":
+	switch c.mode {
+	case "aead_aes256_gcm_rtpsize", "aead_xchacha20_poly1305_rtpsize":
 		if len(packet) < 4 {
 			return nil, fmt.Errorf("packet too small for aead nonce")
 		}
 
-		aead, err := chacha20poly1305.NewX(v.op4.SecretKey[:])
-		if err != nil {
-			return nil, err
-		}
-
-		nonce := make([]byte, chacha20poly1305.NonceSizeX)
-		// Nonce suffix is 4 bytes placed at the start of the XChaCha nonce; upper bytes stay zeroed.
+		// Nonce suffix is 4 bytes placed at the start of the nonce; the remaining bytes stay zeroed.
+		nonce := c.nonce[:c.aead.NonceSize()]
 		copy(nonce[:4], packet[len(packet)-4:])
 
-		ciphertext := packet[:len(packet)-4]
-		if opus, err := aead.Open(nil, nonce, ciphertext, header); err == nil {
-			return opus, nil
-		}
-		if len(header) > 12 {
-			if opus, err := aead.Open(nil, nonce, ciphertext, header[:12]); err == nil {
-				return opus, nil
-			}
-		}
-		return aead.Open(nil, nonce, ciphertext, nil)
+		return c.aead.Open(dst, nonce, packet[:len(packet)-4], header)
 
 	case "xsalsa20_poly1305_suffix":
 		if len(packet) < 24 {
 			return nil, fmt.Errorf("packet too small for suffix nonce")
 		}
 
-		var nonce [24]byte
-		copy(nonce[:], packet[len(packet)-24:])
+		copy(c.nonce[:], packet[len(packet)-24:])
 
-		if opus, ok := secretbox.Open(nil, packet[:len(packet)-24], &nonce, &v.op4.SecretKey); ok {
+		if opus, ok := secretbox.Open(dst, packet[:len(packet)-24], &c.nonce, &c.key); ok {
 			return opus, nil
 		}
 		return nil, fmt.Errorf("failed to decrypt xsalsa20_poly1305_suffix packet")
@@ -875,24 +1136,41 @@ func (v *VoiceConnection) decryptAudioPacket(mode string, header, packet []byte)
 			return nil, fmt.Errorf("packet too small for lite nonce")
 		}
 
-		var nonce [24]byte
-		copy(nonce[:4], packet[len(packet)-4:])
+		copy(c.nonce[:4], packet[len(packet)-4:])
 
-		if opus, ok := secretbox.Open(nil, packet[:len(packet)-4], &nonce, &v.op4.SecretKey); ok {
+		if opus, ok := secretbox.Open(dst, packet[:len(packet)-4], &c.nonce, &c.key); ok {
 			return opus, nil
 		}
 		return nil, fmt.Errorf("failed to decrypt xsalsa20_poly1305_lite packet")
 
 	default:
-		var nonce [24]byte
-		copy(nonce[:], header)
-		if opus, ok := secretbox.Open(nil, packet, &nonce, &v.op4.SecretKey); ok {
+		copy(c.nonce[:], header)
+		if opus, ok := secretbox.Open(dst, packet, &c.nonce, &c.key); ok {
 			return opus, nil
 		}
 		return nil, fmt.Errorf("failed to decrypt xsalsa20_poly1305 packet")
 	}
 }
 
+func (v *VoiceConnection) encryptAudioPacket(mode string, header, payload []byte, key [32]byte) ([]byte, error) {
+	var c audioCipher
+	if err := c.setup(mode, &key); err != nil {
+		return nil, err
+	}
+	return c.seal(nil, v.getAndIncrementNonce(), header, payload)
+}
+
+func (v *VoiceConnection) decryptAudioPacket(mode string, header, packet []byte) ([]byte, error) {
+	var c audioCipher
+	v.RLock()
+	err := c.setup(mode, &v.op4.SecretKey)
+	v.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return c.open(nil, header, packet)
+}
+
 // opusSender will listen on the given channel and send any
 // pre-encoded opus audio to Discord.  Supposedly.
 func (v *VoiceConnection) opusSender(udpConn *net.UDPConn, close <-chan struct{}, opus <-chan []byte, rate, size int) {
@@ -912,32 +1190,48 @@ func (v *VoiceConnection) opusSender(udpConn *net.UDPConn, close <-chan struct{}
 		v.Unlock()
 	}()
 
-	var sequence uint16
-	var timestamp uint32
 	var recvbuf []byte
 	var ok bool
-	udpHeader := make([]byte, 12)
-
-	// build the parts that don't change in the udpHeader
-	udpHeader[0] = 0x80
-	udpHeader[1] = 0x78
-	binary.BigEndian.PutUint32(udpHeader[8:], v.op2.SSRC)
-
-	// start a send loop that loops until buf chan is closed
-	ticker := time.NewTicker(time.Millisecond * time.Duration(size/(rate/1000)))
-	defer ticker.Stop()
+	var audio audioCipher
+	udpHeader := make([]byte, 0, rtpFixedHeaderSize)
+	sendbuf := make([]byte, 0, maxUDPPacketSize)
+
+	// the parts of the header that don't change
+	header := RTPHeader{PayloadType: 0x78, SSRC: v.op2.SSRC}
+
+	// start a send loop that loops until buf chan is closed. Packets are
+	// paced by their own duration, so that sources with frames other than
+	// size samples long are sent in real time.
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	var next, lastWrite time.Time
+	var lastDuration time.Duration
 	for {
 
 		// Get data from chan.  If chan is closed, return.
+		// backlog records whether the frame was already waiting, so that
+		// gaps in the audio are not counted as late sends.
+		backlog := true
 		select {
-		case <-close:
-			return
 		case recvbuf, ok = <-opus:
-			if !ok {
+		default:
+			backlog = false
+			select {
+			case <-close:
 				return
+			case recvbuf, ok = <-opus:
 			}
-			// else, continue loop
 		}
+		if !ok {
+			return
+		}
+
+		samples := opusPacketSamples(recvbuf, rate)
+		if samples == 0 {
+			samples = size
+		}
+		duration := time.Duration(samples) * time.Second / time.Duration(rate)
 
 		v.RLock()
 		speaking := v.speaking
@@ -950,28 +1244,40 @@ func (v *VoiceConnection) opusSender(udpConn *net.UDPConn, close <-chan struct{}
 		}
 
 		// Add sequence and timestamp to udpPacket
-		binary.BigEndian.PutUint16(udpHeader[2:], sequence)
-		binary.BigEndian.PutUint32(udpHeader[4:], timestamp)
+		udpHeader = header.Append(udpHeader[:0])
+
+		frame, err := v.daveEncrypt(recvbuf)
+		if err != nil {
+			v.log(LogError, "error applying DAVE encryption, %s", err)
+			continue
+		}
 
 		v.RLock()
-		mode := v.encryptionMode
-		key := v.op4.SecretKey
+		err = audio.setup(v.encryptionMode, &v.op4.SecretKey)
 		v.RUnlock()
-
-		sendbuf, err := v.encryptAudioPacket(mode, udpHeader, recvbuf, key)
+		if err == nil {
+			sendbuf, err = audio.seal(sendbuf[:0], v.getAndIncrementNonce(), udpHeader, frame)
+		}
 		if err != nil {
 			v.log(LogError, "error encrypting audio packet, %s", err)
 			return
 		}
 
 		// block here until we're exactly at the right time :)
-		// Then send rtp audio packet to Discord over UDP
-		select {
-		case <-close:
-			return
-		case <-ticker.C:
-			// continue
+		// Then send rtp audio packet to Discord over UDP. After a gap
+		// in the audio the schedule restarts from now.
+		if now := time.Now(); next.Before(now.Add(-duration)) {
+			next = now
+		} else if wait := next.Sub(now); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-close:
+				return
+			case <-timer.C:
+				// continue
+			}
 		}
+		next = next.Add(duration)
 		_, err = udpConn.Write(sendbuf)
 
 		if err != nil {
@@ -980,45 +1286,385 @@ func (v *VoiceConnection) opusSender(udpConn *net.UDPConn, close <-chan struct{}
 			return
 		}
 
-		if (sequence) == 0xFFFF {
-			sequence = 0
-		} else {
-			sequence++
+		now := time.Now()
+		atomic.AddUint64(&v.packetsSent, 1)
+		atomic.StoreInt64(&v.lastSent, now.UnixNano())
+		if backlog && !lastWrite.IsZero() && now.Sub(lastWrite) > lastDuration*3/2 {
+			atomic.AddUint64(&v.packetsLate, 1)
+		}
+		lastWrite = now
+		lastDuration = duration
+
+		header.Sequence++ // wraps from 0xFFFF to 0
+		header.Timestamp += uint32(samples)
+	}
+}
+
+// opusFrameSamples is the duration of an Opus frame at 48kHz for each TOC
+// configuration, from RFC 6716 section 3.1.
+var opusFrameSamples = [32]int{
+	480, 960, 1920, 2880, // SILK NB
+	480, 960, 1920, 2880, // SILK MB
+	480, 960, 1920, 2880, // SILK WB
+	480, 960, // Hybrid SWB
+	480, 960, // Hybrid FB
+	120, 240, 480, 960, // CELT NB
+	120, 240, 480, 960, // CELT WB
+	120, 240, 480, 960, // CELT SWB
+	120, 240, 480, 960, // CELT FB
+}
+
+// opusPacketSamples returns the duration of an Opus packet in samples at
+// rate, read from its TOC byte, or 0 if the packet is malformed.
+func opusPacketSamples(packet []byte, rate int) int {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	frames := 0
+	switch packet[0] & 0x03 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
 		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	n := frames * opusFrameSamples[packet[0]>>3]
+	if n > 5760 { // 120ms
+		return 0
+	}
+	return n * rate / 48000
+}
+
+// Errors returned by SendOpus.
+var (
+	ErrVoiceNotReady      = errors.New("voice connection not ready")
+	ErrVoiceSendQueueFull = errors.New("voice send queue full")
+)
+
+// SendOpus queues an opus frame to be sent, without blocking for longer
+// than deadline. If the queue is full it returns ErrVoiceSendQueueFull once
+// deadline has passed, or immediately if deadline is zero. frame must not
+// be modified until it has been sent.
+func (v *VoiceConnection) SendOpus(frame []byte, deadline time.Time) error {
+
+	v.RLock()
+	c := v.OpusSend
+	v.RUnlock()
+	if c == nil {
+		return ErrVoiceNotReady
+	}
+
+	select {
+	case c <- frame:
+		return nil
+	default:
+	}
+
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
 
-		if timestamp > (0xFFFFFFFF - uint32(size)) {
-			timestamp = 0
-		} else {
-			timestamp += uint32(size)
+		select {
+		case c <- frame:
+			return nil
+		case <-timer.C:
 		}
 	}
+
+	atomic.AddUint64(&v.framesRejected, 1)
+	return ErrVoiceSendQueueFull
+}
+
+// VoiceSendStats holds statistics about sent audio, see SendStats.
+type VoiceSendStats struct {
+	Queued   int // frames waiting in OpusSend
+	Capacity int // capacity of OpusSend
+
+	Sent     uint64 // packets written to the UDP connection
+	Late     uint64 // packets sent over half a frame late while frames were queued
+	Rejected uint64 // frames refused by SendOpus because OpusSend was full
+
+	LastSent time.Time // when the last packet was sent, zero if none was
+}
+
+// SendStats returns statistics about the send queue.
+func (v *VoiceConnection) SendStats() VoiceSendStats {
+
+	v.RLock()
+	c := v.OpusSend
+	v.RUnlock()
+
+	return VoiceSendStats{
+		Queued:   len(c),
+		Capacity: cap(c),
+		Sent:     atomic.LoadUint64(&v.packetsSent),
+		Late:     atomic.LoadUint64(&v.packetsLate),
+		Rejected: atomic.LoadUint64(&v.framesRejected),
+		LastSent: unixNanoTime(atomic.LoadInt64(&v.lastSent)),
+	}
 }
 
 // A Packet contains the headers and content of a received voice packet.
+//
+// Packets delivered on OpusRecv are taken from a pool. Call Release once
+// finished with a packet so its buffers can be reused; none of its fields
+// may be used afterwards. Packets which are never released are garbage
+// collected as usual.
 type Packet struct {
-	SSRC      uint32
-	Sequence  uint16
-	Timestamp uint32
-	Type      []byte
-	Opus      []byte
-	PCM       []int16
+	SSRC       uint32
+	Sequence   uint16
+	Timestamp  uint32
+	Type       []byte
+	CSRC       []uint32
+	Extensions []RTPExtension
+	Opus       []byte
+	PCM        []int16
+
+	buf *packetBuffer
+}
+
+// packetBuffer is the backing storage of a pooled Packet.
+type packetBuffer struct {
+	raw    [maxUDPPacketSize]byte
+	plain  [maxUDPPacketSize]byte
+	typ    [2]byte
+	header RTPHeader
+	csrc   [15]uint32
+	ext    [16]RTPExtension
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &Packet{buf: &packetBuffer{}}
+	},
+}
+
+// getPacket returns an empty Packet from the pool.
+func getPacket() *Packet {
+	return packetPool.Get().(*Packet)
+}
+
+// Release returns the packet to the pool.
+func (p *Packet) Release() {
+	if p == nil || p.buf == nil {
+		return
+	}
+
+	buf := p.buf
+	*p = Packet{buf: buf}
+	packetPool.Put(p)
+}
+
+// unmarshal parses and decrypts a received RTP datagram into p, using p's
+// buffers for the decrypted payload.
+func (p *Packet) unmarshal(c *audioCipher, b []byte) error {
+	buf := p.buf
+	h := &buf.header
+	h.CSRC = buf.csrc[:0]
+	h.Extensions = buf.ext[:0]
+
+	clear, encrypted, err := splitRTPPacket(h, c.mode, b)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := c.open(buf.plain[:0], clear, encrypted)
+	if err != nil {
+		return err
+	}
+
+	opus, err := h.rtpPayload(plaintext, !isRTPSizeMode(c.mode))
+	if err != nil {
+		return err
+	}
+
+	buf.typ[0], buf.typ[1] = b[0], b[1]
+	p.SSRC = h.SSRC
+	p.Sequence = h.Sequence
+	p.Timestamp = h.Timestamp
+	p.Type = buf.typ[:]
+	p.CSRC = nil
+	if len(h.CSRC) > 0 {
+		p.CSRC = h.CSRC
+	}
+	p.Extensions = nil
+	if len(h.Extensions) > 0 {
+		p.Extensions = h.Extensions
+	}
+	p.Opus = opus
+
+	return nil
+}
+
+// parseAudioPacket parses and decrypts a received RTP datagram into a new
+// Packet.
+func (v *VoiceConnection) parseAudioPacket(mode string, b []byte) (*Packet, error) {
+	var c audioCipher
+	v.RLock()
+	err := c.setup(mode, &v.op4.SecretKey)
+	v.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Packet{buf: &packetBuffer{}}
+	if err := p.unmarshal(&c, b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RecvOverflowPolicy selects what happens to received packets when the
+// OpusRecv channel is full.
+type RecvOverflowPolicy int
+
+// Receive overflow policies.
+const (
+	// RecvOverflowBlock stops reading from the UDP socket until there is
+	// room in the channel. Packets may then be dropped by the kernel instead.
+	RecvOverflowBlock RecvOverflowPolicy = iota
+
+	// RecvOverflowDropOldest discards the oldest queued packet to make room.
+	RecvOverflowDropOldest
+
+	// RecvOverflowDropNewest discards the packet just received.
+	RecvOverflowDropNewest
+)
+
+// OnPacket sets a function to be called with each received packet instead
+// of sending it on OpusRecv, or restores OpusRecv if f is nil. f is called
+// from the UDP read loop, so it should return quickly. It may keep the
+// packet, and should call its Release method once done with it.
+func (v *VoiceConnection) OnPacket(f func(*Packet)) {
+	v.Lock()
+	defer v.Unlock()
+	v.packetHandler = f
+}
+
+// DroppedPackets returns the number of received packets dropped because
+// OpusRecv was full, see OpusRecvPolicy.
+func (v *VoiceConnection) DroppedPackets() uint64 {
+	return atomic.LoadUint64(&v.packetsDropped)
+}
+
+// VoiceRecvStats holds statistics about received audio, see RecvStats.
+type VoiceRecvStats struct {
+	Queued   int // packets waiting in OpusRecv
+	Capacity int // capacity of OpusRecv
+
+	Received      uint64 // packets decrypted
+	Dropped       uint64 // packets dropped because OpusRecv was full
+	DecryptErrors uint64 // packets which failed transport or DAVE decryption
+
+	LastReceived time.Time // when the last packet was received, zero if none was
+}
+
+// RecvStats returns statistics about the receive queue.
+func (v *VoiceConnection) RecvStats() VoiceRecvStats {
+
+	v.RLock()
+	c := v.OpusRecv
+	v.RUnlock()
+
+	return VoiceRecvStats{
+		Queued:        len(c),
+		Capacity:      cap(c),
+		Received:      atomic.LoadUint64(&v.packetsRecv),
+		Dropped:       atomic.LoadUint64(&v.packetsDropped),
+		DecryptErrors: atomic.LoadUint64(&v.decryptErrors),
+		LastReceived:  unixNanoTime(atomic.LoadInt64(&v.lastRecv)),
+	}
+}
+
+// unixNanoTime returns the time of a UnixNano timestamp, or the zero time
+// for 0.
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Reconnects returns the number of times the connection was reestablished
+// after being lost.
+func (v *VoiceConnection) Reconnects() uint64 {
+	return atomic.LoadUint64(&v.reconnects)
+}
+
+// queuePacket sends p on c according to policy. It returns p if it was
+// dropped and may be reused, and false if close was signalled while blocked.
+func (v *VoiceConnection) queuePacket(c chan *Packet, p *Packet, policy RecvOverflowPolicy, close <-chan struct{}) (*Packet, bool) {
+
+	switch policy {
+	case RecvOverflowDropOldest:
+		select {
+		case c <- p:
+			return nil, true
+		default:
+		}
+
+		select {
+		case old := <-c:
+			old.Release()
+			atomic.AddUint64(&v.packetsDropped, 1)
+		default:
+		}
+
+		select {
+		case c <- p:
+			return nil, true
+		default:
+			atomic.AddUint64(&v.packetsDropped, 1)
+			return p, true
+		}
+
+	case RecvOverflowDropNewest:
+		select {
+		case c <- p:
+			return nil, true
+		default:
+			atomic.AddUint64(&v.packetsDropped, 1)
+			return p, true
+		}
+
+	default:
+		select {
+		case c <- p:
+			return nil, true
+		case <-close:
+			return p, false
+		}
+	}
 }
 
 // opusReceiver listens on the UDP socket for incoming packets
-// and sends them across the given channel
+// and sends them across the given channel, or to the OnPacket function
 // NOTE :: This function may change names later.
-func (v *VoiceConnection) opusReceiver(udpConn *net.UDPConn, close <-chan struct{}, c chan *Packet) {
+func (v *VoiceConnection) opusReceiver(udpConn *net.UDPConn, close <-chan struct{}, c chan *Packet, policy RecvOverflowPolicy) {
 
 	if udpConn == nil || close == nil {
 		return
 	}
 
-	recvbuf := make([]byte, 1024)
+	var audio audioCipher
+	var p *Packet
+	localAddr, remoteAddr := udpConn.LocalAddr(), udpConn.RemoteAddr()
 	debugReads := 0
 	debugDecryptErrs := 0
 
 	for {
-		rlen, err := udpConn.Read(recvbuf)
+		// Reuse the packet until one is delivered.
+		if p == nil {
+			p = getPacket()
+		}
+
+		rlen, err := udpConn.Read(p.buf.raw[:])
 		if err != nil {
 			// Detect if we have been closed manually. If a Close() has already
 			// happened, the udp connection we are listening on will be different
@@ -1048,58 +1694,69 @@ func (v *VoiceConnection) opusReceiver(udpConn *net.UDPConn, close <-chan struct
 			debugReads++
 		}
 
-		// For now, skip anything except audio.
-		if rlen < 12 || (recvbuf[0] != 0x80 && recvbuf[0] != 0x90) {
+		if rlen < 8 {
 			continue
 		}
+		datagram := p.buf.raw[:rlen]
 
-		cc := int(recvbuf[0] & 0x0F)
-		hasExt := (recvbuf[0] & 0x10) == 0x10
-		plainLength := 12 + (cc * 4)
-		if rlen < plainLength {
+		v.RLock()
+		err = audio.setup(v.encryptionMode, &v.op4.SecretKey)
+		handler := v.packetHandler
+		capture := v.capture
+		v.RUnlock()
+		if err != nil {
+			v.log(LogError, "error setting up decryption, %s", err)
 			continue
 		}
-		if hasExt {
-			if rlen < plainLength+4 {
-				continue
-			}
-			plainLength += 4
+
+		now := time.Now()
+		if capture != nil {
+			capture.writeDatagram(now, remoteAddr, localAddr, datagram)
 		}
 
-		// build a audio packet struct
-		p := Packet{}
-		p.Type = recvbuf[0:2]
-		p.Sequence = binary.BigEndian.Uint16(recvbuf[2:4])
-		p.Timestamp = binary.BigEndian.Uint32(recvbuf[4:8])
-		p.SSRC = binary.BigEndian.Uint32(recvbuf[8:12])
-		// decrypt opus data
-		mode := func() string {
-			v.RLock()
-			defer v.RUnlock()
-			return v.encryptionMode
-		}()
+		if isRTCPPacket(datagram) {
+			v.onRTCP(audio.mode, datagram)
+			continue
+		}
 
-		opus, err := v.decryptAudioPacket(mode, recvbuf[:plainLength], recvbuf[plainLength:rlen])
+		// decrypt opus data
+		err = p.unmarshal(&audio, datagram)
 		if err != nil {
+			atomic.AddUint64(&v.decryptErrors, 1)
 			if debugDecryptErrs < 5 {
 				v.log(LogDebug, "udp decrypt error len=%d: %v", rlen, err)
 				debugDecryptErrs++
 			}
 			continue
 		}
-		p.Opus = opus
+		v.rtpStats.update(p, now)
 
-		if hasExt {
-			extLen := int(binary.BigEndian.Uint16(recvbuf[plainLength-2 : plainLength]))
-			if len(p.Opus) > extLen*4 {
-				p.Opus = p.Opus[extLen*4:]
+		p.Opus, err = v.daveDecrypt(p.SSRC, p.Opus)
+		if err != nil {
+			atomic.AddUint64(&v.decryptErrors, 1)
+			if debugDecryptErrs < 5 {
+				v.log(LogDebug, "DAVE decrypt error ssrc=%d: %v", p.SSRC, err)
+				debugDecryptErrs++
 			}
+			continue
+		}
+
+		atomic.AddUint64(&v.packetsRecv, 1)
+		atomic.StoreInt64(&v.lastRecv, now.UnixNano())
+
+		if capture != nil {
+			capture.writeDecrypted(now, remoteAddr, p)
+		}
+
+		if handler != nil {
+			handler(p)
+			p = nil
+			continue
 		}
 
 		if c != nil {
-			select {
-			case c <- &p:
-			case <-close:
+			var ok bool
+			if p, ok = v.queuePacket(c, p, policy, close); !ok {
 				return
 			}
 		}
@@ -1151,6 +1808,7 @@ func (v *VoiceConnection) reconnect() {
 
 		_, err := v.session.ChannelVoiceJoin(v.GuildID, v.ChannelID, v.mute, v.deaf)
 		if err == nil {
+			atomic.AddUint64(&v.reconnects, 1)
 			v.log(LogInformational, "successfully reconnected to channel %s", v.ChannelID)
 			return
 		}
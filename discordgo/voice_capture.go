@@ -0,0 +1,546 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains code related to capturing received voice packets to a
+// pcap file, and replaying captures through the receive pipeline.
+
+package discordgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Captures are pcap files with nanosecond timestamps, holding IPv4/UDP
+// packets without a link layer header, which Wireshark opens directly.
+const (
+	pcapMagicNanoseconds = 0xa1b23c4d
+	pcapVersionMajor     = 2
+	pcapVersionMinor     = 4
+	pcapSnapLen          = 65535
+	pcapLinkTypeRaw      = 101
+
+	pcapFileHeaderSize   = 24
+	pcapRecordHeaderSize = 16
+	ipv4HeaderSize       = 20
+	udpHeaderSize        = 8
+	ipProtocolUDP        = 17
+)
+
+// CaptureDecryptedPort is the UDP port which decrypted packets are addressed
+// to in a capture, with destination address 0.0.0.0. Wireshark decodes them
+// with "Decode As... RTP".
+const CaptureDecryptedPort = 5004
+
+var captureDecryptedAddr = &net.UDPAddr{IP: net.IPv4zero, Port: CaptureDecryptedPort}
+
+// A VoiceCapture records the packets received by a VoiceConnection, see
+// SetCapture. Each datagram is recorded as received, before decryption, and
+// each audio packet again once decrypted, so garbled audio can be traced to
+// the network or to decryption. Decrypted packets have no RTP header
+// extensions. Packets are decrypted from DAVE as well.
+//
+// The secret keys needed to decrypt raw packets are written separately, so
+// captures may be shared without them: the transport key, and on DAVE
+// connections each sender's media key secret and the SSRC they send with.
+// Note that decrypted packets contain the audio itself.
+type VoiceCapture struct {
+	sync.Mutex
+	w       *bufio.Writer
+	keys    io.Writer
+	closers []io.Closer
+	buf     []byte
+	err     error
+	closed  bool
+}
+
+// A CaptureKey is a secret key recorded by a VoiceCapture. It applies to
+// packets recorded from Time until the next key of the same kind.
+//
+// A transport key has Mode and SecretKey. A DAVE key has the UserID of a
+// sender and the SenderSecret their media keys are derived from in the
+// epoch starting at Time. A key with UserID and SSRC but no secret records
+// the user sending with an SSRC.
+type CaptureKey struct {
+	Time      time.Time `json:"time"`
+	Mode      string    `json:"mode,omitempty"`
+	SecretKey []byte    `json:"secret_key,omitempty"`
+
+	UserID       string `json:"user_id,omitempty"`
+	SSRC         uint32 `json:"ssrc,omitempty"`
+	SenderSecret []byte `json:"sender_secret,omitempty"`
+}
+
+// NewVoiceCapture returns a VoiceCapture which writes packets to w and secret
+// keys to keys, as JSON lines. keys may be nil to discard them.
+func NewVoiceCapture(w io.Writer, keys io.Writer) (*VoiceCapture, error) {
+
+	c := &VoiceCapture{
+		w:    bufio.NewWriter(w),
+		keys: keys,
+		buf:  make([]byte, pcapRecordHeaderSize+ipv4HeaderSize+udpHeaderSize+maxUDPPacketSize),
+	}
+
+	hdr := make([]byte, pcapFileHeaderSize)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagicNanoseconds)
+	binary.LittleEndian.PutUint16(hdr[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err := c.w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// CreateVoiceCapture creates the capture file name, and name + ".keys" for
+// its secret keys.
+func CreateVoiceCapture(name string) (*VoiceCapture, error) {
+
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := os.OpenFile(name+".keys", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c, err := NewVoiceCapture(f, keys)
+	if err != nil {
+		f.Close()
+		keys.Close()
+		return nil, err
+	}
+	c.closers = []io.Closer{f, keys}
+
+	return c, nil
+}
+
+// Close flushes the capture, and closes its files if it was created by
+// CreateVoiceCapture. It returns the first error encountered while writing.
+// Packets received afterwards are not recorded.
+func (c *VoiceCapture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return c.err
+	}
+	c.closed = true
+
+	if err := c.w.Flush(); err != nil && c.err == nil {
+		c.err = err
+	}
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+	c.closers = nil
+
+	return c.err
+}
+
+// writeKey records a transport secret key.
+func (c *VoiceCapture) writeKey(t time.Time, mode string, key *[32]byte) {
+	c.writeCaptureKey(CaptureKey{Time: t, Mode: mode, SecretKey: key[:]})
+}
+
+// writeDAVEKey records the DAVE sender secret of a user.
+func (c *VoiceCapture) writeDAVEKey(t time.Time, userID string, secret []byte) {
+	c.writeCaptureKey(CaptureKey{Time: t, UserID: userID, SenderSecret: secret})
+}
+
+// writeSSRC records the user sending with an SSRC.
+func (c *VoiceCapture) writeSSRC(t time.Time, ssrc uint32, userID string) {
+	c.writeCaptureKey(CaptureKey{Time: t, UserID: userID, SSRC: ssrc})
+}
+
+func (c *VoiceCapture) writeCaptureKey(k CaptureKey) {
+	if c.keys == nil {
+		return
+	}
+
+	b, err := json.Marshal(k)
+	if err != nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil || c.closed {
+		return
+	}
+	if _, err := c.keys.Write(append(b, '\n')); err != nil {
+		c.err = err
+	}
+}
+
+// writeDatagram records a datagram as received from src by dst.
+func (c *VoiceCapture) writeDatagram(t time.Time, src, dst net.Addr, payload []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil || c.closed {
+		return
+	}
+
+	b := c.record(t, src, dst, len(payload))
+	b = append(b, payload...)
+	c.finish(b)
+}
+
+// writeDecrypted records the decrypted RTP packet p, received from src.
+func (c *VoiceCapture) writeDecrypted(t time.Time, src net.Addr, p *Packet) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil || c.closed {
+		return
+	}
+
+	csrc := p.CSRC
+	if len(csrc) > 15 {
+		csrc = csrc[:15]
+	}
+	b := c.record(t, src, captureDecryptedAddr, rtpFixedHeaderSize+4*len(csrc)+len(p.Opus))
+	b = append(b, rtpVersion<<6|byte(len(csrc)), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	h := b[len(b)-rtpFixedHeaderSize:]
+	if len(p.Type) > 1 {
+		h[1] = p.Type[1]
+	}
+	binary.BigEndian.PutUint16(h[2:], p.Sequence)
+	binary.BigEndian.PutUint32(h[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(h[8:], p.SSRC)
+	for _, s := range csrc {
+		b = append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+	}
+	b = append(b, p.Opus...)
+	c.finish(b)
+}
+
+// record starts a pcap record in c.buf for a UDP datagram of length n, and
+// returns it up to the UDP payload.
+func (c *VoiceCapture) record(t time.Time, src, dst net.Addr, n int) []byte {
+	b := c.buf[:pcapRecordHeaderSize+ipv4HeaderSize+udpHeaderSize]
+	size := ipv4HeaderSize + udpHeaderSize + n
+
+	binary.LittleEndian.PutUint32(b[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(b[8:], uint32(size))
+	binary.LittleEndian.PutUint32(b[12:], uint32(size))
+
+	srcIP, srcPort := captureAddr(src)
+	dstIP, dstPort := captureAddr(dst)
+
+	ip := b[pcapRecordHeaderSize:]
+	ip[0] = 0x45 // version 4, 5 word header
+	ip[1] = 0
+	binary.BigEndian.PutUint16(ip[2:], uint16(size))
+	binary.BigEndian.PutUint32(ip[4:], 0) // identification, fragmentation
+	ip[8] = 64                            // TTL
+	ip[9] = ipProtocolUDP
+	binary.BigEndian.PutUint16(ip[10:], 0)
+	copy(ip[12:16], srcIP)
+	copy(ip[16:20], dstIP)
+
+	var sum uint32
+	for i := 0; i < ipv4HeaderSize; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+
+	udp := ip[ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderSize+n))
+	binary.BigEndian.PutUint16(udp[6:], 0) // no checksum
+
+	return b
+}
+
+// finish writes a record built in c.buf.
+func (c *VoiceCapture) finish(b []byte) {
+	if _, err := c.w.Write(b); err != nil {
+		c.err = err
+	}
+	c.buf = b[:0]
+}
+
+// captureAddr returns the IPv4 address and port of a UDP address, or
+// 0.0.0.0 for other addresses.
+func captureAddr(a net.Addr) (net.IP, int) {
+	if u, ok := a.(*net.UDPAddr); ok {
+		if ip := u.IP.To4(); ip != nil {
+			return ip, u.Port
+		}
+		return net.IPv4zero.To4(), u.Port
+	}
+	return net.IPv4zero.To4(), 0
+}
+
+// SetCapture starts recording received packets to c, or stops recording if
+// c is nil. The capture is not closed when the connection is.
+func (v *VoiceConnection) SetCapture(c *VoiceCapture) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.capture = c
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	if v.encryptionMode != "" {
+		c.writeKey(now, v.encryptionMode, &v.op4.SecretKey)
+	}
+
+	// The DAVE keys in use so far.
+	v.dave.Lock()
+	defer v.dave.Unlock()
+	for ssrc, userID := range v.dave.ssrcUsers {
+		c.writeSSRC(now, ssrc, userID)
+	}
+	for userID, d := range v.dave.decryptors {
+		if d.current != nil {
+			c.writeDAVEKey(now, userID, d.current.base)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// Replay
+// ------------------------------------------------------------------------------------------------
+
+// ErrCaptureFormat is returned when reading a file which is not a capture
+// written by VoiceCapture.
+var ErrCaptureFormat = errors.New("not a voice capture")
+
+// A CaptureRecord is a datagram read from a capture.
+type CaptureRecord struct {
+	Time time.Time
+
+	// Decrypted is true for decrypted RTP packets, and false for datagrams
+	// as received.
+	Decrypted bool
+	Data      []byte
+}
+
+// A CaptureReader reads the records of a capture.
+type CaptureReader struct {
+	r   *bufio.Reader
+	hdr [pcapRecordHeaderSize]byte
+	buf []byte
+}
+
+// NewCaptureReader returns a CaptureReader reading the capture from r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+
+	hdr := make([]byte, pcapFileHeaderSize)
+	if _, err := io.ReadFull(cr.r, hdr); err != nil {
+		return nil, ErrCaptureFormat
+	}
+	if binary.LittleEndian.Uint32(hdr[0:]) != pcapMagicNanoseconds || binary.LittleEndian.Uint32(hdr[20:]) != pcapLinkTypeRaw {
+		return nil, ErrCaptureFormat
+	}
+
+	return cr, nil
+}
+
+// Next returns the next record, which is valid until the following call to
+// Next. It returns io.EOF at the end of the capture.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+
+	if _, err := io.ReadFull(cr.r, cr.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrCaptureFormat
+		}
+		return nil, err
+	}
+
+	n := int(binary.LittleEndian.Uint32(cr.hdr[8:]))
+	if n < ipv4HeaderSize+udpHeaderSize || n > pcapSnapLen {
+		return nil, ErrCaptureFormat
+	}
+	if cap(cr.buf) < n {
+		cr.buf = make([]byte, n)
+	}
+	b := cr.buf[:n]
+	if _, err := io.ReadFull(cr.r, b); err != nil {
+		return nil, ErrCaptureFormat
+	}
+	if b[0] != 0x45 || b[9] != ipProtocolUDP {
+		return nil, ErrCaptureFormat
+	}
+
+	sec := int64(binary.LittleEndian.Uint32(cr.hdr[0:]))
+	nsec := int64(binary.LittleEndian.Uint32(cr.hdr[4:]))
+	dstIP := net.IP(b[16:20])
+	dstPort := binary.BigEndian.Uint16(b[ipv4HeaderSize+2:])
+
+	return &CaptureRecord{
+		Time:      time.Unix(sec, nsec),
+		Decrypted: dstIP.Equal(net.IPv4zero) && dstPort == CaptureDecryptedPort,
+		Data:      b[ipv4HeaderSize+udpHeaderSize:],
+	}, nil
+}
+
+// ReadCaptureKeys reads the secret keys written by a VoiceCapture.
+func ReadCaptureKeys(r io.Reader) ([]CaptureKey, error) {
+
+	var keys []CaptureKey
+	dec := json.NewDecoder(r)
+	for {
+		var k CaptureKey
+		if err := dec.Decode(&k); err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case k.SecretKey != nil:
+			if len(k.SecretKey) != 32 {
+				return nil, ErrCaptureFormat
+			}
+		case k.SenderSecret != nil:
+			if k.UserID == "" {
+				return nil, ErrCaptureFormat
+			}
+		case k.UserID == "":
+			return nil, ErrCaptureFormat
+		}
+		keys = append(keys, k)
+	}
+}
+
+// ReplayCapture reads a capture and calls f with each audio packet and the
+// time it was received, as it would have been delivered on OpusRecv. f may
+// keep the packet, and should call its Release method once done with it.
+//
+// If keys is not nil the received datagrams are decrypted with the keys in
+// effect at the time, exercising decryption, DAVE included. Otherwise the
+// decrypted packets are replayed. Packets which fail to decrypt or parse are
+// skipped.
+func ReplayCapture(capture io.Reader, keys []CaptureKey, f func(time.Time, *Packet)) error {
+
+	cr, err := NewCaptureReader(capture)
+	if err != nil {
+		return err
+	}
+
+	var audio audioCipher
+	var mode string
+	var key [32]byte
+	ssrcUsers := make(map[uint32]string)
+	decryptors := make(map[string]*daveDecryptor)
+	nextKey := 0
+	var p *Packet
+
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Decrypted != (keys == nil) || len(rec.Data) < 8 || isRTCPPacket(rec.Data) {
+			continue
+		}
+
+		if keys != nil {
+			for nextKey < len(keys) && !keys[nextKey].Time.After(rec.Time) {
+				k := &keys[nextKey]
+				switch {
+				case k.SecretKey != nil:
+					mode = k.Mode
+					copy(key[:], k.SecretKey)
+				case k.SenderSecret != nil:
+					d, ok := decryptors[k.UserID]
+					if !ok {
+						d = &daveDecryptor{}
+						decryptors[k.UserID] = d
+					}
+					d.transitionTo(newDAVEKeyRatchet(k.SenderSecret))
+				default:
+					ssrcUsers[k.SSRC] = k.UserID
+				}
+				nextKey++
+			}
+			if mode == "" {
+				continue
+			}
+			if err := audio.setup(mode, &key); err != nil {
+				return err
+			}
+		}
+
+		if p == nil {
+			p = getPacket()
+		}
+		if keys != nil {
+			err = p.unmarshal(&audio, rec.Data)
+			if err == nil && hasDAVEMarker(p.Opus) {
+				d := decryptors[ssrcUsers[p.SSRC]]
+				if d == nil {
+					continue
+				}
+				p.Opus, err = d.decrypt(p.Opus)
+			}
+		} else {
+			err = p.unmarshalDecrypted(rec.Data)
+		}
+		if err != nil {
+			continue
+		}
+
+		f(rec.Time, p)
+		p = nil
+	}
+
+	p.Release()
+	return nil
+}
+
+// unmarshalDecrypted parses a decrypted RTP packet from a capture into p.
+func (p *Packet) unmarshalDecrypted(b []byte) error {
+	buf := p.buf
+	h := &buf.header
+	h.CSRC = buf.csrc[:0]
+	h.Extensions = buf.ext[:0]
+
+	n, err := h.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+
+	buf.typ[0], buf.typ[1] = b[0], b[1]
+	p.SSRC = h.SSRC
+	p.Sequence = h.Sequence
+	p.Timestamp = h.Timestamp
+	p.Type = buf.typ[:]
+	p.CSRC = nil
+	if len(h.CSRC) > 0 {
+		p.CSRC = h.CSRC
+	}
+	p.Opus = append(buf.plain[:0], b[n:]...)
+
+	return nil
+}
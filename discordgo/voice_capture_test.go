@@ -0,0 +1,230 @@
+package discordgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo/discordtest"
+)
+
+func TestVoiceCaptureReplay(t *testing.T) {
+	srv, err := discordtest.NewVoiceServer()
+	if err != nil {
+		t.Fatalf("NewVoiceServer returned error: %v", err)
+	}
+	defer srv.Close()
+	srv.Modes = []string{"aead_xchacha20_poly1305_rtpsize"}
+
+	v := connectTestVoice(t, srv)
+	defer v.Close()
+
+	var capture, keys bytes.Buffer
+	c, err := NewVoiceCapture(&capture, &keys)
+	if err != nil {
+		t.Fatalf("NewVoiceCapture returned error: %v", err)
+	}
+	v.SetCapture(c)
+
+	want := []discordtest.VoicePacket{
+		{SSRC: 77, Sequence: 1, Timestamp: 960, Opus: []byte("one")},
+		{SSRC: 77, Sequence: 2, Timestamp: 1920, Opus: []byte("two")},
+		{SSRC: 78, Sequence: 9, Timestamp: 480, Opus: []byte("three")},
+	}
+	for _, p := range want {
+		if err := srv.SendAudio(p); err != nil {
+			t.Fatalf("SendAudio returned error: %v", err)
+		}
+		select {
+		case p := <-v.OpusRecv:
+			p.Release()
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not receive audio")
+		}
+	}
+	v.SetCapture(nil)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	ks, err := ReadCaptureKeys(&keys)
+	if err != nil || len(ks) != 1 || ks[0].Mode != "aead_xchacha20_poly1305_rtpsize" || !bytes.Equal(ks[0].SecretKey, srv.SecretKey[:]) {
+		t.Fatalf("ReadCaptureKeys incorrect: got %+v, %v", ks, err)
+	}
+
+	for _, k := range [][]CaptureKey{ks, nil} {
+		var got []*Packet
+		err := ReplayCapture(bytes.NewReader(capture.Bytes()), k, func(t time.Time, p *Packet) {
+			got = append(got, p)
+		})
+		if err != nil {
+			t.Fatalf("ReplayCapture returned error: %v", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("ReplayCapture packets incorrect: got %d, want %d", len(got), len(want))
+		}
+		for i, p := range got {
+			w := want[i]
+			if p.SSRC != w.SSRC || p.Sequence != w.Sequence || p.Timestamp != w.Timestamp || !bytes.Equal(p.Opus, w.Opus) {
+				t.Errorf("replayed packet %d incorrect: got %+v, want %+v", i, p, w)
+			}
+			p.Release()
+		}
+	}
+
+	// Without the right key nothing decrypts.
+	ks[0].SecretKey = make([]byte, 32)
+	n := 0
+	ReplayCapture(bytes.NewReader(capture.Bytes()), ks, func(t time.Time, p *Packet) { n++ })
+	if n != 0 {
+		t.Errorf("ReplayCapture with wrong key returned %d packets", n)
+	}
+}
+
+func TestVoiceCaptureFormat(t *testing.T) {
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("not a capture file!!!!!!"))); err != ErrCaptureFormat {
+		t.Errorf("NewCaptureReader error incorrect: got %v, want %v", err, ErrCaptureFormat)
+	}
+
+	var b bytes.Buffer
+	c, _ := NewVoiceCapture(&b, nil)
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 40000}
+	c.writeDatagram(time.Unix(100, 5), src, dst, []byte("datagram"))
+	c.Close()
+
+	data := b.Bytes()
+	ip := data[pcapFileHeaderSize+pcapRecordHeaderSize:]
+	var sum uint32
+	for i := 0; i < ipv4HeaderSize; i += 2 {
+		sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	if sum != 0xffff {
+		t.Errorf("ipv4 header checksum incorrect: %#x", sum)
+	}
+
+	r, err := NewCaptureReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewCaptureReader returned error: %v", err)
+	}
+	rec, err := r.Next()
+	if err != nil || !rec.Time.Equal(time.Unix(100, 5)) || rec.Decrypted || string(rec.Data) != "datagram" {
+		t.Errorf("Next incorrect: got %+v, %v", rec, err)
+	}
+
+	// A truncated record is an error, not the end of the capture.
+	r, _ = NewCaptureReader(bytes.NewReader(data[:len(data)-1]))
+	if _, err := r.Next(); err != ErrCaptureFormat {
+		t.Errorf("Next of truncated record error incorrect: got %v, want %v", err, ErrCaptureFormat)
+	}
+}
+
+func TestVoiceCaptureAllocs(t *testing.T) {
+	c, _ := NewVoiceCapture(ioutil.Discard, nil)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	p := &Packet{SSRC: 1, Type: []byte{0x80, 0x78}, Opus: make([]byte, 100)}
+	datagram := make([]byte, 200)
+	now := time.Now()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c.writeDatagram(now, addr, addr, datagram)
+		c.writeDecrypted(now, addr, p)
+	})
+	if allocs != 0 {
+		t.Errorf("capture allocations incorrect: got %v, want 0", allocs)
+	}
+}
+
+func TestVoiceCaptureReplayDAVE(t *testing.T) {
+	srv, err := discordtest.NewVoiceServer()
+	if err != nil {
+		t.Fatalf("NewVoiceServer returned error: %v", err)
+	}
+	defer srv.Close()
+
+	v := connectTestVoice(t, srv)
+	defer v.Close()
+
+	// One sender's key is installed before the capture starts and one
+	// after, so both the keys in use and new keys are recorded.
+	session := &fakeDAVESession{}
+	v.dave.Lock()
+	v.dave.recognized = map[string]bool{"101": true}
+	v.dave.Unlock()
+	v.daveSetSSRCUser(77, "101")
+	if err := v.daveInstallDecryptors(session); err != nil {
+		t.Fatalf("daveInstallDecryptors returned error: %v", err)
+	}
+
+	var capture, keys bytes.Buffer
+	c, err := NewVoiceCapture(&capture, &keys)
+	if err != nil {
+		t.Fatalf("NewVoiceCapture returned error: %v", err)
+	}
+	v.SetCapture(c)
+
+	v.dave.Lock()
+	v.dave.recognized["102"] = true
+	v.dave.Unlock()
+	v.daveSetSSRCUser(78, "102")
+	if err := v.daveInstallDecryptors(session); err != nil {
+		t.Fatalf("daveInstallDecryptors returned error: %v", err)
+	}
+
+	encryptors := make(map[uint32]*daveEncryptor)
+	for ssrc, id := range map[uint32]string{77: "101", 78: "102"} {
+		secret, _ := session.ExportSenderSecret(id)
+		encryptors[ssrc] = newDAVEEncryptor(newDAVEKeyRatchet(secret))
+	}
+	want := []discordtest.VoicePacket{
+		{SSRC: 77, Sequence: 1, Timestamp: 960, Opus: []byte("one")},
+		{SSRC: 78, Sequence: 9, Timestamp: 480, Opus: []byte("two")},
+	}
+	for _, p := range want {
+		sealed, err := encryptors[p.SSRC].encrypt(p.Opus)
+		if err != nil {
+			t.Fatalf("encrypt returned error: %v", err)
+		}
+		sent := p
+		sent.Opus = sealed
+		if err := srv.SendAudio(sent); err != nil {
+			t.Fatalf("SendAudio returned error: %v", err)
+		}
+		select {
+		case p := <-v.OpusRecv:
+			p.Release()
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not receive audio")
+		}
+	}
+	v.SetCapture(nil)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	ks, err := ReadCaptureKeys(&keys)
+	if err != nil {
+		t.Fatalf("ReadCaptureKeys returned error: %v", err)
+	}
+	var got []*Packet
+	err = ReplayCapture(bytes.NewReader(capture.Bytes()), ks, func(t time.Time, p *Packet) {
+		got = append(got, p)
+	})
+	if err != nil {
+		t.Fatalf("ReplayCapture returned error: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ReplayCapture packets incorrect: got %d, want %d", len(got), len(want))
+	}
+	for i, p := range got {
+		if p.SSRC != want[i].SSRC || !bytes.Equal(p.Opus, want[i].Opus) {
+			t.Errorf("replayed packet %d incorrect: got %d %q, want %d %q", i, p.SSRC, p.Opus, want[i].SSRC, want[i].Opus)
+		}
+		p.Release()
+	}
+}
@@ -0,0 +1,987 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains code related to the DAVE end-to-end encrypted voice
+// protocol. See https://daveprotocol.com for the protocol whitepaper.
+
+package discordgo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/hkdf"
+)
+
+// DAVEProtocolVersion is the highest DAVE protocol version supported.
+const DAVEProtocolVersion = 1
+
+// DAVE voice gateway opcodes.
+const (
+	daveOpClientsConnect           = 11 // JSON, server -> client
+	daveOpClientDisconnect         = 13 // JSON, server -> client
+	daveOpPrepareTransition        = 21 // JSON, server -> client
+	daveOpExecuteTransition        = 22 // JSON, server -> client
+	daveOpTransitionReady          = 23 // JSON, client -> server
+	daveOpPrepareEpoch             = 24 // JSON, server -> client
+	daveOpExternalSenderPackage    = 25 // binary, server -> client
+	daveOpKeyPackage               = 26 // binary, client -> server
+	daveOpProposals                = 27 // binary, server -> client
+	daveOpCommitWelcome            = 28 // binary, client -> server
+	daveOpAnnounceCommitTransition = 29 // binary, server -> client
+	daveOpWelcome                  = 30 // binary, server -> client
+	daveOpInvalidCommitWelcome     = 31 // JSON, client -> server
+)
+
+const (
+	daveMagicMarker          = 0xFAFA
+	daveTagSize              = 8
+	daveNonceSize            = 12
+	daveTruncatedNonceOffset = 8
+	daveKeySize              = 16
+	daveSecretSize           = sha256.Size
+
+	// How long frames without the DAVE trailer are still accepted after a
+	// downgrade, or after a new sender key has been installed.
+	davePassthroughWindow = 10 * time.Second
+
+	// Maximum number of generations a receive ratchet will skip ahead.
+	daveMaxGenerationGap = 250
+)
+
+// daveOpusSilence is the Opus silence frame, which is always sent unencrypted.
+var daveOpusSilence = []byte{0xF8, 0xFF, 0xFE}
+
+// A DAVESession performs the MLS group operations required by the DAVE
+// protocol. discordgo handles the voice gateway signalling and the media
+// frame encryption, while the MLS state machine is supplied by the caller,
+// typically a binding to libdave or another MLS implementation using
+// ciphersuite MLS_128_DHKEMP256_AES128GCM_SHA256_P256.
+type DAVESession interface {
+	// Init resets the session for a new MLS group. groupID is the voice
+	// channel ID and userID is the local user.
+	Init(protocolVersion int, groupID uint64, userID string) error
+
+	// SetExternalSender sets the voice gateway's external sender package.
+	SetExternalSender(externalSender []byte) error
+
+	// KeyPackage returns a serialized MLS KeyPackage for the local user.
+	KeyPackage() ([]byte, error)
+
+	// ProcessProposals handles a proposals payload (including its leading
+	// operation type byte) and returns the commit and optional welcome to
+	// send back. A nil commit means there is nothing to commit.
+	ProcessProposals(payload []byte, recognizedUserIDs []string) (commit, welcome []byte, err error)
+
+	// ProcessCommit applies a commit announced by the voice gateway.
+	ProcessCommit(commit []byte) error
+
+	// ProcessWelcome joins the group using a welcome message.
+	ProcessWelcome(welcome []byte, recognizedUserIDs []string) error
+
+	// ExportSenderSecret returns the MLS exporter secret for the media key
+	// of the given user: MLS-Exporter("Discord Secure Frames v0",
+	// little-endian uint64 user ID, 16).
+	ExportSenderSecret(userID string) ([]byte, error)
+}
+
+// daveState holds the DAVE protocol state for a VoiceConnection.
+type daveState struct {
+	sync.Mutex
+
+	protocolVersion    int
+	pendingTransitions map[uint16]int
+	recognized         map[string]bool
+	ssrcUsers          map[uint32]string
+
+	encryptor  *daveEncryptor
+	decryptors map[string]*daveDecryptor
+
+	// Frames without a DAVE trailer are accepted until this time.
+	passthroughUntil time.Time
+}
+
+// reset clears all protocol state.
+func (d *daveState) reset() {
+	d.protocolVersion = 0
+	d.pendingTransitions = make(map[uint16]int)
+	d.encryptor = nil
+	d.decryptors = make(map[string]*daveDecryptor)
+	d.passthroughUntil = time.Time{}
+	if d.recognized == nil {
+		d.recognized = make(map[string]bool)
+	}
+	if d.ssrcUsers == nil {
+		d.ssrcUsers = make(map[uint32]string)
+	}
+}
+
+// recognizedUserIDs returns the user IDs known to be in the call.
+func (d *daveState) recognizedUserIDs() []string {
+	ids := make([]string, 0, len(d.recognized))
+	for id := range d.recognized {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// DAVEProtocolVersion returns the DAVE protocol version currently in use on
+// the connection, 0 when media is not end-to-end encrypted.
+func (v *VoiceConnection) DAVEProtocolVersion() int {
+	v.dave.Lock()
+	defer v.dave.Unlock()
+
+	return v.dave.protocolVersion
+}
+
+// isDAVEOp reports whether op is a JSON DAVE opcode which must be handled in
+// the order it was received.
+func isDAVEOp(op int) bool {
+	switch op {
+	case daveOpClientsConnect, daveOpClientDisconnect, daveOpPrepareTransition,
+		daveOpExecuteTransition, daveOpPrepareEpoch:
+		return true
+	}
+	return false
+}
+
+// daveInit resets the DAVE state and, when protocolVersion is non-zero,
+// re-initialises the MLS session and sends a new key package.
+func (v *VoiceConnection) daveInit(protocolVersion int) {
+
+	v.RLock()
+	session := v.DAVE
+	channelID := v.ChannelID
+	userID := v.UserID
+	v.RUnlock()
+
+	v.dave.Lock()
+	v.dave.reset()
+	v.dave.Unlock()
+
+	if session == nil || protocolVersion == 0 {
+		return
+	}
+
+	groupID, err := strconv.ParseUint(channelID, 10, 64)
+	if err != nil {
+		v.log(LogError, "invalid channel ID for DAVE group, %s", err)
+		return
+	}
+
+	if err := session.Init(protocolVersion, groupID, userID); err != nil {
+		v.log(LogError, "error initialising DAVE session, %s", err)
+		return
+	}
+
+	v.daveSendKeyPackage(session)
+}
+
+// daveSendKeyPackage sends the local key package to the voice gateway.
+func (v *VoiceConnection) daveSendKeyPackage(session DAVESession) {
+	kp, err := session.KeyPackage()
+	if err != nil {
+		v.log(LogError, "error creating DAVE key package, %s", err)
+		return
+	}
+
+	if err := v.wsWriteBinary(daveOpKeyPackage, kp); err != nil {
+		v.log(LogError, "error sending DAVE key package, %s", err)
+	}
+}
+
+// wsWriteBinary sends a binary opcode message over the voice websocket.
+func (v *VoiceConnection) wsWriteBinary(op byte, payload []byte) error {
+	v.RLock()
+	wsConn := v.wsConn
+	v.RUnlock()
+	if wsConn == nil {
+		return fmt.Errorf("no VoiceConnection websocket")
+	}
+
+	msg := make([]byte, 0, len(payload)+1)
+	msg = append(msg, op)
+	msg = append(msg, payload...)
+
+	v.wsMutex.Lock()
+	defer v.wsMutex.Unlock()
+	return wsConn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// wsWriteTransition sends a JSON opcode carrying only a transition ID.
+func (v *VoiceConnection) wsWriteTransition(op int, transitionID uint16) error {
+	type transitionData struct {
+		TransitionID uint16 `json:"transition_id"`
+	}
+	type transitionOp struct {
+		Op   int            `json:"op"`
+		Data transitionData `json:"d"`
+	}
+
+	v.RLock()
+	wsConn := v.wsConn
+	v.RUnlock()
+	if wsConn == nil {
+		return fmt.Errorf("no VoiceConnection websocket")
+	}
+
+	v.wsMutex.Lock()
+	defer v.wsMutex.Unlock()
+	return wsConn.WriteJSON(transitionOp{op, transitionData{transitionID}})
+}
+
+// onDAVEEvent handles the JSON DAVE opcodes.
+func (v *VoiceConnection) onDAVEEvent(e *Event) {
+
+	switch e.Operation {
+
+	case daveOpClientsConnect:
+		var d struct {
+			UserIDs []string `json:"user_ids"`
+		}
+		if err := json.Unmarshal(e.RawData, &d); err != nil {
+			v.log(LogError, "OP11 unmarshall error, %s, %s", err, string(e.RawData))
+			return
+		}
+		v.dave.Lock()
+		if v.dave.recognized == nil {
+			v.dave.recognized = make(map[string]bool)
+		}
+		for _, id := range d.UserIDs {
+			v.dave.recognized[id] = true
+		}
+		v.dave.Unlock()
+
+	case daveOpClientDisconnect:
+		var d struct {
+			UserID string `json:"user_id"`
+		}
+		if err := json.Unmarshal(e.RawData, &d); err != nil {
+			v.log(LogError, "OP13 unmarshall error, %s, %s", err, string(e.RawData))
+			return
+		}
+		v.dave.Lock()
+		delete(v.dave.recognized, d.UserID)
+		delete(v.dave.decryptors, d.UserID)
+		for ssrc, id := range v.dave.ssrcUsers {
+			if id == d.UserID {
+				delete(v.dave.ssrcUsers, ssrc)
+			}
+		}
+		v.dave.Unlock()
+
+	case daveOpPrepareTransition:
+		var d struct {
+			ProtocolVersion int    `json:"protocol_version"`
+			TransitionID    uint16 `json:"transition_id"`
+		}
+		if err := json.Unmarshal(e.RawData, &d); err != nil {
+			v.log(LogError, "OP21 unmarshall error, %s, %s", err, string(e.RawData))
+			return
+		}
+		v.log(LogInformational, "preparing DAVE transition %d to protocol version %d", d.TransitionID, d.ProtocolVersion)
+
+		v.dave.Lock()
+		if d.ProtocolVersion == 0 {
+			// Downgrading, so start accepting unencrypted frames now.
+			v.dave.passthroughUntil = time.Now().Add(davePassthroughWindow)
+		}
+		v.dave.Unlock()
+
+		v.daveStageTransition(d.TransitionID, d.ProtocolVersion)
+
+	case daveOpExecuteTransition:
+		var d struct {
+			TransitionID uint16 `json:"transition_id"`
+		}
+		if err := json.Unmarshal(e.RawData, &d); err != nil {
+			v.log(LogError, "OP22 unmarshall error, %s, %s", err, string(e.RawData))
+			return
+		}
+		v.daveExecuteTransition(d.TransitionID)
+
+	case daveOpPrepareEpoch:
+		var d struct {
+			ProtocolVersion int    `json:"protocol_version"`
+			Epoch           uint64 `json:"epoch"`
+		}
+		if err := json.Unmarshal(e.RawData, &d); err != nil {
+			v.log(LogError, "OP24 unmarshall error, %s, %s", err, string(e.RawData))
+			return
+		}
+		// Epoch 1 means a new MLS group is being created.
+		if d.Epoch == 1 {
+			v.log(LogInformational, "DAVE group reset, protocol version %d", d.ProtocolVersion)
+			v.daveInit(d.ProtocolVersion)
+		}
+	}
+}
+
+// onDAVEBinaryEvent handles the binary DAVE opcodes. Server binary messages
+// are a big-endian uint16 sequence number, a uint8 opcode and the payload.
+func (v *VoiceConnection) onDAVEBinaryEvent(message []byte) {
+
+	if len(message) < 3 {
+		v.log(LogError, "binary message too small, %d bytes", len(message))
+		return
+	}
+
+	v.setLastSequence(int64(binary.BigEndian.Uint16(message)))
+	op := message[2]
+	payload := message[3:]
+
+	v.RLock()
+	session := v.DAVE
+	v.RUnlock()
+	if session == nil {
+		v.log(LogDebug, "ignoring binary opcode %d, DAVE not enabled", op)
+		return
+	}
+
+	v.log(LogDebug, "received binary opcode %d, %d bytes", op, len(payload))
+
+	switch op {
+
+	case daveOpExternalSenderPackage:
+		if err := session.SetExternalSender(payload); err != nil {
+			v.log(LogError, "error setting DAVE external sender, %s", err)
+		}
+
+	case daveOpProposals:
+		v.dave.Lock()
+		recognized := v.dave.recognizedUserIDs()
+		v.dave.Unlock()
+
+		commit, welcome, err := session.ProcessProposals(payload, recognized)
+		if err != nil {
+			v.log(LogError, "error processing DAVE proposals, %s", err)
+			return
+		}
+		if commit == nil {
+			return
+		}
+		if err := v.wsWriteBinary(daveOpCommitWelcome, append(commit, welcome...)); err != nil {
+			v.log(LogError, "error sending DAVE commit, %s", err)
+		}
+
+	case daveOpAnnounceCommitTransition, daveOpWelcome:
+		if len(payload) < 2 {
+			v.log(LogError, "DAVE opcode %d payload too small", op)
+			return
+		}
+		transitionID := binary.BigEndian.Uint16(payload)
+
+		var err error
+		if op == daveOpAnnounceCommitTransition {
+			err = session.ProcessCommit(payload[2:])
+		} else {
+			v.dave.Lock()
+			recognized := v.dave.recognizedUserIDs()
+			v.dave.Unlock()
+			err = session.ProcessWelcome(payload[2:], recognized)
+		}
+		if err != nil {
+			v.log(LogError, "error processing DAVE opcode %d, %s", op, err)
+			v.daveRecover(transitionID)
+			return
+		}
+
+		if err := v.daveInstallDecryptors(session); err != nil {
+			v.log(LogError, "error deriving DAVE receive keys, %s", err)
+			v.daveRecover(transitionID)
+			return
+		}
+
+		v.daveStageTransition(transitionID, DAVEProtocolVersion)
+
+	default:
+		v.log(LogDebug, "unknown binary voice operation, %d", op)
+	}
+}
+
+// daveRecover tells the voice gateway the commit or welcome for the given
+// transition could not be processed and rejoins the group from scratch.
+func (v *VoiceConnection) daveRecover(transitionID uint16) {
+	if err := v.wsWriteTransition(daveOpInvalidCommitWelcome, transitionID); err != nil {
+		v.log(LogError, "error sending DAVE invalid commit, %s", err)
+	}
+	v.daveInit(DAVEProtocolVersion)
+}
+
+// daveStageTransition records a pending protocol transition. Transition 0 is
+// executed immediately, anything else is acknowledged and executed once the
+// voice gateway says so.
+func (v *VoiceConnection) daveStageTransition(transitionID uint16, protocolVersion int) {
+
+	v.dave.Lock()
+	if v.dave.pendingTransitions == nil {
+		v.dave.pendingTransitions = make(map[uint16]int)
+	}
+	v.dave.pendingTransitions[transitionID] = protocolVersion
+	v.dave.Unlock()
+
+	if transitionID == 0 {
+		v.daveExecuteTransition(transitionID)
+		return
+	}
+
+	if err := v.wsWriteTransition(daveOpTransitionReady, transitionID); err != nil {
+		v.log(LogError, "error sending DAVE transition ready, %s", err)
+	}
+}
+
+// daveExecuteTransition switches the connection to the protocol version of a
+// previously prepared transition.
+func (v *VoiceConnection) daveExecuteTransition(transitionID uint16) {
+
+	v.RLock()
+	session := v.DAVE
+	userID := v.UserID
+	v.RUnlock()
+
+	v.dave.Lock()
+	defer v.dave.Unlock()
+
+	protocolVersion, ok := v.dave.pendingTransitions[transitionID]
+	if !ok {
+		v.log(LogWarning, "execute for unknown DAVE transition %d", transitionID)
+		return
+	}
+	delete(v.dave.pendingTransitions, transitionID)
+
+	v.log(LogInformational, "executing DAVE transition %d to protocol version %d", transitionID, protocolVersion)
+
+	if protocolVersion == 0 || session == nil {
+		if v.dave.protocolVersion != 0 {
+			v.dave.passthroughUntil = time.Now().Add(davePassthroughWindow)
+		}
+		v.dave.protocolVersion = 0
+		v.dave.encryptor = nil
+		return
+	}
+
+	secret, err := session.ExportSenderSecret(userID)
+	if err != nil {
+		v.log(LogError, "error deriving DAVE send key, %s", err)
+		return
+	}
+	if v.dave.protocolVersion == 0 {
+		// Upgrading, so peers may still send unencrypted frames for a while.
+		v.dave.passthroughUntil = time.Now().Add(davePassthroughWindow)
+	}
+	v.dave.protocolVersion = protocolVersion
+	v.dave.encryptor = newDAVEEncryptor(newDAVEKeyRatchet(secret))
+}
+
+// daveInstallDecryptors derives a new receive ratchet for every other user in
+// the call. Previous ratchets are kept for a short while so frames encrypted
+// under the old epoch can still be decrypted.
+func (v *VoiceConnection) daveInstallDecryptors(session DAVESession) error {
+
+	v.RLock()
+	self := v.UserID
+	capture := v.capture
+	v.RUnlock()
+
+	v.dave.Lock()
+	defer v.dave.Unlock()
+
+	if v.dave.decryptors == nil {
+		v.dave.decryptors = make(map[string]*daveDecryptor)
+	}
+
+	now := time.Now()
+
+	for id := range v.dave.recognized {
+		if id == self {
+			continue
+		}
+		secret, err := session.ExportSenderSecret(id)
+		if err != nil {
+			return err
+		}
+		d, ok := v.dave.decryptors[id]
+		if !ok {
+			d = &daveDecryptor{}
+			v.dave.decryptors[id] = d
+		}
+		d.transitionTo(newDAVEKeyRatchet(secret))
+		if capture != nil {
+			capture.writeDAVEKey(now, id, secret)
+		}
+	}
+	return nil
+}
+
+// daveSetSSRCUser records which user is sending on an SSRC.
+func (v *VoiceConnection) daveSetSSRCUser(ssrc uint32, userID string) {
+	v.RLock()
+	capture := v.capture
+	v.RUnlock()
+	if capture != nil {
+		capture.writeSSRC(time.Now(), ssrc, userID)
+	}
+
+	v.dave.Lock()
+	defer v.dave.Unlock()
+
+	if v.dave.ssrcUsers == nil {
+		v.dave.ssrcUsers = make(map[uint32]string)
+	}
+	v.dave.ssrcUsers[ssrc] = userID
+	if v.dave.recognized == nil {
+		v.dave.recognized = make(map[string]bool)
+	}
+	v.dave.recognized[userID] = true
+}
+
+// daveEncrypt applies DAVE frame encryption to an outgoing Opus frame when
+// the connection is end-to-end encrypted, otherwise it returns the frame.
+func (v *VoiceConnection) daveEncrypt(frame []byte) ([]byte, error) {
+	v.dave.Lock()
+	defer v.dave.Unlock()
+
+	if v.dave.protocolVersion == 0 || v.dave.encryptor == nil || isOpusSilence(frame) {
+		return frame, nil
+	}
+	return v.dave.encryptor.encrypt(frame)
+}
+
+// daveDecrypt removes DAVE frame encryption from a received Opus frame.
+func (v *VoiceConnection) daveDecrypt(ssrc uint32, frame []byte) ([]byte, error) {
+	v.dave.Lock()
+	defer v.dave.Unlock()
+
+	if !hasDAVEMarker(frame) {
+		if v.dave.protocolVersion == 0 || isOpusSilence(frame) || time.Now().Before(v.dave.passthroughUntil) {
+			return frame, nil
+		}
+		return nil, fmt.Errorf("unencrypted frame on DAVE connection")
+	}
+
+	userID, ok := v.dave.ssrcUsers[ssrc]
+	if !ok {
+		return nil, fmt.Errorf("no user for ssrc %d", ssrc)
+	}
+	d, ok := v.dave.decryptors[userID]
+	if !ok {
+		return nil, fmt.Errorf("no DAVE key for user %s", userID)
+	}
+	return d.decrypt(frame)
+}
+
+func isOpusSilence(frame []byte) bool {
+	return len(frame) == len(daveOpusSilence) &&
+		frame[0] == daveOpusSilence[0] && frame[1] == daveOpusSilence[1] && frame[2] == daveOpusSilence[2]
+}
+
+func hasDAVEMarker(frame []byte) bool {
+	return len(frame) >= 2 && binary.BigEndian.Uint16(frame[len(frame)-2:]) == daveMagicMarker
+}
+
+// ------------------------------------------------------------------------------------------------
+// DAVE media frame encryption
+// ------------------------------------------------------------------------------------------------
+
+// A daveKeyRatchet derives per-generation media keys from a sender's base
+// secret using the MLS hash ratchet (RFC 9420 section 9.1) with SHA-256.
+type daveKeyRatchet struct {
+	base       []byte // the secret of generation 0, for captures
+	secret     []byte
+	generation uint32
+	keys       map[uint32][]byte
+}
+
+func newDAVEKeyRatchet(baseSecret []byte) *daveKeyRatchet {
+	return &daveKeyRatchet{
+		base:   append([]byte{}, baseSecret...),
+		secret: append([]byte{}, baseSecret...),
+		keys:   make(map[uint32][]byte),
+	}
+}
+
+// key returns the media key for a generation. Keys for generations older than
+// the requested one are discarded.
+func (r *daveKeyRatchet) key(generation uint32) ([]byte, error) {
+	if k, ok := r.keys[generation]; ok {
+		return k, nil
+	}
+	if generation < r.generation {
+		return nil, fmt.Errorf("key for generation %d already erased", generation)
+	}
+	if generation-r.generation > daveMaxGenerationGap {
+		return nil, fmt.Errorf("generation %d too far ahead of %d", generation, r.generation)
+	}
+
+	for r.generation <= generation {
+		k, err := daveDeriveTreeSecret(r.secret, "key", r.generation, daveKeySize)
+		if err != nil {
+			return nil, err
+		}
+		next, err := daveDeriveTreeSecret(r.secret, "secret", r.generation, daveSecretSize)
+		if err != nil {
+			return nil, err
+		}
+		r.keys[r.generation] = k
+		r.secret = next
+		r.generation++
+	}
+
+	for g := range r.keys {
+		if g+2 < generation {
+			delete(r.keys, g)
+		}
+	}
+	return r.keys[generation], nil
+}
+
+// oldest returns the oldest generation a key can still be returned for.
+func (r *daveKeyRatchet) oldest() uint32 {
+	oldest := r.generation
+	for g := range r.keys {
+		if g < oldest {
+			oldest = g
+		}
+	}
+	return oldest
+}
+
+// daveDeriveTreeSecret implements DeriveTreeSecret from RFC 9420.
+func daveDeriveTreeSecret(secret []byte, label string, generation uint32, length int) ([]byte, error) {
+	var context [4]byte
+	binary.BigEndian.PutUint32(context[:], generation)
+	return daveExpandWithLabel(secret, label, context[:], length)
+}
+
+// daveExpandWithLabel implements ExpandWithLabel from RFC 9420.
+func daveExpandWithLabel(secret []byte, label string, context []byte, length int) ([]byte, error) {
+	fullLabel := "MLS 1.0 " + label
+
+	info := make([]byte, 2, 2+len(fullLabel)+len(context)+8)
+	binary.BigEndian.PutUint16(info, uint16(length))
+	info = appendMLSVarint(info, uint64(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = appendMLSVarint(info, uint64(len(context)))
+	info = append(info, context...)
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// appendMLSVarint appends a variable length integer as defined in RFC 9000.
+func appendMLSVarint(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, byte(n>>8)|0x40, byte(n))
+	default:
+		return append(b, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+// appendULEB128 appends an unsigned LEB128 encoded integer.
+func appendULEB128(b []byte, n uint64) []byte {
+	for {
+		c := byte(n & 0x7F)
+		n >>= 7
+		if n != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// readULEB128 decodes an unsigned LEB128 integer, returning the number of
+// bytes consumed.
+func readULEB128(b []byte) (uint64, int, error) {
+	var n uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		n |= uint64(b[i]&0x7F) << (7 * uint(i))
+		if b[i]&0x80 == 0 {
+			return n, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("invalid ULEB128")
+}
+
+// daveNonce expands a 32-bit truncated sync nonce into an AES-GCM nonce.
+func daveNonce(truncated uint32) []byte {
+	nonce := make([]byte, daveNonceSize)
+	binary.LittleEndian.PutUint32(nonce[daveTruncatedNonceOffset:], truncated)
+	return nonce
+}
+
+// A daveRange is an unencrypted byte range within a media frame.
+type daveRange struct {
+	offset, size int
+}
+
+// daveSealFrame encrypts a media frame, leaving the given ranges in the clear,
+// and appends the DAVE trailer:
+//
+//	frame | 8-byte tag | ULEB128 nonce | ULEB128 ranges | trailer size | 0xFAFA
+func daveSealFrame(key []byte, truncatedNonce uint32, frame []byte, ranges []daveRange) ([]byte, error) {
+	gcm, err := newDAVEGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, plaintext, err := splitDAVERanges(frame, ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nil, daveNonce(truncatedNonce), plaintext, aad)
+	ciphertext, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+
+	out := make([]byte, 0, len(frame)+daveTagSize+16)
+	out = joinDAVERanges(out, aad, ciphertext, ranges, len(frame))
+	trailer := len(out)
+	out = append(out, tag[:daveTagSize]...)
+	out = appendULEB128(out, uint64(truncatedNonce))
+	for _, r := range ranges {
+		out = appendULEB128(out, uint64(r.offset))
+		out = appendULEB128(out, uint64(r.size))
+	}
+
+	size := len(out) - trailer + 3
+	if size > 0xFF {
+		return nil, fmt.Errorf("DAVE trailer too large")
+	}
+	out = append(out, byte(size), 0xFA, 0xFA)
+	return out, nil
+}
+
+// A daveFrame is a parsed DAVE encrypted media frame.
+type daveFrame struct {
+	media          []byte
+	tag            []byte
+	truncatedNonce uint32
+	ranges         []daveRange
+}
+
+// parseDAVEFrame splits a received frame into its media and trailer parts.
+func parseDAVEFrame(frame []byte) (*daveFrame, error) {
+	if !hasDAVEMarker(frame) {
+		return nil, errors.New("missing DAVE magic marker")
+	}
+	if len(frame) < 3 {
+		return nil, errors.New("DAVE frame too small")
+	}
+
+	size := int(frame[len(frame)-3])
+	if size < daveTagSize+1+3 || size > len(frame) {
+		return nil, fmt.Errorf("invalid DAVE trailer size %d", size)
+	}
+
+	f := &daveFrame{media: frame[:len(frame)-size]}
+	trailer := frame[len(frame)-size : len(frame)-3]
+	f.tag = trailer[:daveTagSize]
+	trailer = trailer[daveTagSize:]
+
+	nonce, n, err := readULEB128(trailer)
+	if err != nil {
+		return nil, err
+	}
+	if nonce > 0xFFFFFFFF {
+		return nil, errors.New("DAVE nonce out of range")
+	}
+	f.truncatedNonce = uint32(nonce)
+	trailer = trailer[n:]
+
+	end := 0
+	for len(trailer) > 0 {
+		offset, n, err := readULEB128(trailer)
+		if err != nil {
+			return nil, err
+		}
+		trailer = trailer[n:]
+		size, n, err := readULEB128(trailer)
+		if err != nil {
+			return nil, err
+		}
+		trailer = trailer[n:]
+
+		if offset < uint64(end) || offset+size > uint64(len(f.media)) {
+			return nil, errors.New("invalid DAVE unencrypted range")
+		}
+		f.ranges = append(f.ranges, daveRange{int(offset), int(size)})
+		end = int(offset + size)
+	}
+
+	return f, nil
+}
+
+// daveOpenFrame decrypts a parsed frame.
+func daveOpenFrame(key []byte, f *daveFrame) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, ciphertext, err := splitDAVERanges(f.media, f.ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	// Go's GCM does not support 8 byte tags, so decrypt with CTR mode, which
+	// for a 96-bit nonce starts at counter 2, then recompute the tag.
+	nonce := daveNonce(f.truncatedNonce)
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	iv[aes.BlockSize-1] = 2
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+
+	sealed := gcm.Seal(nil, nonce, plaintext, aad)
+	if subtle.ConstantTimeCompare(sealed[len(plaintext):len(plaintext)+daveTagSize], f.tag) != 1 {
+		return nil, errors.New("DAVE frame authentication failed")
+	}
+
+	return joinDAVERanges(nil, aad, plaintext, f.ranges, len(f.media)), nil
+}
+
+func newDAVEGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// splitDAVERanges separates a frame into its unencrypted bytes (the AAD) and
+// the bytes to be encrypted.
+func splitDAVERanges(frame []byte, ranges []daveRange) (clear, secret []byte, err error) {
+	pos := 0
+	for _, r := range ranges {
+		if r.offset < pos || r.offset+r.size > len(frame) {
+			return nil, nil, errors.New("invalid DAVE unencrypted range")
+		}
+		secret = append(secret, frame[pos:r.offset]...)
+		clear = append(clear, frame[r.offset:r.offset+r.size]...)
+		pos = r.offset + r.size
+	}
+	secret = append(secret, frame[pos:]...)
+	return clear, secret, nil
+}
+
+// joinDAVERanges is the inverse of splitDAVERanges.
+func joinDAVERanges(out, clear, secret []byte, ranges []daveRange, length int) []byte {
+	pos := 0
+	for _, r := range ranges {
+		n := r.offset - pos
+		out = append(out, secret[:n]...)
+		secret = secret[n:]
+		out = append(out, clear[:r.size]...)
+		clear = clear[r.size:]
+		pos = r.offset + r.size
+	}
+	return append(out, secret[:length-pos]...)
+}
+
+// A daveEncryptor encrypts outgoing frames for the local user.
+type daveEncryptor struct {
+	ratchet *daveKeyRatchet
+	nonce   uint32
+}
+
+func newDAVEEncryptor(r *daveKeyRatchet) *daveEncryptor {
+	return &daveEncryptor{ratchet: r}
+}
+
+func (e *daveEncryptor) encrypt(frame []byte) ([]byte, error) {
+	nonce := e.nonce
+	e.nonce++
+
+	// The top byte of the truncated nonce is the key generation.
+	key, err := e.ratchet.key(nonce >> 24)
+	if err != nil {
+		return nil, err
+	}
+	return daveSealFrame(key, nonce, frame, nil)
+}
+
+// A daveDecryptor decrypts frames from one remote user. During a key
+// transition the previous ratchet is kept until it expires.
+type daveDecryptor struct {
+	current    *daveKeyRatchet
+	previous   *daveKeyRatchet
+	previousTo time.Time
+}
+
+func (d *daveDecryptor) transitionTo(r *daveKeyRatchet) {
+	if d.current != nil {
+		d.previous = d.current
+		d.previousTo = time.Now().Add(davePassthroughWindow)
+	}
+	d.current = r
+}
+
+func (d *daveDecryptor) decrypt(frame []byte) ([]byte, error) {
+	f, err := parseDAVEFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.previous != nil && time.Now().After(d.previousTo) {
+		d.previous = nil
+	}
+
+	var lastErr error
+	for _, r := range []*daveKeyRatchet{d.current, d.previous} {
+		if r == nil {
+			continue
+		}
+		key, err := r.key(daveWrappedGeneration(r.oldest(), f.truncatedNonce>>24))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		opus, err := daveOpenFrame(key, f)
+		if err == nil {
+			return opus, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no DAVE key ratchet")
+	}
+	return nil, lastErr
+}
+
+// daveWrappedGeneration expands the 8-bit generation carried in a nonce into
+// a full generation, assuming it is not older than the oldest retained one.
+func daveWrappedGeneration(oldest uint32, generation uint32) uint32 {
+	factor := oldest / 256
+	if generation < oldest%256 {
+		factor++
+	}
+	return factor*256 + generation
+}
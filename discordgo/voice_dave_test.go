@@ -0,0 +1,550 @@
+package discordgo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/hkdf"
+)
+
+// testWSMessage is a message received by the server side of a test websocket.
+type testWSMessage struct {
+	Type int
+	Data []byte
+}
+
+// newTestVoiceWS returns a client websocket connected to a local server which
+// forwards every message it receives on the returned channel, and a function
+// closing both.
+func newTestVoiceWS(t *testing.T) (*websocket.Conn, <-chan testWSMessage, func()) {
+	t.Helper()
+
+	received := make(chan testWSMessage, 32)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- testWSMessage{mt, data}
+		}
+	}))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("Dial returned error: %v", err)
+	}
+
+	return conn, received, func() {
+		conn.Close()
+		srv.Close()
+	}
+}
+
+// expectWSMessage waits for the next message sent by the client.
+func expectWSMessage(t *testing.T, c <-chan testWSMessage) testWSMessage {
+	t.Helper()
+
+	select {
+	case m := <-c:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for websocket message")
+	}
+	return testWSMessage{}
+}
+
+// fakeDAVESession is a DAVESession which derives sender secrets from the user
+// ID so both ends of a test can compute the same keys.
+type fakeDAVESession struct {
+	inits          int
+	externalSender []byte
+	commitErr      error
+}
+
+func (f *fakeDAVESession) Init(protocolVersion int, groupID uint64, userID string) error {
+	f.inits++
+	return nil
+}
+
+func (f *fakeDAVESession) SetExternalSender(externalSender []byte) error {
+	f.externalSender = externalSender
+	return nil
+}
+
+func (f *fakeDAVESession) KeyPackage() ([]byte, error) {
+	return []byte("key-package"), nil
+}
+
+func (f *fakeDAVESession) ProcessProposals(payload []byte, recognizedUserIDs []string) ([]byte, []byte, error) {
+	return []byte("commit"), []byte("welcome"), nil
+}
+
+func (f *fakeDAVESession) ProcessCommit(commit []byte) error {
+	return f.commitErr
+}
+
+func (f *fakeDAVESession) ProcessWelcome(welcome []byte, recognizedUserIDs []string) error {
+	return nil
+}
+
+func (f *fakeDAVESession) ExportSenderSecret(userID string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(userID))
+	return sum[:16], nil
+}
+
+func daveServerBinary(seq uint16, op byte, payload []byte) []byte {
+	return append([]byte{byte(seq >> 8), byte(seq), op}, payload...)
+}
+
+func daveServerJSON(op int, d interface{}) []byte {
+	data, _ := json.Marshal(d)
+	msg, _ := json.Marshal(struct {
+		Op   int             `json:"op"`
+		Data json.RawMessage `json:"d"`
+	}{op, data})
+	return msg
+}
+
+func TestULEB128(t *testing.T) {
+	tests := []struct {
+		n   uint64
+		hex string
+	}{
+		{0, "00"},
+		{127, "7f"},
+		{128, "8001"},
+		{624485, "e58e26"},
+		{0xFFFFFFFF, "ffffffff0f"},
+	}
+
+	for _, tt := range tests {
+		b := appendULEB128(nil, tt.n)
+		if hex.EncodeToString(b) != tt.hex {
+			t.Errorf("appendULEB128(%d) incorrect: got %x, want %s", tt.n, b, tt.hex)
+		}
+		n, l, err := readULEB128(b)
+		if err != nil || n != tt.n || l != len(b) {
+			t.Errorf("readULEB128(%x) incorrect: got %d, %d, %v", b, n, l, err)
+		}
+	}
+
+	if _, _, err := readULEB128([]byte{0x80, 0x80}); err == nil {
+		t.Error("readULEB128 of truncated input returned nil error")
+	}
+}
+
+func TestDAVEFrameLayout(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	frame := []byte("opus frame")
+
+	sealed, err := daveSealFrame(key, 0x01000002, frame, nil)
+	if err != nil {
+		t.Fatalf("daveSealFrame returned error: %v", err)
+	}
+
+	// The ciphertext and tag must be standard AES-128-GCM with the tag
+	// truncated to 8 bytes and the nonce in the last 4 bytes, little endian.
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0x02, 0x00, 0x00, 0x01}
+	want := gcm.Seal(nil, nonce, frame, nil)[:len(frame)+daveTagSize]
+	want = append(want, 0x82, 0x80, 0x80, 0x08) // ULEB128 nonce
+	want = append(want, 8+4+3, 0xFA, 0xFA)
+
+	if !bytes.Equal(sealed, want) {
+		t.Errorf("sealed frame incorrect:\n got %x\nwant %x", sealed, want)
+	}
+}
+
+// TestDAVEVectors checks the frame transform and key ratchet against
+// published vectors rather than output of this package. The cipher is checked
+// with test case 2 of McGrew and Viega, "The Galois/Counter Mode of Operation
+// (GCM)", whose all-zero IV is the DAVE nonce for truncated nonce 0. The
+// ratchet is checked against the KDFLabel encoding of RFC 9420 section 8,
+// written out byte for byte, with HKDF-Expand from RFC 5869.
+func TestDAVEVectors(t *testing.T) {
+	key := make([]byte, 16)
+	frame := make([]byte, 16)
+	// C = 0388dace60b6a392f328c2b971b2fe78,
+	// T = ab6e47d42cec13bdf53a67b21257bddf, truncated to 8 bytes.
+	want := "0388dace60b6a392f328c2b971b2fe78" + "ab6e47d42cec13bd" + "00" + "0c" + "fafa"
+
+	sealed, err := daveSealFrame(key, 0, frame, nil)
+	if err != nil || hex.EncodeToString(sealed) != want {
+		t.Errorf("daveSealFrame incorrect:\n got %x, %v\nwant %s", sealed, err, want)
+	}
+
+	b, _ := hex.DecodeString(want)
+	f, err := parseDAVEFrame(b)
+	if err != nil {
+		t.Fatalf("parseDAVEFrame(%s) returned error: %v", want, err)
+	}
+	if opened, err := daveOpenFrame(key, f); err != nil || !bytes.Equal(opened, frame) {
+		t.Errorf("daveOpenFrame(%s) incorrect: got %x, %v", want, opened, err)
+	}
+
+	secret := make([]byte, daveSecretSize)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	expand := func(secret []byte, info string, length int) []byte {
+		b, _ := hex.DecodeString(info)
+		out := make([]byte, length)
+		hkdf.Expand(sha256.New, secret, b).Read(out)
+		return out
+	}
+
+	// struct { uint16 length; opaque label<V> = "MLS 1.0 " + label;
+	// opaque context<V> = uint32 generation; } KDFLabel;
+	const (
+		keyLabel    = "0010" + "0b" + "4d4c5320312e30206b6579" + "04"
+		secretLabel = "0020" + "0e" + "4d4c5320312e3020736563726574" + "04"
+	)
+	r := newDAVEKeyRatchet(secret)
+	next := secret
+	for _, generation := range []string{"00000000", "00000001", "00000002"} {
+		want := expand(next, keyLabel+generation, daveKeySize)
+		next = expand(next, secretLabel+generation, daveSecretSize)
+
+		g, _ := hex.DecodeString(generation)
+		k, err := r.key(binary.BigEndian.Uint32(g))
+		if err != nil || !bytes.Equal(k, want) {
+			t.Errorf("key(%s) incorrect: got %x, %v, want %x", generation, k, err, want)
+		}
+	}
+}
+
+func TestDAVEFrameRoundTrip(t *testing.T) {
+	key := []byte("fedcba9876543210")
+	frame := []byte("\x01\x02\x03\x04\x05\x06\x07\x08\x09")
+
+	for _, ranges := range [][]daveRange{nil, {{0, 1}}, {{1, 2}, {5, 1}}, {{7, 2}}} {
+		sealed, err := daveSealFrame(key, 42, frame, ranges)
+		if err != nil {
+			t.Fatalf("daveSealFrame(%v) returned error: %v", ranges, err)
+		}
+
+		for _, r := range ranges {
+			if !bytes.Equal(sealed[r.offset:r.offset+r.size], frame[r.offset:r.offset+r.size]) {
+				t.Errorf("range %v was encrypted", r)
+			}
+		}
+
+		f, err := parseDAVEFrame(sealed)
+		if err != nil {
+			t.Fatalf("parseDAVEFrame(%v) returned error: %v", ranges, err)
+		}
+		if f.truncatedNonce != 42 || len(f.ranges) != len(ranges) {
+			t.Errorf("parsed frame incorrect: nonce %d, ranges %v", f.truncatedNonce, f.ranges)
+		}
+
+		opened, err := daveOpenFrame(key, f)
+		if err != nil {
+			t.Fatalf("daveOpenFrame(%v) returned error: %v", ranges, err)
+		}
+		if !bytes.Equal(opened, frame) {
+			t.Errorf("round trip incorrect: got %x, want %x", opened, frame)
+		}
+
+		sealed[len(sealed)/4] ^= 0x01
+		if f, err := parseDAVEFrame(sealed); err == nil {
+			if _, err := daveOpenFrame(key, f); err == nil {
+				t.Errorf("tampered frame with ranges %v decrypted", ranges)
+			}
+		}
+	}
+}
+
+func TestParseDAVEFrameInvalid(t *testing.T) {
+	for _, frame := range [][]byte{
+		nil,
+		{0xFA, 0xFA},
+		{0x00, 0xFA, 0xFA},
+		{0xFF, 0xFA, 0xFA},
+		append(make([]byte, 8), 0x80, 12, 0xFA, 0xFA),
+	} {
+		if _, err := parseDAVEFrame(frame); err == nil {
+			t.Errorf("parseDAVEFrame(%x) returned nil error", frame)
+		}
+	}
+}
+
+func TestDAVEKeyRatchet(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+
+	r := newDAVEKeyRatchet(secret)
+	k0, err := r.key(0)
+	if err != nil {
+		t.Fatalf("key(0) returned error: %v", err)
+	}
+	k5, err := r.key(5)
+	if err != nil {
+		t.Fatalf("key(5) returned error: %v", err)
+	}
+	if bytes.Equal(k0, k5) || len(k0) != daveKeySize {
+		t.Errorf("ratchet keys incorrect: %x, %x", k0, k5)
+	}
+
+	other := newDAVEKeyRatchet(secret)
+	if k, _ := other.key(5); !bytes.Equal(k, k5) {
+		t.Errorf("ratchet not deterministic: got %x, want %x", k, k5)
+	}
+
+	if _, err := r.key(0); err == nil {
+		t.Error("key(0) after ratcheting returned nil error")
+	}
+	if _, err := r.key(5 + daveMaxGenerationGap + 2); err == nil {
+		t.Error("key too far ahead returned nil error")
+	}
+}
+
+func TestDAVEWrappedGeneration(t *testing.T) {
+	tests := []struct {
+		oldest, generation, want uint32
+	}{
+		{0, 0, 0},
+		{0, 3, 3},
+		{255, 255, 255},
+		{255, 0, 256},
+		{300, 50, 306},
+		{300, 43, 555},
+	}
+
+	for _, tt := range tests {
+		if got := daveWrappedGeneration(tt.oldest, tt.generation); got != tt.want {
+			t.Errorf("daveWrappedGeneration(%d, %d) incorrect: got %d, want %d", tt.oldest, tt.generation, got, tt.want)
+		}
+	}
+}
+
+func TestVoiceSpeakingUpdateUnmarshal(t *testing.T) {
+	for data, want := range map[string]bool{
+		`{"user_id":"1","ssrc":2,"speaking":true}`:  true,
+		`{"user_id":"1","ssrc":2,"speaking":false}`: false,
+		`{"user_id":"1","ssrc":2,"speaking":5}`:     true,
+		`{"user_id":"1","ssrc":2,"speaking":0}`:     false,
+	} {
+		var vs VoiceSpeakingUpdate
+		if err := json.Unmarshal([]byte(data), &vs); err != nil {
+			t.Fatalf("Unmarshal(%s) returned error: %v", data, err)
+		}
+		if vs.Speaking != want || vs.UserID != "1" || vs.SSRC != 2 {
+			t.Errorf("Unmarshal(%s) incorrect: got %+v", data, vs)
+		}
+	}
+}
+
+func TestDAVETransitions(t *testing.T) {
+	wsConn, received, closeWS := newTestVoiceWS(t)
+	defer closeWS()
+	session := &fakeDAVESession{}
+	v := &VoiceConnection{
+		UserID:         "100",
+		ChannelID:      "200",
+		DAVE:           session,
+		gatewayVersion: 8,
+		wsConn:         wsConn,
+	}
+
+	// Joining a DAVE call sends a key package.
+	v.onEvent(daveServerJSON(4, map[string]interface{}{"mode": "aead_aes256_gcm_rtpsize", "dave_protocol_version": 1}))
+	if m := expectWSMessage(t, received); m.Type != websocket.BinaryMessage || string(m.Data) != "\x1akey-package" {
+		t.Fatalf("expected key package, got %d %q", m.Type, m.Data)
+	}
+	if v.DAVEProtocolVersion() != 0 {
+		t.Errorf("protocol version before first transition incorrect: got %d", v.DAVEProtocolVersion())
+	}
+
+	v.onEvent(daveServerJSON(daveOpClientsConnect, map[string]interface{}{"user_ids": []string{"101"}}))
+	v.onEvent(daveServerJSON(5, map[string]interface{}{"user_id": "101", "ssrc": 7, "speaking": 1}))
+
+	v.onDAVEBinaryEvent(daveServerBinary(1, daveOpExternalSenderPackage, []byte("external")))
+	if string(session.externalSender) != "external" {
+		t.Errorf("external sender incorrect: got %q", session.externalSender)
+	}
+
+	v.onDAVEBinaryEvent(daveServerBinary(2, daveOpProposals, []byte{0, 1, 2}))
+	if m := expectWSMessage(t, received); string(m.Data) != "\x1ccommitwelcome" {
+		t.Fatalf("expected commit welcome, got %q", m.Data)
+	}
+
+	v.onDAVEBinaryEvent(daveServerBinary(3, daveOpAnnounceCommitTransition, []byte{0, 5, 'c'}))
+	m := expectWSMessage(t, received)
+	if m.Type != websocket.TextMessage || !strings.Contains(string(m.Data), `"op":23`) || !strings.Contains(string(m.Data), `"transition_id":5`) {
+		t.Fatalf("expected transition ready, got %q", m.Data)
+	}
+	if v.lastSequence != 3 {
+		t.Errorf("last sequence incorrect: got %d, want 3", v.lastSequence)
+	}
+
+	v.onEvent(daveServerJSON(daveOpExecuteTransition, map[string]interface{}{"transition_id": 5}))
+	if v.DAVEProtocolVersion() != 1 {
+		t.Fatalf("protocol version after transition incorrect: got %d", v.DAVEProtocolVersion())
+	}
+
+	// Our frames are encrypted with our own sender key.
+	opus := []byte("some opus data")
+	sealed, err := v.daveEncrypt(opus)
+	if err != nil {
+		t.Fatalf("daveEncrypt returned error: %v", err)
+	}
+	self, _ := session.ExportSenderSecret("100")
+	peer := &daveDecryptor{}
+	peer.transitionTo(newDAVEKeyRatchet(self))
+	if plain, err := peer.decrypt(sealed); err != nil || !bytes.Equal(plain, opus) {
+		t.Errorf("peer decrypt incorrect: got %q, %v", plain, err)
+	}
+	if silence, _ := v.daveEncrypt(daveOpusSilence); !bytes.Equal(silence, daveOpusSilence) {
+		t.Errorf("silence frame was encrypted: %x", silence)
+	}
+
+	// Frames from others are decrypted with their sender key.
+	other, _ := session.ExportSenderSecret("101")
+	sealed, _ = newDAVEEncryptor(newDAVEKeyRatchet(other)).encrypt(opus)
+	if plain, err := v.daveDecrypt(7, sealed); err != nil || !bytes.Equal(plain, opus) {
+		t.Errorf("daveDecrypt incorrect: got %q, %v", plain, err)
+	}
+	if _, err := v.daveDecrypt(8, sealed); err == nil {
+		t.Error("daveDecrypt for unknown ssrc returned nil error")
+	}
+
+	// Downgrade to unencrypted media.
+	v.onEvent(daveServerJSON(daveOpPrepareTransition, map[string]interface{}{"protocol_version": 0, "transition_id": 6}))
+	if m := expectWSMessage(t, received); !strings.Contains(string(m.Data), `"transition_id":6`) {
+		t.Fatalf("expected transition ready, got %q", m.Data)
+	}
+	if plain, err := v.daveDecrypt(7, opus); err != nil || !bytes.Equal(plain, opus) {
+		t.Errorf("unencrypted frame during downgrade rejected: %v", err)
+	}
+	v.onEvent(daveServerJSON(daveOpExecuteTransition, map[string]interface{}{"transition_id": 6}))
+	if v.DAVEProtocolVersion() != 0 {
+		t.Errorf("protocol version after downgrade incorrect: got %d", v.DAVEProtocolVersion())
+	}
+	if frame, _ := v.daveEncrypt(opus); !bytes.Equal(frame, opus) {
+		t.Errorf("frame encrypted after downgrade: %x", frame)
+	}
+}
+
+// orderedDAVESession records the order of Init and SetExternalSender.
+type orderedDAVESession struct {
+	fakeDAVESession
+
+	sync.Mutex
+	calls []string
+}
+
+func (o *orderedDAVESession) Init(protocolVersion int, groupID uint64, userID string) error {
+	o.Lock()
+	defer o.Unlock()
+	o.calls = append(o.calls, "init")
+	return nil
+}
+
+func (o *orderedDAVESession) SetExternalSender(externalSender []byte) error {
+	o.Lock()
+	defer o.Unlock()
+	o.calls = append(o.calls, "external sender")
+	return nil
+}
+
+func TestDAVESessionDescriptionOrder(t *testing.T) {
+	// The gateway sends the external sender right after OP4, which resets
+	// the session; it must not be handled first.
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, daveServerJSON(4, map[string]interface{}{"mode": "aead_aes256_gcm_rtpsize", "dave_protocol_version": 1}))
+		conn.WriteMessage(websocket.BinaryMessage, daveServerBinary(1, daveOpExternalSenderPackage, []byte("external")))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	session := &orderedDAVESession{}
+	v := &VoiceConnection{
+		UserID:         "100",
+		ChannelID:      "200",
+		DAVE:           session,
+		gatewayVersion: 8,
+		wsConn:         wsConn,
+	}
+	close := make(chan struct{})
+	go v.wsListen(wsConn, close)
+	defer func() {
+		v.Lock()
+		v.wsConn = nil
+		v.Unlock()
+		wsConn.Close()
+	}()
+
+	want := []string{"init", "external sender"}
+	var got []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		session.Lock()
+		got = append(got[:0], session.calls...)
+		session.Unlock()
+		if len(got) == len(want) {
+			break
+		}
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("DAVE session calls incorrect: got %q, want %q", got, want)
+	}
+}
+
+func TestDAVEInvalidCommit(t *testing.T) {
+	wsConn, received, closeWS := newTestVoiceWS(t)
+	defer closeWS()
+	session := &fakeDAVESession{commitErr: errors.New("bad commit")}
+	v := &VoiceConnection{
+		UserID:    "100",
+		ChannelID: "200",
+		DAVE:      session,
+		wsConn:    wsConn,
+	}
+
+	v.onDAVEBinaryEvent(daveServerBinary(1, daveOpAnnounceCommitTransition, []byte{0, 9, 'c'}))
+
+	m := expectWSMessage(t, received)
+	if !strings.Contains(string(m.Data), `"op":31`) || !strings.Contains(string(m.Data), `"transition_id":9`) {
+		t.Fatalf("expected invalid commit welcome, got %q", m.Data)
+	}
+	if m := expectWSMessage(t, received); string(m.Data) != "\x1akey-package" {
+		t.Fatalf("expected new key package, got %q", m.Data)
+	}
+	if session.inits != 1 {
+		t.Errorf("session re-initialised %d times, want 1", session.inits)
+	}
+}
@@ -0,0 +1,578 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains code related to RTCP packets on the voice UDP
+// connection, and receive statistics for each remote source.
+
+package discordgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RTCP packet types from RFC 3550.
+const (
+	rtcpTypeSenderReport   = 200
+	rtcpTypeReceiverReport = 201
+	rtcpTypeBye            = 203
+
+	rtcpHeaderSize      = 8 // common header and sender SSRC
+	rtcpReportBlockSize = 24
+	rtcpMaxReportBlocks = 31
+)
+
+// Sequence number validation limits from RFC 3550 appendix A.1.
+const (
+	rtpMaxDropout   = 3000
+	rtpMaxMisorder  = 100
+	rtpSequenceMod  = 1 << 16
+	rtpClockRate    = 48000
+	jitterFixedBits = 4
+)
+
+// An RTCPPacket is a parsed RTCP packet: an *RTCPSenderReport,
+// *RTCPReceiverReport or *RTCPBye.
+type RTCPPacket interface {
+	// Marshal returns the wire format of the packet.
+	Marshal() []byte
+}
+
+// An RTCPReportBlock holds reception statistics for a single source.
+type RTCPReportBlock struct {
+	SSRC             uint32
+	FractionLost     uint8 // fraction of packets lost since the last report, in 1/256ths
+	TotalLost        int32 // cumulative packets lost, 24 bits
+	HighestSequence  uint32
+	Jitter           uint32 // interarrival jitter in timestamp units
+	LastSR           uint32 // middle 32 bits of the last SR NTP timestamp
+	DelaySinceLastSR uint32 // in 1/65536 seconds
+}
+
+// An RTCPSenderReport is an RTCP SR packet.
+type RTCPSenderReport struct {
+	SSRC        uint32
+	NTPTime     uint64
+	RTPTime     uint32
+	PacketCount uint32
+	OctetCount  uint32
+	Reports     []RTCPReportBlock
+}
+
+// An RTCPReceiverReport is an RTCP RR packet.
+type RTCPReceiverReport struct {
+	SSRC    uint32
+	Reports []RTCPReportBlock
+}
+
+// An RTCPBye is an RTCP BYE packet.
+type RTCPBye struct {
+	Sources []uint32
+	Reason  string
+}
+
+// VoiceRTCPHandler type provides a function definition for RTCP packets
+// received on a voice connection.
+type VoiceRTCPHandler func(vc *VoiceConnection, p RTCPPacket)
+
+// AddRTCPHandler adds a handler for RTCP packets.
+func (v *VoiceConnection) AddRTCPHandler(h VoiceRTCPHandler) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.voiceRTCPHandlers = append(v.voiceRTCPHandlers, h)
+}
+
+// ParseRTCP parses a compound RTCP packet. Packet types other than SR, RR and
+// BYE are skipped.
+func ParseRTCP(b []byte) ([]RTCPPacket, error) {
+	var packets []RTCPPacket
+
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("rtcp packet too small")
+		}
+		if b[0]>>6 != rtpVersion {
+			return nil, fmt.Errorf("unsupported rtcp version %d", b[0]>>6)
+		}
+
+		count := int(b[0] & 0x1F)
+		length := (int(binary.BigEndian.Uint16(b[2:])) + 1) * 4
+		if length > len(b) {
+			return nil, fmt.Errorf("rtcp packet length %d exceeds %d", length, len(b))
+		}
+
+		body := b[4:length]
+		if b[0]&0x20 != 0 {
+			// Padding, only allowed on the last packet.
+			p := int(b[length-1])
+			if p == 0 || p > len(body) {
+				return nil, fmt.Errorf("invalid rtcp padding length %d", p)
+			}
+			body = body[:len(body)-p]
+		}
+
+		switch b[1] {
+		case rtcpTypeSenderReport:
+			if len(body) < 24+count*rtcpReportBlockSize {
+				return nil, errors.New("rtcp sender report too small")
+			}
+			sr := &RTCPSenderReport{
+				SSRC:        binary.BigEndian.Uint32(body),
+				NTPTime:     binary.BigEndian.Uint64(body[4:]),
+				RTPTime:     binary.BigEndian.Uint32(body[12:]),
+				PacketCount: binary.BigEndian.Uint32(body[16:]),
+				OctetCount:  binary.BigEndian.Uint32(body[20:]),
+				Reports:     parseRTCPReportBlocks(body[24:], count),
+			}
+			packets = append(packets, sr)
+
+		case rtcpTypeReceiverReport:
+			if len(body) < 4+count*rtcpReportBlockSize {
+				return nil, errors.New("rtcp receiver report too small")
+			}
+			rr := &RTCPReceiverReport{
+				SSRC:    binary.BigEndian.Uint32(body),
+				Reports: parseRTCPReportBlocks(body[4:], count),
+			}
+			packets = append(packets, rr)
+
+		case rtcpTypeBye:
+			if len(body) < count*4 {
+				return nil, errors.New("rtcp bye too small")
+			}
+			bye := &RTCPBye{Sources: make([]uint32, count)}
+			for i := range bye.Sources {
+				bye.Sources[i] = binary.BigEndian.Uint32(body[i*4:])
+			}
+			if reason := body[count*4:]; len(reason) > 0 {
+				l := int(reason[0])
+				if l+1 > len(reason) {
+					return nil, errors.New("rtcp bye reason overruns packet")
+				}
+				bye.Reason = string(reason[1 : l+1])
+			}
+			packets = append(packets, bye)
+		}
+
+		b = b[length:]
+	}
+
+	return packets, nil
+}
+
+func parseRTCPReportBlocks(b []byte, count int) []RTCPReportBlock {
+	if count == 0 {
+		return nil
+	}
+
+	blocks := make([]RTCPReportBlock, count)
+	for i := range blocks {
+		r := b[i*rtcpReportBlockSize:]
+		lost := int32(binary.BigEndian.Uint32(r[4:]) & 0xFFFFFF)
+		if lost&0x800000 != 0 {
+			lost -= 1 << 24
+		}
+		blocks[i] = RTCPReportBlock{
+			SSRC:             binary.BigEndian.Uint32(r),
+			FractionLost:     r[4],
+			TotalLost:        lost,
+			HighestSequence:  binary.BigEndian.Uint32(r[8:]),
+			Jitter:           binary.BigEndian.Uint32(r[12:]),
+			LastSR:           binary.BigEndian.Uint32(r[16:]),
+			DelaySinceLastSR: binary.BigEndian.Uint32(r[20:]),
+		}
+	}
+	return blocks
+}
+
+// appendRTCPHeader appends the common RTCP header for a packet whose body,
+// excluding the 4 byte header, is bodyLen bytes.
+func appendRTCPHeader(b []byte, count int, packetType uint8, bodyLen int) []byte {
+	b = append(b, rtpVersion<<6|uint8(count&0x1F), packetType, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(bodyLen/4))
+	return b
+}
+
+func appendRTCPReportBlocks(b []byte, blocks []RTCPReportBlock) []byte {
+	for _, r := range blocks {
+		var block [rtcpReportBlockSize]byte
+		binary.BigEndian.PutUint32(block[0:], r.SSRC)
+		binary.BigEndian.PutUint32(block[4:], uint32(r.TotalLost)&0xFFFFFF)
+		block[4] = r.FractionLost
+		binary.BigEndian.PutUint32(block[8:], r.HighestSequence)
+		binary.BigEndian.PutUint32(block[12:], r.Jitter)
+		binary.BigEndian.PutUint32(block[16:], r.LastSR)
+		binary.BigEndian.PutUint32(block[20:], r.DelaySinceLastSR)
+		b = append(b, block[:]...)
+	}
+	return b
+}
+
+// Marshal returns the wire format of the sender report.
+func (sr *RTCPSenderReport) Marshal() []byte {
+	b := appendRTCPHeader(nil, len(sr.Reports), rtcpTypeSenderReport, 24+len(sr.Reports)*rtcpReportBlockSize)
+	var info [24]byte
+	binary.BigEndian.PutUint32(info[0:], sr.SSRC)
+	binary.BigEndian.PutUint64(info[4:], sr.NTPTime)
+	binary.BigEndian.PutUint32(info[12:], sr.RTPTime)
+	binary.BigEndian.PutUint32(info[16:], sr.PacketCount)
+	binary.BigEndian.PutUint32(info[20:], sr.OctetCount)
+	b = append(b, info[:]...)
+	return appendRTCPReportBlocks(b, sr.Reports)
+}
+
+// Marshal returns the wire format of the receiver report.
+func (rr *RTCPReceiverReport) Marshal() []byte {
+	b := appendRTCPHeader(nil, len(rr.Reports), rtcpTypeReceiverReport, 4+len(rr.Reports)*rtcpReportBlockSize)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[4:], rr.SSRC)
+	return appendRTCPReportBlocks(b, rr.Reports)
+}
+
+// Marshal returns the wire format of the BYE packet.
+func (bye *RTCPBye) Marshal() []byte {
+	bodyLen := len(bye.Sources) * 4
+	if bye.Reason != "" {
+		bodyLen += 1 + len(bye.Reason)
+	}
+	padded := (bodyLen + 3) &^ 3
+
+	b := appendRTCPHeader(nil, len(bye.Sources), rtcpTypeBye, padded)
+	for _, s := range bye.Sources {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], s)
+	}
+	if bye.Reason != "" {
+		b = append(b, byte(len(bye.Reason)))
+		b = append(b, bye.Reason...)
+	}
+	return append(b, make([]byte, padded-bodyLen)...)
+}
+
+// ------------------------------------------------------------------------------------------------
+// Receive statistics
+// ------------------------------------------------------------------------------------------------
+
+// RTPReceiveStats holds reception statistics for one remote source.
+type RTPReceiveStats struct {
+	SSRC            uint32
+	PacketsReceived uint64
+	PacketsLost     int64   // cumulative, may be negative when duplicates are received
+	FractionLost    float64 // fraction lost since the previous receiver report
+	Jitter          time.Duration
+	HighestSequence uint32 // extended highest sequence number received
+}
+
+// rtpSourceStats tracks a remote source as described in RFC 3550 appendix A.
+type rtpSourceStats struct {
+	maxSeq        uint16
+	cycles        uint32
+	baseSeq       uint32
+	badSeq        uint32
+	received      uint64
+	expectedPrior uint64
+	receivedPrior uint64
+	transit       uint32
+	jitter        uint32 // scaled by 1<<jitterFixedBits
+
+	lastSR     uint32
+	lastSRTime time.Time
+}
+
+func newRTPSourceStats(seq uint16) *rtpSourceStats {
+	s := &rtpSourceStats{}
+	s.initSeq(seq)
+	return s
+}
+
+func (s *rtpSourceStats) initSeq(seq uint16) {
+	s.baseSeq = uint32(seq)
+	s.maxSeq = seq
+	s.badSeq = rtpSequenceMod + 1
+	s.cycles = 0
+	s.received = 0
+	s.receivedPrior = 0
+	s.expectedPrior = 0
+}
+
+// update records a received packet, returning false if it was rejected as
+// out of sequence.
+func (s *rtpSourceStats) update(seq uint16, timestamp uint32, arrival uint32) bool {
+	delta := seq - s.maxSeq
+
+	switch {
+	case delta < rtpMaxDropout:
+		if seq < s.maxSeq {
+			s.cycles += rtpSequenceMod
+		}
+		s.maxSeq = seq
+	case int(delta) <= rtpSequenceMod-rtpMaxMisorder:
+		// A very large jump, assume the sender restarted if it happens twice.
+		if uint32(seq) == s.badSeq {
+			s.initSeq(seq)
+			s.transit = 0
+		} else {
+			s.badSeq = (uint32(seq) + 1) & (rtpSequenceMod - 1)
+			return false
+		}
+	default:
+		// Duplicate or reordered packet.
+	}
+	s.received++
+
+	// Arrival times and timestamps wrap, so differences are taken modulo
+	// 2^32.
+	transit := arrival - timestamp
+	if s.received > 1 {
+		d := int64(int32(transit - s.transit))
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += uint32(d) - ((s.jitter + 1<<(jitterFixedBits-1)) >> jitterFixedBits)
+	}
+	s.transit = transit
+
+	return true
+}
+
+func (s *rtpSourceStats) extendedMax() uint32 {
+	return s.cycles + uint32(s.maxSeq)
+}
+
+func (s *rtpSourceStats) expected() uint64 {
+	return uint64(s.extendedMax()) - uint64(s.baseSeq) + 1
+}
+
+func (s *rtpSourceStats) lost() int64 {
+	return int64(s.expected()) - int64(s.received)
+}
+
+// fractionLost returns the fraction lost since the last call, in 1/256ths.
+func (s *rtpSourceStats) fractionLost() uint8 {
+	expected := s.expected()
+	expectedInterval := expected - s.expectedPrior
+	receivedInterval := s.received - s.receivedPrior
+	s.expectedPrior = expected
+	s.receivedPrior = s.received
+
+	lostInterval := int64(expectedInterval) - int64(receivedInterval)
+	if expectedInterval == 0 || lostInterval <= 0 {
+		return 0
+	}
+	return uint8((lostInterval << 8) / int64(expectedInterval))
+}
+
+// reportBlock builds an RTCP report block and resets the interval counters.
+func (s *rtpSourceStats) reportBlock(ssrc uint32, now time.Time) RTCPReportBlock {
+	lost := s.lost()
+	if lost > 0x7FFFFF {
+		lost = 0x7FFFFF
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+
+	r := RTCPReportBlock{
+		SSRC:            ssrc,
+		FractionLost:    s.fractionLost(),
+		TotalLost:       int32(lost),
+		HighestSequence: s.extendedMax(),
+		Jitter:          s.jitter >> jitterFixedBits,
+		LastSR:          s.lastSR,
+	}
+	if !s.lastSRTime.IsZero() {
+		r.DelaySinceLastSR = uint32(now.Sub(s.lastSRTime) * 65536 / time.Second)
+	}
+	return r
+}
+
+// rtpReceiveStats tracks all remote sources of a voice connection.
+type rtpReceiveStats struct {
+	sync.Mutex
+	sources map[uint32]*rtpSourceStats
+	start   time.Time
+}
+
+// update records a received packet from the given source.
+func (r *rtpReceiveStats) update(p *Packet, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.sources == nil {
+		r.sources = make(map[uint32]*rtpSourceStats)
+		r.start = now
+	}
+
+	// Arrival time in RTP timestamp units, wrapping like RTP timestamps.
+	// Whole seconds and the remainder are scaled separately so that the
+	// multiplication cannot overflow however long the connection lasts.
+	elapsed := now.Sub(r.start)
+	arrival := uint32(elapsed/time.Second)*rtpClockRate + uint32(elapsed%time.Second*rtpClockRate/time.Second)
+
+	s, ok := r.sources[p.SSRC]
+	if !ok {
+		s = newRTPSourceStats(p.Sequence)
+		r.sources[p.SSRC] = s
+	}
+	s.update(p.Sequence, p.Timestamp, arrival)
+}
+
+// senderReport records the arrival of a sender report for LSR and DLSR.
+func (r *rtpReceiveStats) senderReport(sr *RTCPSenderReport, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if s, ok := r.sources[sr.SSRC]; ok {
+		s.lastSR = uint32(sr.NTPTime >> 16)
+		s.lastSRTime = now
+	}
+}
+
+// bye removes sources which have left.
+func (r *rtpReceiveStats) bye(bye *RTCPBye) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, ssrc := range bye.Sources {
+		delete(r.sources, ssrc)
+	}
+}
+
+// receiverReport builds a receiver report for up to 31 sources.
+func (r *rtpReceiveStats) receiverReport(ssrc uint32, now time.Time) *RTCPReceiverReport {
+	r.Lock()
+	defer r.Unlock()
+
+	rr := &RTCPReceiverReport{SSRC: ssrc}
+	for source, s := range r.sources {
+		if len(rr.Reports) == rtcpMaxReportBlocks {
+			break
+		}
+		rr.Reports = append(rr.Reports, s.reportBlock(source, now))
+	}
+	return rr
+}
+
+// ReceiveStats returns reception statistics for each remote source, keyed by
+// SSRC. Use the VoiceSpeakingUpdate events to map an SSRC to a user.
+func (v *VoiceConnection) ReceiveStats() map[uint32]RTPReceiveStats {
+	v.rtpStats.Lock()
+	defer v.rtpStats.Unlock()
+
+	stats := make(map[uint32]RTPReceiveStats, len(v.rtpStats.sources))
+	for ssrc, s := range v.rtpStats.sources {
+		expectedInterval := s.expected() - s.expectedPrior
+		receivedInterval := s.received - s.receivedPrior
+
+		st := RTPReceiveStats{
+			SSRC:            ssrc,
+			PacketsReceived: s.received,
+			PacketsLost:     s.lost(),
+			Jitter:          time.Duration(s.jitter>>jitterFixedBits) * time.Second / rtpClockRate,
+			HighestSequence: s.extendedMax(),
+		}
+		if expectedInterval > 0 && expectedInterval > receivedInterval {
+			st.FractionLost = float64(expectedInterval-receivedInterval) / float64(expectedInterval)
+		}
+		stats[ssrc] = st
+	}
+	return stats
+}
+
+// onRTCP handles an RTCP packet received on the voice UDP connection. The
+// first 8 bytes are sent in the clear and the rest is encrypted with the
+// connection's transport encryption mode.
+func (v *VoiceConnection) onRTCP(mode string, b []byte) {
+	if len(b) < rtcpHeaderSize {
+		return
+	}
+
+	body, err := v.decryptAudioPacket(mode, b[:rtcpHeaderSize], b[rtcpHeaderSize:])
+	if err != nil {
+		v.log(LogDebug, "rtcp decrypt error, %s", err)
+		return
+	}
+	packet := append(append(make([]byte, 0, rtcpHeaderSize+len(body)), b[:rtcpHeaderSize]...), body...)
+
+	// The packets of a compound packet are walked by their own lengths, but
+	// a single packet's length may still count the encryption overhead.
+	if length := (int(binary.BigEndian.Uint16(packet[2:])) + 1) * 4; length > len(packet) {
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)/4-1))
+	}
+
+	packets, err := ParseRTCP(packet)
+	if err != nil {
+		v.log(LogDebug, "rtcp parse error, %s", err)
+		return
+	}
+
+	now := time.Now()
+	for _, p := range packets {
+		switch p := p.(type) {
+		case *RTCPSenderReport:
+			v.rtpStats.senderReport(p, now)
+		case *RTCPBye:
+			v.rtpStats.bye(p)
+		}
+	}
+
+	v.RLock()
+	handlers := v.voiceRTCPHandlers
+	v.RUnlock()
+
+	for _, p := range packets {
+		for _, h := range handlers {
+			h(v, p)
+		}
+	}
+}
+
+// rtcpReporter sends a receiver report every interval.
+func (v *VoiceConnection) rtcpReporter(udpConn *net.UDPConn, close <-chan struct{}, i time.Duration) {
+
+	if udpConn == nil || close == nil || i <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(i)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-close:
+			return
+		}
+
+		v.RLock()
+		ssrc := v.op2.SSRC
+		mode := v.encryptionMode
+		key := v.op4.SecretKey
+		v.RUnlock()
+
+		rr := v.rtpStats.receiverReport(ssrc, time.Now())
+		if len(rr.Reports) == 0 {
+			continue
+		}
+
+		b := rr.Marshal()
+		packet, err := v.encryptAudioPacket(mode, b[:rtcpHeaderSize], b[rtcpHeaderSize:], key)
+		if err != nil {
+			v.log(LogError, "error encrypting rtcp packet, %s", err)
+			continue
+		}
+
+		_, err = udpConn.Write(packet)
+		if err != nil {
+			v.log(LogError, "rtcp write error, %s", err)
+			return
+		}
+	}
+}
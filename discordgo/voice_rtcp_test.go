@@ -0,0 +1,208 @@
+package discordgo
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRTCPRoundTrip(t *testing.T) {
+	sr := &RTCPSenderReport{
+		SSRC:        1,
+		NTPTime:     0x0102030405060708,
+		RTPTime:     960,
+		PacketCount: 50,
+		OctetCount:  4000,
+		Reports: []RTCPReportBlock{
+			{SSRC: 2, FractionLost: 25, TotalLost: -3, HighestSequence: 70000, Jitter: 12, LastSR: 5, DelaySinceLastSR: 6},
+		},
+	}
+	rr := &RTCPReceiverReport{
+		SSRC: 3,
+		Reports: []RTCPReportBlock{
+			{SSRC: 4, TotalLost: 100},
+			{SSRC: 5, FractionLost: 255},
+		},
+	}
+	bye := &RTCPBye{Sources: []uint32{6, 7}, Reason: "leaving"}
+
+	var compound []byte
+	for _, p := range []RTCPPacket{sr, rr, bye} {
+		compound = append(compound, p.Marshal()...)
+	}
+	if len(compound)%4 != 0 {
+		t.Fatalf("compound packet length %d is not a multiple of 4", len(compound))
+	}
+
+	packets, err := ParseRTCP(compound)
+	if err != nil {
+		t.Fatalf("ParseRTCP returned error: %v", err)
+	}
+	if !reflect.DeepEqual(packets, []RTCPPacket{sr, rr, bye}) {
+		t.Errorf("ParseRTCP incorrect:\n got %+v\nwant %+v", packets, []RTCPPacket{sr, rr, bye})
+	}
+}
+
+func TestParseRTCPInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x80, 200},
+		{0x40, 200, 0x00, 0x00},
+		{0x80, 200, 0x00, 0x06, 0x00},
+		{0x81, 201, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01},
+		{0x82, 203, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01},
+		{0xA0, 201, 0x00, 0x01, 0x00, 0x00, 0x00, 0x09},
+	} {
+		if _, err := ParseRTCP(b); err == nil {
+			t.Errorf("ParseRTCP(%x) returned nil error", b)
+		}
+	}
+}
+
+func TestRTPReceiveStats(t *testing.T) {
+	var stats rtpReceiveStats
+	now := time.Now()
+
+	// Sequence numbers wrap and 3 of 11 packets are lost.
+	for i, seq := range []uint16{65533, 65534, 0, 1, 3, 4, 5, 7} {
+		now = now.Add(20 * time.Millisecond)
+		stats.update(&Packet{SSRC: 9, Sequence: seq, Timestamp: uint32(i) * 960}, now)
+	}
+
+	s := stats.sources[9]
+	if s.received != 8 || s.lost() != 3 || s.extendedMax() != 65536+7 {
+		t.Errorf("stats incorrect: received %d, lost %d, max %d", s.received, s.lost(), s.extendedMax())
+	}
+
+	rr := stats.receiverReport(1, now)
+	if len(rr.Reports) != 1 {
+		t.Fatalf("receiver report has %d blocks, want 1", len(rr.Reports))
+	}
+	if r := rr.Reports[0]; r.SSRC != 9 || r.TotalLost != 3 || r.FractionLost != 3*256/11 {
+		t.Errorf("report block incorrect: %+v", r)
+	}
+
+	// The interval counters reset after a report.
+	if r := stats.receiverReport(1, now).Reports[0]; r.FractionLost != 0 {
+		t.Errorf("fraction lost after reset incorrect: got %d, want 0", r.FractionLost)
+	}
+}
+
+func TestRTPReceiveStatsJitter(t *testing.T) {
+	v := &VoiceConnection{}
+	now := time.Now()
+
+	// Packets arriving alternately 10ms early and late.
+	for i := 0; i < 200; i++ {
+		arrival := now.Add(time.Duration(i) * 20 * time.Millisecond)
+		if i%2 == 1 {
+			arrival = arrival.Add(10 * time.Millisecond)
+		}
+		v.rtpStats.update(&Packet{SSRC: 1, Sequence: uint16(i), Timestamp: uint32(i) * 960}, arrival)
+	}
+
+	st := v.ReceiveStats()[1]
+	if st.Jitter < 9*time.Millisecond || st.Jitter > 11*time.Millisecond {
+		t.Errorf("jitter incorrect: got %s, want ~10ms", st.Jitter)
+	}
+	if st.PacketsReceived != 200 || st.PacketsLost != 0 {
+		t.Errorf("stats incorrect: %+v", st)
+	}
+}
+
+func TestRTPReceiveStatsJitterUptime(t *testing.T) {
+	// The arrival time in RTP units wraps 2^32/48000 seconds, about 25
+	// hours, after the first packet, and in nanoseconds times 48000
+	// overflows after about 53 hours, both in the middle of these 4
+	// seconds.
+	for _, uptime := range []time.Duration{(1<<32/rtpClockRate - 2) * time.Second, math.MaxInt64/rtpClockRate - 2*time.Second} {
+		var stats rtpReceiveStats
+		now := time.Now()
+		stats.sources = make(map[uint32]*rtpSourceStats)
+		stats.start = now.Add(-uptime)
+		for i := 0; i < 200; i++ {
+			arrival := now.Add(time.Duration(i) * 20 * time.Millisecond)
+			if i%2 == 1 {
+				arrival = arrival.Add(10 * time.Millisecond)
+			}
+			stats.update(&Packet{SSRC: 1, Sequence: uint16(i), Timestamp: uint32(i) * 960}, arrival)
+		}
+
+		if j := time.Duration(stats.sources[1].jitter>>jitterFixedBits) * time.Second / rtpClockRate; j < 9*time.Millisecond || j > 11*time.Millisecond {
+			t.Errorf("jitter after %s incorrect: got %s, want ~10ms", uptime, j)
+		}
+	}
+}
+
+func TestOnRTCP(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	v := &VoiceConnection{op4: voiceOP4{SecretKey: key}}
+	v.rtpStats.update(&Packet{SSRC: 42, Sequence: 1}, time.Now())
+
+	var received []RTCPPacket
+	v.AddRTCPHandler(func(vc *VoiceConnection, p RTCPPacket) {
+		received = append(received, p)
+	})
+
+	sr := &RTCPSenderReport{SSRC: 42, NTPTime: 0x0000AAAABBBB0000}
+	b := sr.Marshal()
+	packet, err := v.encryptAudioPacket("aead_aes256_gcm_rtpsize", b[:rtcpHeaderSize], b[rtcpHeaderSize:], key)
+	if err != nil {
+		t.Fatalf("encryptAudioPacket returned error: %v", err)
+	}
+
+	v.onRTCP("aead_aes256_gcm_rtpsize", packet)
+	if len(received) != 1 || !reflect.DeepEqual(received[0], sr) {
+		t.Fatalf("handler received %+v, want %+v", received, sr)
+	}
+	if lsr := v.rtpStats.sources[42].lastSR; lsr != 0xAAAABBBB {
+		t.Errorf("last SR incorrect: got %x, want aaaabbbb", lsr)
+	}
+
+	// Packets which fail to decrypt are dropped.
+	v.onRTCP("aead_aes256_gcm_rtpsize", (&RTCPBye{Sources: []uint32{42}}).Marshal())
+	if len(received) != 1 || len(v.ReceiveStats()) != 1 {
+		t.Errorf("unencrypted BYE handled: %d packets, %d sources", len(received), len(v.ReceiveStats()))
+	}
+
+	// Each packet of a compound SR, SDES and BYE is found by its own
+	// length.
+	sdes := []byte{0x81, 202, 0, 2, 0, 0, 0, 42, 1, 0, 0, 0}
+	b = append(append(sr.Marshal(), sdes...), (&RTCPBye{Sources: []uint32{42}}).Marshal()...)
+	packet, err = v.encryptAudioPacket("aead_aes256_gcm_rtpsize", b[:rtcpHeaderSize], b[rtcpHeaderSize:], key)
+	if err != nil {
+		t.Fatalf("encryptAudioPacket returned error: %v", err)
+	}
+	v.onRTCP("aead_aes256_gcm_rtpsize", packet)
+	if len(received) != 3 || !reflect.DeepEqual(received[1], sr) || len(v.ReceiveStats()) != 0 {
+		t.Errorf("compound packet incorrect: got %+v, %d sources", received, len(v.ReceiveStats()))
+	}
+
+	// The OP4 of a resume may replace the key while packets arrive, which
+	// the race detector checks.
+	started, stop, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			v.Lock()
+			v.op4 = voiceOP4{SecretKey: key}
+			v.Unlock()
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 100; i++ {
+		v.onRTCP("aead_aes256_gcm_rtpsize", packet)
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,259 @@
+// Discordgo - Discord bindings for Go
+// Available at https://github.com/darui3018823/discordgo
+
+// Copyright 2015-2016 Bruce Marriner <bruce@sqls.net>.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains code related to parsing RTP packets received over the
+// voice UDP connection.
+
+package discordgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	rtpVersion         = 2
+	rtpFixedHeaderSize = 12
+
+	// Extension profiles from RFC 8285.
+	rtpOneByteExtensionProfile = 0xBEDE
+	rtpTwoByteExtensionProfile = 0x1000 // upper 12 bits, the lower 4 are app bits
+)
+
+// An RTPExtension is a single RTP header extension element.
+type RTPExtension struct {
+	ID   uint8
+	Data []byte
+}
+
+// An RTPHeader holds the header of an RTP packet, as defined in RFC 3550.
+type RTPHeader struct {
+	Padding     bool
+	Marker      bool
+	PayloadType uint8
+	Sequence    uint16
+	Timestamp   uint32
+	SSRC        uint32
+	CSRC        []uint32
+
+	// Extension is true when the packet carries a header extension.
+	// ExtensionLength is the length of the extension body in 32-bit words.
+	Extension        bool
+	ExtensionProfile uint16
+	ExtensionLength  uint16
+	Extensions       []RTPExtension
+}
+
+// isRTCPPacket reports whether b looks like an RTCP packet multiplexed on the
+// same port as RTP, using the payload type ranges from RFC 5761.
+func isRTCPPacket(b []byte) bool {
+	return len(b) >= 2 && b[0]>>6 == rtpVersion && b[1] >= 192 && b[1] <= 223
+}
+
+// ParseRTPHeader parses the fixed header and CSRC list of an RTP packet, and
+// the extension header if present. The extension body is not parsed, as it
+// may be encrypted, see ParseExtensionBody. The returned length is the
+// number of bytes consumed from b.
+func ParseRTPHeader(b []byte) (*RTPHeader, int, error) {
+	h := &RTPHeader{}
+	n, err := h.Unmarshal(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, n, nil
+}
+
+// Unmarshal is like ParseRTPHeader but parses into h, reusing the capacity
+// of its CSRC and Extensions slices.
+func (h *RTPHeader) Unmarshal(b []byte) (int, error) {
+	if len(b) < rtpFixedHeaderSize {
+		return 0, fmt.Errorf("rtp packet too small, %d bytes", len(b))
+	}
+	if b[0]>>6 != rtpVersion {
+		return 0, fmt.Errorf("unsupported rtp version %d", b[0]>>6)
+	}
+
+	*h = RTPHeader{
+		Padding:     b[0]&0x20 != 0,
+		Extension:   b[0]&0x10 != 0,
+		Marker:      b[1]&0x80 != 0,
+		PayloadType: b[1] & 0x7F,
+		Sequence:    binary.BigEndian.Uint16(b[2:]),
+		Timestamp:   binary.BigEndian.Uint32(b[4:]),
+		SSRC:        binary.BigEndian.Uint32(b[8:]),
+		CSRC:        h.CSRC[:0],
+		Extensions:  h.Extensions[:0],
+	}
+
+	n := rtpFixedHeaderSize
+	cc := int(b[0] & 0x0F)
+	if len(b) < n+cc*4 {
+		return 0, errors.New("rtp packet too small for csrc list")
+	}
+	for i := 0; i < cc; i++ {
+		h.CSRC = append(h.CSRC, binary.BigEndian.Uint32(b[n:]))
+		n += 4
+	}
+
+	if h.Extension {
+		if len(b) < n+4 {
+			return 0, errors.New("rtp packet too small for extension header")
+		}
+		h.ExtensionProfile = binary.BigEndian.Uint16(b[n:])
+		h.ExtensionLength = binary.BigEndian.Uint16(b[n+2:])
+		n += 4
+	}
+
+	return n, nil
+}
+
+// Append appends the fixed header and CSRC list of h to b and returns the
+// extended slice. Header extensions are not written, so the extension bit
+// is always clear.
+func (h *RTPHeader) Append(b []byte) []byte {
+	first := byte(rtpVersion<<6) | byte(len(h.CSRC)&0x0F)
+	if h.Padding {
+		first |= 0x20
+	}
+	second := h.PayloadType & 0x7F
+	if h.Marker {
+		second |= 0x80
+	}
+	b = append(b, first, second, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	n := len(b) - rtpFixedHeaderSize
+	binary.BigEndian.PutUint16(b[n+2:], h.Sequence)
+	binary.BigEndian.PutUint32(b[n+4:], h.Timestamp)
+	binary.BigEndian.PutUint32(b[n+8:], h.SSRC)
+	for i := 0; i < len(h.CSRC) && i < 15; i++ {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], h.CSRC[i])
+	}
+	return b
+}
+
+// ParseExtensionBody parses the header extension body, which must be exactly
+// ExtensionLength words long, into Extensions. One-byte and two-byte header
+// extensions (RFC 8285) are split into elements; any other profile is
+// returned as a single element with ID 0.
+func (h *RTPHeader) ParseExtensionBody(body []byte) error {
+	if len(body) != int(h.ExtensionLength)*4 {
+		return fmt.Errorf("rtp extension body is %d bytes, want %d", len(body), int(h.ExtensionLength)*4)
+	}
+
+	h.Extensions = h.Extensions[:0]
+
+	switch {
+	case h.ExtensionProfile == rtpOneByteExtensionProfile:
+		for i := 0; i < len(body); {
+			id := body[i] >> 4
+			if id == 0 {
+				// Padding byte.
+				i++
+				continue
+			}
+			if id == 15 {
+				// Reserved, stop processing.
+				return nil
+			}
+			l := int(body[i]&0x0F) + 1
+			i++
+			if i+l > len(body) {
+				return errors.New("rtp one-byte extension overruns body")
+			}
+			h.Extensions = append(h.Extensions, RTPExtension{ID: id, Data: body[i : i+l]})
+			i += l
+		}
+
+	case h.ExtensionProfile&0xFFF0 == rtpTwoByteExtensionProfile:
+		for i := 0; i < len(body); {
+			id := body[i]
+			if id == 0 {
+				i++
+				continue
+			}
+			if i+2 > len(body) {
+				return errors.New("rtp two-byte extension overruns body")
+			}
+			l := int(body[i+1])
+			i += 2
+			if i+l > len(body) {
+				return errors.New("rtp two-byte extension overruns body")
+			}
+			h.Extensions = append(h.Extensions, RTPExtension{ID: id, Data: body[i : i+l]})
+			i += l
+		}
+
+	default:
+		if len(body) > 0 {
+			h.Extensions = append(h.Extensions, RTPExtension{Data: body})
+		}
+	}
+
+	return nil
+}
+
+// isRTPSizeMode reports whether an encryption mode is one of the rtpsize
+// modes, which leave the extension header in the clear but encrypt its body.
+func isRTPSizeMode(mode string) bool {
+	return mode == "aead_aes256_gcm_rtpsize" || mode == "aead_xchacha20_poly1305_rtpsize"
+}
+
+// splitRTPPacket parses the header of a received datagram into h and splits
+// it into the part which is sent in the clear and the encrypted part. In
+// rtpsize modes the clear part includes the extension header, otherwise
+// only the fixed header and CSRC list.
+func splitRTPPacket(h *RTPHeader, mode string, b []byte) (clear, encrypted []byte, err error) {
+	n, err := h.Unmarshal(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if h.Extension && !isRTPSizeMode(mode) {
+		n -= 4
+	}
+
+	return b[:n], b[n:], nil
+}
+
+// rtpPayload extracts the payload from decrypted packet data, parsing the
+// extension body and removing padding. When extHeader is true the extension
+// header was encrypted as well and precedes the body.
+func (h *RTPHeader) rtpPayload(plaintext []byte, extHeader bool) ([]byte, error) {
+	if h.Extension {
+		if extHeader {
+			if len(plaintext) < 4 {
+				return nil, errors.New("rtp payload too small for extension header")
+			}
+			h.ExtensionProfile = binary.BigEndian.Uint16(plaintext)
+			h.ExtensionLength = binary.BigEndian.Uint16(plaintext[2:])
+			plaintext = plaintext[4:]
+		}
+
+		l := int(h.ExtensionLength) * 4
+		if len(plaintext) < l {
+			return nil, errors.New("rtp payload too small for extension body")
+		}
+		if err := h.ParseExtensionBody(plaintext[:l]); err != nil {
+			return nil, err
+		}
+		plaintext = plaintext[l:]
+	}
+
+	if h.Padding {
+		if len(plaintext) == 0 {
+			return nil, errors.New("rtp padding on empty payload")
+		}
+		p := int(plaintext[len(plaintext)-1])
+		if p == 0 || p > len(plaintext) {
+			return nil, fmt.Errorf("invalid rtp padding length %d", p)
+		}
+		plaintext = plaintext[:len(plaintext)-p]
+	}
+
+	return plaintext, nil
+}
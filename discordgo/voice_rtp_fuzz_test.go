@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package discordgo
+
+import "testing"
+
+// FuzzParseAudioPacket checks that no datagram makes the receive path panic.
+// It is kept in a file of its own as testing.F needs Go 1.18, and the module
+// supports older versions.
+func FuzzParseAudioPacket(f *testing.F) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	v := &VoiceConnection{op4: voiceOP4{SecretKey: key}}
+	header := []byte{0x90, 0x78, 0x00, 0x07, 0x00, 0x00, 0x03, 0xC0, 0x00, 0x00, 0x00, 0x2A, 0xBE, 0xDE, 0x00, 0x01}
+	packet, _ := v.encryptAudioPacket("aead_aes256_gcm_rtpsize", header, []byte{0x10, 0xFF, 0x00, 0x00, 'o', 'p', 'u', 's'}, key)
+
+	f.Add(packet)
+	f.Add([]byte{0x80, 0x78, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	f.Add([]byte{0xBF, 0xF8, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x10, 0x00, 0xFF, 0xFF})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, mode := range preferredEncryptionModes {
+			v.parseAudioPacket(mode, b)
+		}
+
+		h, n, err := ParseRTPHeader(b)
+		if err != nil {
+			return
+		}
+		if n > len(b) {
+			t.Fatalf("header length %d exceeds packet length %d", n, len(b))
+		}
+		h.rtpPayload(b[n:], false)
+		h.rtpPayload(b[n:], true)
+	})
+}
@@ -0,0 +1,141 @@
+package discordgo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseRTPHeader(t *testing.T) {
+	packet := []byte{
+		0xB2, 0xF8, 0x01, 0x02, // V=2 P=1 X=1 CC=2, M=1 PT=120, sequence
+		0x00, 0x00, 0x03, 0xC0, // timestamp
+		0x00, 0x00, 0x00, 0x2A, // ssrc
+		0x00, 0x00, 0x00, 0x01, // csrc 1
+		0x00, 0x00, 0x00, 0x02, // csrc 2
+		0xBE, 0xDE, 0x00, 0x02, // one-byte extension profile, 2 words
+		0x11, 0xAA, 0xBB, 0x00, // id 1 len 2, padding
+		0x20, 0xCC, 0x00, 0x00, // id 2 len 1, padding
+	}
+
+	h, n, err := ParseRTPHeader(packet)
+	if err != nil {
+		t.Fatalf("ParseRTPHeader returned error: %v", err)
+	}
+	if n != 24 {
+		t.Errorf("header length incorrect: got %d, want 24", n)
+	}
+	if !h.Padding || !h.Marker || h.PayloadType != 120 || h.Sequence != 0x0102 || h.Timestamp != 960 || h.SSRC != 42 {
+		t.Errorf("fixed header incorrect: %+v", h)
+	}
+	if len(h.CSRC) != 2 || h.CSRC[0] != 1 || h.CSRC[1] != 2 {
+		t.Errorf("csrc list incorrect: %v", h.CSRC)
+	}
+	if !h.Extension || h.ExtensionProfile != 0xBEDE || h.ExtensionLength != 2 {
+		t.Errorf("extension header incorrect: %+v", h)
+	}
+
+	if err := h.ParseExtensionBody(packet[n:]); err != nil {
+		t.Fatalf("ParseExtensionBody returned error: %v", err)
+	}
+	if len(h.Extensions) != 2 ||
+		h.Extensions[0].ID != 1 || !bytes.Equal(h.Extensions[0].Data, []byte{0xAA, 0xBB}) ||
+		h.Extensions[1].ID != 2 || !bytes.Equal(h.Extensions[1].Data, []byte{0xCC}) {
+		t.Errorf("extensions incorrect: %+v", h.Extensions)
+	}
+}
+
+func TestRTPHeaderAppend(t *testing.T) {
+	h := &RTPHeader{Marker: true, PayloadType: 111, Sequence: 0xFFFF, Timestamp: 960, SSRC: 42, CSRC: []uint32{7}}
+	b := h.Append([]byte{0xAA})
+	want := []byte{
+		0xAA,
+		0x81, 0xEF, 0xFF, 0xFF, // V=2 CC=1, M=1 PT=111, sequence
+		0x00, 0x00, 0x03, 0xC0, // timestamp
+		0x00, 0x00, 0x00, 0x2A, // ssrc
+		0x00, 0x00, 0x00, 0x07, // csrc
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("header incorrect: got % x, want % x", b, want)
+	}
+
+	got, n, err := ParseRTPHeader(b[1:])
+	if err != nil {
+		t.Fatalf("ParseRTPHeader returned error: %v", err)
+	}
+	if n != 16 || !got.Marker || got.PayloadType != 111 || got.Sequence != 0xFFFF || got.Timestamp != 960 || got.SSRC != 42 || got.CSRC[0] != 7 {
+		t.Errorf("parsed header incorrect: %+v", got)
+	}
+}
+
+func TestParseExtensionBodyTwoByte(t *testing.T) {
+	h := &RTPHeader{Extension: true, ExtensionProfile: 0x1000, ExtensionLength: 2}
+	body := []byte{0x05, 0x03, 0x01, 0x02, 0x03, 0x00, 0x06, 0x00}
+
+	if err := h.ParseExtensionBody(body); err != nil {
+		t.Fatalf("ParseExtensionBody returned error: %v", err)
+	}
+	if len(h.Extensions) != 2 ||
+		h.Extensions[0].ID != 5 || !bytes.Equal(h.Extensions[0].Data, []byte{1, 2, 3}) ||
+		h.Extensions[1].ID != 6 || len(h.Extensions[1].Data) != 0 {
+		t.Errorf("extensions incorrect: %+v", h.Extensions)
+	}
+
+	h.ExtensionLength = 1
+	if err := h.ParseExtensionBody([]byte{0x05, 0x09, 0x01, 0x02}); err == nil {
+		t.Error("ParseExtensionBody of overrunning element returned nil error")
+	}
+}
+
+func TestParseAudioPacket(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	extBody := []byte{0x10, 0xFF, 0x00, 0x00}
+	opus := []byte("opus payload")
+
+	for _, mode := range preferredEncryptionModes {
+		v := &VoiceConnection{op4: voiceOP4{SecretKey: key}}
+
+		// An rtpsize packet leaves the extension header in the clear, the
+		// legacy modes only leave the fixed header in the clear.
+		header := []byte{0xB0, 0x78, 0x00, 0x07, 0x00, 0x00, 0x03, 0xC0, 0x00, 0x00, 0x00, 0x2A}
+		extHeader := []byte{0xBE, 0xDE, 0x00, 0x01}
+		padded := append(append([]byte{}, opus...), 0x00, 0x00, 0x03)
+
+		var plaintext []byte
+		if isRTPSizeMode(mode) {
+			header = append(header, extHeader...)
+		} else {
+			plaintext = append(plaintext, extHeader...)
+		}
+		plaintext = append(append(plaintext, extBody...), padded...)
+
+		packet, err := v.encryptAudioPacket(mode, header, plaintext, key)
+		if err != nil {
+			t.Fatalf("encryptAudioPacket(%s) returned error: %v", mode, err)
+		}
+
+		p, err := v.parseAudioPacket(mode, packet)
+		if err != nil {
+			t.Fatalf("parseAudioPacket(%s) returned error: %v", mode, err)
+		}
+		if !bytes.Equal(p.Opus, opus) {
+			t.Errorf("parseAudioPacket(%s) opus incorrect: got %q, want %q", mode, p.Opus, opus)
+		}
+		if p.SSRC != 42 || p.Sequence != 7 || p.Timestamp != 960 {
+			t.Errorf("parseAudioPacket(%s) header incorrect: %+v", mode, p)
+		}
+		if len(p.Extensions) != 1 || p.Extensions[0].ID != 1 || !bytes.Equal(p.Extensions[0].Data, []byte{0xFF}) {
+			t.Errorf("parseAudioPacket(%s) extensions incorrect: %+v", mode, p.Extensions)
+		}
+	}
+}
+
+func TestIsRTCPPacket(t *testing.T) {
+	if !isRTCPPacket([]byte{0x80, 200}) || !isRTCPPacket([]byte{0x81, 201}) {
+		t.Error("isRTCPPacket did not detect sender or receiver report")
+	}
+	if isRTCPPacket([]byte{0x80, 0x78}) || isRTCPPacket([]byte{0x90, 0xF8}) {
+		t.Error("isRTCPPacket detected an audio packet")
+	}
+}
@@ -0,0 +1,210 @@
+package discordgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo/discordtest"
+)
+
+// connectTestVoice opens a voice connection to srv and waits until it is
+// ready to send audio.
+func connectTestVoice(t *testing.T, srv *discordtest.VoiceServer) *VoiceConnection {
+	t.Helper()
+
+	s := &Session{
+		Dialer:                 srv.Dialer(),
+		VoiceEndpointAllowlist: []string{"127.0.0.1"},
+		VoiceConnections:       map[string]*VoiceConnection{},
+	}
+	v := &VoiceConnection{session: s, sessionID: "session", UserID: "100", GuildID: "200"}
+	s.VoiceConnections[v.GuildID] = v
+
+	s.onVoiceServerUpdate(&VoiceServerUpdate{Token: "token", GuildID: v.GuildID, Endpoint: srv.Endpoint()})
+	waitTestVoice(t, v)
+	return v
+}
+
+// waitTestVoice waits until v is ready and has received its secret key.
+func waitTestVoice(t *testing.T, v *VoiceConnection) {
+	t.Helper()
+
+	for i := 0; i < 500; i++ {
+		v.RLock()
+		ready := v.Ready && v.op4.Mode != ""
+		v.RUnlock()
+		if ready {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("voice connection did not become ready")
+}
+
+// expectVoiceOp returns the next message of type op received by srv.
+func expectVoiceOp(t *testing.T, srv *discordtest.VoiceServer, op int) json.RawMessage {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-srv.Ops:
+			if m.Op == op {
+				return m.Data
+			}
+		case <-timeout:
+			t.Fatalf("voice server did not receive op %d", op)
+		}
+	}
+}
+
+// testVoiceRoundTrip sends a frame in each direction over v.
+func testVoiceRoundTrip(t *testing.T, srv *discordtest.VoiceServer, v *VoiceConnection) {
+	t.Helper()
+
+	if err := v.SendOpus([]byte("to server"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("SendOpus returned error: %v", err)
+	}
+	select {
+	case p := <-srv.Audio:
+		if p.SSRC != srv.SSRC || string(p.Opus) != "to server" {
+			t.Errorf("server received incorrect packet: %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not receive audio")
+	}
+
+	err := srv.SendAudio(discordtest.VoicePacket{SSRC: 77, Sequence: 9, Timestamp: 960, Opus: []byte("to client")})
+	if err != nil {
+		t.Fatalf("SendAudio returned error: %v", err)
+	}
+	select {
+	case p := <-v.OpusRecv:
+		if p.SSRC != 77 || p.Sequence != 9 || !bytes.Equal(p.Opus, []byte("to client")) {
+			t.Errorf("client received incorrect packet: %+v", p)
+		}
+		p.Release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not receive audio")
+	}
+}
+
+func TestVoiceConnectionJoin(t *testing.T) {
+	srv, err := discordtest.NewVoiceServer()
+	if err != nil {
+		t.Fatalf("NewVoiceServer returned error: %v", err)
+	}
+	defer srv.Close()
+
+	v := connectTestVoice(t, srv)
+	defer v.Close()
+
+	var identify struct {
+		ServerID  string `json:"server_id"`
+		UserID    string `json:"user_id"`
+		SessionID string `json:"session_id"`
+		Token     string `json:"token"`
+	}
+	json.Unmarshal(expectVoiceOp(t, srv, discordtest.VoiceOpIdentify), &identify)
+	if identify.ServerID != "200" || identify.UserID != "100" || identify.SessionID != "session" || identify.Token != "token" {
+		t.Errorf("identify incorrect: %+v", identify)
+	}
+
+	var sp struct {
+		Protocol string `json:"protocol"`
+		Data     struct {
+			Address string `json:"address"`
+			Port    int    `json:"port"`
+			Mode    string `json:"mode"`
+		} `json:"data"`
+	}
+	json.Unmarshal(expectVoiceOp(t, srv, discordtest.VoiceOpSelectProtocol), &sp)
+	if sp.Protocol != "udp" || sp.Data.Address != "127.0.0.1" || sp.Data.Port == 0 || sp.Data.Mode != "aead_aes256_gcm_rtpsize" {
+		t.Errorf("select protocol incorrect: %+v", sp)
+	}
+
+	speaking := make(chan *VoiceSpeakingUpdate, 1)
+	v.AddHandler(func(vc *VoiceConnection, vs *VoiceSpeakingUpdate) {
+		speaking <- vs
+	})
+	srv.SendSpeaking("300", 77, 1)
+	select {
+	case vs := <-speaking:
+		if vs.UserID != "300" || vs.SSRC != 77 || !vs.Speaking {
+			t.Errorf("speaking update incorrect: %+v", vs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("speaking update not received")
+	}
+
+	testVoiceRoundTrip(t, srv, v)
+	expectVoiceOp(t, srv, discordtest.VoiceOpSpeaking)
+}
+
+func TestVoiceConnectionEncryptionModes(t *testing.T) {
+	for _, mode := range discordtest.VoiceModes {
+		srv, err := discordtest.NewVoiceServer()
+		if err != nil {
+			t.Fatalf("NewVoiceServer returned error: %v", err)
+		}
+		srv.Modes = []string{"xsalsa20_poly1305", mode}
+
+		v := connectTestVoice(t, srv)
+		if srv.Mode() != mode || v.encryptionMode != mode {
+			t.Errorf("negotiated mode incorrect: server %s, client %s, want %s", srv.Mode(), v.encryptionMode, mode)
+		}
+		testVoiceRoundTrip(t, srv, v)
+
+		v.Close()
+		srv.Close()
+	}
+}
+
+func TestVoiceConnectionServerChange(t *testing.T) {
+	srv, err := discordtest.NewVoiceServer()
+	if err != nil {
+		t.Fatalf("NewVoiceServer returned error: %v", err)
+	}
+	defer srv.Close()
+
+	v := connectTestVoice(t, srv)
+	defer v.Close()
+
+	// A Voice Server Update while connected moves the connection.
+	v.session.onVoiceServerUpdate(&VoiceServerUpdate{Token: "token2", GuildID: v.GuildID, Endpoint: srv.Endpoint()})
+	waitTestVoice(t, v)
+
+	if srv.Sessions() != 2 {
+		t.Errorf("server sessions incorrect: got %d, want 2", srv.Sessions())
+	}
+	testVoiceRoundTrip(t, srv, v)
+}
+
+func TestValidVoiceEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		allowed  []string
+		want     bool
+	}{
+		{"c-ams01.discord.media:443", VoiceEndpointDomains, true},
+		{"discord.media.example.com", VoiceEndpointDomains, false},
+		{"127.0.0.1:8443", VoiceEndpointDomains, false},
+		{"127.0.0.1:8443", []string{"127.0.0.1"}, true},
+		{"127.0.0.10:8443", []string{"127.0.0.1"}, false},
+		{"voice.example.com", []string{".example.com"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := validVoiceEndpoint(tt.endpoint, tt.allowed); got != tt.want {
+			t.Errorf("validVoiceEndpoint(%s, %v) incorrect: got %t, want %t", tt.endpoint, tt.allowed, got, tt.want)
+		}
+	}
+
+	s := &Session{VoiceConnections: map[string]*VoiceConnection{}}
+	v := &VoiceConnection{session: s, sessionID: "session", endpoint: "127.0.0.1:1"}
+	if err := v.open(); err == nil {
+		t.Error("open with disallowed endpoint returned nil error")
+	}
+}
@@ -0,0 +1,389 @@
+package discordgo
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectEncryptionMode(t *testing.T) {
+	tests := []struct {
+		modes []string
+		want  string
+	}{
+		{[]string{"xsalsa20_poly1305", "aead_xchacha20_poly1305_rtpsize", "aead_aes256_gcm_rtpsize"}, "aead_aes256_gcm_rtpsize"},
+		{[]string{"xsalsa20_poly1305", "aead_xchacha20_poly1305_rtpsize"}, "aead_xchacha20_poly1305_rtpsize"},
+		{[]string{"xsalsa20_poly1305", "xsalsa20_poly1305_suffix", "xsalsa20_poly1305_lite"}, "xsalsa20_poly1305_lite"},
+		{[]string{"xsalsa20_poly1305"}, "xsalsa20_poly1305"},
+	}
+
+	for _, tt := range tests {
+		v := &VoiceConnection{op2: voiceOP2{Modes: tt.modes}}
+		mode, err := v.selectEncryptionMode()
+		if err != nil {
+			t.Errorf("selectEncryptionMode(%v) returned error: %v", tt.modes, err)
+		}
+		if mode != tt.want {
+			t.Errorf("selectEncryptionMode(%v) incorrect: got %s, want %s", tt.modes, mode, tt.want)
+		}
+	}
+
+	v := &VoiceConnection{}
+	if _, err := v.selectEncryptionMode(); err == nil {
+		t.Error("selectEncryptionMode with no modes returned nil error")
+	}
+	v.op2.Modes = []string{"some_future_mode", "other_mode"}
+	if _, err := v.selectEncryptionMode(); err == nil || !strings.Contains(err.Error(), "some_future_mode, other_mode") {
+		t.Errorf("selectEncryptionMode with unsupported modes error incorrect: got %v", err)
+	}
+}
+
+func TestAudioPacketRoundTrip(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	header := []byte{0x80, 0x78, 0x00, 0x01, 0x00, 0x00, 0x03, 0xC0, 0x00, 0x00, 0x00, 0x2A}
+	payload := []byte("opus payload")
+
+	for _, mode := range preferredEncryptionModes {
+		v := &VoiceConnection{op4: voiceOP4{SecretKey: key}}
+
+		for i := 0; i < 3; i++ {
+			packet, err := v.encryptAudioPacket(mode, header, payload, key)
+			if err != nil {
+				t.Fatalf("encryptAudioPacket(%s) returned error: %v", mode, err)
+			}
+			if !bytes.Equal(packet[:len(header)], header) {
+				t.Errorf("encryptAudioPacket(%s) header incorrect: got %x", mode, packet[:len(header)])
+			}
+
+			opus, err := v.decryptAudioPacket(mode, header, packet[len(header):])
+			if err != nil {
+				t.Fatalf("decryptAudioPacket(%s) returned error: %v", mode, err)
+			}
+			if !bytes.Equal(opus, payload) {
+				t.Errorf("decryptAudioPacket(%s) incorrect: got %q, want %q", mode, opus, payload)
+			}
+
+			packet[len(header)] ^= 0xFF
+			if _, err := v.decryptAudioPacket(mode, header, packet[len(header):]); err == nil {
+				t.Errorf("decryptAudioPacket(%s) of tampered packet returned nil error", mode)
+			}
+		}
+	}
+}
+
+func TestAudioPacketAllocs(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	const mode = "aead_aes256_gcm_rtpsize"
+	header := []byte{0x80, 0x78, 0x00, 0x01, 0x00, 0x00, 0x03, 0xC0, 0x00, 0x00, 0x00, 0x2A}
+	frame := make([]byte, 120)
+
+	var audio audioCipher
+	if err := audio.setup(mode, &key); err != nil {
+		t.Fatalf("setup returned error: %v", err)
+	}
+	sendbuf := make([]byte, 0, maxUDPPacketSize)
+	p := getPacket()
+	defer p.Release()
+
+	var counter uint32
+	allocs := testing.AllocsPerRun(100, func() {
+		counter++
+		sendbuf, _ = audio.seal(sendbuf[:0], counter, header, frame)
+		if err := audio.setup(mode, &key); err != nil {
+			t.Fatalf("setup returned error: %v", err)
+		}
+		if err := p.unmarshal(&audio, sendbuf); err != nil {
+			t.Fatalf("unmarshal returned error: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("allocations per packet incorrect: got %v, want 0", allocs)
+	}
+}
+
+func BenchmarkAudioSend(b *testing.B) {
+	var key [32]byte
+	header := []byte{0x80, 0x78, 0x00, 0x01, 0x00, 0x00, 0x03, 0xC0, 0x00, 0x00, 0x00, 0x2A}
+	frame := make([]byte, 120)
+
+	for _, mode := range preferredEncryptionModes {
+		b.Run(mode, func(b *testing.B) {
+			var audio audioCipher
+			sendbuf := make([]byte, 0, maxUDPPacketSize)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				audio.setup(mode, &key)
+				sendbuf, _ = audio.seal(sendbuf[:0], uint32(i), header, frame)
+			}
+		})
+	}
+}
+
+func BenchmarkAudioReceive(b *testing.B) {
+	var key [32]byte
+	header := []byte{0x80, 0x78, 0x00, 0x01, 0x00, 0x00, 0x03, 0xC0, 0x00, 0x00, 0x00, 0x2A}
+	frame := make([]byte, 120)
+
+	for _, mode := range preferredEncryptionModes {
+		b.Run(mode, func(b *testing.B) {
+			var audio audioCipher
+			audio.setup(mode, &key)
+			packet, _ := audio.seal(nil, 1, header, frame)
+			p := getPacket()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				audio.setup(mode, &key)
+				if err := p.unmarshal(&audio, packet); err != nil {
+					b.Fatal(err)
+				}
+			}
+			p.Release()
+		})
+	}
+}
+
+func TestQueuePacket(t *testing.T) {
+	tests := []struct {
+		policy  RecvOverflowPolicy
+		want    []uint16
+		dropped uint64
+	}{
+		{RecvOverflowDropNewest, []uint16{1, 2}, 2},
+		{RecvOverflowDropOldest, []uint16{3, 4}, 2},
+	}
+
+	for _, tt := range tests {
+		v := &VoiceConnection{}
+		c := make(chan *Packet, 2)
+		for seq := uint16(1); seq <= 4; seq++ {
+			if _, ok := v.queuePacket(c, &Packet{Sequence: seq}, tt.policy, nil); !ok {
+				t.Fatalf("queuePacket(%d) returned false", tt.policy)
+			}
+		}
+
+		var got []uint16
+		for len(c) > 0 {
+			got = append(got, (<-c).Sequence)
+		}
+		if len(got) != len(tt.want) || got[0] != tt.want[0] || got[1] != tt.want[1] {
+			t.Errorf("queuePacket(%d) queued %v, want %v", tt.policy, got, tt.want)
+		}
+		if v.DroppedPackets() != tt.dropped {
+			t.Errorf("DroppedPackets(%d) incorrect: got %d, want %d", tt.policy, v.DroppedPackets(), tt.dropped)
+		}
+	}
+
+	v := &VoiceConnection{}
+	done := make(chan struct{})
+	c := make(chan *Packet)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+	}()
+	if _, ok := v.queuePacket(c, &Packet{}, RecvOverflowBlock, done); ok {
+		t.Error("blocked queuePacket returned true after close")
+	}
+	if v.DroppedPackets() != 0 {
+		t.Errorf("blocking policy dropped %d packets", v.DroppedPackets())
+	}
+}
+
+func TestOnPacket(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP returned error: %v", err)
+	}
+	defer conn.Close()
+
+	const mode = "aead_aes256_gcm_rtpsize"
+	v := &VoiceConnection{encryptionMode: mode, op4: voiceOP4{SecretKey: key}}
+	received := make(chan *Packet, 1)
+	v.OnPacket(func(p *Packet) {
+		received <- p
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go v.opusReceiver(conn, done, nil, RecvOverflowBlock)
+
+	header := []byte{0x80, 0x78, 0x00, 0x05, 0x00, 0x00, 0x03, 0xC0, 0x00, 0x00, 0x00, 0x2A}
+	packet, err := v.encryptAudioPacket(mode, header, []byte("opus"), key)
+	if err != nil {
+		t.Fatalf("encryptAudioPacket returned error: %v", err)
+	}
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP returned error: %v", err)
+	}
+	defer sender.Close()
+	sender.Write(packet)
+
+	select {
+	case p := <-received:
+		if p.SSRC != 42 || p.Sequence != 5 || string(p.Opus) != "opus" {
+			t.Errorf("OnPacket packet incorrect: %+v", p)
+		}
+		p.Release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnPacket function was not called")
+	}
+}
+
+func TestSendOpus(t *testing.T) {
+	v := &VoiceConnection{}
+	if err := v.SendOpus([]byte{1}, time.Time{}); err != ErrVoiceNotReady {
+		t.Errorf("SendOpus without OpusSend incorrect: got %v, want %v", err, ErrVoiceNotReady)
+	}
+
+	v.OpusSend = make(chan []byte, 2)
+	for i := 0; i < 2; i++ {
+		if err := v.SendOpus([]byte{1}, time.Time{}); err != nil {
+			t.Fatalf("SendOpus returned error: %v", err)
+		}
+	}
+	if err := v.SendOpus([]byte{1}, time.Time{}); err != ErrVoiceSendQueueFull {
+		t.Errorf("SendOpus on full queue incorrect: got %v, want %v", err, ErrVoiceSendQueueFull)
+	}
+
+	start := time.Now()
+	if err := v.SendOpus([]byte{1}, start.Add(20*time.Millisecond)); err != ErrVoiceSendQueueFull {
+		t.Errorf("SendOpus with deadline incorrect: got %v, want %v", err, ErrVoiceSendQueueFull)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("SendOpus returned before its deadline")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-v.OpusSend
+	}()
+	if err := v.SendOpus([]byte{2}, time.Now().Add(5*time.Second)); err != nil {
+		t.Errorf("SendOpus with deadline returned error once queue drained: %v", err)
+	}
+
+	st := v.SendStats()
+	if st.Queued != 2 || st.Capacity != 2 || st.Rejected != 2 || !st.LastSent.IsZero() {
+		t.Errorf("SendStats incorrect: %+v", st)
+	}
+}
+
+func TestOpusSenderStats(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP returned error: %v", err)
+	}
+	defer conn.Close()
+
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP returned error: %v", err)
+	}
+	defer sender.Close()
+
+	v := &VoiceConnection{encryptionMode: "aead_aes256_gcm_rtpsize", speaking: true}
+	v.OpusSend = make(chan []byte, 3)
+	for i := 0; i < 3; i++ {
+		v.SendOpus([]byte("opus"), time.Time{})
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go v.opusSender(sender, done, v.OpusSend, 48000, 960)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxUDPPacketSize)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("reading packet %d returned error: %v", i, err)
+		}
+	}
+
+	// The counter is updated just after the write.
+	for i := 0; i < 100 && v.SendStats().Sent < 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if st := v.SendStats(); st.Sent != 3 || st.Queued != 0 || time.Since(st.LastSent) > time.Second {
+		t.Errorf("SendStats incorrect: %+v", st)
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   int
+	}{
+		{[]byte{0xF8, 0xFF, 0xFE}, 960}, // CELT FB 20ms
+		{[]byte{0xF0}, 480},             // CELT FB 10ms
+		{[]byte{0x79}, 1920},            // Hybrid FB 20ms, two frames
+		{[]byte{0x1B, 0x02}, 5760},      // SILK NB 60ms, two frames
+		{[]byte{0xFB, 0x07}, 0},         // over 120ms
+		{[]byte{0xFB}, 0},               // missing frame count
+		{nil, 0},
+	}
+
+	for _, tt := range tests {
+		if got := opusPacketSamples(tt.packet, 48000); got != tt.want {
+			t.Errorf("opusPacketSamples(%x) incorrect: got %d, want %d", tt.packet, got, tt.want)
+		}
+	}
+}
+
+func TestOpusSenderDurations(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP returned error: %v", err)
+	}
+	defer conn.Close()
+
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP returned error: %v", err)
+	}
+	defer sender.Close()
+
+	// 40ms, 10ms, 20ms and an unparsable packet, which takes the
+	// sender's frame size.
+	packets := [][]byte{{0xFB, 0x02, 0xFF}, {0xF0, 0xFF}, {0xF8, 0xFF, 0xFE}, {}, {0xF8, 0xFF, 0xFE}}
+	want := []uint32{0, 1920, 2400, 3360, 4320}
+
+	v := &VoiceConnection{encryptionMode: "aead_aes256_gcm_rtpsize", speaking: true}
+	v.OpusSend = make(chan []byte, len(packets))
+	for _, p := range packets {
+		v.OpusSend <- p
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	start := time.Now()
+	go v.opusSender(sender, done, v.OpusSend, 48000, 960)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxUDPPacketSize)
+	for i, w := range want {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading packet %d returned error: %v", i, err)
+		}
+		var h RTPHeader
+		if _, err := h.Unmarshal(buf[:n]); err != nil {
+			t.Fatalf("parsing packet %d returned error: %v", i, err)
+		}
+		if h.Timestamp != w {
+			t.Errorf("packet %d timestamp incorrect: got %d, want %d", i, h.Timestamp, w)
+		}
+	}
+
+	// The last packet is sent after the first four, 90ms.
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("packets sent too fast: %v", d)
+	}
+}
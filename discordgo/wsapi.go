@@ -115,6 +115,7 @@ func (s *Session) Open() error {
 	}
 	s.log(LogInformational, "Op 10 Hello Packet received from Discord")
 	s.LastHeartbeatAck = time.Now().UTC()
+	atomic.StoreInt64(&s.heartbeatAck, s.LastHeartbeatAck.UnixNano())
 	var h helloOp
 	if err = json.Unmarshal(e.RawData, &h); err != nil {
 		err = fmt.Errorf("error unmarshalling helloOp, %s", err)
@@ -266,12 +267,33 @@ type helloOp struct {
 const FailedHeartbeatAcks time.Duration = 5 * time.Millisecond
 
 // HeartbeatLatency returns the latency between heartbeat acknowledgement and heartbeat send.
+// It does not wait for the session lock, which Open holds while connecting.
 func (s *Session) HeartbeatLatency() time.Duration {
 
-	return s.LastHeartbeatAck.Sub(s.LastHeartbeatSent)
+	return time.Duration(atomic.LoadInt64(&s.heartbeatAck) - atomic.LoadInt64(&s.heartbeatSent))
 
 }
 
+// HeartbeatAck returns the time the last heartbeat acknowledgement was
+// received, like LastHeartbeatAck but without waiting for the session lock.
+func (s *Session) HeartbeatAck() time.Time {
+	return unixTime(atomic.LoadInt64(&s.heartbeatAck))
+}
+
+// GatewayReady reports whether the gateway connection is ready, like
+// DataReady but without waiting for the session lock.
+func (s *Session) GatewayReady() bool {
+	return atomic.LoadInt32(&s.dataReady) != 0
+}
+
+// unixTime returns the time of Unix nanoseconds ns, or the zero time for 0.
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
 // heartbeat sends regular heartbeats to Discord so it knows the client
 // is still connected.  If you do not send these heartbeats Discord will
 // disconnect the websocket connection after a few seconds.
@@ -293,11 +315,23 @@ func (s *Session) heartbeat(wsConn *websocket.Conn, listening <-chan interface{}
 		s.RUnlock()
 		sequence := atomic.LoadInt64(s.sequence)
 		s.log(LogDebug, "sending gateway websocket heartbeat seq %d", sequence)
-		s.wsMutex.Lock()
+		s.Lock()
 		s.LastHeartbeatSent = time.Now().UTC()
+		atomic.StoreInt64(&s.heartbeatSent, s.LastHeartbeatSent.UnixNano())
+		s.Unlock()
+		s.wsMutex.Lock()
 		err = wsConn.WriteJSON(heartbeatOp{1, sequence})
 		s.wsMutex.Unlock()
 		if err != nil || time.Now().UTC().Sub(last) > (heartbeatIntervalMsec*FailedHeartbeatAcks) {
+			// As in listen, a connection which has already been replaced,
+			// e.g. after an Op 7 Reconnect, must not close its successor.
+			s.RLock()
+			sameConnection := s.wsConn == wsConn
+			s.RUnlock()
+			if !sameConnection {
+				return
+			}
+
 			if err != nil {
 				s.log(LogError, "error sending heartbeat to gateway %s, %s", s.gateway, err)
 			} else {
@@ -309,6 +343,7 @@ func (s *Session) heartbeat(wsConn *websocket.Conn, listening <-chan interface{}
 		}
 		s.Lock()
 		s.DataReady = true
+		atomic.StoreInt32(&s.dataReady, 1)
 		s.Unlock()
 
 		select {
@@ -636,6 +671,7 @@ func (s *Session) onEvent(messageType int, message []byte) (*Event, error) {
 	if e.Operation == 11 {
 		s.Lock()
 		s.LastHeartbeatAck = time.Now().UTC()
+		atomic.StoreInt64(&s.heartbeatAck, s.LastHeartbeatAck.UnixNano())
 		s.Unlock()
 		s.log(LogDebug, "got heartbeat ACK")
 		return e, nil
@@ -695,13 +731,41 @@ type voiceChannelJoinOp struct {
 	Data voiceChannelJoinData `json:"d"`
 }
 
+// VoiceOption is a function which configures a voice connection before it
+// connects. It can be supplied as an argument to ChannelVoiceJoin.
+type VoiceOption func(v *VoiceConnection)
+
+// WithOpusSendDepth sets the capacity of the OpusSend channel.
+func WithOpusSendDepth(depth int) VoiceOption {
+	return func(v *VoiceConnection) {
+		v.OpusSendDepth = depth
+	}
+}
+
+// WithOpusRecv sets the capacity of the OpusRecv channel and what to do with
+// received packets once it is full.
+func WithOpusRecv(depth int, policy RecvOverflowPolicy) VoiceOption {
+	return func(v *VoiceConnection) {
+		v.OpusRecvDepth = depth
+		v.OpusRecvPolicy = policy
+	}
+}
+
+// WithRTCPReportInterval sets how often RTCP receiver reports are sent.
+func WithRTCPReportInterval(interval time.Duration) VoiceOption {
+	return func(v *VoiceConnection) {
+		v.RTCPReportInterval = interval
+	}
+}
+
 // ChannelVoiceJoin joins the session user to a voice channel.
 //
 //	gID     : Guild ID of the channel to join.
 //	cID     : Channel ID of the channel to join.
 //	mute    : If true, you will be set to muted upon joining.
 //	deaf    : If true, you will be set to deafened upon joining.
-func (s *Session) ChannelVoiceJoin(gID, cID string, mute, deaf bool) (voice *VoiceConnection, err error) {
+//	options : Configure the connection, see VoiceOption.
+func (s *Session) ChannelVoiceJoin(gID, cID string, mute, deaf bool, options ...VoiceOption) (voice *VoiceConnection, err error) {
 
 	s.log(LogInformational, "called")
 
@@ -722,6 +786,9 @@ func (s *Session) ChannelVoiceJoin(gID, cID string, mute, deaf bool) (voice *Voi
 	voice.deaf = deaf
 	voice.mute = mute
 	voice.session = s
+	for _, o := range options {
+		o(voice)
+	}
 	voice.Unlock()
 
 	err = s.ChannelVoiceJoinManual(gID, cID, mute, deaf)
@@ -875,6 +942,12 @@ func (s *Session) identify() error {
 	return err
 }
 
+// Reconnects returns the number of times the gateway connection was
+// reestablished after being lost.
+func (s *Session) Reconnects() uint64 {
+	return atomic.LoadUint64(&s.reconnects)
+}
+
 func (s *Session) reconnect() {
 
 	s.log(LogInformational, "called")
@@ -890,6 +963,7 @@ func (s *Session) reconnect() {
 
 			err = s.Open()
 			if err == nil {
+				atomic.AddUint64(&s.reconnects, 1)
 				s.log(LogInformational, "successfully reconnected to gateway")
 
 				// I'm not sure if this is actually needed.
@@ -946,6 +1020,7 @@ func (s *Session) CloseWithCode(closeCode int) (err error) {
 	s.Lock()
 
 	s.DataReady = false
+	atomic.StoreInt32(&s.dataReady, 0)
 
 	if s.listening != nil {
 		s.log(LogInformational, "closing listening channel")
@@ -0,0 +1,230 @@
+package discordgo
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo/discordtest"
+)
+
+// newTestServer starts a fake Discord server with a guild containing a text
+// and a voice channel.
+func newTestServer(t *testing.T) *discordtest.Server {
+	t.Helper()
+
+	srv, err := discordtest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer returned error: %v", err)
+	}
+	srv.Token = "Bot token"
+	srv.Guilds = []discordtest.Guild{{
+		ID:   "10",
+		Name: "guild",
+		Channels: []discordtest.Channel{
+			{ID: "11", Name: "general", Type: discordtest.ChannelTypeGuildText},
+			{ID: "12", Name: "General", Type: discordtest.ChannelTypeGuildVoice},
+		},
+	}}
+	return srv
+}
+
+// newTestSession returns a session which connects to srv.
+func newTestSession(t *testing.T, srv *discordtest.Server) *Session {
+	t.Helper()
+
+	s, err := New("Bot token")
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	s.Client = srv.Client()
+	s.Dialer = srv.Dialer()
+	s.VoiceEndpointAllowlist = []string{"127.0.0.1"}
+	return s
+}
+
+// expectGatewayOp returns the next message of type op received by srv.
+func expectGatewayOp(t *testing.T, srv *discordtest.Server, op int) json.RawMessage {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-srv.Ops:
+			if m.Op == op {
+				return m.Data
+			}
+		case <-timeout:
+			t.Fatalf("gateway did not receive op %d", op)
+		}
+	}
+}
+
+func TestSessionREST(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	s := newTestSession(t, srv)
+
+	gateway, err := s.Gateway()
+	if err != nil || gateway != srv.URL() {
+		t.Errorf("Gateway incorrect: got %s, %v, want %s", gateway, err, srv.URL())
+	}
+
+	c, err := s.Channel("12")
+	if err != nil || c.Name != "General" || c.Type != ChannelTypeGuildVoice || c.GuildID != "10" {
+		t.Errorf("Channel incorrect: got %+v, %v", c, err)
+	}
+
+	m, err := s.ChannelMessageSend("11", "hello")
+	if err != nil || m.Content != "hello" || m.ChannelID != "11" || m.Author.ID != srv.User.ID {
+		t.Errorf("ChannelMessageSend incorrect: got %+v, %v", m, err)
+	}
+
+	if _, err := s.Channel("99"); err == nil {
+		t.Error("Channel of unknown channel returned nil error")
+	} else if restErr, ok := err.(*RESTError); !ok || restErr.Response.StatusCode != 404 {
+		t.Errorf("Channel of unknown channel error incorrect: %v", err)
+	}
+}
+
+func TestSessionAutoJoinVoice(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	s := newTestSession(t, srv)
+
+	joined := make(chan *VoiceConnection, 1)
+	s.AddHandler(func(s *Session, g *GuildCreate) {
+		for _, c := range g.Channels {
+			if c.Type != ChannelTypeGuildVoice || c.Name != "General" {
+				continue
+			}
+			vc, err := s.ChannelVoiceJoin(g.ID, c.ID, false, true, WithOpusSendDepth(8))
+			if err != nil {
+				t.Errorf("ChannelVoiceJoin returned error: %v", err)
+				return
+			}
+			joined <- vc
+		}
+	})
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer s.Close()
+
+	var vc *VoiceConnection
+	select {
+	case vc = <-joined:
+	case <-time.After(15 * time.Second):
+		t.Fatal("voice channel was not joined")
+	}
+
+	vc.RLock()
+	sendDepth := cap(vc.OpusSend)
+	vc.RUnlock()
+	if vc.ChannelID != "12" || vc.UserID != srv.User.ID || sendDepth != 8 {
+		t.Errorf("voice connection incorrect: channel %s, user %s, send depth %d", vc.ChannelID, vc.UserID, sendDepth)
+	}
+	if err := vc.SendOpus([]byte("opus"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("SendOpus returned error: %v", err)
+	}
+	select {
+	case p := <-srv.Voice.Audio:
+		if string(p.Opus) != "opus" {
+			t.Errorf("voice server received %q, want opus", p.Opus)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("voice server did not receive audio")
+	}
+
+	vc.Disconnect()
+	var leave struct {
+		ChannelID *string `json:"channel_id"`
+	}
+	expectGatewayOp(t, srv, discordtest.GatewayOpVoiceStateUpdate)
+	json.Unmarshal(expectGatewayOp(t, srv, discordtest.GatewayOpVoiceStateUpdate), &leave)
+	if leave.ChannelID != nil {
+		t.Errorf("leave channel incorrect: got %s, want null", *leave.ChannelID)
+	}
+}
+
+func TestSessionReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	s := newTestSession(t, srv)
+
+	resumed := make(chan struct{}, 2)
+	s.AddHandler(func(s *Session, r *Resumed) {
+		resumed <- struct{}{}
+	})
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer s.Close()
+	expectGatewayOp(t, srv, discordtest.GatewayOpIdentify)
+
+	// Op 7 and dropped connections are resumed.
+	for _, disconnect := range []func(){
+		func() { srv.SendOp(discordtest.GatewayOpReconnect, nil) },
+		func() { srv.Disconnect(0) },
+	} {
+		disconnect()
+
+		var resume struct {
+			SessionID string `json:"session_id"`
+			Sequence  int64  `json:"seq"`
+		}
+		json.Unmarshal(expectGatewayOp(t, srv, discordtest.GatewayOpResume), &resume)
+		if resume.SessionID != srv.SessionID() || resume.Sequence == 0 {
+			t.Errorf("resume incorrect: %+v", resume)
+		}
+
+		select {
+		case <-resumed:
+		case <-time.After(10 * time.Second):
+			t.Fatal("session was not resumed")
+		}
+	}
+
+	// An invalid session starts a new one.
+	srv.SendOp(discordtest.GatewayOpInvalidSession, false)
+	var identify struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(expectGatewayOp(t, srv, discordtest.GatewayOpIdentify), &identify)
+	if identify.Token != "Bot token" {
+		t.Errorf("identify token incorrect: got %q", identify.Token)
+	}
+
+	if srv.Connections() != 3 {
+		t.Errorf("gateway connections incorrect: got %d, want 3", srv.Connections())
+	}
+}
+
+func TestSessionStatusUnlocked(t *testing.T) {
+	s, err := New("Bot token")
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	// Open holds the lock while connecting; the status must not wait for it.
+	s.Lock()
+	defer s.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.HeartbeatLatency()
+		if ack := s.HeartbeatAck(); !ack.Equal(s.LastHeartbeatAck) {
+			t.Errorf("HeartbeatAck incorrect: got %v, want %v", ack, s.LastHeartbeatAck)
+		}
+		if s.GatewayReady() {
+			t.Error("GatewayReady of closed session returned true")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("status waited for the session lock")
+	}
+}
@@ -0,0 +1,131 @@
+// Package guilds runs a bot's voice pipeline in several guilds at once.
+//
+// A Manager joins a voice channel in each configured guild as it becomes
+// available, running a pipeline of its own on each connection, and stops
+// each pipeline independently when its guild is deleted or its connection
+// is dropped. Guilds are configured by a Config each, on top of a default
+// Config taken from the environment.
+package guilds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Errors returned when joining guilds.
+var (
+	// ErrNoChannel is returned when a guild has no voice channel matching
+	// its Config.
+	ErrNoChannel = errors.New("voice channel not found")
+
+	// ErrMaxGuilds is returned when Manager.Max guilds are joined
+	// already.
+	ErrMaxGuilds = errors.New("too many guilds joined")
+)
+
+// A Config is the configuration of the voice connection in a guild.
+type Config struct {
+	// GuildID is the guild configured, or empty in a default Config
+	// applying to every guild.
+	GuildID string `json:"guild_id"`
+
+	// ChannelID or, if empty, ChannelName selects the voice channel
+	// joined.
+	ChannelID   string `json:"channel_id,omitempty"`
+	ChannelName string `json:"channel_name,omitempty"`
+
+	// SendDepth and RecvDepth set the capacity of the connection's
+	// OpusSend and OpusRecv channels, or discordgo's defaults if zero.
+	SendDepth int `json:"send_buffer_frames,omitempty"`
+	RecvDepth int `json:"recv_buffer_packets,omitempty"`
+
+	// Settings are the guild's values of the bot's other settings, such
+	// as "OUTPUT_FRAMES"; see Setting.
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// ConfigFromEnv returns the default Config of the single-guild settings
+// GUILD_ID, VOICE_CHANNEL_ID, VOICE_CHANNEL_NAME, SEND_BUFFER_FRAMES and
+// RECV_BUFFER_PACKETS.
+func ConfigFromEnv() *Config {
+	c := &Config{
+		GuildID:     strings.TrimSpace(os.Getenv("GUILD_ID")),
+		ChannelID:   strings.TrimSpace(os.Getenv("VOICE_CHANNEL_ID")),
+		ChannelName: os.Getenv("VOICE_CHANNEL_NAME"),
+	}
+	c.SendDepth, _ = strconv.Atoi(strings.TrimSpace(os.Getenv("SEND_BUFFER_FRAMES")))
+	c.RecvDepth, _ = strconv.Atoi(strings.TrimSpace(os.Getenv("RECV_BUFFER_PACKETS")))
+	return c
+}
+
+// LoadConfigs reads the Configs of guilds from a JSON file holding an
+// array of them, such as
+//
+//	[{"guild_id": "123", "channel_name": "Office", "settings": {"OUTPUT_FRAMES": "1920"}}]
+func LoadConfigs(path string) ([]*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, c := range configs {
+		if c == nil || c.GuildID == "" {
+			return nil, fmt.Errorf("%s: guild %d has no guild_id", path, i)
+		}
+	}
+	return configs, nil
+}
+
+// Setting returns the guild's value of a setting, or the environment's
+// if the guild has none.
+func (c *Config) Setting(key string) string {
+	if v, ok := c.Settings[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// merge returns c with the values it leaves unset taken from def.
+func (c *Config) merge(def *Config) *Config {
+	m := *c
+	if m.ChannelID == "" && m.ChannelName == "" {
+		m.ChannelID, m.ChannelName = def.ChannelID, def.ChannelName
+	}
+	if m.SendDepth == 0 {
+		m.SendDepth = def.SendDepth
+	}
+	if m.RecvDepth == 0 {
+		m.RecvDepth = def.RecvDepth
+	}
+	m.Settings = map[string]string{}
+	for k, v := range def.Settings {
+		m.Settings[k] = v
+	}
+	for k, v := range c.Settings {
+		m.Settings[k] = v
+	}
+	return &m
+}
+
+// channel returns the voice channel of g selected by c, or nil.
+func (c *Config) channel(g *discordgo.Guild) *discordgo.Channel {
+	for _, ch := range g.Channels {
+		if ch.Type != discordgo.ChannelTypeGuildVoice {
+			continue
+		}
+		if c.ChannelID != "" && ch.ID == c.ChannelID || c.ChannelID == "" && ch.Name == c.ChannelName {
+			return ch
+		}
+	}
+	return nil
+}
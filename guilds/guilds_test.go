@@ -0,0 +1,234 @@
+package guilds
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/bwmarrin/discordgo/discordtest"
+)
+
+func TestLoadConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guilds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "guilds.json")
+	ioutil.WriteFile(name, []byte(`[
+		{"guild_id": "1", "channel_name": "Office", "settings": {"OUTPUT_FRAMES": "1920"}},
+		{"guild_id": "2", "recv_buffer_packets": 100}
+	]`), 0644)
+	configs, err := LoadConfigs(name)
+	if err != nil {
+		t.Fatalf("LoadConfigs returned error: %v", err)
+	}
+	want := []*Config{
+		{GuildID: "1", ChannelName: "Office", Settings: map[string]string{"OUTPUT_FRAMES": "1920"}},
+		{GuildID: "2", RecvDepth: 100},
+	}
+	if !reflect.DeepEqual(configs, want) {
+		t.Errorf("configs incorrect: got %+v, want %+v", configs, want)
+	}
+
+	ioutil.WriteFile(name, []byte(`[{"channel_id": "1"}]`), 0644)
+	if _, err := LoadConfigs(name); err == nil {
+		t.Error("LoadConfigs without guild_id returned no error")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	os.Setenv("GUILDS_TEST_SETTING", "env")
+	defer os.Unsetenv("GUILDS_TEST_SETTING")
+
+	def := &Config{ChannelName: "General", RecvDepth: 50, Settings: map[string]string{"A": "default"}}
+	s, _ := discordgo.New("Bot token")
+	m := NewManager(s, def, []*Config{
+		{GuildID: "1", ChannelID: "11", Settings: map[string]string{"GUILDS_TEST_SETTING": "guild"}},
+		{GuildID: "2", SendDepth: 10},
+	})
+
+	c := m.Config("1")
+	if c.ChannelID != "11" || c.ChannelName != "" || c.RecvDepth != 50 {
+		t.Errorf("guild 1 config incorrect: got %+v", c)
+	}
+	if got := c.Setting("GUILDS_TEST_SETTING"); got != "guild" {
+		t.Errorf("guild setting incorrect: got %q, want guild", got)
+	}
+	if got := c.Setting("A"); got != "default" {
+		t.Errorf("default setting incorrect: got %q, want default", got)
+	}
+
+	c = m.Config("2")
+	if c.ChannelName != "General" || c.SendDepth != 10 || c.Setting("GUILDS_TEST_SETTING") != "env" {
+		t.Errorf("guild 2 config incorrect: got %+v", c)
+	}
+
+	// Without a GuildID the default applies to every guild, and with one
+	// only to that guild.
+	if c := m.Config("3"); c == nil || c.GuildID != "3" || c.ChannelName != "General" {
+		t.Errorf("default config incorrect: got %+v", c)
+	}
+	def.GuildID = "4"
+	if c := m.Config("3"); c != nil {
+		t.Errorf("config of unconfigured guild incorrect: got %+v", c)
+	}
+}
+
+func TestManager(t *testing.T) {
+	srv, err := discordtest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer returned error: %v", err)
+	}
+	defer srv.Close()
+	srv.Token = "Bot token"
+	srv.Guilds = []discordtest.Guild{
+		{ID: "10", Name: "office", Channels: []discordtest.Channel{
+			{ID: "11", Name: "General", Type: discordtest.ChannelTypeGuildVoice},
+		}},
+		{ID: "20", Name: "partner", Channels: []discordtest.Channel{
+			{ID: "21", Name: "General", Type: discordtest.ChannelTypeGuildVoice},
+			{ID: "22", Name: "Meeting", Type: discordtest.ChannelTypeGuildVoice},
+		}},
+		{ID: "30", Name: "other", Channels: []discordtest.Channel{
+			{ID: "31", Name: "Lounge", Type: discordtest.ChannelTypeGuildVoice},
+		}},
+	}
+
+	// A voice server serves one connection.
+	voice, err := discordtest.NewVoiceServer()
+	if err != nil {
+		t.Fatalf("NewVoiceServer returned error: %v", err)
+	}
+	defer voice.Close()
+	srv.GuildVoice = map[string]*discordtest.VoiceServer{"20": voice}
+
+	s, _ := discordgo.New("Bot token")
+	s.Client = srv.Client()
+	s.Dialer = srv.Dialer()
+	s.VoiceEndpointAllowlist = []string{"127.0.0.1"}
+
+	m := NewManager(s, &Config{ChannelName: "General"}, []*Config{{GuildID: "20", ChannelID: "22"}})
+	m.Deaf = true
+
+	var mu sync.Mutex
+	running := map[string]string{}
+	joined := make(chan string, 10)
+	left := make(chan string, 10)
+	errs := make(chan string, 10)
+	m.Run = func(vc *discordgo.VoiceConnection, cfg *Config, stop <-chan struct{}) {
+		mu.Lock()
+		running[cfg.GuildID] = vc.ChannelID
+		mu.Unlock()
+		<-stop
+		mu.Lock()
+		delete(running, cfg.GuildID)
+		mu.Unlock()
+	}
+	m.OnJoin = func(cfg *Config, c *discordgo.Channel) { joined <- c.ID }
+	m.OnLeave = func(guildID string) { left <- guildID }
+	m.OnError = func(guildID string, err error) { errs <- guildID }
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer s.Close()
+
+	expect := func(ch chan string, want string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	// Each guild joins its own channel; the third has none.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-joined:
+			got[id] = true
+		case <-time.After(10 * time.Second):
+			t.Fatal("channels not joined")
+		}
+	}
+	if !got["11"] || !got["22"] {
+		t.Errorf("joined channels incorrect: got %v", got)
+	}
+	expect(errs, "30")
+	if ids := m.Guilds(); !reflect.DeepEqual(ids, []string{"10", "20"}) {
+		t.Errorf("Guilds incorrect: got %v", ids)
+	}
+	if vc := m.VoiceConnection("20"); vc == nil || vc.ChannelID != "22" {
+		t.Errorf("VoiceConnection incorrect: got %+v", vc)
+	}
+
+	// Moving to another channel restarts the guild's pipeline there, and
+	// the gateway confirming the move's disconnect doesn't stop it again.
+	if err := m.JoinChannel("20", "31"); !errors.Is(err, ErrNoChannel) {
+		t.Errorf("JoinChannel of another guild's channel incorrect: got %v, want %v", err, ErrNoChannel)
+	}
+	if err := m.JoinChannel("20", "21"); err != nil {
+		t.Fatalf("JoinChannel returned error: %v", err)
+	}
+	expect(left, "20")
+	expect(joined, "21")
+	select {
+	case id := <-left:
+		t.Errorf("guild %s left after moving", id)
+	case <-time.After(200 * time.Millisecond):
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(running, map[string]string{"10": "11", "20": "21"}) {
+		t.Errorf("running pipelines after moving incorrect: got %v", running)
+	}
+	mu.Unlock()
+
+	// Deleting a guild stops only its pipeline.
+	srv.Dispatch("GUILD_DELETE", map[string]interface{}{"id": "20"})
+	expect(left, "20")
+	mu.Lock()
+	if !reflect.DeepEqual(running, map[string]string{"10": "11"}) {
+		t.Errorf("running pipelines incorrect: got %v", running)
+	}
+	mu.Unlock()
+
+	// So does being disconnected.
+	srv.Dispatch("VOICE_STATE_UPDATE", map[string]interface{}{"guild_id": "10", "channel_id": nil, "user_id": srv.User.ID})
+	expect(left, "10")
+	if ids := m.Guilds(); len(ids) != 0 {
+		t.Errorf("Guilds after leaving incorrect: got %v", ids)
+	}
+	if m.Leave("10") {
+		t.Error("Leave of left guild returned true")
+	}
+	m.Close()
+}
+
+func TestManagerMax(t *testing.T) {
+	s, _ := discordgo.New("Bot token")
+	m := NewManager(s, &Config{ChannelName: "General"}, nil)
+	m.Max = 1
+	m.conns["10"] = &conn{stop: make(chan struct{})}
+
+	g := &discordgo.Guild{ID: "20", Channels: []*discordgo.Channel{
+		{ID: "21", Name: "General", Type: discordgo.ChannelTypeGuildVoice},
+	}}
+	if err := m.Join(g); !errors.Is(err, ErrMaxGuilds) {
+		t.Errorf("Join beyond Max incorrect: got %v, want %v", err, ErrMaxGuilds)
+	}
+	if ids := m.Guilds(); !reflect.DeepEqual(ids, []string{"10"}) {
+		t.Errorf("Guilds incorrect: got %v", ids)
+	}
+}
@@ -0,0 +1,248 @@
+package guilds
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A conn is the voice connection and pipeline of a guild.
+type conn struct {
+	cfg  *Config
+	vc   *discordgo.VoiceConnection // nil while joining
+	stop chan struct{}
+	done chan struct{} // closed when Run returns
+}
+
+// A Manager keeps a voice connection, with a pipeline of its own, in each
+// configured guild.
+type Manager struct {
+	Session *discordgo.Session
+
+	// Mute and Deaf are the bot's voice state in every channel.
+	Mute, Deaf bool
+
+	// Max, if not zero, is the number of guilds joined at most, for
+	// pipelines using a device which can't be shared. Other guilds fail
+	// to join with ErrMaxGuilds.
+	Max int
+
+	// Run is the pipeline of each connection; it must return once stop
+	// is closed.
+	Run func(vc *discordgo.VoiceConnection, cfg *Config, stop <-chan struct{})
+
+	// OnJoin, OnLeave and OnError, if set, are called when a channel is
+	// joined, when a guild's pipeline is stopped, and when a channel
+	// can't be joined.
+	OnJoin  func(cfg *Config, c *discordgo.Channel)
+	OnLeave func(guildID string)
+	OnError func(guildID string, err error)
+
+	def *Config
+
+	sync.Mutex
+	configs map[string]*Config
+	conns   map[string]*conn
+	left    map[string]int // disconnects not yet echoed by the gateway
+}
+
+// NewManager returns a Manager joining a channel in each guild of s which
+// has a Config in configs, or in every guild if def has no GuildID, and
+// only def's guild otherwise. The settings configs leave unset are taken
+// from def.
+func NewManager(s *discordgo.Session, def *Config, configs []*Config) *Manager {
+	m := &Manager{
+		Session: s,
+		def:     def,
+		configs: map[string]*Config{},
+		conns:   map[string]*conn{},
+		left:    map[string]int{},
+	}
+	for _, c := range configs {
+		m.configs[c.GuildID] = c.merge(def)
+	}
+
+	s.AddHandler(func(s *discordgo.Session, g *discordgo.GuildCreate) {
+		if err := m.Join(g.Guild); err != nil && m.OnError != nil {
+			m.OnError(g.ID, err)
+		}
+	})
+	s.AddHandler(func(s *discordgo.Session, g *discordgo.GuildDelete) {
+		m.Leave(g.ID)
+	})
+	s.AddHandler(func(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+		// The bot was disconnected or kicked from the channel, unless
+		// this is the gateway confirming a Leave.
+		if s.State.User == nil || v.UserID != s.State.User.ID || v.ChannelID != "" {
+			return
+		}
+		m.Lock()
+		echo := m.left[v.GuildID] > 0
+		if echo {
+			m.left[v.GuildID]--
+		}
+		m.Unlock()
+		if !echo {
+			m.Leave(v.GuildID)
+		}
+	})
+	return m
+}
+
+// Config returns the Config of a guild, or nil if the guild is not
+// configured.
+func (m *Manager) Config(guildID string) *Config {
+	m.Lock()
+	defer m.Unlock()
+	if c, ok := m.configs[guildID]; ok {
+		return c
+	}
+	if m.def.GuildID != "" && m.def.GuildID != guildID {
+		return nil
+	}
+	c := m.def.merge(m.def)
+	c.GuildID = guildID
+	return c
+}
+
+// Join joins the configured voice channel of g and starts its pipeline,
+// unless g is not configured or already joined.
+func (m *Manager) Join(g *discordgo.Guild) error {
+	cfg := m.Config(g.ID)
+	if cfg == nil || cfg.ChannelID == "" && cfg.ChannelName == "" {
+		return nil
+	}
+	c := cfg.channel(g)
+	if c == nil {
+		return fmt.Errorf("guild %s: %w", g.ID, ErrNoChannel)
+	}
+	return m.join(g.ID, cfg, c)
+}
+
+// JoinChannel joins the voice channel channelID of a configured guild and
+// starts its pipeline, first leaving the channel the guild is in if it is
+// another.
+func (m *Manager) JoinChannel(guildID, channelID string) error {
+	cfg := m.Config(guildID)
+	c, err := m.Session.State.Channel(channelID)
+	if cfg == nil || err != nil || c.GuildID != guildID || c.Type != discordgo.ChannelTypeGuildVoice {
+		return fmt.Errorf("guild %s: %w", guildID, ErrNoChannel)
+	}
+	if vc := m.VoiceConnection(guildID); vc != nil {
+		vc.RLock()
+		joined := vc.ChannelID == channelID
+		vc.RUnlock()
+		if joined {
+			return nil
+		}
+		m.Leave(guildID)
+	}
+	return m.join(guildID, cfg, c)
+}
+
+// join joins the voice channel c of a guild configured by cfg.
+func (m *Manager) join(guildID string, cfg *Config, c *discordgo.Channel) error {
+	m.Lock()
+	if _, ok := m.conns[guildID]; ok {
+		m.Unlock()
+		return nil
+	}
+	if m.Max > 0 && len(m.conns) >= m.Max {
+		m.Unlock()
+		return fmt.Errorf("guild %s: %w", guildID, ErrMaxGuilds)
+	}
+	cn := &conn{cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+	m.conns[guildID] = cn
+	m.Unlock()
+
+	s := m.Session
+	vc, err := s.ChannelVoiceJoin(guildID, c.ID, m.Mute, m.Deaf,
+		discordgo.WithOpusSendDepth(cfg.SendDepth),
+		discordgo.WithOpusRecv(cfg.RecvDepth, discordgo.RecvOverflowDropOldest))
+	m.Lock()
+	if m.conns[guildID] != cn {
+		// Left while joining.
+		if err == nil {
+			m.left[guildID]++
+		}
+		m.Unlock()
+		if err == nil {
+			vc.Disconnect()
+		}
+		return nil
+	}
+	if err != nil {
+		delete(m.conns, guildID)
+		m.Unlock()
+		return err
+	}
+	cn.vc = vc
+	m.Unlock()
+
+	if m.OnJoin != nil {
+		m.OnJoin(cfg, c)
+	}
+	go func() {
+		defer close(cn.done)
+		m.Run(vc, cfg, cn.stop)
+	}()
+	return nil
+}
+
+// Leave stops the pipeline of a guild, waits for it to return and
+// disconnects from the guild's channel. It reports whether the guild was
+// joined.
+func (m *Manager) Leave(guildID string) bool {
+	m.Lock()
+	cn := m.conns[guildID]
+	delete(m.conns, guildID)
+	m.Unlock()
+	if cn == nil {
+		return false
+	}
+
+	close(cn.stop)
+	if cn.vc != nil {
+		<-cn.done
+		m.Lock()
+		m.left[guildID]++
+		m.Unlock()
+		cn.vc.Disconnect()
+	}
+	if m.OnLeave != nil {
+		m.OnLeave(guildID)
+	}
+	return true
+}
+
+// Close leaves every guild.
+func (m *Manager) Close() {
+	for _, id := range m.Guilds() {
+		m.Leave(id)
+	}
+}
+
+// Guilds returns the sorted IDs of the guilds joined.
+func (m *Manager) Guilds() []string {
+	m.Lock()
+	defer m.Unlock()
+	ids := make([]string, 0, len(m.conns))
+	for id := range m.conns {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// VoiceConnection returns the voice connection of a guild, or nil if it is
+// not joined.
+func (m *Manager) VoiceConnection(guildID string) *discordgo.VoiceConnection {
+	m.Lock()
+	defer m.Unlock()
+	if cn := m.conns[guildID]; cn != nil {
+		return cn.vc
+	}
+	return nil
+}
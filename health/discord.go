@@ -0,0 +1,69 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Gateway returns a readiness check which fails while the gateway
+// connection of s is not ready. Like Heartbeat, it does not wait for the
+// session lock, which s holds while reconnecting.
+func Gateway(s *discordgo.Session) Check {
+	return func() (string, error) {
+		if !s.GatewayReady() {
+			return "", errors.New("not connected")
+		}
+		return "", nil
+	}
+}
+
+// Heartbeat returns a liveness check which fails if no heartbeat has been
+// acknowledged by the gateway within maxAge. Discord asks for a heartbeat
+// about every 41 seconds, and s reconnects after missing a few.
+func Heartbeat(s *discordgo.Session, maxAge time.Duration) Check {
+	return func() (string, error) {
+		age := time.Since(s.HeartbeatAck())
+		detail := "last ack " + ago(age)
+		if age > maxAge {
+			return detail, fmt.Errorf("no heartbeat ack for %v", age.Round(time.Second))
+		}
+		return detail, nil
+	}
+}
+
+// Voice returns a readiness check which fails while vc is not ready, or
+// if maxSendIdle is not 0 and it sent no packet within maxSendIdle, for
+// bots which send continuously. The time since the last packet sent and
+// received is given either way.
+func Voice(vc *discordgo.VoiceConnection, maxSendIdle time.Duration) Check {
+	return func() (string, error) {
+		vc.RLock()
+		ready := vc.Ready
+		vc.RUnlock()
+		sent, received := vc.SendStats().LastSent, vc.RecvStats().LastReceived
+
+		detail := "last sent " + since(sent) + ", last received " + since(received)
+		if !ready {
+			return detail, errors.New("not ready")
+		}
+		if maxSendIdle > 0 && time.Since(sent) > maxSendIdle {
+			return detail, errors.New("not sending")
+		}
+		return detail, nil
+	}
+}
+
+// since describes the time since t, or "never" for the zero time.
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return ago(time.Since(t))
+}
+
+func ago(d time.Duration) string {
+	return d.Round(time.Millisecond).String() + " ago"
+}
@@ -0,0 +1,179 @@
+// Package health reports whether a bot is alive and ready, so that systemd
+// or a container orchestrator can tell a wedged bot from a working one.
+//
+// A Checker holds named checks of the parts of a bot, such as its gateway
+// connection, voice connections and sound devices. Liveness checks fail
+// when a part is stuck and the bot should be restarted; readiness checks
+// also fail while a part is still starting or reconnecting. The Checker
+// serves them as /healthz and /readyz, in the style of Kubernetes, and
+// reports them to systemd with sd_notify.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Check returns an error describing what is wrong with part of a bot, or
+// nil if it is fine. detail, if not empty, is shown either way.
+type Check func() (detail string, err error)
+
+// A Checker holds the checks of a bot.
+type Checker struct {
+	sync.Mutex
+	next   int
+	checks map[int]check
+}
+
+type check struct {
+	name  string
+	ready bool // checked for readiness alone
+	fn    Check
+}
+
+// A Result is the outcome of a Check.
+type Result struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// NewChecker returns a Checker without checks, which is both alive and
+// ready.
+func NewChecker() *Checker {
+	return &Checker{checks: map[int]check{}}
+}
+
+// Live adds a liveness check, which is also checked for readiness, until
+// the returned function is called.
+func (c *Checker) Live(name string, fn Check) (remove func()) {
+	return c.add(check{name, false, fn})
+}
+
+// Ready adds a readiness check until the returned function is called.
+func (c *Checker) Ready(name string, fn Check) (remove func()) {
+	return c.add(check{name, true, fn})
+}
+
+func (c *Checker) add(ch check) func() {
+	c.Lock()
+	defer c.Unlock()
+	id := c.next
+	c.next++
+	c.checks[id] = ch
+	return func() {
+		c.Lock()
+		defer c.Unlock()
+		delete(c.checks, id)
+	}
+}
+
+// Check runs the liveness checks, and the readiness checks too if ready is
+// set, returning their results sorted by name and whether all passed.
+func (c *Checker) Check(ready bool) ([]Result, bool) {
+	c.Lock()
+	var checks []check
+	for _, ch := range c.checks {
+		if ready || !ch.ready {
+			checks = append(checks, ch)
+		}
+	}
+	c.Unlock()
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+
+	ok := true
+	results := make([]Result, len(checks))
+	for i, ch := range checks {
+		detail, err := ch.fn()
+		results[i] = Result{ch.name, detail, err}
+		if err != nil {
+			ok = false
+		}
+	}
+	return results, ok
+}
+
+// Handler returns the handler of /healthz, or of /readyz if ready is set.
+// It responds 200 if every check passes and 503 otherwise, listing each
+// check as "[+]name ok" or "[-]name failed: reason".
+func (c *Checker) Handler(ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ok := c.Check(ready)
+		var b strings.Builder
+		for _, res := range results {
+			if res.Err != nil {
+				fmt.Fprintf(&b, "[-]%s failed: %v", res.Name, res.Err)
+			} else {
+				fmt.Fprintf(&b, "[+]%s ok", res.Name)
+			}
+			if res.Detail != "" {
+				fmt.Fprintf(&b, " (%s)", res.Detail)
+			}
+			b.WriteByte('\n')
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if ok {
+			b.WriteString("ok\n")
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			b.WriteString("failed\n")
+		}
+		if r.Method != http.MethodHead {
+			w.Write([]byte(b.String()))
+		}
+	})
+}
+
+// A Probe records the progress of a loop, such as the one reading a sound
+// device, for a Check. It is safe for concurrent use.
+type Probe struct {
+	last int64 // UnixNano of the last Beat, accessed atomically
+
+	mu  sync.Mutex
+	err error
+}
+
+// Beat records that the loop made progress, clearing any failure.
+func (p *Probe) Beat() {
+	atomic.StoreInt64(&p.last, time.Now().UnixNano())
+	p.mu.Lock()
+	p.err = nil
+	p.mu.Unlock()
+}
+
+// Fail records that the loop stopped with err, such as failing to open its
+// device.
+func (p *Probe) Fail(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+}
+
+// Check returns a Check which fails if the loop has failed, has not begun,
+// or, unless maxAge is 0, made no progress within maxAge.
+func (p *Probe) Check(maxAge time.Duration) Check {
+	return func() (string, error) {
+		p.mu.Lock()
+		err := p.err
+		p.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		last := atomic.LoadInt64(&p.last)
+		if last == 0 {
+			return "", fmt.Errorf("not started")
+		}
+		age := time.Since(time.Unix(0, last))
+		if maxAge > 0 && age > maxAge {
+			return "", fmt.Errorf("no progress for %v", age.Round(time.Millisecond))
+		}
+		return "", nil
+	}
+}
@@ -0,0 +1,176 @@
+package health
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func get(t *testing.T, h http.Handler) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	b, _ := ioutil.ReadAll(rec.Body)
+	return rec.Code, string(b)
+}
+
+func TestChecker(t *testing.T) {
+	c := NewChecker()
+	var probe Probe
+	c.Live("audio", probe.Check(time.Second))
+	remove := c.Ready("voice", func() (string, error) {
+		return "last sent never", errors.New("not ready")
+	})
+
+	code, body := get(t, c.Handler(false))
+	want := "[-]audio failed: not started\nfailed\n"
+	if code != http.StatusServiceUnavailable || body != want {
+		t.Errorf("healthz before starting incorrect: got %d %q, want 503 %q", code, body, want)
+	}
+
+	probe.Beat()
+	if code, body := get(t, c.Handler(false)); code != http.StatusOK || body != "[+]audio ok\nok\n" {
+		t.Errorf("healthz incorrect: got %d %q", code, body)
+	}
+	code, body = get(t, c.Handler(true))
+	want = "[+]audio ok\n[-]voice failed: not ready (last sent never)\nfailed\n"
+	if code != http.StatusServiceUnavailable || body != want {
+		t.Errorf("readyz incorrect: got %d %q, want 503 %q", code, body, want)
+	}
+
+	remove()
+	if code, _ := get(t, c.Handler(true)); code != http.StatusOK {
+		t.Errorf("readyz after removing check incorrect: got %d, want 200", code)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := probe.Check(0)(); err != nil {
+		t.Errorf("Check without maxAge returned %v", err)
+	}
+	if _, err := probe.Check(time.Millisecond)(); err == nil {
+		t.Error("Check of stalled probe returned nil")
+	}
+
+	probe.Fail(errors.New("no device"))
+	if _, body := get(t, c.Handler(false)); !strings.Contains(body, "[-]audio failed: no device") {
+		t.Errorf("healthz after failure incorrect: got %q", body)
+	}
+	if _, err := probe.Check(0)(); err == nil {
+		t.Error("Check of failed probe returned nil")
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	s, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	if _, err := Gateway(s)(); err == nil {
+		t.Error("Gateway of closed session returned nil")
+	}
+	// New counts as an ack; the checks must not wait for the session
+	// lock, which Open holds while connecting.
+	s.Lock()
+	time.Sleep(20 * time.Millisecond)
+	if detail, err := Heartbeat(s, time.Minute)(); err != nil || !strings.HasPrefix(detail, "last ack ") {
+		t.Errorf("Heartbeat incorrect: got %q, %v", detail, err)
+	}
+	if _, err := Heartbeat(s, 10*time.Millisecond)(); err == nil {
+		t.Error("Heartbeat of stale session returned nil")
+	}
+	if _, err := Gateway(s)(); err == nil {
+		t.Error("Gateway of locked session returned nil")
+	}
+	s.Unlock()
+
+	vc := &discordgo.VoiceConnection{Ready: true}
+	if detail, err := Voice(vc, 0)(); err != nil || detail != "last sent never, last received never" {
+		t.Errorf("Voice incorrect: got %q, %v", detail, err)
+	}
+	if _, err := Voice(vc, time.Second)(); err == nil {
+		t.Error("Voice of silent connection returned nil")
+	}
+}
+
+func TestSystemd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "200000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := WatchdogInterval(); got != 200*time.Millisecond {
+		t.Errorf("WatchdogInterval incorrect: got %v, want 200ms", got)
+	}
+
+	var ready int32
+	c := NewChecker()
+	c.Ready("voice", func() (string, error) {
+		if atomic.LoadInt32(&ready) == 0 {
+			return "", errors.New("not ready")
+		}
+		return "", nil
+	})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.Systemd(stop)
+		close(done)
+	}()
+
+	read := func() string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read returned error: %v", err)
+		}
+		return string(buf[:n])
+	}
+	// Alive, so the watchdog is fed, but not yet ready.
+	if got := read(); got != "WATCHDOG=1" {
+		t.Errorf("first notification incorrect: got %q, want WATCHDOG=1", got)
+	}
+	if got := read(); got != "STATUS=voice: not ready" {
+		t.Errorf("status incorrect: got %q", got)
+	}
+
+	atomic.StoreInt32(&ready, 1)
+	var got []string
+	for len(got) < 3 {
+		if s := read(); s != "WATCHDOG=1" || len(got) > 0 {
+			got = append(got, s)
+		}
+	}
+	if strings.Join(got, ",") != "READY=1,WATCHDOG=1,STATUS=Ready" {
+		t.Errorf("notifications once ready incorrect: got %q", got)
+	}
+
+	close(stop)
+	<-done
+	for {
+		if s := read(); s == "STOPPING=1" {
+			break
+		}
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Errorf("Notify without systemd returned %t, %v", sent, err)
+	}
+}
@@ -0,0 +1,103 @@
+package health
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notify sends state, such as "READY=1", to the service manager over
+// NOTIFY_SOCKET, as sd_notify does. It reports whether it was sent, which
+// it is not, without an error, when the bot is not run by systemd.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which the service manager
+// expects "WATCHDOG=1", from WATCHDOG_USEC, or 0 if its watchdog is not
+// enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Systemd reports the checks of c to the service manager until stop is
+// closed: "READY=1" once the readiness checks first pass, "WATCHDOG=1"
+// at least twice per watchdog interval while the liveness checks pass, so
+// that a wedged bot is restarted, and the failing checks as its status. It
+// returns at once when the bot is not run by systemd.
+func (c *Checker) Systemd(stop <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdog := WatchdogInterval()
+	interval := time.Second
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := false
+	status, reported := "", false
+	for {
+		_, alive := c.Check(false)
+		results, ok := c.Check(true)
+		if ok && !ready {
+			ready = true
+			Notify("READY=1")
+		}
+		if alive && watchdog > 0 {
+			Notify("WATCHDOG=1")
+		}
+		if s := failing(results); s != status || !reported {
+			status, reported = s, true
+			if s == "" {
+				s = "Ready"
+			}
+			Notify("STATUS=" + s)
+		}
+
+		select {
+		case <-stop:
+			Notify("STOPPING=1")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// failing describes the checks which failed, or returns "" if none did.
+func failing(results []Result) string {
+	var names []string
+	for _, res := range results {
+		if res.Err != nil {
+			names = append(names, res.Name+": "+res.Err.Error())
+		}
+	}
+	return strings.Join(names, "; ")
+}
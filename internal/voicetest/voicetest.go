@@ -0,0 +1,82 @@
+// Package voicetest provides fakes of voice connections and Opus codecs
+// for tests.
+package voicetest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// FrameSize is the number of samples decoded from each packet, 20ms of
+// 48kHz mono audio.
+const FrameSize = 960
+
+// A Voice records what is sent to it. Its send queue holds two frames.
+type Voice struct {
+	sync.Mutex
+	events []string
+}
+
+// Speaking records "speaking" or "silent".
+func (v *Voice) Speaking(b bool) error {
+	v.Lock()
+	defer v.Unlock()
+	if b {
+		v.events = append(v.events, "speaking")
+	} else {
+		v.events = append(v.events, "silent")
+	}
+	return nil
+}
+
+// SendOpus records the frame as a string.
+func (v *Voice) SendOpus(frame []byte, deadline time.Time) error {
+	v.Lock()
+	defer v.Unlock()
+	v.events = append(v.events, string(frame))
+	return nil
+}
+
+// SendStats reports the capacity of the send queue.
+func (v *Voice) SendStats() discordgo.VoiceSendStats {
+	return discordgo.VoiceSendStats{Capacity: 2}
+}
+
+// Events returns what has been recorded, in order.
+func (v *Voice) Events() []string {
+	v.Lock()
+	defer v.Unlock()
+	return append([]string(nil), v.events...)
+}
+
+// An Encoder encodes a frame as a single byte, its first sample divided
+// by Scale.
+type Encoder struct {
+	Scale int16
+}
+
+// Encode encodes pcm to data.
+func (e Encoder) Encode(pcm []int16, data []byte) (int, error) {
+	data[0] = byte(pcm[0] / e.Scale)
+	return 1, nil
+}
+
+// A Decoder decodes a packet to a frame of FrameSize samples of its first
+// byte times Scale.
+type Decoder struct {
+	Scale int16
+}
+
+// Decode decodes data to pcm.
+func (d Decoder) Decode(data []byte, pcm []int16) (int, error) {
+	if len(data) == 0 {
+		return 0, errors.New("empty packet")
+	}
+	for i := range pcm[:FrameSize] {
+		pcm[i] = int16(data[0]) * d.Scale
+	}
+	return FrameSize, nil
+}
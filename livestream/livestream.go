@@ -0,0 +1,344 @@
+// Package livestream serves live audio to HTTP clients, so that people who
+// aren't on Discord can listen to a voice channel.
+//
+// A Server is given the mixed audio of the channel one frame at a time and
+// streams it to each listener as Ogg Opus, WAV or raw PCM over a chunked
+// response. Every listener has a buffer of its own; those which fall too
+// far behind are disconnected rather than holding up the others.
+package livestream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"discord-audio-stream/oggopus"
+	"discord-audio-stream/voicesend"
+)
+
+// Audio format of the frames streamed.
+const (
+	SampleRate = 48000
+	FrameSize  = 960 // 20ms of mono audio
+)
+
+// ErrFormat is returned for an unknown or unavailable stream format.
+var ErrFormat = errors.New("unsupported stream format")
+
+// Format is the encoding of a stream.
+type Format int
+
+const (
+	// Ogg streams Ogg Opus, encoded once for every listener.
+	Ogg Format = iota
+	// WAV streams 16-bit PCM after a WAV header of unknown length.
+	WAV
+	// PCM streams raw 16-bit little-endian PCM, as audio/L16.
+	PCM
+)
+
+func (f Format) String() string {
+	switch f {
+	case Ogg:
+		return "ogg"
+	case WAV:
+		return "wav"
+	case PCM:
+		return "pcm"
+	}
+	return "unknown"
+}
+
+// ParseFormat returns the Format named "ogg", "opus", "wav" or "pcm".
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "ogg", "opus":
+		return Ogg, nil
+	case "wav":
+		return WAV, nil
+	case "pcm", "l16":
+		return PCM, nil
+	}
+	return 0, ErrFormat
+}
+
+// contentTypes are the Content-Type of each Format.
+var contentTypes = map[Format]string{
+	Ogg: "audio/ogg",
+	WAV: "audio/wav",
+	PCM: "audio/L16;rate=48000;channels=1",
+}
+
+// opusPreSkip is the lookahead of libopus encoders at 48kHz.
+const opusPreSkip = 312
+
+// flushFrames is the number of Ogg Opus frames written to each page, so
+// that listeners receive audio every 100ms.
+const flushFrames = 5
+
+// An OpusEncoder encodes frames of 48kHz mono PCM, for example
+// *opus.Encoder from gopkg.in/hraban/opus.v2.
+type OpusEncoder = voicesend.OpusEncoder
+
+// A Mixer adds the next frame of a channel's audio to pcm, such as a
+// relay.Forwarder in Mix mode.
+type Mixer interface {
+	Mix(pcm []int16) bool
+}
+
+// A frame is a frame of audio in the encodings listeners need.
+type frame struct {
+	pcm  []byte // little-endian samples
+	opus []byte // nil if no listener wants Ogg
+}
+
+// A listener is an HTTP client receiving a stream.
+type listener struct {
+	format Format
+	frames chan *frame
+	slow   bool // disconnected for falling behind
+}
+
+// A Server streams live audio to HTTP listeners.
+type Server struct {
+	// Buffer is the number of frames queued for each listener, beyond
+	// which it is disconnected.
+	Buffer int
+
+	// OnJoin and OnLeave, if set, are called when a listener connects and
+	// disconnects, slow reporting whether it was disconnected for falling
+	// behind.
+	OnJoin  func(r *http.Request, f Format)
+	OnLeave func(r *http.Request, slow bool)
+
+	enc  OpusEncoder
+	opus [1000]byte
+
+	sync.Mutex
+	listeners map[*listener]bool
+	closed    bool
+}
+
+// NewServer returns a Server encoding Ogg streams with enc, or only
+// serving WAV and PCM if enc is nil.
+func NewServer(enc OpusEncoder) *Server {
+	return &Server{
+		Buffer:    50,
+		enc:       enc,
+		listeners: map[*listener]bool{},
+	}
+}
+
+// Listeners returns the number of listeners connected.
+func (s *Server) Listeners() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.listeners)
+}
+
+// Write streams a frame of FrameSize samples to every listener. Listeners
+// whose buffers are full are disconnected.
+func (s *Server) Write(pcm []int16) error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+
+	f := &frame{pcm: make([]byte, 2*len(pcm))}
+	for i, v := range pcm {
+		binary.LittleEndian.PutUint16(f.pcm[2*i:], uint16(v))
+	}
+	for l := range s.listeners {
+		if l.format == Ogg {
+			n, err := s.enc.Encode(pcm, s.opus[:])
+			if err != nil {
+				return err
+			}
+			f.opus = append([]byte(nil), s.opus[:n]...)
+			break
+		}
+	}
+
+	for l := range s.listeners {
+		select {
+		case l.frames <- f:
+		default:
+			l.slow = true
+			close(l.frames)
+			delete(s.listeners, l)
+		}
+	}
+	return nil
+}
+
+// Close ends the stream of every listener, and refuses new ones.
+func (s *Server) Close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		close(l.frames)
+		delete(s.listeners, l)
+	}
+}
+
+// Run writes the audio of m to each output every 20ms until stop is
+// closed, and silence while it has none. The outputs are the Write of a
+// Server or anything else taking the channel's mix, such as an RTP sender,
+// so that they all share one frame clock.
+func Run(m Mixer, stop <-chan struct{}, outputs ...func(pcm []int16) error) {
+	ticker := time.NewTicker(FrameSize * time.Second / SampleRate)
+	defer ticker.Stop()
+
+	pcm := make([]int16, FrameSize)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for i := range pcm {
+			pcm[i] = 0
+		}
+		m.Mix(pcm)
+		for _, write := range outputs {
+			write(pcm)
+		}
+	}
+}
+
+// ServeHTTP streams the audio to a listener until it disconnects, in the
+// format of its "format" query parameter: "ogg" (the default if the
+// Server has an encoder), "wav" (the default otherwise) or "pcm".
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := WAV
+	if s.enc != nil {
+		format = Ogg
+	}
+	if name := r.URL.Query().Get("format"); name != "" {
+		var err error
+		format, err = ParseFormat(name)
+		if err != nil || format == Ogg && s.enc == nil {
+			http.Error(w, ErrFormat.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.Lock()
+	closed := s.closed
+	s.Unlock()
+	if closed {
+		http.Error(w, "stream closed", http.StatusServiceUnavailable)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentTypes[format])
+	h.Set("Cache-Control", "no-cache, no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	var ogg *oggopus.Writer
+	var err error
+	switch format {
+	case Ogg:
+		head := oggopus.Head{Version: 1, Channels: 1, PreSkip: opusPreSkip, InputSampleRate: SampleRate}
+		ogg, err = oggopus.NewWriter(w, rand.Uint32(), head, oggopus.Tags{Vendor: "discord-audio-stream"})
+	case WAV:
+		_, err = w.Write(wavHeader())
+	}
+	if err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	l := &listener{format: format, frames: make(chan *frame, s.Buffer)}
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
+	}
+	s.listeners[l] = true
+	s.Unlock()
+	if s.OnJoin != nil {
+		s.OnJoin(r, format)
+	}
+
+	s.stream(w, r, l, ogg, flusher)
+
+	s.Lock()
+	delete(s.listeners, l)
+	slow := l.slow
+	s.Unlock()
+	if s.OnLeave != nil {
+		s.OnLeave(r, slow)
+	}
+}
+
+// stream writes the frames of l to w until the listener disconnects or is
+// dropped.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, l *listener, ogg *oggopus.Writer, flusher http.Flusher) error {
+	n := 0
+	for {
+		var f *frame
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case f = <-l.frames:
+		}
+		if f == nil {
+			return nil
+		}
+
+		var err error
+		if ogg != nil {
+			if err := ogg.WritePacket(f.opus); err != nil {
+				return err
+			}
+			if n++; n%flushFrames != 0 {
+				continue
+			}
+			err = ogg.Flush()
+		} else {
+			_, err = w.Write(f.pcm)
+		}
+		if err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// wavHeader returns the header of a 16-bit mono WAV stream of unknown
+// length, whose sizes are set to their largest value as players expect.
+func wavHeader() []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(0xFFFFFFFF))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, []uint32{16})
+	binary.Write(&b, binary.LittleEndian, []uint16{1, 1}) // PCM, mono
+	binary.Write(&b, binary.LittleEndian, []uint32{SampleRate, SampleRate * 2})
+	binary.Write(&b, binary.LittleEndian, []uint16{2, 16})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(0xFFFFFFFF))
+	return b.Bytes()
+}
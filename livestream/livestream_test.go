@@ -0,0 +1,220 @@
+package livestream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"discord-audio-stream/oggopus"
+)
+
+// fakeEncoder encodes a frame as a 20ms Opus packet holding its first
+// sample.
+type fakeEncoder struct{}
+
+func (fakeEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	data[0] = 0xF8
+	data[1] = byte(pcm[0])
+	return 2, nil
+}
+
+// fakeMixer mixes frames counting up from 1.
+type fakeMixer struct{ n int16 }
+
+func (m *fakeMixer) Mix(pcm []int16) bool {
+	m.n++
+	for i := range pcm {
+		pcm[i] += m.n
+	}
+	return true
+}
+
+// listen starts the stream of srv in format, running it until the test
+// ends.
+func listen(t *testing.T, srv *Server, format string) io.ReadCloser {
+	t.Helper()
+	hs := httptest.NewServer(srv)
+	t.Cleanup(hs.Close)
+
+	resp, err := http.Get(hs.URL + "/stream?format=" + format)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status incorrect: got %d", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Content-Type"), contentTypes[mustParse(t, format)]; got != want {
+		t.Errorf("Content-Type incorrect: got %q, want %q", got, want)
+	}
+
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go Run(&fakeMixer{}, stop, srv.Write)
+	return resp.Body
+}
+
+func mustParse(t *testing.T, name string) Format {
+	f, err := ParseFormat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestWAV(t *testing.T) {
+	srv := NewServer(nil)
+	body := listen(t, srv, "wav")
+	defer body.Close()
+
+	header := make([]byte, 44)
+	if _, err := io.ReadFull(body, header); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header, wavHeader()) || string(header[8:12]) != "WAVE" {
+		t.Errorf("header incorrect: got % x", header)
+	}
+
+	// Frames follow each other, whenever the listener joined.
+	pcm := make([]int16, 3*FrameSize)
+	if err := binary.Read(body, binary.LittleEndian, pcm); err != nil {
+		t.Fatal(err)
+	}
+	first := pcm[0]
+	for i, want := range []int16{first, first + 1, first + 2} {
+		if got := pcm[i*FrameSize+FrameSize-1]; got != want {
+			t.Errorf("frame %d incorrect: got %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestOgg(t *testing.T) {
+	srv := NewServer(fakeEncoder{})
+	body := listen(t, srv, "ogg")
+	defer body.Close()
+
+	r, err := oggopus.NewReader(body)
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	if r.Head.Channels != 1 || r.Head.PreSkip != opusPreSkip {
+		t.Errorf("head incorrect: got %+v", r.Head)
+	}
+	var prev byte
+	for i := 0; i < flushFrames*2; i++ {
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket returned error: %v", err)
+		}
+		if i > 0 && p[1] != prev+1 {
+			t.Errorf("packet %d incorrect: got % x after %d", i, p, prev)
+		}
+		prev = p[1]
+	}
+}
+
+func TestFormats(t *testing.T) {
+	hs := httptest.NewServer(NewServer(nil))
+	defer hs.Close()
+
+	// Ogg needs an encoder.
+	for _, format := range []string{"ogg", "mp3"} {
+		resp, err := http.Get(hs.URL + "/stream?format=" + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status of %s incorrect: got %d, want %d", format, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	resp, err := http.Head(hs.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "audio/wav" {
+		t.Errorf("HEAD incorrect: got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestSlowListener(t *testing.T) {
+	srv := NewServer(fakeEncoder{})
+	srv.Buffer = 2
+	slow := &listener{format: PCM, frames: make(chan *frame, srv.Buffer)}
+	fast := &listener{format: Ogg, frames: make(chan *frame, srv.Buffer)}
+	srv.listeners[slow] = true
+	srv.listeners[fast] = true
+
+	pcm := make([]int16, FrameSize)
+	for i := 0; i < 3; i++ {
+		pcm[0] = int16(i)
+		srv.Write(pcm)
+		<-fast.frames
+	}
+
+	if !slow.slow || srv.Listeners() != 1 {
+		t.Errorf("slow listener not dropped: slow %t, listeners %d", slow.slow, srv.Listeners())
+	}
+	var n int
+	for range slow.frames {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("frames queued for slow listener incorrect: got %d, want 2", n)
+	}
+	select {
+	case f := <-fast.frames:
+		t.Errorf("unexpected frame for fast listener: %+v", f)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv := NewServer(nil)
+	left := make(chan bool, 1)
+	srv.OnLeave = func(r *http.Request, slow bool) { left <- slow }
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+
+	resp, err := http.Get(hs.URL + "/stream?format=pcm")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	for srv.Listeners() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Closing ends the stream without waiting for the listener.
+	srv.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stream ended with error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not ended by Close")
+	}
+	if slow := <-left; slow || srv.Listeners() != 0 {
+		t.Errorf("listener after Close incorrect: slow %t, listeners %d", slow, srv.Listeners())
+	}
+
+	resp, err = http.Get(hs.URL + "/stream?format=pcm")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status after Close incorrect: got %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
@@ -1,24 +1,27 @@
 package main
 
 import (
+	"context"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time" // Import time for potential delays
 
+	"discord-audio-stream/guilds"
+	"discord-audio-stream/health"
+	"discord-audio-stream/metrics"
+
 	"github.com/bwmarrin/discordgo"
 	"github.com/gordonklaus/portaudio"
 	"github.com/joho/godotenv"
 	"gopkg.in/hraban/opus.v2"
 )
 
-var (
-	currentVC       *discordgo.VoiceConnection
-	stopAudioStream chan struct{}
-)
-
 func main() {
 	// Open a file for logging
 	logFile, err := os.OpenFile("bot.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -61,37 +64,61 @@ func main() {
 	// Add a handler for the ready event
 	dg.AddHandler(ready)
 
-	// Add a handler for GuildCreate to auto-join the voice channel
-	var joined bool
-	dg.AddHandler(func(s *discordgo.Session, event *discordgo.GuildCreate) {
-		if joined {
+	// Join the voice channel of each guild as it becomes available, with an
+	// audio stream of its own. GUILDS_FILE configures guilds individually;
+	// the .env settings are the default for the others.
+	var configs []*guilds.Config
+	if path := os.Getenv("GUILDS_FILE"); path != "" {
+		configs, err = guilds.LoadConfigs(path)
+		if err != nil {
+			log.Println("Error loading guilds file:", err)
 			return
 		}
-
-		voiceChannelName := os.Getenv("VOICE_CHANNEL_NAME")
-		if voiceChannelName == "" {
-			log.Println("VOICE_CHANNEL_NAME not found in .env file. Bot will not join a voice channel.")
-			return
-		}
-
-		for _, c := range event.Guild.Channels {
-			if c.Type == discordgo.ChannelTypeGuildVoice && c.Name == voiceChannelName {
-				vc, err := s.ChannelVoiceJoin(event.Guild.ID, c.ID, false, true)
-				if err != nil {
-					log.Printf("Error joining voice channel: %v\n", err)
-					return
-				}
-				log.Printf("Successfully joined voice channel '%s' (%s).\n", voiceChannelName, c.ID)
-				joined = true
-				currentVC = vc // Assign to global variable
-				stopAudioStream = make(chan struct{}) // Initialize the channel
-				go streamAudio(s, vc, stopAudioStream)
-				return
-			}
-		}
-
-		log.Printf("Voice channel '%s' not found in guild '%s'.\n", voiceChannelName, event.Guild.Name)
+	}
+	// Expose the state of the gateway and of each voice connection to
+	// Prometheus at /metrics, and whether they and the mic work at
+	// /healthz and /readyz and to systemd.
+	registry := metrics.NewRegistry()
+	registry.Register(metrics.Session(dg))
+	checker := health.NewChecker()
+	checker.Live("gateway heartbeat", health.Heartbeat(dg, 5*time.Minute))
+	checker.Ready("gateway", health.Gateway(dg))
+	metricsAddr, healthAddr := os.Getenv("METRICS_ADDR"), os.Getenv("HEALTH_ADDR")
+	statusServers := serveStatus([]statusRoute{
+		{metricsAddr, "/metrics", registry},
+		{healthAddr, "/healthz", checker.Handler(false)},
+		{healthAddr, "/readyz", checker.Handler(true)},
 	})
+	systemdStop := make(chan struct{})
+	go checker.Systemd(systemdStop)
+
+	// The mic and speaker are single devices, so they stream to the first
+	// guild joined only.
+	manager := guilds.NewManager(dg, guilds.ConfigFromEnv(), configs)
+	manager.Deaf = true
+	manager.Max = 1
+	manager.Run = func(vc *discordgo.VoiceConnection, cfg *guilds.Config, stop <-chan struct{}) {
+		audio := &metrics.Audio{}
+		defer registry.Register(metrics.Voice(vc))()
+		defer registry.Register(func(w *metrics.Writer) { audio.Collect(w, "guild", vc.GuildID) })()
+		// The mic is read continuously, so a stalled read means the
+		// device is stuck, and the bot should always be sending.
+		mic := &health.Probe{}
+		defer checker.Live("microphone "+vc.GuildID, mic.Check(5*time.Second))()
+		defer checker.Ready("voice "+vc.GuildID, health.Voice(vc, 10*time.Second))()
+		streamAudio(dg, vc, outputFrames(cfg), audio, mic, stop)
+		// A failed mic stays reported until the guild is left.
+		<-stop
+	}
+	manager.OnJoin = func(cfg *guilds.Config, c *discordgo.Channel) {
+		log.Printf("Successfully joined voice channel '%s' (%s) in guild %s.\n", c.Name, c.ID, cfg.GuildID)
+	}
+	manager.OnLeave = func(guildID string) {
+		log.Printf("Left voice channel in guild %s.\n", guildID)
+	}
+	manager.OnError = func(guildID string, err error) {
+		log.Printf("Error joining voice channel in guild %s: %v\n", guildID, err)
+	}
 
 	// Add a handler for messages
 	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
@@ -124,28 +151,76 @@ func main() {
 
 	// Cleanly close down the Discord session.
 	log.Println("Closing Discord session.")
+	close(systemdStop)
 	
-	// Signal streamAudio goroutine to stop and clean up voice connection
-	if stopAudioStream != nil {
-		close(stopAudioStream)
-		// Give some time for the goroutine to clean up
-		time.Sleep(1 * time.Second)
-	}
+	// Stop each guild's audio stream and disconnect from its voice channel
+	manager.Close()
 
-	if currentVC != nil && currentVC.Ready {
-		log.Println("Disconnecting from voice channel.")
-		currentVC.Disconnect()
+	for _, srv := range statusServers {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		srv.Shutdown(ctx)
+		cancel()
 	}
 
 	dg.Close()
 }
 
+// A statusRoute is a handler of the status servers, for a pattern such
+// as "/metrics" on an address, which is not served if it is "".
+type statusRoute struct {
+	addr, pattern string
+	handler       http.Handler
+}
+
+// serveStatus serves each route, sharing a server between those on the
+// same address.
+func serveStatus(routes []statusRoute) []*http.Server {
+	muxes := map[string]*http.ServeMux{}
+	for _, r := range routes {
+		if r.addr == "" {
+			continue
+		}
+		if muxes[r.addr] == nil {
+			muxes[r.addr] = http.NewServeMux()
+		}
+		muxes[r.addr].Handle(r.pattern, r.handler)
+	}
+
+	var servers []*http.Server
+	for addr, mux := range muxes {
+		srv := &http.Server{Addr: addr, Handler: mux}
+		servers = append(servers, srv)
+		go func() {
+			log.Printf("Serving status on %s\n", addr)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("Error serving status:", err)
+			}
+		}()
+	}
+	return servers
+}
+
 func ready(s *discordgo.Session, event *discordgo.Ready) {
 	log.Println("Bot is ready!")
 	s.UpdateGameStatus(0, "Streaming Audio")
 }
 
-func streamAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan <-chan struct{}) {
+// outputFrames returns the speaker's buffer size, from the guild's
+// OUTPUT_FRAMES.
+func outputFrames(cfg *guilds.Config) int {
+	raw := strings.TrimSpace(cfg.Setting("OUTPUT_FRAMES"))
+	if raw == "" {
+		return 960
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid OUTPUT_FRAMES=%q in guild %s, defaulting to 960\n", raw, cfg.GuildID)
+		return 960
+	}
+	return n
+}
+
+func streamAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, outputFrames int, audio *metrics.Audio, mic *health.Probe, stopChan <-chan struct{}) {
 	log.Println("Starting audio stream.")
 	vc.Speaking(true)
 	defer vc.Speaking(false)
@@ -159,15 +234,17 @@ func streamAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan <
 	micStream, err := portaudio.OpenDefaultStream(1, 0, 48000, len(in), in)
 	if err != nil {
 		log.Println("Error opening PortAudio input stream:", err)
+		mic.Fail(err)
 		return
 	}
 	defer micStream.Close()
 
 	// --- Output Stream (Speakers) ---
-	out := make([]int16, 960)
+	out := make([]int16, outputFrames)
 	speakerStream, err := portaudio.OpenDefaultStream(0, 1, 48000, len(out), out)
 	if err != nil {
 		log.Println("Error opening PortAudio output stream:", err)
+		mic.Fail(err)
 		return
 	}
 	defer speakerStream.Close()
@@ -176,6 +253,7 @@ func streamAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan <
 	opusEncoder, err := opus.NewEncoder(48000, 1, opus.AppAudio)
 	if err != nil {
 		log.Println("Error creating Opus encoder:", err)
+		mic.Fail(err)
 		return
 	}
 
@@ -183,38 +261,49 @@ func streamAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan <
 	opusDecoder, err := opus.NewDecoder(48000, 1)
 	if err != nil {
 		log.Println("Error creating Opus decoder:", err)
+		mic.Fail(err)
 		return
 	}
 
 	// --- Goroutine to receive and play audio ---
+	// The speaker is closed once it stops writing to it.
+	recvDone := make(chan struct{})
+	defer func() { <-recvDone }()
 	go func() {
+		defer close(recvDone)
+		decodeBuf := make([]int16, 960)
+		pending := make([]int16, 0, 2*len(out))
 		for {
+			var p *discordgo.Packet
+			var ok bool
 			select {
 			case <-stopChan:
 				log.Println("Stopping audio receive goroutine.")
 				return
-			default:
-				if vc == nil || !vc.Ready {
-					log.Println("VC not ready, returning from receive goroutine")
-					return
-				}
-				p, ok := <-vc.OpusRecv
-				if !ok {
-					log.Println("OpusRecv channel closed, returning from receive goroutine")
-					return
-				}
-				
-				_, err := opusDecoder.Decode(p.Opus, out)
-				if err != nil {
-					log.Println("Error decoding Opus data:", err)
-					continue
-				}
+			case p, ok = <-vc.OpusRecv:
+			}
+			if !ok {
+				log.Println("OpusRecv channel closed, returning from receive goroutine")
+				return
+			}
 
-				if speakerStream != nil {
-					err = speakerStream.Write()
-					if err != nil {
-						log.Println("Error writing to PortAudio output stream:", err)
-					}
+			n, err := opusDecoder.Decode(p.Opus, decodeBuf)
+			p.Release()
+			if err != nil {
+				audio.DecodeErrors.Inc()
+				log.Println("Error decoding Opus data:", err)
+				continue
+			}
+
+			pending = append(pending, decodeBuf[:n]...)
+			for len(pending) >= len(out) {
+				copy(out, pending)
+				pending = append(pending[:0], pending[len(out):]...)
+				err = speakerStream.Write()
+				if err == portaudio.OutputUnderflowed {
+					audio.Underruns.Inc()
+				} else if err != nil {
+					log.Println("Error writing to PortAudio output stream:", err)
 				}
 			}
 		}
@@ -223,14 +312,26 @@ func streamAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan <
 	err = micStream.Start()
 	if err != nil {
 		log.Println("Error starting PortAudio input stream:", err)
+		mic.Fail(err)
 		return
 	}
 	err = speakerStream.Start()
 	if err != nil {
 		log.Println("Error starting PortAudio output stream:", err)
+		mic.Fail(err)
 		return
 	}
 
+	// Encoded frames are queued on OpusSend, so rotate through enough
+	// buffers to cover the queue plus the frame being sent.
+	opusBufs := make([][1000]byte, vc.SendStats().Capacity+2)
+	opusNext := 0
+
+	// Dropped frames are counted, and logged at most every dropLogInterval.
+	const dropLogInterval = 10 * time.Second
+	var lastDropLog time.Time
+	var droppedSinceLog uint64
+
 	// --- Main loop to read from mic, encode, and send ---
 	for {
 		select {
@@ -241,19 +342,38 @@ func streamAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan <
 			return
 		default:
 			err = micStream.Read()
-			if err != nil {
-				// log.Println("Error reading from PortAudio input stream:", err)
+			if err == portaudio.InputOverflowed {
+				audio.Overruns.Inc()
+				mic.Beat()
+			} else if err != nil {
+				// Don't send the previous frame again; wait a frame
+				// before retrying the device.
+				mic.Fail(err)
+				time.Sleep(20 * time.Millisecond)
+				continue
+			} else {
+				mic.Beat()
 			}
 
-			opusData := make([]byte, 1000)
+			opusData := opusBufs[opusNext][:]
+			opusNext = (opusNext + 1) % len(opusBufs)
 			n, err := opusEncoder.Encode(in, opusData)
 			if err != nil {
+				audio.EncodeErrors.Inc()
 				log.Println("Error encoding Opus data:", err)
 				continue
 			}
 
 			if vc.Ready {
-				vc.OpusSend <- opusData[:n]
+				// Drop the frame rather than block capture on the network.
+				if err := vc.SendOpus(opusData[:n], time.Time{}); err != nil {
+					audio.Dropped.Inc()
+					droppedSinceLog++
+					if now := time.Now(); now.Sub(lastDropLog) >= dropLogInterval {
+						log.Printf("Dropped %d opus frames: %v\n", droppedSinceLog, err)
+						lastDropLog, droppedSinceLog = now, 0
+					}
+				}
 			}
 		}
 	}
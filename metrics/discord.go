@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Session returns a collector of the gateway metrics of s: heartbeat
+// latency, reconnects and the waits of its REST rate limiter.
+func Session(s *discordgo.Session) func(w *Writer) {
+	return func(w *Writer) {
+		w.Gauge("discord_gateway_up", "Whether the gateway connection is ready.", boolValue(s.GatewayReady()))
+		w.Gauge("discord_gateway_heartbeat_latency_seconds", "Time between the last heartbeat sent and its acknowledgement.",
+			s.HeartbeatLatency().Seconds())
+		w.Counter("discord_gateway_reconnects_total", "Gateway connections reestablished after being lost.",
+			float64(s.Reconnects()))
+		if s.Ratelimiter != nil {
+			st := s.Ratelimiter.Stats()
+			w.Counter("discord_rest_ratelimit_waits_total", "REST requests held back by a rate limit.", float64(st.Waits))
+			w.Counter("discord_rest_ratelimit_wait_seconds_total", "Time REST requests were held back by rate limits.",
+				st.Waited.Seconds())
+		}
+	}
+}
+
+// Voice returns a collector of the packet counters and queue depths of
+// vc, labelled with its guild.
+func Voice(vc *discordgo.VoiceConnection) func(w *Writer) {
+	return func(w *Writer) {
+		vc.RLock()
+		guild, ready := vc.GuildID, vc.Ready
+		vc.RUnlock()
+		send, recv := vc.SendStats(), vc.RecvStats()
+
+		w.Gauge("discord_voice_ready", "Whether the voice connection is ready to send and receive.", boolValue(ready), "guild", guild)
+		w.Counter("discord_voice_reconnects_total", "Voice connections reestablished after being lost.",
+			float64(vc.Reconnects()), "guild", guild)
+
+		w.Counter("discord_voice_packets_sent_total", "Voice packets sent.", float64(send.Sent), "guild", guild)
+		w.Counter("discord_voice_packets_late_total", "Voice packets sent over half a frame late.", float64(send.Late), "guild", guild)
+		w.Counter("discord_voice_frames_rejected_total", "Frames refused because the send queue was full.",
+			float64(send.Rejected), "guild", guild)
+		w.Gauge("discord_voice_send_queue_depth", "Frames waiting to be sent.", float64(send.Queued), "guild", guild)
+		w.Gauge("discord_voice_send_queue_capacity", "Capacity of the send queue.", float64(send.Capacity), "guild", guild)
+
+		w.Counter("discord_voice_packets_received_total", "Voice packets received and decrypted.", float64(recv.Received), "guild", guild)
+		w.Counter("discord_voice_packets_dropped_total", "Received packets dropped because the receive queue was full.",
+			float64(recv.Dropped), "guild", guild)
+		w.Counter("discord_voice_decrypt_errors_total", "Received packets which failed to decrypt.",
+			float64(recv.DecryptErrors), "guild", guild)
+		w.Gauge("discord_voice_recv_queue_depth", "Received packets waiting to be handled.", float64(recv.Queued), "guild", guild)
+		w.Gauge("discord_voice_recv_queue_capacity", "Capacity of the receive queue.", float64(recv.Capacity), "guild", guild)
+	}
+}
+
+// Audio counts the errors of a bot's audio between Opus and the sound
+// device.
+type Audio struct {
+	EncodeErrors Counter // mic frames which failed to encode
+	DecodeErrors Counter // received packets which failed to decode
+	Overruns     Counter // mic reads which found the input overflowed
+	Underruns    Counter // speaker writes which found the output underflowed
+	Dropped      Counter // mic frames dropped instead of sent
+}
+
+// Collect writes the counts of a, labelled with labels.
+func (a *Audio) Collect(w *Writer, labels ...string) {
+	w.Counter("audio_encode_errors_total", "Frames which failed to encode to Opus.", float64(a.EncodeErrors.Value()), labels...)
+	w.Counter("audio_decode_errors_total", "Opus packets which failed to decode.", float64(a.DecodeErrors.Value()), labels...)
+	w.Counter("audio_input_overruns_total", "Sound device reads which found input lost.", float64(a.Overruns.Value()), labels...)
+	w.Counter("audio_output_underruns_total", "Sound device writes which found the output had run dry.",
+		float64(a.Underruns.Value()), labels...)
+	w.Counter("audio_frames_dropped_total", "Mic frames dropped instead of sent.", float64(a.Dropped.Value()), labels...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,218 @@
+// Package metrics exposes the state of the bots to Prometheus, so that
+// several bridges can be watched from one place.
+//
+// A Registry holds collectors, functions which write the current value of
+// each metric when it is scraped. The values mostly come from counters
+// kept elsewhere, such as the statistics of a discordgo.VoiceConnection;
+// the bots count what they see themselves in Counters. The Registry serves
+// them over HTTP in the Prometheus text format, version 0.0.4.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the media type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// A Counter is a count which only goes up. It is safe for concurrent use.
+type Counter struct {
+	n uint64
+}
+
+// Inc adds one to c.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+// Add adds n to c.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+// Value returns the count of c.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// A Registry holds the collectors of the metrics it serves.
+type Registry struct {
+	sync.Mutex
+	next       int
+	collectors map[int]func(w *Writer)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[int]func(w *Writer){}}
+}
+
+// Register adds collect to the collectors of r, until the returned
+// function is called. collect is called on every scrape, and must not
+// block.
+func (r *Registry) Register(collect func(w *Writer)) (unregister func()) {
+	r.Lock()
+	defer r.Unlock()
+	id := r.next
+	r.next++
+	r.collectors[id] = collect
+	return func() {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.collectors, id)
+	}
+}
+
+// Collect returns the samples of every collector of r.
+func (r *Registry) Collect() *Writer {
+	r.Lock()
+	ids := make([]int, 0, len(r.collectors))
+	for id := range r.collectors {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	collectors := make([]func(w *Writer), len(ids))
+	for i, id := range ids {
+		collectors[i] = r.collectors[id]
+	}
+	r.Unlock()
+
+	w := &Writer{families: map[string]*family{}}
+	for _, collect := range collectors {
+		collect(w)
+	}
+	return w
+}
+
+// ServeHTTP writes the metrics of r in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	samples := r.Collect()
+	w.Header().Set("Content-Type", ContentType)
+	if req.Method == http.MethodHead {
+		return
+	}
+	samples.WriteTo(w)
+}
+
+// A Writer gathers the samples written by collectors, grouping them by
+// metric.
+type Writer struct {
+	families map[string]*family
+}
+
+// family is a metric and its samples.
+type family struct {
+	name, help, kind string
+	samples          []sample
+}
+
+type sample struct {
+	labels string // formatted, such as `{guild="123"}`
+	value  float64
+}
+
+// Counter writes a sample of the counter name. labels are pairs of label
+// names and values, such as "guild", "1234".
+func (w *Writer) Counter(name, help string, value float64, labels ...string) {
+	w.add(name, help, "counter", value, labels)
+}
+
+// Gauge writes a sample of the gauge name, which may go up and down.
+func (w *Writer) Gauge(name, help string, value float64, labels ...string) {
+	w.add(name, help, "gauge", value, labels)
+}
+
+func (w *Writer) add(name, help, kind string, value float64, labels []string) {
+	f := w.families[name]
+	if f == nil {
+		f = &family{name: name, help: help, kind: kind}
+		w.families[name] = f
+	}
+	f.samples = append(f.samples, sample{formatLabels(labels), value})
+}
+
+// Value returns the value of the sample of name with labels, and whether
+// there is one.
+func (w *Writer) Value(name string, labels ...string) (float64, bool) {
+	f := w.families[name]
+	if f == nil {
+		return 0, false
+	}
+	want := formatLabels(labels)
+	for _, s := range f.samples {
+		if s.labels == want {
+			return s.value, true
+		}
+	}
+	return 0, false
+}
+
+// WriteTo writes the samples in the Prometheus text format, sorted by
+// metric name.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	names := make([]string, 0, len(w.families))
+	for name := range w.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := w.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.samples {
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, s.labels, formatValue(s.value))
+		}
+	}
+	n, err := io.WriteString(out, b.String())
+	return int64(n), err
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// formatLabels returns the label set of name and value pairs, or "" if
+// there are none. A name without a value is dropped.
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
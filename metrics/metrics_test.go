@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	var c Counter
+	c.Add(2)
+	c.Inc()
+	r.Register(func(w *Writer) {
+		w.Counter("b_total", "Things counted.", float64(c.Value()), "guild", "1")
+		w.Gauge("a", "A gauge\nwith a \\ in its help.", 0.5)
+	})
+	unregister := r.Register(func(w *Writer) {
+		w.Counter("b_total", "Things counted.", 4, "guild", `say "hi"`)
+	})
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	get := func() string {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+			t.Errorf("Content-Type incorrect: got %q, want %q", ct, ContentType)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	want := "# HELP a A gauge\\nwith a \\\\ in its help.\n" +
+		"# TYPE a gauge\n" +
+		"a 0.5\n" +
+		"# HELP b_total Things counted.\n" +
+		"# TYPE b_total counter\n" +
+		"b_total{guild=\"1\"} 3\n" +
+		"b_total{guild=\"say \\\"hi\\\"\"} 4\n"
+	if got := get(); got != want {
+		t.Errorf("metrics incorrect: got\n%s\nwant\n%s", got, want)
+	}
+
+	unregister()
+	if got := get(); strings.Contains(got, "say") {
+		t.Errorf("metrics after unregistering incorrect: got\n%s", got)
+	}
+
+	resp, err := http.Post(srv.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Post returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Post status incorrect: got %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	s, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	vc := &discordgo.VoiceConnection{GuildID: "123", OpusSend: make(chan []byte, 4)}
+	vc.OpusSend <- []byte{1}
+	var audio Audio
+	audio.Underruns.Inc()
+	audio.Dropped.Inc()
+
+	r := NewRegistry()
+	r.Register(Session(s))
+	r.Register(Voice(vc))
+	r.Register(func(w *Writer) { audio.Collect(w, "guild", "123") })
+	w := r.Collect()
+
+	for _, tt := range []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"discord_gateway_up", nil, 0},
+		{"discord_gateway_reconnects_total", nil, 0},
+		{"discord_rest_ratelimit_waits_total", nil, 0},
+		{"discord_voice_ready", []string{"guild", "123"}, 0},
+		{"discord_voice_send_queue_depth", []string{"guild", "123"}, 1},
+		{"discord_voice_send_queue_capacity", []string{"guild", "123"}, 4},
+		{"discord_voice_packets_received_total", []string{"guild", "123"}, 0},
+		{"audio_output_underruns_total", []string{"guild", "123"}, 1},
+		{"audio_encode_errors_total", []string{"guild", "123"}, 0},
+		{"audio_frames_dropped_total", []string{"guild", "123"}, 1},
+	} {
+		got, ok := w.Value(tt.name, tt.labels...)
+		if !ok || got != tt.want {
+			t.Errorf("%s%v incorrect: got %v (%t), want %v", tt.name, tt.labels, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package mixer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// minGain and maxGain bound the db option of /mix gain.
+var (
+	minGain = float64(MinGain)
+	maxGain = float64(MaxGain)
+)
+
+// userOption is the user option of the /mix subcommands.
+var userOption = &discordgo.ApplicationCommandOption{
+	Type:        discordgo.ApplicationCommandOptionUser,
+	Name:        "user",
+	Description: "User in the voice channel",
+	Required:    true,
+}
+
+// Command is the /mix application command handled by HandleInteraction.
+var Command = &discordgo.ApplicationCommand{
+	Name:        "mix",
+	Description: "Set how loud each user is through the room speaker",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "gain",
+			Description: "Make a user louder or quieter",
+			Options: []*discordgo.ApplicationCommandOption{
+				userOption,
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "db",
+					Description: "Gain in dB, e.g. -6 for half as loud",
+					Required:    true,
+					MinValue:    &minGain,
+					MaxValue:    maxGain,
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "mute",
+			Description: "Leave a user out of the room speaker",
+			Options: []*discordgo.ApplicationCommandOption{
+				userOption,
+				{Type: discordgo.ApplicationCommandOptionBoolean, Name: "on", Description: "Mute (default) or unmute"},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "solo",
+			Description: "Play only soloed users through the room speaker",
+			Options: []*discordgo.ApplicationCommandOption{
+				userOption,
+				{Type: discordgo.ApplicationCommandOptionBoolean, Name: "on", Description: "Solo (default) or unsolo"},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "auto",
+			Description: "Even out everyone's loudness automatically",
+			Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionBoolean, Name: "on", Description: "On or off", Required: true},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "reset",
+			Description: "Clear a user's settings, or everyone's",
+			Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "User to reset"},
+			},
+		},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "show", Description: "Show the mix settings"},
+	},
+}
+
+// HandleInteraction answers /mix commands. Other interactions are ignored.
+func (m *Mixer) HandleInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return nil
+	}
+	data := i.ApplicationCommandData()
+	if data.Name != Command.Name || len(data.Options) == 0 {
+		return nil
+	}
+	content, ephemeral := m.command(data.Options[0])
+	resp := &discordgo.InteractionResponseData{
+		Content: content,
+		// Name users without notifying them.
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}
+	if ephemeral {
+		resp.Flags = discordgo.MessageFlagsEphemeral
+	}
+	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: resp,
+	})
+}
+
+// command runs a /mix subcommand, returning the reply and whether it is
+// only for the user.
+func (m *Mixer) command(sub *discordgo.ApplicationCommandInteractionDataOption) (string, bool) {
+	opts := map[string]*discordgo.ApplicationCommandInteractionDataOption{}
+	for _, o := range sub.Options {
+		opts[o.Name] = o
+	}
+	var userID string
+	if o := opts["user"]; o != nil {
+		userID = o.UserValue(nil).ID
+	}
+	on := func() bool {
+		return opts["on"] == nil || opts["on"].BoolValue()
+	}
+
+	var reply string
+	var err error
+	switch sub.Name {
+	case "gain":
+		if userID == "" || opts["db"] == nil {
+			return "No user or gain given.", true
+		}
+		db := opts["db"].FloatValue()
+		err = m.Update(userID, func(st *Settings) { st.Gain = db })
+		reply = fmt.Sprintf("<@%s> is at %s.", userID, formatGain(m.User(userID).Gain))
+	case "mute":
+		if userID == "" {
+			return "No user given.", true
+		}
+		muted := on()
+		err = m.Update(userID, func(st *Settings) { st.Mute = muted })
+		reply = fmt.Sprintf("<@%s> is muted.", userID)
+		if !muted {
+			reply = fmt.Sprintf("<@%s> is unmuted.", userID)
+		}
+	case "solo":
+		if userID == "" {
+			return "No user given.", true
+		}
+		solo := on()
+		err = m.Update(userID, func(st *Settings) { st.Solo = solo })
+		reply = fmt.Sprintf("<@%s> is soloed.", userID)
+		if !solo {
+			reply = fmt.Sprintf("<@%s> is no longer soloed.", userID)
+		}
+	case "auto":
+		auto := on()
+		err = m.SetAuto(auto)
+		reply = fmt.Sprintf("Automatic loudness is on, at %g LUFS.", m.Target)
+		if !auto {
+			reply = "Automatic loudness is off."
+		}
+	case "reset":
+		if userID == "" {
+			err = m.Reset()
+			reply = "Everyone's mix settings are cleared."
+		} else {
+			err = m.Set(userID, Settings{})
+			reply = fmt.Sprintf("<@%s>'s mix settings are cleared.", userID)
+		}
+	case "show":
+		return m.summary(), true
+	default:
+		return "Unknown command.", true
+	}
+	if err != nil {
+		return reply + " It could not be saved: " + err.Error(), false
+	}
+	return reply, false
+}
+
+// summary describes the settings of every user.
+func (m *Mixer) summary() string {
+	var b strings.Builder
+	if m.Auto() {
+		fmt.Fprintf(&b, "Automatic loudness: on, at %g LUFS\n", m.Target)
+	} else {
+		b.WriteString("Automatic loudness: off\n")
+	}
+	users := m.Users()
+	if len(users) == 0 {
+		b.WriteString("Everyone is at 0 dB.")
+		return b.String()
+	}
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		st := users[id]
+		fmt.Fprintf(&b, "<@%s>: %s", id, formatGain(st.Gain))
+		if st.Mute {
+			b.WriteString(", muted")
+		}
+		if st.Solo {
+			b.WriteString(", soloed")
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func formatGain(db float64) string {
+	return fmt.Sprintf("%+g dB", db)
+}
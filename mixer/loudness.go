@@ -0,0 +1,124 @@
+package mixer
+
+import "math"
+
+// Loudness normalisation follows EBU R128: audio is K-weighted as in
+// ITU-R BS.1770 and its short-term loudness measured over the last 3
+// seconds, in 100ms blocks.
+const (
+	blockSize   = 4800 // 100ms at 48kHz
+	shortBlocks = 30   // 3s
+
+	// gateLUFS is the loudness below which a block is left out of the
+	// measurement, so that background noise between words is not boosted.
+	gateLUFS = -50
+
+	// maxBoost and maxCut limit the gain of normalisation, in dB.
+	maxBoost = 15
+	maxCut   = 30
+
+	// riseStep and fallStep are the most the gain changes per frame of
+	// 20ms, in dB: slowly up, so that a pause does not end in a burst,
+	// and quickly down.
+	riseStep = 0.1
+	fallStep = 0.5
+)
+
+// A biquad is a second-order IIR filter.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the two stages of the K-weighting filter at 48kHz: a
+// high shelf modelling the head, and a high-pass.
+func kWeighting() [2]biquad {
+	return [2]biquad{
+		{b0: 1.53512485958697, b1: -2.69169618940638, b2: 1.19839281085285, a1: -1.69065929318241, a2: 0.73248077421585},
+		{b0: 1, b1: -2, b2: 1, a1: -1.99004745483398, a2: 0.99007225036621},
+	}
+}
+
+// A normalizer measures the short-term loudness of a speaker and follows
+// it with a gain bringing them to a target loudness.
+type normalizer struct {
+	k      [2]biquad
+	sum    float64 // of the squares of the weighted samples in the block
+	n      int     // samples in the block
+	blocks [shortBlocks]float64
+	next   int // index in blocks of the next block
+	count  int // blocks measured, up to shortBlocks
+	gain   float64
+}
+
+func newNormalizer() *normalizer {
+	return &normalizer{k: kWeighting()}
+}
+
+// measure adds pcm to the measurement.
+func (n *normalizer) measure(pcm []int16) {
+	for _, s := range pcm {
+		x := float64(s) / 32768
+		x = n.k[1].filter(n.k[0].filter(x))
+		n.sum += x * x
+		if n.n++; n.n < blockSize {
+			continue
+		}
+		ms := n.sum / blockSize
+		n.sum, n.n = 0, 0
+		if lufs(ms) < gateLUFS {
+			continue
+		}
+		n.blocks[n.next] = ms
+		n.next = (n.next + 1) % shortBlocks
+		if n.count < shortBlocks {
+			n.count++
+		}
+	}
+}
+
+// loudness returns the short-term loudness in LUFS, and false before a
+// block has been measured.
+func (n *normalizer) loudness() (float64, bool) {
+	if n.count == 0 {
+		return 0, false
+	}
+	var sum float64
+	for _, ms := range n.blocks[:n.count] {
+		sum += ms
+	}
+	return lufs(sum / float64(n.count)), true
+}
+
+// process measures pcm and returns the gain in dB bringing it towards
+// target.
+func (n *normalizer) process(pcm []int16, target float64) float64 {
+	n.measure(pcm)
+	l, ok := n.loudness()
+	if !ok {
+		return n.gain
+	}
+	want := math.Max(-maxCut, math.Min(target-l, maxBoost))
+	switch {
+	case want > n.gain:
+		n.gain = math.Min(want, n.gain+riseStep)
+	case want < n.gain:
+		n.gain = math.Max(want, n.gain-fallStep)
+	}
+	return n.gain
+}
+
+// lufs returns the loudness of K-weighted audio whose mean square is ms.
+func lufs(ms float64) float64 {
+	if ms <= 0 {
+		return math.Inf(-1)
+	}
+	return -0.691 + 10*math.Log10(ms)
+}
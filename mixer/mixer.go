@@ -0,0 +1,359 @@
+// Package mixer sets how loud each user is in the mix played into the room,
+// so that a participant far louder or quieter than the others can be
+// evened out.
+//
+// A Mixer holds a gain, mute and solo setting for each user, keyed by
+// their user ID and applied to the audio of each SSRC the voice gateway
+// reports they speak with. It can also normalise each speaker's loudness
+// automatically. Settings are changed with the /mix command or over HTTP,
+// and saved to a file so that they survive a restart.
+package mixer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// DefaultTarget is the loudness speakers are normalised to, in LUFS, as
+// recommended by EBU R128.
+const DefaultTarget = -23
+
+// Limits of the gain of a user, in dB.
+const (
+	MinGain = -30
+	MaxGain = 20
+)
+
+// Settings are the mix settings of a user.
+type Settings struct {
+	// Gain is added to the user's audio, in dB.
+	Gain float64 `json:"gain_db"`
+	// Mute leaves the user out of the mix.
+	Mute bool `json:"mute"`
+	// Solo leaves everyone who is not soloed out of the mix.
+	Solo bool `json:"solo"`
+}
+
+// file is what a Mixer saves.
+type file struct {
+	Auto  bool                `json:"auto"`
+	Users map[string]Settings `json:"users"`
+}
+
+// A Mixer applies the mix settings of each user to their audio.
+type Mixer struct {
+	// Target is the loudness speakers are normalised to in automatic
+	// mode, in LUFS.
+	Target float64
+
+	path   string
+	saving sync.Mutex // held while saving, so that saves don't overtake each other
+
+	sync.Mutex
+	auto        bool
+	users       map[string]Settings
+	ssrcs       map[uint32]string // user IDs by SSRC
+	normalizers map[uint32]*normalizer
+}
+
+// New returns a Mixer without settings, which are not saved.
+func New() *Mixer {
+	return &Mixer{
+		Target:      DefaultTarget,
+		users:       map[string]Settings{},
+		ssrcs:       map[uint32]string{},
+		normalizers: map[uint32]*normalizer{},
+	}
+}
+
+// Load returns a Mixer with the settings saved in path, which it saves
+// its settings to when they change. A missing file has no settings.
+func Load(path string) (*Mixer, error) {
+	m := New()
+	m.path = path
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	m.auto = f.Auto
+	for id, st := range f.Users {
+		m.users[id] = st
+	}
+	return m, nil
+}
+
+// save writes the settings to the file of m, if it has one, replacing it
+// at once so that a crash can't leave it half written. m must not be
+// locked: only the settings are copied under the lock, as Process waits
+// for it on the audio path.
+func (m *Mixer) save() error {
+	if m.path == "" {
+		return nil
+	}
+	m.saving.Lock()
+	defer m.saving.Unlock()
+	m.Lock()
+	b, err := json.MarshalIndent(file{Auto: m.auto, Users: m.users}, "", "  ")
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// SetUser records the user speaking with ssrc.
+func (m *Mixer) SetUser(ssrc uint32, userID string) {
+	m.Lock()
+	defer m.Unlock()
+	m.ssrcs[ssrc] = userID
+}
+
+// SpeakingUpdate records the user of an SSRC. It can be added as a
+// handler of the voice connection.
+func (m *Mixer) SpeakingUpdate(vc *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+	if vs.UserID != "" {
+		m.SetUser(uint32(vs.SSRC), vs.UserID)
+	}
+}
+
+// RemoveUser forgets the SSRCs of a user who left the channel, and the
+// loudness measured of them. Their settings are kept.
+func (m *Mixer) RemoveUser(userID string) {
+	m.Lock()
+	defer m.Unlock()
+	for ssrc, id := range m.ssrcs {
+		if id == userID {
+			delete(m.ssrcs, ssrc)
+			delete(m.normalizers, ssrc)
+		}
+	}
+}
+
+// User returns the settings of a user.
+func (m *Mixer) User(userID string) Settings {
+	m.Lock()
+	defer m.Unlock()
+	return m.users[userID]
+}
+
+// Users returns the settings of the users who have any.
+func (m *Mixer) Users() map[string]Settings {
+	m.Lock()
+	defer m.Unlock()
+	users := make(map[string]Settings, len(m.users))
+	for id, st := range m.users {
+		users[id] = st
+	}
+	return users
+}
+
+// Set sets the settings of a user, limiting their gain to between MinGain
+// and MaxGain, and saves them. The zero Settings removes the user's.
+func (m *Mixer) Set(userID string, st Settings) error {
+	m.Lock()
+	m.set(userID, st)
+	m.Unlock()
+	return m.save()
+}
+
+// Update changes the settings of a user with f and saves them.
+func (m *Mixer) Update(userID string, f func(st *Settings)) error {
+	m.Lock()
+	st := m.users[userID]
+	f(&st)
+	m.set(userID, st)
+	m.Unlock()
+	return m.save()
+}
+
+func (m *Mixer) set(userID string, st Settings) {
+	st.Gain = math.Max(MinGain, math.Min(st.Gain, MaxGain))
+	if st == (Settings{}) {
+		delete(m.users, userID)
+	} else {
+		m.users[userID] = st
+	}
+}
+
+// Reset removes the settings of every user and saves them.
+func (m *Mixer) Reset() error {
+	m.Lock()
+	m.users = map[string]Settings{}
+	m.Unlock()
+	return m.save()
+}
+
+// Auto reports whether loudness is normalised automatically.
+func (m *Mixer) Auto() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.auto
+}
+
+// SetAuto turns automatic loudness normalisation on or off and saves it.
+// Each user's gain is applied on top.
+func (m *Mixer) SetAuto(auto bool) error {
+	m.Lock()
+	m.auto = auto
+	m.Unlock()
+	return m.save()
+}
+
+// Loudness returns the short-term loudness of each user measured in
+// automatic mode, in LUFS.
+func (m *Mixer) Loudness() map[string]float64 {
+	m.Lock()
+	defer m.Unlock()
+	loudness := map[string]float64{}
+	for ssrc, n := range m.normalizers {
+		userID := m.ssrcs[ssrc]
+		if l, ok := n.loudness(); ok && userID != "" {
+			loudness[userID] = math.Round(l*10) / 10
+		}
+	}
+	return loudness
+}
+
+// Process applies the settings of the user speaking with ssrc to a frame
+// of their decoded 48kHz mono audio.
+func (m *Mixer) Process(ssrc uint32, pcm []int16) {
+	m.Lock()
+	defer m.Unlock()
+
+	userID := m.ssrcs[ssrc]
+	st := m.users[userID]
+	if st.Mute || !st.Solo && m.soloing() {
+		for i := range pcm {
+			pcm[i] = 0
+		}
+		return
+	}
+
+	gain := st.Gain
+	if m.auto {
+		n := m.normalizers[ssrc]
+		if n == nil {
+			n = newNormalizer()
+			m.normalizers[ssrc] = n
+		}
+		gain += n.process(pcm, m.Target)
+	}
+	if gain == 0 {
+		return
+	}
+	g := math.Pow(10, gain/20)
+	for i, s := range pcm {
+		v := float64(s) * g
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		pcm[i] = int16(v)
+	}
+}
+
+// soloing reports whether any user is soloed.
+func (m *Mixer) soloing() bool {
+	for _, st := range m.users {
+		if st.Solo {
+			return true
+		}
+	}
+	return false
+}
+
+// state is the body of the responses of ServeHTTP.
+type state struct {
+	Auto     bool                `json:"auto"`
+	Target   float64             `json:"target_lufs"`
+	Users    map[string]Settings `json:"users"`
+	Loudness map[string]float64  `json:"loudness"`
+}
+
+// request is the body posted to ServeHTTP, changing the fields set.
+type request struct {
+	User  string   `json:"user"`
+	Gain  *float64 `json:"gain_db"`
+	Mute  *bool    `json:"mute"`
+	Solo  *bool    `json:"solo"`
+	Reset bool     `json:"reset"` // the user's settings, or everyone's
+	Auto  *bool    `json:"auto"`
+}
+
+// ServeHTTP serves the settings as JSON on GET, and changes them on POST
+// of a JSON object such as {"user": "123", "gain_db": -6} or
+// {"auto": true}, responding with the new settings.
+func (m *Mixer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req request
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.apply(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(state{m.Auto(), m.Target, m.Users(), m.Loudness()})
+}
+
+// apply makes the changes of a request.
+func (m *Mixer) apply(req *request) error {
+	if req.Auto != nil {
+		if err := m.SetAuto(*req.Auto); err != nil {
+			return err
+		}
+	}
+	if req.Reset && req.User == "" {
+		return m.Reset()
+	}
+	if req.User == "" {
+		return nil
+	}
+	return m.Update(req.User, func(st *Settings) {
+		if req.Reset {
+			*st = Settings{}
+		}
+		if req.Gain != nil {
+			st.Gain = *req.Gain
+		}
+		if req.Mute != nil {
+			st.Mute = *req.Mute
+		}
+		if req.Solo != nil {
+			st.Solo = *req.Solo
+		}
+	})
+}
@@ -0,0 +1,251 @@
+package mixer
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/bwmarrin/discordgo/discordtest"
+)
+
+func frame(v int16) []int16 {
+	pcm := make([]int16, 960)
+	for i := range pcm {
+		pcm[i] = v
+	}
+	return pcm
+}
+
+func TestMixer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mix.json")
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load of missing file returned error: %v", err)
+	}
+	m.SpeakingUpdate(nil, &discordgo.VoiceSpeakingUpdate{UserID: "ann", SSRC: 1, Speaking: true})
+	m.SetUser(2, "bob")
+
+	if err := m.Set("ann", Settings{Gain: -6}); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	pcm := frame(1000)
+	m.Process(1, pcm)
+	if pcm[0] != 501 {
+		t.Errorf("sample at -6 dB incorrect: got %d, want 501", pcm[0])
+	}
+	m.Set("bob", Settings{Gain: 100})
+	if got := m.User("bob").Gain; got != MaxGain {
+		t.Errorf("Gain incorrect: got %v, want %v", got, MaxGain)
+	}
+	pcm = frame(10000)
+	m.Process(2, pcm)
+	if pcm[0] != 32767 {
+		t.Errorf("boosted sample incorrect: got %d, want 32767", pcm[0])
+	}
+
+	// Muted users are silent, and while anyone is soloed so is everyone
+	// else, unknown speakers included.
+	m.Update("bob", func(st *Settings) { st.Mute = true })
+	pcm = frame(1000)
+	if m.Process(2, pcm); pcm[0] != 0 {
+		t.Errorf("muted sample incorrect: got %d, want 0", pcm[0])
+	}
+	m.Set("bob", Settings{})
+	m.Update("ann", func(st *Settings) { st.Solo = true })
+	for _, ssrc := range []uint32{2, 3} {
+		pcm = frame(1000)
+		if m.Process(ssrc, pcm); pcm[0] != 0 {
+			t.Errorf("sample of SSRC %d during solo incorrect: got %d, want 0", ssrc, pcm[0])
+		}
+	}
+	pcm = frame(1000)
+	if m.Process(1, pcm); pcm[0] != 501 {
+		t.Errorf("soloed sample incorrect: got %d, want 501", pcm[0])
+	}
+	m.SetAuto(true)
+
+	// The settings survive a restart.
+	m, err = Load(path)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	users := m.Users()
+	if len(users) != 1 || users["ann"] != (Settings{Gain: -6, Solo: true}) || !m.Auto() {
+		t.Errorf("loaded settings incorrect: got %+v, auto %t", users, m.Auto())
+	}
+	if err := m.Reset(); err != nil || len(m.Users()) != 0 {
+		t.Errorf("Reset incorrect: got %+v, %v", m.Users(), err)
+	}
+}
+
+// sine returns a frame of a 1kHz sine wave of amplitude a, from sample n.
+func sine(a float64, n int) []int16 {
+	pcm := make([]int16, 960)
+	for i := range pcm {
+		pcm[i] = int16(a * 32767 * math.Sin(2*math.Pi*1000*float64(n+i)/48000))
+	}
+	return pcm
+}
+
+func TestNormalize(t *testing.T) {
+	m := New()
+	m.SetUser(1, "quiet")
+	m.SetUser(2, "loud")
+	m.SetAuto(true)
+
+	// 5 seconds of each speaker, one 40 dB too quiet and one 13 dB too
+	// loud.
+	var quiet, loud []int16
+	for n := 0; n < 5*48000; n += 960 {
+		quiet = sine(0.01, n)
+		m.Process(1, quiet)
+		loud = sine(0.5, n)
+		m.Process(2, loud)
+	}
+
+	loudness := m.Loudness()
+	if l := loudness["quiet"]; math.Abs(l-(-43)) > 0.5 {
+		t.Errorf("loudness of quiet speaker incorrect: got %v, want -43", l)
+	}
+	if l := loudness["loud"]; math.Abs(l-(-9)) > 0.5 {
+		t.Errorf("loudness of loud speaker incorrect: got %v, want -9", l)
+	}
+	// The quiet speaker is boosted by at most maxBoost.
+	if got, want := peakOf(quiet), 0.01*math.Pow(10, maxBoost/20.0); math.Abs(got-want) > 0.01 {
+		t.Errorf("peak of quiet speaker incorrect: got %.3f, want %.3f", got, want)
+	}
+	if got := peakOf(loud); math.Abs(got-0.1) > 0.01 {
+		t.Errorf("peak of loud speaker incorrect: got %.3f, want 0.1", got)
+	}
+
+	// A user leaving takes their loudness with them.
+	m.RemoveUser("loud")
+	if loudness := m.Loudness(); len(loudness) != 1 || len(m.normalizers) != 1 || m.ssrcs[2] != "" {
+		t.Errorf("loudness after RemoveUser incorrect: got %v, %d normalizers", loudness, len(m.normalizers))
+	}
+}
+
+func peakOf(pcm []int16) float64 {
+	var max float64
+	for _, s := range pcm {
+		max = math.Max(max, math.Abs(float64(s))/32767)
+	}
+	return max
+}
+
+func TestServeHTTP(t *testing.T) {
+	m := New()
+	post := func(body string) (int, state) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/mix", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		var st state
+		json.Unmarshal(rec.Body.Bytes(), &st)
+		return rec.Code, st
+	}
+
+	if code, st := post(`{"user": "ann", "gain_db": -6}`); code != http.StatusOK || st.Users["ann"].Gain != -6 {
+		t.Errorf("gain incorrect: got %d %+v", code, st)
+	}
+	if code, st := post(`{"user": "ann", "mute": true, "auto": true}`); code != http.StatusOK || st.Users["ann"] != (Settings{Gain: -6, Mute: true}) || !st.Auto {
+		t.Errorf("mute incorrect: got %d %+v", code, st)
+	}
+	if code, st := post(`{"user": "ann", "reset": true}`); code != http.StatusOK || len(st.Users) != 0 || st.Target != DefaultTarget {
+		t.Errorf("reset incorrect: got %d %+v", code, st)
+	}
+	if code, _ := post(`{"user": `); code != http.StatusBadRequest {
+		t.Errorf("invalid body incorrect: got %d, want 400", code)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/mix", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("delete incorrect: got %d, want 405", rec.Code)
+	}
+}
+
+// interactionResponse is the part of an interaction response checked by
+// the tests.
+type interactionResponse struct {
+	Type discordgo.InteractionResponseType
+	Data struct {
+		Content         string
+		Flags           discordgo.MessageFlags
+		AllowedMentions *discordgo.MessageAllowedMentions `json:"allowed_mentions"`
+	}
+}
+
+func TestHandleInteraction(t *testing.T) {
+	srv, err := discordtest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer returned error: %v", err)
+	}
+	defer srv.Close()
+
+	responses := make(chan interactionResponse, 10)
+	srv.HandleFunc("POST", "/interactions/*/*/callback", func(w http.ResponseWriter, r *http.Request) {
+		var resp interactionResponse
+		json.NewDecoder(r.Body).Decode(&resp)
+		responses <- resp
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	s, _ := discordgo.New("Bot token")
+	s.Client = srv.Client()
+	m := New()
+
+	command := func(name string, options ...*discordgo.ApplicationCommandInteractionDataOption) interactionResponse {
+		t.Helper()
+		i := &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			ID: "5", Token: "tok", Type: discordgo.InteractionApplicationCommand, GuildID: "1",
+			Data: discordgo.ApplicationCommandInteractionData{Name: "mix", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: name, Type: discordgo.ApplicationCommandOptionSubCommand, Options: options},
+			}},
+		}}
+		if err := m.HandleInteraction(s, i); err != nil {
+			t.Fatalf("HandleInteraction returned error: %v", err)
+		}
+		select {
+		case resp := <-responses:
+			return resp
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a response")
+		}
+		return interactionResponse{}
+	}
+	user := &discordgo.ApplicationCommandInteractionDataOption{Name: "user", Type: discordgo.ApplicationCommandOptionUser, Value: "42"}
+	on := func(b bool) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: "on", Type: discordgo.ApplicationCommandOptionBoolean, Value: b}
+	}
+
+	resp := command("gain", user, &discordgo.ApplicationCommandInteractionDataOption{Name: "db", Type: discordgo.ApplicationCommandOptionNumber, Value: -6.0})
+	if resp.Data.Content != "<@42> is at -6 dB." || resp.Data.AllowedMentions == nil {
+		t.Errorf("response to gain incorrect: %+v", resp.Data)
+	}
+	if resp := command("mute", user); resp.Data.Content != "<@42> is muted." || !m.User("42").Mute {
+		t.Errorf("response to mute incorrect: %q", resp.Data.Content)
+	}
+	if resp := command("solo", user, on(false)); resp.Data.Content != "<@42> is no longer soloed." {
+		t.Errorf("response to solo incorrect: %q", resp.Data.Content)
+	}
+	if resp := command("auto", on(true)); !strings.HasPrefix(resp.Data.Content, "Automatic loudness is on") || !m.Auto() {
+		t.Errorf("response to auto incorrect: %q", resp.Data.Content)
+	}
+
+	resp = command("show")
+	want := "Automatic loudness: on, at -23 LUFS\n<@42>: -6 dB, muted"
+	if resp.Data.Flags != discordgo.MessageFlagsEphemeral || resp.Data.Content != want {
+		t.Errorf("response to show incorrect: got %q, want %q", resp.Data.Content, want)
+	}
+	if resp := command("reset"); len(m.Users()) != 0 {
+		t.Errorf("response to reset incorrect: %q", resp.Data.Content)
+	}
+}
@@ -0,0 +1,373 @@
+package oggopus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Ogg page header, from RFC 3533.
+const (
+	pageHeaderSize = 27
+	maxSegments    = 255
+
+	flagContinued = 0x01
+	flagBOS       = 0x02
+	flagEOS       = 0x04
+)
+
+// crcTable is the Ogg CRC-32: polynomial 0x04c11db7, not reflected, with no
+// initial or final xor.
+var crcTable = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func crcUpdate(crc uint32, b []byte) uint32 {
+	for _, v := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// A page is an Ogg page.
+type page struct {
+	flags    byte
+	granule  int64
+	serial   uint32
+	sequence uint32
+	segments []byte
+	body     []byte
+}
+
+// readPage reads a page from r into p, reusing its buffers.
+func readPage(r io.Reader, p *page) error {
+	var hdr [pageHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrFormat
+		}
+		return err
+	}
+	if string(hdr[:4]) != "OggS" || hdr[4] != 0 {
+		return ErrFormat
+	}
+
+	p.flags = hdr[5]
+	p.granule = int64(binary.LittleEndian.Uint64(hdr[6:]))
+	p.serial = binary.LittleEndian.Uint32(hdr[14:])
+	p.sequence = binary.LittleEndian.Uint32(hdr[18:])
+	checksum := binary.LittleEndian.Uint32(hdr[22:])
+
+	p.segments = append(p.segments[:0], make([]byte, hdr[26])...)
+	if _, err := io.ReadFull(r, p.segments); err != nil {
+		return ErrFormat
+	}
+	size := 0
+	for _, s := range p.segments {
+		size += int(s)
+	}
+	if cap(p.body) < size {
+		p.body = make([]byte, size)
+	}
+	p.body = p.body[:size]
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return ErrFormat
+	}
+
+	binary.LittleEndian.PutUint32(hdr[22:], 0)
+	crc := crcUpdate(0, hdr[:])
+	crc = crcUpdate(crc, p.segments)
+	crc = crcUpdate(crc, p.body)
+	if crc != checksum {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// writePage writes p to w.
+func writePage(w io.Writer, p *page) error {
+	hdr := make([]byte, pageHeaderSize, pageHeaderSize+len(p.segments))
+	copy(hdr, "OggS")
+	hdr[5] = p.flags
+	binary.LittleEndian.PutUint64(hdr[6:], uint64(p.granule))
+	binary.LittleEndian.PutUint32(hdr[14:], p.serial)
+	binary.LittleEndian.PutUint32(hdr[18:], p.sequence)
+	hdr[26] = byte(len(p.segments))
+	hdr = append(hdr, p.segments...)
+
+	crc := crcUpdate(crcUpdate(0, hdr), p.body)
+	binary.LittleEndian.PutUint32(hdr[22:], crc)
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(p.body)
+	return err
+}
+
+// lacing returns the segment table entries of a packet of n bytes.
+func lacing(segments []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		segments = append(segments, 255)
+	}
+	return append(segments, byte(n))
+}
+
+// ------------------------------------------------------------------------------------------------
+// Reader
+// ------------------------------------------------------------------------------------------------
+
+// A Reader reads the Opus packets of the first logical stream in an Ogg
+// file, page by page. Pages of other streams are skipped.
+type Reader struct {
+	Head Head
+	Tags Tags
+
+	r       *bufio.Reader
+	page    page
+	serial  uint32
+	seg     int // next segment of page
+	off     int // offset of that segment in page.body
+	packet  []byte
+	granule int64 // of the last page read
+	eos     bool
+}
+
+// NewReader reads the headers of an Ogg Opus stream from r.
+func NewReader(r io.Reader) (*Reader, error) {
+
+	or := &Reader{r: bufio.NewReader(r)}
+
+	if err := readPage(or.r, &or.page); err != nil {
+		if err == io.EOF {
+			err = ErrFormat
+		}
+		return nil, err
+	}
+	if or.page.flags&flagBOS == 0 {
+		return nil, ErrFormat
+	}
+	or.serial = or.page.serial
+
+	head, err := or.nextPacket()
+	if err != nil {
+		return nil, ErrFormat
+	}
+	if or.Head, err = parseHead(head); err != nil {
+		return nil, err
+	}
+
+	tags, err := or.nextPacket()
+	if err != nil {
+		return nil, ErrFormat
+	}
+	if or.Tags, err = parseTags(tags); err != nil {
+		return nil, err
+	}
+
+	return or, nil
+}
+
+// ReadPacket returns the next Opus packet, valid until the following call.
+// It returns io.EOF at the end of the stream.
+func (or *Reader) ReadPacket() ([]byte, error) {
+	return or.nextPacket()
+}
+
+// Granule returns the granule position of the last page read, the number
+// of samples at 48kHz, including pre-skip, up to the end of the last packet
+// completed on that page.
+func (or *Reader) Granule() int64 {
+	return or.granule
+}
+
+// nextPacket reassembles the next packet of the stream.
+func (or *Reader) nextPacket() ([]byte, error) {
+	or.packet = or.packet[:0]
+	for {
+		for or.seg < len(or.page.segments) {
+			n := int(or.page.segments[or.seg])
+			or.packet = append(or.packet, or.page.body[or.off:or.off+n]...)
+			or.seg++
+			or.off += n
+			if n < 255 {
+				return or.packet, nil
+			}
+		}
+
+		if or.eos {
+			return nil, io.EOF
+		}
+		if err := or.readPage(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readPage reads the next page of the stream.
+func (or *Reader) readPage() error {
+	for {
+		if err := readPage(or.r, &or.page); err != nil {
+			if err == io.EOF && len(or.packet) > 0 {
+				return ErrFormat
+			}
+			return err
+		}
+		if or.page.serial != or.serial {
+			continue
+		}
+
+		// A packet continued from a lost page cannot be completed.
+		if or.page.flags&flagContinued == 0 {
+			or.packet = or.packet[:0]
+		}
+		or.seg, or.off = 0, 0
+		if or.page.granule != -1 {
+			or.granule = or.page.granule
+		}
+		or.eos = or.page.flags&flagEOS != 0
+		return nil
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// Writer
+// ------------------------------------------------------------------------------------------------
+
+// maxPageSamples is the duration after which the Writer ends a page.
+const maxPageSamples = SampleRate
+
+// A Writer writes Opus packets to an Ogg stream.
+type Writer struct {
+	w        io.Writer
+	page     page
+	samples  int // in the current page
+	granule  int64
+	sequence uint32
+	closed   bool
+}
+
+// NewWriter writes the headers of an Ogg Opus stream with the given serial
+// number to w. Tags.Vendor should be set.
+func NewWriter(w io.Writer, serial uint32, head Head, tags Tags) (*Writer, error) {
+
+	headPacket, err := head.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	ow := &Writer{w: w}
+	ow.page.serial = serial
+
+	// Each header has a page to itself, the first marked beginning of stream.
+	if err := ow.writeHeader(headPacket, flagBOS); err != nil {
+		return nil, err
+	}
+	if err := ow.writeHeader(tags.marshal(), 0); err != nil {
+		return nil, err
+	}
+
+	return ow, nil
+}
+
+// writeHeader writes a header packet on pages of its own. Only long tags
+// span several pages.
+func (ow *Writer) writeHeader(packet []byte, flags byte) error {
+	for {
+		p := page{flags: flags, serial: ow.page.serial, sequence: ow.sequence}
+		full := len(packet) >= 255*maxSegments
+		if full {
+			p.segments = bytes.Repeat([]byte{255}, maxSegments)
+			p.body = packet[:255*maxSegments]
+		} else {
+			p.segments = lacing(nil, len(packet))
+			p.body = packet
+		}
+
+		if err := writePage(ow.w, &p); err != nil {
+			return err
+		}
+		ow.sequence++
+		if !full {
+			return nil
+		}
+		packet = packet[255*maxSegments:]
+		flags = flagContinued
+	}
+}
+
+// WritePacket adds an Opus packet to the stream. Pages are written once
+// they hold a second of audio, or on Flush.
+func (ow *Writer) WritePacket(packet []byte) error {
+	samples, err := PacketSamples(packet)
+	if err != nil {
+		return err
+	}
+	return ow.writePacket(packet, samples)
+}
+
+// writePacket adds a packet of the given duration to the page.
+func (ow *Writer) writePacket(packet []byte, samples int) error {
+	if len(ow.page.segments)+len(packet)/255+1 > maxSegments {
+		if err := ow.Flush(); err != nil {
+			return err
+		}
+	}
+
+	ow.page.segments = lacing(ow.page.segments, len(packet))
+	ow.page.body = append(ow.page.body, packet...)
+	ow.samples += samples
+	ow.granule += int64(samples)
+
+	if ow.samples >= maxPageSamples {
+		return ow.Flush()
+	}
+	return nil
+}
+
+// Flush writes the packets added since the last page.
+func (ow *Writer) Flush() error {
+	return ow.flush(0)
+}
+
+// flush writes the current page with flags, if it holds any packets or is
+// the last page.
+func (ow *Writer) flush(flags byte) error {
+	if len(ow.page.segments) == 0 && flags&flagEOS == 0 {
+		return nil
+	}
+
+	ow.page.flags = flags
+	ow.page.granule = ow.granule
+	ow.page.sequence = ow.sequence
+	err := writePage(ow.w, &ow.page)
+	ow.sequence++
+	ow.page.segments = ow.page.segments[:0]
+	ow.page.body = ow.page.body[:0]
+	ow.samples = 0
+	return err
+}
+
+// Close writes the final page, marked end of stream. It does not close the
+// underlying writer.
+func (ow *Writer) Close() error {
+	if ow.closed {
+		return nil
+	}
+	ow.closed = true
+	return ow.flush(flagEOS)
+}
@@ -0,0 +1,200 @@
+// Package oggopus reads and writes Opus audio in Ogg containers, as
+// specified by RFC 7845.
+package oggopus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// SampleRate is the rate of Ogg Opus granule positions and Opus packet
+// durations, whatever the rate of the original audio.
+const SampleRate = 48000
+
+// Errors returned when reading streams.
+var (
+	ErrFormat   = errors.New("not an Ogg Opus stream")
+	ErrChecksum = errors.New("ogg page checksum mismatch")
+	ErrPacket   = errors.New("invalid opus packet")
+)
+
+// Head is the identification header of an Ogg Opus stream.
+type Head struct {
+	Version         uint8
+	Channels        uint8
+	PreSkip         uint16 // samples to discard from the start of the decoded audio
+	InputSampleRate uint32 // informational only
+	OutputGain      int16  // Q7.8 dB
+	MappingFamily   uint8
+
+	// Mapping is the channel mapping table, for mapping families other
+	// than 0.
+	Mapping []byte
+}
+
+// Tags is the comment header of an Ogg Opus stream.
+type Tags struct {
+	Vendor   string
+	Comments []string // "NAME=value"
+}
+
+const (
+	headMagic = "OpusHead"
+	tagsMagic = "OpusTags"
+)
+
+// parseHead parses an OpusHead packet.
+func parseHead(b []byte) (Head, error) {
+	if len(b) < 19 || !bytes.HasPrefix(b, []byte(headMagic)) {
+		return Head{}, ErrFormat
+	}
+
+	h := Head{
+		Version:         b[8],
+		Channels:        b[9],
+		PreSkip:         binary.LittleEndian.Uint16(b[10:]),
+		InputSampleRate: binary.LittleEndian.Uint32(b[12:]),
+		OutputGain:      int16(binary.LittleEndian.Uint16(b[16:])),
+		MappingFamily:   b[18],
+	}
+	if h.Version>>4 != 0 || h.Channels == 0 {
+		return Head{}, ErrFormat
+	}
+	if h.MappingFamily != 0 {
+		if len(b) < 21+int(h.Channels) {
+			return Head{}, ErrFormat
+		}
+		h.Mapping = append([]byte(nil), b[19:21+int(h.Channels)]...)
+	}
+
+	return h, nil
+}
+
+// marshal returns the OpusHead packet.
+func (h *Head) marshal() ([]byte, error) {
+	if h.Channels == 0 || (h.MappingFamily == 0 && h.Channels > 2) {
+		return nil, errors.New("unsupported channel count")
+	}
+
+	b := make([]byte, 19, 21+len(h.Mapping))
+	copy(b, headMagic)
+	b[8] = h.Version
+	if b[8] == 0 {
+		b[8] = 1
+	}
+	b[9] = h.Channels
+	binary.LittleEndian.PutUint16(b[10:], h.PreSkip)
+	binary.LittleEndian.PutUint32(b[12:], h.InputSampleRate)
+	binary.LittleEndian.PutUint16(b[16:], uint16(h.OutputGain))
+	b[18] = h.MappingFamily
+	if h.MappingFamily != 0 {
+		b = append(b, h.Mapping...)
+	}
+
+	return b, nil
+}
+
+// parseTags parses an OpusTags packet.
+func parseTags(b []byte) (Tags, error) {
+	if !bytes.HasPrefix(b, []byte(tagsMagic)) {
+		return Tags{}, ErrFormat
+	}
+	b = b[len(tagsMagic):]
+
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+
+	var t Tags
+	var ok bool
+	if t.Vendor, ok = next(); !ok || len(b) < 4 {
+		return Tags{}, ErrFormat
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		c, ok := next()
+		if !ok {
+			return Tags{}, ErrFormat
+		}
+		t.Comments = append(t.Comments, c)
+	}
+
+	return t, nil
+}
+
+// marshal returns the OpusTags packet.
+func (t *Tags) marshal() []byte {
+	b := []byte(tagsMagic)
+	put := func(s string) {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(s)))
+		b = append(b, s...)
+	}
+
+	put(t.Vendor)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(t.Comments)))
+	for _, c := range t.Comments {
+		put(c)
+	}
+	return b
+}
+
+// frameSamples is the duration of an Opus frame at 48kHz for each TOC
+// configuration, from RFC 6716 section 3.1.
+var frameSamples = [32]int{
+	480, 960, 1920, 2880, // SILK NB
+	480, 960, 1920, 2880, // SILK MB
+	480, 960, 1920, 2880, // SILK WB
+	480, 960, // Hybrid SWB
+	480, 960, // Hybrid FB
+	120, 240, 480, 960, // CELT NB
+	120, 240, 480, 960, // CELT WB
+	120, 240, 480, 960, // CELT SWB
+	120, 240, 480, 960, // CELT FB
+}
+
+// PacketSamples returns the duration of an Opus packet in samples at 48kHz.
+func PacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, ErrPacket
+	}
+
+	frames := 0
+	switch packet[0] & 0x03 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, ErrPacket
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	n := frames * frameSamples[packet[0]>>3]
+	if n == 0 || n > 5760 {
+		return 0, ErrPacket
+	}
+	return n, nil
+}
+
+// PacketChannels returns the number of channels coded in an Opus packet.
+func PacketChannels(packet []byte) int {
+	if len(packet) > 0 && packet[0]&0x04 != 0 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,259 @@
+package oggopus
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketSamples(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   int
+	}{
+		{[]byte{0xF8}, 960},            // CELT FB 20ms, one frame
+		{[]byte{0xFC}, 960},            // stereo
+		{[]byte{0x08 | 0x01}, 1920},    // SILK NB 20ms, two frames
+		{[]byte{0x18, 0}, 2880},        // SILK NB 60ms
+		{[]byte{0x80 | 0x03, 3}, 360},  // CELT NB 2.5ms, three frames
+		{[]byte{0x18 | 0x03, 2}, 5760}, // two 60ms frames
+		{[]byte{0x18 | 0x03, 3}, 0},    // too long
+		{[]byte{0x03}, 0},
+		{nil, 0},
+	}
+
+	for _, tt := range tests {
+		got, err := PacketSamples(tt.packet)
+		if tt.want == 0 {
+			if err != ErrPacket {
+				t.Errorf("PacketSamples(%x) error incorrect: got %v, want %v", tt.packet, err, ErrPacket)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("PacketSamples(%x) incorrect: got %d, %v, want %d", tt.packet, got, err, tt.want)
+		}
+	}
+}
+
+func TestWriterReader(t *testing.T) {
+	head := Head{Channels: 2, PreSkip: 312, InputSampleRate: 44100, OutputGain: -256}
+	tags := Tags{Vendor: "test", Comments: []string{"TITLE=t", strings.Repeat("X", 70000)}}
+
+	var b bytes.Buffer
+	w, err := NewWriter(&b, 42, head, tags)
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+
+	// 150 20ms packets make three pages of 50.
+	var packets [][]byte
+	for i := 0; i < 150; i++ {
+		p := append([]byte{0xFC}, bytes.Repeat([]byte{byte(i)}, i*3)...)
+		packets = append(packets, p)
+		if err := w.WritePacket(p); err != nil {
+			t.Fatalf("WritePacket returned error: %v", err)
+		}
+	}
+	if err := w.WritePacket([]byte{0x03}); err != ErrPacket {
+		t.Errorf("WritePacket of invalid packet error incorrect: got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	head.Version = 1
+	if !reflect.DeepEqual(r.Head, head) {
+		t.Errorf("Head incorrect: got %+v, want %+v", r.Head, head)
+	}
+	if !reflect.DeepEqual(r.Tags, tags) {
+		t.Errorf("Tags incorrect: got %q, want %q", r.Tags.Comments[0], tags.Comments[0])
+	}
+
+	for i, want := range packets {
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket %d returned error: %v", i, err)
+		}
+		if !bytes.Equal(p, want) {
+			t.Fatalf("packet %d incorrect: got %d bytes, want %d", i, len(p), len(want))
+		}
+		if i == 49 && r.Granule() != 50*960 {
+			t.Errorf("granule incorrect: got %d, want %d", r.Granule(), 50*960)
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("ReadPacket at end error incorrect: got %v, want EOF", err)
+	}
+	if r.Granule() != 150*960 {
+		t.Errorf("final granule incorrect: got %d, want %d", r.Granule(), 150*960)
+	}
+
+	// Corruption is detected by the page checksum.
+	data := append([]byte(nil), b.Bytes()...)
+	data[len(data)-100] ^= 0xFF
+	r, _ = NewReader(bytes.NewReader(data))
+	for err == nil {
+		_, err = r.ReadPacket()
+	}
+	if err != ErrChecksum {
+		t.Errorf("ReadPacket of corrupt page error incorrect: got %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestReaderFile(t *testing.T) {
+	// air.dca in the repository root is an Ogg Opus file.
+	f, err := os.Open("../air.dca")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	if r.Head.Channels == 0 || r.Tags.Vendor == "" {
+		t.Errorf("headers incorrect: %+v %+v", r.Head, r.Tags)
+	}
+
+	samples := 0
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadPacket returned error: %v", err)
+		}
+		n, err := PacketSamples(p)
+		if err != nil {
+			t.Fatalf("PacketSamples returned error: %v", err)
+		}
+		samples += n
+	}
+	if int64(samples) < r.Granule() {
+		t.Errorf("packet samples %d less than final granule %d", samples, r.Granule())
+	}
+}
+
+func TestStream(t *testing.T) {
+	// A pre-skip of 1.5 packets drops only the first one.
+	head := Head{Channels: 1, PreSkip: 1440}
+	var b bytes.Buffer
+	w, err := NewWriter(&b, 1, head, Tags{Vendor: "test"})
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.WritePacket([]byte{0xF8, byte(i)}); err != nil {
+			t.Fatalf("WritePacket returned error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	send := make(chan []byte, 2)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- r.Stream(send, nil)
+		close(send)
+	}()
+
+	// Received packets are not overwritten while the channel fills.
+	var got [][]byte
+	for p := range send {
+		for len(send) < cap(send) && len(got) < 97 && len(errc) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if p[1] != byte(len(got)+1) {
+			t.Fatalf("packet %d overwritten: got %d", len(got), p[1])
+		}
+		got = append(got, append([]byte(nil), p...))
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Stream returned error: %v", err)
+	}
+	if len(got) != 99 || got[0][1] != 1 || got[98][1] != 99 {
+		t.Errorf("streamed packets incorrect: got %d", len(got))
+	}
+
+	// Stream returns when stopped.
+	r, _ = NewReader(bytes.NewReader(b.Bytes()))
+	stop := make(chan struct{})
+	close(stop)
+	if err := r.Stream(make(chan []byte), stop); err != nil {
+		t.Errorf("stopped Stream returned error: %v", err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var b bytes.Buffer
+	rec, err := NewRecorder(&b, 7, 2, Tags{})
+	if err != nil {
+		t.Fatalf("NewRecorder returned error: %v", err)
+	}
+
+	packet := []byte{0xFC, 0x01}
+	writes := []struct {
+		timestamp uint32
+		packet    []byte
+	}{
+		{1000, packet},
+		{1960, packet},
+		{1960, packet},               // duplicate
+		{1000 + 4*960 + 600, packet}, // two lost packets and a 12.5ms gap
+		{1000, packet},               // late
+		{0x40000000, packet},         // timestamp reset
+	}
+	for _, w := range writes {
+		if err := rec.WritePacket(w.timestamp, w.packet); err != nil {
+			t.Fatalf("WritePacket(%d) returned error: %v", w.timestamp, err)
+		}
+	}
+	if err := rec.WritePacket(0, []byte{}); err != ErrPacket {
+		t.Errorf("WritePacket of invalid packet error incorrect: got %v", err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	r, err := NewReader(&b)
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	if r.Head.Channels != 2 || r.Head.PreSkip != 0 || r.Tags.Vendor != recorderVendor {
+		t.Errorf("headers incorrect: got %+v, %+v", r.Head, r.Tags)
+	}
+
+	// Silence: 2x20ms, 10ms and 2.5ms, leaving 0.5ms unfilled.
+	want := [][]byte{packet, packet, {0xFC, 0xFF, 0xFE}, {0xFC, 0xFF, 0xFE}, {0xF4, 0xFF, 0xFE}, {0xE4, 0xFF, 0xFE}, packet, packet}
+	for i, w := range want {
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket %d returned error: %v", i, err)
+		}
+		if !bytes.Equal(p, w) {
+			t.Errorf("packet %d incorrect: got %x, want %x", i, p, w)
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("ReadPacket at end error incorrect: got %v, want EOF", err)
+	}
+	if want := int64(6*960 + 480 + 120); r.Granule() != want {
+		t.Errorf("granule incorrect: got %d, want %d", r.Granule(), want)
+	}
+}
@@ -0,0 +1,136 @@
+package oggopus
+
+import "io"
+
+// Stream sends the packets of the stream on send, typically a
+// VoiceConnection's OpusSend channel, until the end of the stream or until
+// stop is closed. Packets are read a page at a time as they are needed, so
+// the send channel's consumer sets the pace; discordgo's sender advances
+// by each packet's own duration.
+//
+// Packets lying wholly within the pre-skip are not sent. A partial packet
+// at the edge of the pre-skip is sent whole, as trimming it would need
+// decoding.
+//
+// Sent packets must be consumed before the channel's capacity plus two
+// further packets have been sent, after which their buffers are reused.
+func (or *Reader) Stream(send chan<- []byte, stop <-chan struct{}) error {
+	bufs := make([][]byte, cap(send)+2)
+	skip := int(or.Head.PreSkip)
+
+	for i := 0; ; i = (i + 1) % len(bufs) {
+		packet, err := or.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		samples, err := PacketSamples(packet)
+		if err != nil {
+			return err
+		}
+		if skip >= samples {
+			skip -= samples
+			continue
+		}
+		skip = 0
+
+		bufs[i] = append(bufs[i][:0], packet...)
+		select {
+		case send <- bufs[i]:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// recorderVendor is the vendor string of recordings with none set.
+const recorderVendor = "discord-audio-stream"
+
+// silenceSizes are the durations of the CELT fullband configurations, from
+// 20ms down to 2.5ms, used to fill gaps with silence.
+var silenceSizes = [4]int{960, 480, 240, 120}
+
+// maxRecorderGap is the longest gap filled with silence. Longer jumps in
+// either direction, such as a timestamp reset, are taken as a new start.
+const maxRecorderGap = 10 * 60 * SampleRate
+
+// A Recorder writes Opus packets received over RTP to an Ogg Opus stream.
+// Granule positions follow the RTP timestamps: gaps left by lost packets or
+// by the sender pausing are filled with silence, and late or duplicate
+// packets are dropped.
+type Recorder struct {
+	w       *Writer
+	silence [4][]byte // per silenceSizes
+	started bool
+	next    uint32 // RTP timestamp expected next
+}
+
+// NewRecorder writes the headers of an Ogg Opus stream of received audio
+// with the given serial number and channel count to w. If tags.Vendor is
+// empty a default is used.
+func NewRecorder(w io.Writer, serial uint32, channels int, tags Tags) (*Recorder, error) {
+	if channels != 1 && channels != 2 {
+		return nil, ErrFormat
+	}
+	if tags.Vendor == "" {
+		tags.Vendor = recorderVendor
+	}
+
+	head := Head{Version: 1, Channels: uint8(channels), InputSampleRate: SampleRate}
+	ow, err := NewWriter(w, serial, head, tags)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recorder{w: ow}
+	for i := range rec.silence {
+		toc := byte(31-i) << 3 // CELT FB
+		if channels == 2 {
+			toc |= 0x04
+		}
+		rec.silence[i] = []byte{toc, 0xFF, 0xFE}
+	}
+	return rec, nil
+}
+
+// WritePacket adds a packet received with the given RTP timestamp, which
+// counts 48kHz samples.
+func (rec *Recorder) WritePacket(timestamp uint32, packet []byte) error {
+	samples, err := PacketSamples(packet)
+	if err != nil {
+		return err
+	}
+
+	if rec.started {
+		gap := int32(timestamp - rec.next)
+		if gap < 0 && gap >= -maxRecorderGap {
+			return nil
+		}
+		if gap > 0 && gap <= maxRecorderGap {
+			for i, n := range silenceSizes {
+				for ; gap >= int32(n); gap -= int32(n) {
+					if err := rec.w.writePacket(rec.silence[i], n); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	rec.started = true
+	rec.next = timestamp + uint32(samples)
+	return rec.w.writePacket(packet, samples)
+}
+
+// Flush writes the packets added since the last page, for readers
+// following the stream live.
+func (rec *Recorder) Flush() error {
+	return rec.w.Flush()
+}
+
+// Close writes the final page. It does not close the underlying writer.
+func (rec *Recorder) Close() error {
+	return rec.w.Close()
+}
@@ -0,0 +1,264 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Command is the /queue application command handled by HandleInteraction.
+var Command = &discordgo.ApplicationCommand{
+	Name:        "queue",
+	Description: "Control the music queue",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "add",
+			Description: "Add a track to the queue",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:         discordgo.ApplicationCommandOptionString,
+					Name:         "track",
+					Description:  "Track to add",
+					Required:     true,
+					Autocomplete: true,
+				},
+			},
+		},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "list", Description: "Show the queue"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "skip", Description: "Skip the current track"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "pause", Description: "Pause playback"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "resume", Description: "Resume playback"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "shuffle", Description: "Shuffle the upcoming tracks"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "stop", Description: "Stop playback and clear the queue"},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "loop",
+			Description: "Set the loop mode",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "mode",
+					Description: "What to repeat",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "off", Value: "off"},
+						{Name: "track", Value: "track"},
+						{Name: "queue", Value: "queue"},
+					},
+				},
+			},
+		},
+	},
+}
+
+// Custom IDs of the control buttons.
+const (
+	buttonPause   = "queue:pause" // toggles pause and resume
+	buttonSkip    = "queue:skip"
+	buttonLoop    = "queue:loop" // cycles through the loop modes
+	buttonShuffle = "queue:shuffle"
+	buttonStop    = "queue:stop"
+)
+
+// maxListed is the number of upcoming tracks shown in the queue.
+const maxListed = 10
+
+// HandleInteraction answers /queue commands, their autocomplete requests
+// and the control buttons. Other interactions are ignored.
+func (m *Manager) HandleInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	if i.GuildID == "" {
+		return nil
+	}
+
+	switch i.Type {
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		data := i.ApplicationCommandData()
+		if data.Name != Command.Name || len(data.Options) == 0 || len(data.Options[0].Options) == 0 {
+			return nil
+		}
+		choices := []*discordgo.ApplicationCommandOptionChoice{}
+		for _, match := range m.Match(data.Options[0].Options[0].StringValue(), 25) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: match, Value: match})
+		}
+		return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+			Data: &discordgo.InteractionResponseData{Choices: choices},
+		})
+
+	case discordgo.InteractionApplicationCommand:
+		data := i.ApplicationCommandData()
+		if data.Name != Command.Name || len(data.Options) == 0 {
+			return nil
+		}
+		q := m.Queue(i.GuildID)
+		content, ephemeral := m.command(q, i, data.Options[0])
+		resp := m.response(q, content)
+		if ephemeral {
+			resp = &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral}
+		}
+		return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: resp,
+		})
+
+	case discordgo.InteractionMessageComponent:
+		id := i.MessageComponentData().CustomID
+		if !strings.HasPrefix(id, "queue:") {
+			return nil
+		}
+		q := m.Queue(i.GuildID)
+		return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: m.response(q, m.button(q, id)),
+		})
+	}
+	return nil
+}
+
+// command runs a /queue subcommand, returning the reply and whether it is
+// only for the user.
+func (m *Manager) command(q *Queue, i *discordgo.InteractionCreate, sub *discordgo.ApplicationCommandInteractionDataOption) (string, bool) {
+	switch sub.Name {
+	case "add":
+		if len(sub.Options) == 0 {
+			return "No track given.", true
+		}
+		name := sub.Options[0].StringValue()
+		t, err := m.Track(name)
+		if err != nil {
+			return "Can't add " + name + ": " + err.Error(), true
+		}
+		if u := interactionUser(i); u != nil {
+			t.RequestedBy = u.ID
+		}
+		q.Enqueue(t)
+		return "Added " + t.Title + ".", false
+	case "list":
+		return "", false
+	case "skip":
+		if !q.Skip() {
+			return "Nothing is playing.", true
+		}
+		return "Skipped.", false
+	case "pause":
+		q.Pause()
+		return "Paused.", false
+	case "resume":
+		q.Resume()
+		return "Resumed.", false
+	case "shuffle":
+		q.Shuffle()
+		return "Shuffled.", false
+	case "stop":
+		q.Stop()
+		return "Stopped.", false
+	case "loop":
+		mode := LoopOff
+		if len(sub.Options) > 0 {
+			switch sub.Options[0].StringValue() {
+			case "track":
+				mode = LoopTrack
+			case "queue":
+				mode = LoopQueue
+			}
+		}
+		q.SetLoop(mode)
+		return "Loop " + mode.String() + ".", false
+	}
+	return "Unknown command.", true
+}
+
+// button runs the action of a control button, returning a note for the
+// updated message.
+func (m *Manager) button(q *Queue, id string) string {
+	switch id {
+	case buttonPause:
+		if q.Status().Paused {
+			q.Resume()
+			return "Resumed."
+		}
+		q.Pause()
+		return "Paused."
+	case buttonSkip:
+		if q.Skip() {
+			return "Skipped."
+		}
+	case buttonLoop:
+		mode := (q.Status().Loop + 1) % 3
+		q.SetLoop(mode)
+		return "Loop " + mode.String() + "."
+	case buttonShuffle:
+		q.Shuffle()
+		return "Shuffled."
+	case buttonStop:
+		q.Stop()
+		return "Stopped."
+	}
+	return ""
+}
+
+// response returns a message showing the queue under note, with the
+// control buttons.
+func (m *Manager) response(q *Queue, note string) *discordgo.InteractionResponseData {
+	st := q.Status()
+
+	var b strings.Builder
+	if note != "" {
+		b.WriteString(note + "\n")
+	}
+	if st.Current != nil {
+		fmt.Fprintf(&b, "Now playing: **%s** (%s)", st.Current.Title, formatPosition(st.Position))
+		if st.Paused {
+			b.WriteString(", paused")
+		}
+		b.WriteString("\n")
+	}
+	if st.Loop != LoopOff {
+		b.WriteString("Loop: " + st.Loop.String() + "\n")
+	}
+	if len(st.Upcoming) == 0 {
+		b.WriteString("The queue is empty.")
+	} else {
+		b.WriteString("Up next:")
+		for n, t := range st.Upcoming {
+			if n == maxListed {
+				fmt.Fprintf(&b, "\n…and %d more", len(st.Upcoming)-n)
+				break
+			}
+			fmt.Fprintf(&b, "\n%d. %s", n+1, t.Title)
+		}
+	}
+
+	pause := "Pause"
+	if st.Paused {
+		pause = "Resume"
+	}
+	return &discordgo.InteractionResponseData{
+		Content: b.String(),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: pause, Style: discordgo.PrimaryButton, CustomID: buttonPause},
+				discordgo.Button{Label: "Skip", Style: discordgo.SecondaryButton, CustomID: buttonSkip},
+				discordgo.Button{Label: "Loop", Style: discordgo.SecondaryButton, CustomID: buttonLoop},
+				discordgo.Button{Label: "Shuffle", Style: discordgo.SecondaryButton, CustomID: buttonShuffle},
+				discordgo.Button{Label: "Stop", Style: discordgo.DangerButton, CustomID: buttonStop},
+			}},
+		},
+	}
+}
+
+// interactionUser returns the user of an interaction in a guild or a DM.
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+func formatPosition(d time.Duration) string {
+	s := int(d / time.Second)
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
@@ -0,0 +1,410 @@
+// Package queue plays per-guild queues of Opus tracks to voice
+// connections.
+//
+// Each guild has a Queue of tracks, played in turn to the guild's
+// VoiceConnection in Session.VoiceConnections by sending the tracks' Opus
+// packets on OpusSend, unchanged unless Manager.Mix replaces them. Queues
+// can be paused, skipped, looped and shuffled, and the Manager reports
+// tracks starting and ending through OnEvent. Slash commands and buttons
+// controlling the queues are in commands.go.
+package queue
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/oggopus"
+)
+
+// A Track is a queued recording.
+type Track struct {
+	Title       string
+	Path        string
+	RequestedBy string // user ID, if any
+}
+
+// LoopMode selects what is played when a track ends.
+type LoopMode int
+
+// Loop modes.
+const (
+	LoopOff   LoopMode = iota
+	LoopTrack          // repeat the current track until skipped
+	LoopQueue          // move each finished track to the end of the queue
+)
+
+func (l LoopMode) String() string {
+	switch l {
+	case LoopTrack:
+		return "track"
+	case LoopQueue:
+		return "queue"
+	}
+	return "off"
+}
+
+// EventType is the type of a queue Event.
+type EventType int
+
+// Event types.
+const (
+	TrackStart EventType = iota
+	TrackEnd
+)
+
+// EndReason is why a track stopped playing.
+type EndReason int
+
+// End reasons.
+const (
+	Finished EndReason = iota
+	Skipped
+	Stopped
+	Failed // Event.Err holds the error
+)
+
+// An Event reports a track starting or ending in a guild's queue.
+type Event struct {
+	Type    EventType
+	GuildID string
+	Track   *Track
+	Reason  EndReason // for TrackEnd
+	Err     error
+}
+
+// A Manager holds the queues of a session's guilds.
+type Manager struct {
+	Session *discordgo.Session
+
+	// Open opens a track for playback. If nil, OpenFile(t.Path) is used.
+	Open func(t *Track) (PacketReader, error)
+
+	// Mix, if set, is called from the playback goroutine of a queue with
+	// each packet of a track, and the packet it returns is sent instead,
+	// for example with other audio mixed on top.
+	Mix func(guildID string, packet []byte) []byte
+
+	// OnEvent, if set, is called from the playback goroutine of a queue
+	// when a track starts or ends. It must not call Skip or Stop, which
+	// wait for that goroutine.
+	OnEvent func(e *Event)
+
+	// Dir is the directory of the tracks offered by the /queue command.
+	Dir string
+
+	sync.Mutex
+	queues map[string]*Queue
+}
+
+// NewManager returns a Manager playing to the voice connections of s.
+func NewManager(s *discordgo.Session) *Manager {
+	return &Manager{Session: s, queues: map[string]*Queue{}}
+}
+
+// Queue returns the queue of a guild, creating it if needed.
+func (m *Manager) Queue(guildID string) *Queue {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.queues == nil {
+		m.queues = map[string]*Queue{}
+	}
+	q, ok := m.queues[guildID]
+	if !ok {
+		q = &Queue{m: m, guildID: guildID, changed: make(chan struct{}, 1)}
+		m.queues[guildID] = q
+	}
+	return q
+}
+
+// Playing reports whether the queue of a guild is playing a track.
+func (m *Manager) Playing(guildID string) bool {
+	m.Lock()
+	q := m.queues[guildID]
+	m.Unlock()
+	return q != nil && q.Playing()
+}
+
+func (m *Manager) emit(e *Event) {
+	if m.OnEvent != nil {
+		m.OnEvent(e)
+	}
+}
+
+func (m *Manager) open(t *Track) (PacketReader, error) {
+	if m.Open != nil {
+		return m.Open(t)
+	}
+	return OpenFile(t.Path)
+}
+
+// opusSend returns the OpusSend channel of the guild's voice connection,
+// or nil if there is none ready to send.
+func (m *Manager) opusSend(guildID string) chan []byte {
+	if m.Session == nil {
+		return nil
+	}
+	m.Session.RLock()
+	vc := m.Session.VoiceConnections[guildID]
+	m.Session.RUnlock()
+	if vc == nil {
+		return nil
+	}
+
+	vc.RLock()
+	defer vc.RUnlock()
+	if !vc.Ready {
+		return nil
+	}
+	return vc.OpusSend
+}
+
+// voiceWait is how often a playing queue without a ready voice
+// connection looks for one.
+const voiceWait = 250 * time.Millisecond
+
+// A Queue is the play queue of a guild. Its methods may be called from
+// any goroutine.
+type Queue struct {
+	m       *Manager
+	guildID string
+
+	sync.Mutex
+	tracks   []*Track
+	current  *Track
+	position int64 // samples of current sent
+	paused   bool
+	loop     LoopMode
+	running  bool
+	ending   bool          // set by Skip and Stop while playing
+	end      EndReason     // why
+	done     chan struct{} // closed when current ends
+	changed  chan struct{}
+}
+
+// Status is a snapshot of a queue.
+type Status struct {
+	Current  *Track // nil when idle
+	Position time.Duration
+	Paused   bool
+	Loop     LoopMode
+	Upcoming []*Track
+}
+
+// Enqueue adds tracks to the end of the queue, starting playback if the
+// queue was idle.
+func (q *Queue) Enqueue(tracks ...*Track) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.tracks = append(q.tracks, tracks...)
+	if !q.running && len(q.tracks) > 0 {
+		q.running = true
+		go q.run()
+	}
+}
+
+// Skip ends the current track, playing the next one. It returns once the
+// track has ended, reporting whether one was playing.
+func (q *Queue) Skip() bool {
+	return q.interrupt(Skipped)
+}
+
+// Stop clears the queue and ends the current track, returning once it has
+// ended.
+func (q *Queue) Stop() {
+	q.Lock()
+	q.tracks = nil
+	q.Unlock()
+	q.interrupt(Stopped)
+}
+
+func (q *Queue) interrupt(reason EndReason) bool {
+	q.Lock()
+	if q.current == nil {
+		q.Unlock()
+		return false
+	}
+	q.end = reason
+	q.ending = true
+	q.notify()
+	done := q.done
+	q.Unlock()
+
+	<-done
+	return true
+}
+
+// Pause pauses playback. Packets already queued on the voice connection
+// are still sent.
+func (q *Queue) Pause() {
+	q.Lock()
+	q.paused = true
+	q.Unlock()
+}
+
+// Resume resumes paused playback.
+func (q *Queue) Resume() {
+	q.Lock()
+	q.paused = false
+	q.notify()
+	q.Unlock()
+}
+
+// SetLoop sets the loop mode.
+func (q *Queue) SetLoop(mode LoopMode) {
+	q.Lock()
+	q.loop = mode
+	q.Unlock()
+}
+
+// Shuffle shuffles the upcoming tracks.
+func (q *Queue) Shuffle() {
+	q.Lock()
+	rand.Shuffle(len(q.tracks), func(i, j int) {
+		q.tracks[i], q.tracks[j] = q.tracks[j], q.tracks[i]
+	})
+	q.Unlock()
+}
+
+// Playing reports whether a track is playing and not paused.
+func (q *Queue) Playing() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.current != nil && !q.paused
+}
+
+// Status returns the state of the queue.
+func (q *Queue) Status() Status {
+	q.Lock()
+	defer q.Unlock()
+
+	return Status{
+		Current:  q.current,
+		Position: time.Duration(q.position) * time.Second / oggopus.SampleRate,
+		Paused:   q.paused,
+		Loop:     q.loop,
+		Upcoming: append([]*Track(nil), q.tracks...),
+	}
+}
+
+// notify wakes the playback goroutine. q must be locked.
+func (q *Queue) notify() {
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run plays tracks until the queue is empty.
+func (q *Queue) run() {
+	for {
+		q.Lock()
+		if len(q.tracks) == 0 {
+			q.running = false
+			q.Unlock()
+			return
+		}
+		t := q.tracks[0]
+		q.tracks = q.tracks[1:]
+		q.current = t
+		q.position = 0
+		q.ending = false
+		done := make(chan struct{})
+		q.done = done
+		q.Unlock()
+
+		q.m.emit(&Event{Type: TrackStart, GuildID: q.guildID, Track: t})
+		reason, err := q.play(t)
+
+		q.Lock()
+		// A skip or stop while the track was finishing still counts.
+		if q.ending && reason == Finished {
+			reason = q.end
+		}
+		switch {
+		case q.loop == LoopTrack && reason == Finished:
+			q.tracks = append([]*Track{t}, q.tracks...)
+		case q.loop == LoopQueue && (reason == Finished || reason == Skipped):
+			q.tracks = append(q.tracks, t)
+		}
+		q.current = nil
+		q.position = 0
+		q.Unlock()
+		close(done)
+
+		q.m.emit(&Event{Type: TrackEnd, GuildID: q.guildID, Track: t, Reason: reason, Err: err})
+	}
+}
+
+// play sends the packets of a track to the guild's voice connection.
+func (q *Queue) play(t *Track) (EndReason, error) {
+	r, err := q.m.open(t)
+	if err != nil {
+		return Failed, err
+	}
+	defer r.Close()
+
+	// Sent packets stay queued on OpusSend, so rotate through enough
+	// buffers to cover the queue plus the packet being sent.
+	var bufs [][]byte
+	next := 0
+
+	for {
+		packet, err := r.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				return Finished, nil
+			}
+			return Failed, err
+		}
+		samples, err := oggopus.PacketSamples(packet)
+		if err != nil {
+			return Failed, err
+		}
+		if q.m.Mix != nil {
+			packet = q.m.Mix(q.guildID, packet)
+		}
+
+		for sent := false; !sent; {
+			q.Lock()
+			interrupted, reason, paused := q.ending, q.end, q.paused
+			q.Unlock()
+			if interrupted {
+				return reason, nil
+			}
+
+			var send chan []byte
+			if !paused {
+				send = q.m.opusSend(q.guildID)
+			}
+			if send == nil {
+				select {
+				case <-q.changed:
+				case <-time.After(voiceWait):
+				}
+				continue
+			}
+
+			if n := cap(send) + 2; len(bufs) < n {
+				bufs = append(bufs, make([][]byte, n-len(bufs))...)
+			}
+			next = (next + 1) % len(bufs)
+			bufs[next] = append(bufs[next][:0], packet...)
+
+			select {
+			case send <- bufs[next]:
+				sent = true
+			case <-q.changed:
+			}
+		}
+
+		q.Lock()
+		q.position += int64(samples)
+		q.Unlock()
+	}
+}
@@ -0,0 +1,430 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/bwmarrin/discordgo/discordtest"
+
+	"discord-audio-stream/dca"
+	"discord-audio-stream/oggopus"
+)
+
+// fakeTrack plays 20ms packets holding its title and packet number.
+type fakeTrack struct {
+	title string
+	n, i  int
+}
+
+func (f *fakeTrack) ReadPacket() ([]byte, error) {
+	if f.i == f.n {
+		return nil, io.EOF
+	}
+	f.i++
+	return []byte{0xF8, byte(f.i), f.title[0]}, nil
+}
+
+func (f *fakeTrack) Close() error { return nil }
+
+// newTestManager returns a Manager playing tracks of packets packets to a
+// ready voice connection in guild "1", and the channels of its packets and
+// events.
+func newTestManager(packets int) (*Manager, chan []byte, chan *Event) {
+	vc := &discordgo.VoiceConnection{Ready: true, OpusSend: make(chan []byte, 2)}
+	s := &discordgo.Session{VoiceConnections: map[string]*discordgo.VoiceConnection{"1": vc}}
+
+	events := make(chan *Event, 100)
+	m := NewManager(s)
+	m.Open = func(t *Track) (PacketReader, error) {
+		return &fakeTrack{title: t.Title, n: packets}, nil
+	}
+	m.OnEvent = func(e *Event) { events <- e }
+	return m, vc.OpusSend, events
+}
+
+// receive returns the next packet sent, as "<title><number>".
+func receive(t *testing.T, send chan []byte) string {
+	t.Helper()
+	select {
+	case p := <-send:
+		return string(p[2:]) + string('0'+p[1])
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+	}
+	return ""
+}
+
+// expectEvent checks the next event.
+func expectEvent(t *testing.T, events chan *Event, typ EventType, title string, reason EndReason) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Type != typ || e.Track.Title != title || (typ == TrackEnd && e.Reason != reason) || e.GuildID != "1" {
+			t.Errorf("event incorrect: got %+v %q, want %v %q %v", e, e.Track.Title, typ, title, reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+}
+
+func TestQueuePlayback(t *testing.T) {
+	m, send, events := newTestManager(3)
+	q := m.Queue("1")
+	q.Enqueue(&Track{Title: "A"}, &Track{Title: "B"})
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, receive(t, send))
+	}
+	if want := []string{"A1", "A2", "A3", "B1", "B2", "B3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("packets incorrect: got %v, want %v", got, want)
+	}
+
+	expectEvent(t, events, TrackStart, "A", 0)
+	expectEvent(t, events, TrackEnd, "A", Finished)
+	expectEvent(t, events, TrackStart, "B", 0)
+	expectEvent(t, events, TrackEnd, "B", Finished)
+
+	// The queue restarts when a track is added.
+	q.Enqueue(&Track{Title: "C"})
+	if p := receive(t, send); p != "C1" {
+		t.Errorf("packet after restart incorrect: got %s, want C1", p)
+	}
+}
+
+func TestQueueMix(t *testing.T) {
+	m, send, _ := newTestManager(2)
+	m.Mix = func(guildID string, packet []byte) []byte {
+		if guildID != "1" {
+			t.Errorf("Mix guild incorrect: got %s, want 1", guildID)
+		}
+		return []byte{packet[0], packet[1], packet[2] + 'a' - 'A'}
+	}
+	m.Queue("1").Enqueue(&Track{Title: "A"})
+
+	for _, want := range []string{"a1", "a2"} {
+		if p := receive(t, send); p != want {
+			t.Errorf("mixed packet incorrect: got %s, want %s", p, want)
+		}
+	}
+}
+
+func TestQueueControls(t *testing.T) {
+	m, send, events := newTestManager(1000)
+	q := m.Queue("1")
+	q.Enqueue(&Track{Title: "A"}, &Track{Title: "B"}, &Track{Title: "C"})
+	receive(t, send)
+	expectEvent(t, events, TrackStart, "A", 0)
+
+	// Nothing is sent while paused, beyond the packet already waiting.
+	q.Pause()
+	if m.Playing("1") {
+		t.Error("Playing while paused")
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(send) > 0 {
+		<-send
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(send) != 0 {
+		t.Errorf("packets sent while paused")
+	}
+	q.Resume()
+	receive(t, send)
+
+	if !q.Skip() {
+		t.Error("Skip returned false while playing")
+	}
+	expectEvent(t, events, TrackEnd, "A", Skipped)
+	expectEvent(t, events, TrackStart, "B", 0)
+
+	st := q.Status()
+	if st.Current == nil || st.Current.Title != "B" || len(st.Upcoming) != 1 || st.Upcoming[0].Title != "C" {
+		t.Errorf("Status incorrect: %+v", st)
+	}
+
+	// Looping the queue moves skipped tracks to the end.
+	q.SetLoop(LoopQueue)
+	q.Skip()
+	expectEvent(t, events, TrackEnd, "B", Skipped)
+	expectEvent(t, events, TrackStart, "C", 0)
+	if st := q.Status(); len(st.Upcoming) != 1 || st.Upcoming[0].Title != "B" || st.Loop != LoopQueue {
+		t.Errorf("Status after loop incorrect: %+v", st)
+	}
+
+	q.Stop()
+	expectEvent(t, events, TrackEnd, "C", Stopped)
+	if st := q.Status(); st.Current != nil || len(st.Upcoming) != 0 {
+		t.Errorf("Status after Stop incorrect: %+v", st)
+	}
+	if q.Skip() {
+		t.Error("Skip returned true while idle")
+	}
+}
+
+func TestQueueLoopTrack(t *testing.T) {
+	m, send, events := newTestManager(2)
+	q := m.Queue("1")
+	q.SetLoop(LoopTrack)
+	q.Enqueue(&Track{Title: "A"}, &Track{Title: "B"})
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, receive(t, send))
+	}
+	if want := []string{"A1", "A2", "A1", "A2", "A1", "A2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("packets incorrect: got %v, want %v", got, want)
+	}
+
+	// Skipping moves on to the next track, which then repeats. Pausing
+	// first holds a track as current.
+	q.Pause()
+	for q.Status().Current == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if !q.Skip() {
+		t.Fatal("Skip returned false while paused")
+	}
+	q.Resume()
+	for len(events) > 0 {
+		<-events
+	}
+	for i := 0; i < 8; i++ {
+		if p := receive(t, send); p == "B1" {
+			q.Stop()
+			return
+		}
+	}
+	t.Error("B not played after skip")
+}
+
+func TestQueueShuffle(t *testing.T) {
+	m, send, _ := newTestManager(1000)
+	q := m.Queue("1")
+	var titles []string
+	for i := 0; i < 20; i++ {
+		title := string(rune('a' + i))
+		titles = append(titles, title)
+		q.Enqueue(&Track{Title: title})
+	}
+	receive(t, send)
+	defer q.Stop()
+
+	q.Shuffle()
+	var got []string
+	for _, tr := range q.Status().Upcoming {
+		got = append(got, tr.Title)
+	}
+	if reflect.DeepEqual(got, titles[1:]) {
+		t.Error("Shuffle left the queue in order")
+	}
+	for _, title := range titles[1:] {
+		if !strings.Contains(strings.Join(got, ""), title) {
+			t.Errorf("Shuffle lost track %s", title)
+		}
+	}
+}
+
+func TestTrackFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An Ogg file whose pre-skip covers the first packet.
+	var ogg bytes.Buffer
+	w, _ := oggopus.NewWriter(&ogg, 1, oggopus.Head{Channels: 1, PreSkip: 960}, oggopus.Tags{Vendor: "test"})
+	for i := 1; i <= 3; i++ {
+		w.WritePacket([]byte{0xF8, byte(i)})
+	}
+	w.Close()
+
+	var d bytes.Buffer
+	dw, _ := dca.NewWriter(&d, nil)
+	dw.WriteFrame([]byte{0xF8, 7})
+
+	files := map[string][]byte{
+		"Song.opus":  ogg.Bytes(),
+		"Song.dca":   d.Bytes(),
+		"Jingle.DCA": d.Bytes(),
+		"notes.txt":  nil,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &Manager{Dir: dir}
+	if got, _ := m.Names(); !reflect.DeepEqual(got, []string{"Jingle", "Song"}) {
+		t.Errorf("Names incorrect: got %v", got)
+	}
+	if got := m.Match("ng", 5); !reflect.DeepEqual(got, []string{"Jingle", "Song"}) {
+		t.Errorf("Match incorrect: got %v", got)
+	}
+	if _, err := m.Track("../Song"); err != ErrUnknownTrack {
+		t.Errorf("Track outside Dir error incorrect: got %v", err)
+	}
+
+	// Ogg is preferred to DCA.
+	tr, err := m.Track("Song")
+	if err != nil {
+		t.Fatalf("Track returned error: %v", err)
+	}
+	r, err := OpenFile(tr.Path)
+	if err != nil {
+		t.Fatalf("OpenFile returned error: %v", err)
+	}
+	var got []byte
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadPacket returned error: %v", err)
+		}
+		got = append(got, p[1])
+	}
+	r.Close()
+	if !bytes.Equal(got, []byte{2, 3}) {
+		t.Errorf("Ogg packets incorrect: got %v, want [2 3]", got)
+	}
+
+	tr, _ = m.Track("Jingle")
+	r, err = OpenFile(tr.Path)
+	if err != nil {
+		t.Fatalf("OpenFile of DCA returned error: %v", err)
+	}
+	if p, err := r.ReadPacket(); err != nil || p[1] != 7 {
+		t.Errorf("DCA packet incorrect: got %v, %v", p, err)
+	}
+	r.Close()
+}
+
+// interactionResponse is the part of an interaction response checked by
+// the tests.
+type interactionResponse struct {
+	Type discordgo.InteractionResponseType
+	Data struct {
+		Content    string
+		Flags      discordgo.MessageFlags
+		Choices    []discordgo.ApplicationCommandOptionChoice
+		Components []struct {
+			Components []struct {
+				Label    string
+				CustomID string `json:"custom_id"`
+			}
+		}
+	}
+}
+
+func TestHandleInteraction(t *testing.T) {
+	srv, err := discordtest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer returned error: %v", err)
+	}
+	defer srv.Close()
+
+	responses := make(chan interactionResponse, 10)
+	srv.HandleFunc("POST", "/interactions/*/*/callback", func(w http.ResponseWriter, r *http.Request) {
+		var resp interactionResponse
+		json.NewDecoder(r.Body).Decode(&resp)
+		responses <- resp
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	s, _ := discordgo.New("Bot token")
+	s.Client = srv.Client()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "Song.dca"), nil, 0644)
+
+	m, _, _ := newTestManager(1000)
+	m.Dir = dir
+	defer m.Queue("1").Stop()
+
+	command := func(typ discordgo.InteractionType, data discordgo.InteractionData) interactionResponse {
+		t.Helper()
+		i := &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			ID: "5", Token: "tok", Type: typ, GuildID: "1", Data: data,
+			Member: &discordgo.Member{User: &discordgo.User{ID: "42"}},
+		}}
+		if err := m.HandleInteraction(s, i); err != nil {
+			t.Fatalf("HandleInteraction returned error: %v", err)
+		}
+		select {
+		case resp := <-responses:
+			return resp
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a response")
+		}
+		return interactionResponse{}
+	}
+	sub := func(name string, options ...*discordgo.ApplicationCommandInteractionDataOption) discordgo.ApplicationCommandInteractionData {
+		return discordgo.ApplicationCommandInteractionData{Name: "queue", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+			{Name: name, Type: discordgo.ApplicationCommandOptionSubCommand, Options: options},
+		}}
+	}
+	track := func(name string, focused bool) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: "track", Type: discordgo.ApplicationCommandOptionString, Value: name, Focused: focused}
+	}
+
+	resp := command(discordgo.InteractionApplicationCommandAutocomplete, sub("add", track("so", true)))
+	if resp.Type != discordgo.InteractionApplicationCommandAutocompleteResult || len(resp.Data.Choices) != 1 || resp.Data.Choices[0].Value != "Song" {
+		t.Errorf("autocomplete response incorrect: %+v", resp.Data)
+	}
+
+	resp = command(discordgo.InteractionApplicationCommand, sub("add", track("Nope", false)))
+	if resp.Data.Flags != discordgo.MessageFlagsEphemeral || !strings.Contains(resp.Data.Content, "unknown track") {
+		t.Errorf("response to unknown track incorrect: %+v", resp.Data)
+	}
+
+	resp = command(discordgo.InteractionApplicationCommand, sub("add", track("Song", false)))
+	if !strings.HasPrefix(resp.Data.Content, "Added Song.") || len(resp.Data.Components) != 1 {
+		t.Errorf("response to add incorrect: %+v", resp.Data)
+	}
+	if st := m.Queue("1").Status(); st.Current == nil || st.Current.RequestedBy != "42" {
+		t.Errorf("added track incorrect: %+v", st.Current)
+	}
+
+	resp = command(discordgo.InteractionApplicationCommand, sub("loop", &discordgo.ApplicationCommandInteractionDataOption{
+		Name: "mode", Type: discordgo.ApplicationCommandOptionString, Value: "queue",
+	}))
+	if !strings.Contains(resp.Data.Content, "Loop: queue") {
+		t.Errorf("response to loop incorrect: %q", resp.Data.Content)
+	}
+
+	// The pause button toggles, updating the message.
+	resp = command(discordgo.InteractionMessageComponent, discordgo.MessageComponentInteractionData{CustomID: buttonPause})
+	if resp.Type != discordgo.InteractionResponseUpdateMessage || !strings.Contains(resp.Data.Content, "Now playing: **Song** (0:00), paused") {
+		t.Errorf("response to pause button incorrect: %q", resp.Data.Content)
+	}
+	if b := resp.Data.Components[0].Components[0]; b.Label != "Resume" || b.CustomID != buttonPause {
+		t.Errorf("pause button incorrect: got %+v", b)
+	}
+	resp = command(discordgo.InteractionMessageComponent, discordgo.MessageComponentInteractionData{CustomID: buttonPause})
+	if !strings.HasPrefix(resp.Data.Content, "Resumed.") {
+		t.Errorf("response to resume button incorrect: %q", resp.Data.Content)
+	}
+
+	resp = command(discordgo.InteractionMessageComponent, discordgo.MessageComponentInteractionData{CustomID: buttonStop})
+	if resp.Data.Content != "Stopped.\nLoop: queue\nThe queue is empty." {
+		t.Errorf("response to stop button incorrect: %q", resp.Data.Content)
+	}
+}
@@ -0,0 +1,148 @@
+package queue
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"discord-audio-stream/catalog"
+	"discord-audio-stream/dca"
+	"discord-audio-stream/oggopus"
+)
+
+// Errors returned when opening tracks.
+var (
+	ErrUnknownTrack = errors.New("unknown track")
+	ErrFormat       = errors.New("unsupported track file")
+)
+
+// extensions are the file extensions of tracks, which are played without
+// decoding.
+var extensions = []string{".opus", ".ogg", ".dca"}
+
+// A PacketReader returns the Opus packets of a track in order.
+type PacketReader interface {
+	// ReadPacket returns the next packet, valid until the following call,
+	// or io.EOF at the end of the track.
+	ReadPacket() ([]byte, error)
+	Close() error
+}
+
+// OpenFile opens an Ogg Opus or DCA file, detected from its contents.
+func OpenFile(name string) (PacketReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+	if string(magic) == "OggS" {
+		or, err := oggopus.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, ErrFormat
+		}
+		return &oggTrack{Reader: or, c: f, skip: int(or.Head.PreSkip)}, nil
+	}
+
+	dr, err := dca.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, ErrFormat
+	}
+	return &dcaTrack{Reader: dr, c: f}, nil
+}
+
+// oggTrack reads an Ogg Opus file, dropping the packets wholly within its
+// pre-skip.
+type oggTrack struct {
+	*oggopus.Reader
+	c    io.Closer
+	skip int
+}
+
+func (t *oggTrack) ReadPacket() ([]byte, error) {
+	for {
+		packet, err := t.Reader.ReadPacket()
+		if err != nil || t.skip == 0 {
+			return packet, err
+		}
+		n, err := oggopus.PacketSamples(packet)
+		if err != nil {
+			return nil, err
+		}
+		if n > t.skip {
+			t.skip = 0
+			return packet, nil
+		}
+		t.skip -= n
+	}
+}
+
+func (t *oggTrack) Close() error {
+	return t.c.Close()
+}
+
+// dcaTrack reads the frames of a DCA file.
+type dcaTrack struct {
+	*dca.Reader
+	c io.Closer
+}
+
+func (t *dcaTrack) ReadPacket() ([]byte, error) {
+	return t.ReadFrame()
+}
+
+func (t *dcaTrack) Close() error {
+	return t.c.Close()
+}
+
+// Names returns the sorted names of the tracks in Dir, their file names
+// without the extension.
+func (m *Manager) Names() ([]string, error) {
+	return catalog.Names(m.Dir, extensions)
+}
+
+// Match returns up to max track names containing query, ignoring case,
+// with those starting with it first.
+func (m *Manager) Match(query string, max int) []string {
+	names, err := m.Names()
+	if err != nil {
+		return nil
+	}
+	return catalog.Match(names, query, max)
+}
+
+// Track returns the named track in Dir.
+func (m *Manager) Track(name string) (*Track, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, ErrUnknownTrack
+	}
+
+	files, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	best := -1
+	path := ""
+	for _, f := range files {
+		ext := catalog.Extension(f.Name(), extensions)
+		if ext < 0 || !f.Mode().IsRegular() || strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())) != name {
+			continue
+		}
+		if best < 0 || ext < best {
+			best = ext
+			path = filepath.Join(m.Dir, f.Name())
+		}
+	}
+	if path == "" {
+		return nil, ErrUnknownTrack
+	}
+
+	return &Track{Title: name, Path: path}, nil
+}
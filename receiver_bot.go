@@ -1,24 +1,34 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"discord-audio-stream/guilds"
+	"discord-audio-stream/health"
+	"discord-audio-stream/livestream"
+	"discord-audio-stream/metrics"
+	"discord-audio-stream/relay"
+	"discord-audio-stream/rtpbridge"
+	"discord-audio-stream/sip"
+
 	"github.com/bwmarrin/discordgo"
 	"github.com/gordonklaus/portaudio"
 	"github.com/joho/godotenv"
 	"gopkg.in/hraban/opus.v2"
 )
 
-var (
-	currentReceiverVC       *discordgo.VoiceConnection
-	stopReceiverAudioStream chan struct{}
-)
-
 func main() {
 	// Open a file for logging
 	logFile, err := os.OpenFile("receiver_bot.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -67,73 +77,134 @@ func main() {
 	// Add a handler for the ready event
 	dg.AddHandler(readyReceiver)
 
-	// Add a handler for GuildCreate to auto-join the voice channel
-	var joined bool
-	dg.AddHandler(func(s *discordgo.Session, event *discordgo.GuildCreate) {
-		if joined {
-			return
-		}
-
-		if targetGuildID != "" && event.Guild.ID != targetGuildID {
+	// Join the voice channel of each guild as it becomes available, with a
+	// receiver of its own. GUILDS_FILE configures guilds individually; the
+	// .env settings are the default for the others.
+	var configs []*guilds.Config
+	if path := os.Getenv("GUILDS_FILE"); path != "" {
+		configs, err = guilds.LoadConfigs(path)
+		if err != nil {
+			log.Println("Error loading guilds file:", err)
 			return
 		}
+	}
+	defaultConfig := guilds.ConfigFromEnv()
+	if defaultConfig.RecvDepth == 0 {
+		defaultConfig.RecvDepth = 50
+	}
+	if defaultConfig.ChannelID == "" && defaultConfig.ChannelName == "" && len(configs) == 0 {
+		log.Println("VOICE_CHANNEL_NAME or VOICE_CHANNEL_ID not found in .env file. Bot will not join a voice channel.")
+	}
+	// Serve each guild's channel mix to HTTP listeners at /stream, for
+	// example with ffplay http://localhost:8000/stream.
+	streamAddr := os.Getenv("STREAM_ADDR")
+	var streamServer *http.Server
+	if streamAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/stream", serveLiveStream)
+		streamServer = &http.Server{Addr: streamAddr, Handler: mux}
+		go func() {
+			log.Printf("Serving live stream on %s/stream\n", streamAddr)
+			if err := streamServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("Error serving live stream:", err)
+			}
+		}()
+	}
 
-		if voiceChannelID == "" && voiceChannelName == "" {
-			log.Println("VOICE_CHANNEL_NAME or VOICE_CHANNEL_ID not found in .env file. Bot will not join a voice channel.")
+	// Expose the state of the gateway and of each voice connection to
+	// Prometheus at /metrics, and whether they and the speaker work at
+	// /healthz and /readyz and to systemd.
+	registry := metrics.NewRegistry()
+	registry.Register(metrics.Session(dg))
+	checker := health.NewChecker()
+	checker.Live("gateway heartbeat", health.Heartbeat(dg, 5*time.Minute))
+	checker.Ready("gateway", health.Gateway(dg))
+	metricsAddr, healthAddr := os.Getenv("METRICS_ADDR"), os.Getenv("HEALTH_ADDR")
+	statusServers := serveStatus([]statusRoute{
+		{metricsAddr, "/metrics", registry},
+		{healthAddr, "/healthz", checker.Handler(false)},
+		{healthAddr, "/readyz", checker.Handler(true)},
+	})
+	systemdStop := make(chan struct{})
+	go checker.Systemd(systemdStop)
+
+	// Answer phone calls over SIP into the voice channel of SIP_GUILD_ID,
+	// or of the only guild joined, registering with SIP_REGISTRAR if set.
+	var phone *sip.UserAgent
+	phoneStop := make(chan struct{})
+	unregistered := make(chan struct{})
+	if addr := os.Getenv("SIP_ADDR"); addr != "" {
+		phone, err = startPhoneGateway(addr, phoneStop, unregistered)
+		if err != nil {
+			log.Println("Error starting SIP gateway:", err)
 			return
 		}
+	} else {
+		close(unregistered)
+	}
 
-		for _, c := range event.Guild.Channels {
-			if c.Type != discordgo.ChannelTypeGuildVoice {
-				continue
-			}
-			if voiceChannelID != "" && c.ID != voiceChannelID {
-				continue
-			}
-			if voiceChannelID == "" && c.Name != voiceChannelName {
-				continue
-			}
-
-			s.Lock()
-			if _, ok := s.VoiceConnections[event.Guild.ID]; !ok {
-				s.VoiceConnections[event.Guild.ID] = &discordgo.VoiceConnection{LogLevel: discordgo.LogDebug}
+	manager := guilds.NewManager(dg, defaultConfig, configs)
+	manager.Run = func(vc *discordgo.VoiceConnection, cfg *guilds.Config, stop <-chan struct{}) {
+		vc.LogLevel = discordgo.LogDebug
+		vc.AddHandler(func(v *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+			log.Printf("VoiceSpeakingUpdate: guild=%s user=%s speaking=%t ssrc=%d\n", v.GuildID, vs.UserID, vs.Speaking, vs.SSRC)
+		})
+		go func() {
+			for i := 0; i < 10; i++ {
+				log.Printf("VC state: guild=%s ready=%t opusRecvNil=%t dropped=%d\n", vc.GuildID, vc.Ready, vc.OpusRecv == nil, vc.DroppedPackets())
+				time.Sleep(1 * time.Second)
 			}
-			s.Unlock()
-
-			vc, err := s.ChannelVoiceJoin(event.Guild.ID, c.ID, false, false)
+		}()
+		// The channel is mixed once for the live stream, the RTP bridge
+		// and phone callers, which each get every frame.
+		var outputs []func(pcm []int16) error
+		if streamAddr != "" {
+			live, err := startLiveStream(vc.GuildID, stop)
 			if err != nil {
-				log.Printf("Error joining voice channel: %v\n", err)
-				return
-			}
-			if voiceChannelID != "" {
-				log.Printf("Successfully joined voice channel ID '%s'.\n", c.ID)
+				log.Printf("Error starting live stream for guild %s: %v\n", vc.GuildID, err)
 			} else {
-				log.Printf("Successfully joined voice channel '%s' (%s).\n", voiceChannelName, c.ID)
+				outputs = append(outputs, live.Write)
 			}
-			vc.LogLevel = discordgo.LogDebug
-			vc.AddHandler(func(v *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
-				log.Printf("VoiceSpeakingUpdate: user=%s speaking=%t ssrc=%d\n", vs.UserID, vs.Speaking, vs.SSRC)
-			})
-			go func() {
-				for i := 0; i < 10; i++ {
-					log.Printf("VC state: ready=%t opusRecvNil=%t\n", vc.Ready, vc.OpusRecv == nil)
-					time.Sleep(1 * time.Second)
-				}
-			}()
-
-			joined = true
-			currentReceiverVC = vc // Assign to global variable
-			stopReceiverAudioStream = make(chan struct{}) // Initialize the channel
-			go receiveAudio(s, vc, stopReceiverAudioStream)
-			return
+		}
+		sender, err := startRTPBridge(vc, cfg, stop)
+		if err != nil {
+			log.Printf("Error starting RTP bridge for guild %s: %v\n", vc.GuildID, err)
+		}
+		if sender != nil {
+			defer sender.Close()
+			outputs = append(outputs, sender.WriteFrame)
+		}
+		if phone != nil {
+			outputs = append(outputs, addPhoneLine(vc, stop).Write)
 		}
 
-		if voiceChannelID != "" {
-			log.Printf("Voice channel ID '%s' not found in guild '%s'.\n", voiceChannelID, event.Guild.Name)
-			return
+		var forwarder *relay.Forwarder
+		if len(outputs) > 0 {
+			forwarder = relay.NewForwarder(func() (relay.OpusDecoder, error) {
+				return opus.NewDecoder(48000, 1)
+			})
+			forwarder.Mode = relay.Mix
+			go livestream.Run(forwarder, stop, outputs...)
 		}
-		log.Printf("Voice channel '%s' not found in guild '%s'.\n", voiceChannelName, event.Guild.Name)
-	})
+		audio := &metrics.Audio{}
+		defer registry.Register(metrics.Voice(vc))()
+		defer registry.Register(func(w *metrics.Writer) { audio.Collect(w, "guild", vc.GuildID) })()
+		speaker := &health.Probe{}
+		defer checker.Ready("voice "+vc.GuildID, health.Voice(vc, 0))()
+		defer checker.Ready("speaker "+vc.GuildID, speaker.Check(0))()
+		receiveAudio(dg, vc, forwarder, audio, speaker, stop)
+		// A failed speaker stays reported until the guild is left.
+		<-stop
+	}
+	manager.OnJoin = func(cfg *guilds.Config, c *discordgo.Channel) {
+		log.Printf("Successfully joined voice channel '%s' (%s) in guild %s.\n", c.Name, c.ID, cfg.GuildID)
+	}
+	manager.OnLeave = func(guildID string) {
+		log.Printf("Left voice channel in guild %s.\n", guildID)
+	}
+	manager.OnError = func(guildID string, err error) {
+		log.Printf("Error joining voice channel in guild %s: %v\n", guildID, err)
+	}
 
 	dg.AddHandler(func(s *discordgo.Session, vsu *discordgo.VoiceStateUpdate) {
 		if vsu == nil || vsu.VoiceState == nil {
@@ -177,17 +248,24 @@ func main() {
 
 	// Cleanly close down the Discord session.
 	log.Println("Closing Discord session for Receiver Bot.")
+	close(systemdStop)
+
+	// Stop each guild's receiver and disconnect from its voice channel
+	manager.Close()
 
-	// Signal receiveAudio goroutine to stop and clean up voice connection
-	if stopReceiverAudioStream != nil {
-		close(stopReceiverAudioStream)
-		// Give some time for the goroutine to clean up
-		time.Sleep(1 * time.Second)
+	if phone != nil {
+		close(phoneStop)
+		<-unregistered
+		phone.Close()
 	}
 
-	if currentReceiverVC != nil && currentReceiverVC.Ready {
-		log.Println("Disconnecting from voice channel for Receiver Bot.")
-		currentReceiverVC.Disconnect()
+	for _, srv := range append(statusServers, streamServer) {
+		if srv == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		srv.Shutdown(ctx)
+		cancel()
 	}
 
 	dg.Close()
@@ -198,7 +276,373 @@ func readyReceiver(s *discordgo.Session, event *discordgo.Ready) {
 	s.UpdateGameStatus(0, "Receiving Audio")
 }
 
-func receiveAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan <-chan struct{}) {
+// liveStreams are the live streams of each guild joined, by guild ID.
+var liveStreams = struct {
+	sync.Mutex
+	m map[string]*livestream.Server
+}{m: map[string]*livestream.Server{}}
+
+// startLiveStream serves the live stream of a guild's voice channel until
+// stop is closed, when its listeners are disconnected, returning the
+// server to write its mix to.
+func startLiveStream(guildID string, stop <-chan struct{}) (*livestream.Server, error) {
+	encoder, err := opus.NewEncoder(48000, 1, opus.AppAudio)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := livestream.NewServer(encoder)
+	srv.OnJoin = func(r *http.Request, f livestream.Format) {
+		log.Printf("Live stream listener %s joined guild %s (%s).\n", r.RemoteAddr, guildID, f)
+	}
+	srv.OnLeave = func(r *http.Request, slow bool) {
+		if slow {
+			log.Printf("Live stream listener %s of guild %s dropped for falling behind.\n", r.RemoteAddr, guildID)
+			return
+		}
+		log.Printf("Live stream listener %s left guild %s.\n", r.RemoteAddr, guildID)
+	}
+
+	liveStreams.Lock()
+	liveStreams.m[guildID] = srv
+	liveStreams.Unlock()
+	go func() {
+		<-stop
+		liveStreams.Lock()
+		if liveStreams.m[guildID] == srv {
+			delete(liveStreams.m, guildID)
+		}
+		liveStreams.Unlock()
+		srv.Close()
+	}()
+	return srv, nil
+}
+
+// startRTPBridge connects a guild's voice channel to studio equipment over
+// RTP until stop is closed. RTP_IN_ADDR is listened on for a stream to send
+// to the channel, and the mix of the channel is sent to RTP_OUT_ADDR with
+// the returned sender, if set.
+func startRTPBridge(vc *discordgo.VoiceConnection, cfg *guilds.Config, stop <-chan struct{}) (*rtpbridge.Sender, error) {
+	if addr := cfg.Setting("RTP_IN_ADDR"); addr != "" {
+		format, err := rtpFormatFromEnv(cfg, "RTP_IN_FORMAT")
+		if err != nil {
+			return nil, err
+		}
+		encoder, err := opus.NewEncoder(48000, 1, opus.AppAudio)
+		if err != nil {
+			return nil, err
+		}
+		receiver, err := rtpbridge.Listen(addr, format, encoder)
+		if err != nil {
+			return nil, err
+		}
+		receiver.OnSource = func(ssrc uint32) {
+			log.Printf("RTP stream from SSRC %d started in guild %s.\n", ssrc, vc.GuildID)
+		}
+		log.Printf("Receiving RTP %s on %s for guild %s.\n", format, receiver.Addr(), vc.GuildID)
+		rtpInputs.Lock()
+		rtpInputs.m[vc.GuildID] = receiver
+		rtpInputs.Unlock()
+		go func() {
+			<-stop
+			rtpInputs.Lock()
+			if rtpInputs.m[vc.GuildID] == receiver {
+				delete(rtpInputs.m, vc.GuildID)
+			}
+			rtpInputs.Unlock()
+			receiver.Close()
+		}()
+		go receiver.Run(vc, stop)
+	}
+
+	addr := cfg.Setting("RTP_OUT_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	format, err := rtpFormatFromEnv(cfg, "RTP_OUT_FORMAT")
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := opus.NewEncoder(48000, 1, opus.AppAudio)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := rtpbridge.Dial(addr, format, encoder)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Sending RTP %s to %s for guild %s.\n", format, addr, vc.GuildID)
+	if path := cfg.Setting("RTP_SDP_FILE"); path != "" {
+		if err := ioutil.WriteFile(path, sender.SDP(), 0644); err != nil {
+			log.Println("Error writing SDP file:", err)
+		}
+	}
+	return sender, nil
+}
+
+// rtpFormatFromEnv returns the RTP format of the setting key, Opus by
+// default.
+func rtpFormatFromEnv(cfg *guilds.Config, key string) (rtpbridge.Format, error) {
+	name := cfg.Setting(key)
+	if name == "" {
+		return rtpbridge.Opus, nil
+	}
+	return rtpbridge.ParseFormat(name)
+}
+
+// startPhoneGateway answers phone calls over SIP on addr until stop is
+// closed, registering as SIP_USER with SIP_REGISTRAR if it is set, and
+// closes unregistered once the registration is removed.
+func startPhoneGateway(addr string, stop <-chan struct{}, unregistered chan<- struct{}) (*sip.UserAgent, error) {
+	ua, err := sip.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	ua.User = os.Getenv("SIP_USER")
+	ua.Password = os.Getenv("SIP_PASSWORD")
+	ua.OnCall = answerCall
+	ua.OnHangup = func(c *sip.Call) {
+		log.Printf("Phone call from %s ended.\n", c.From)
+	}
+	ua.OnError = func(err error) {
+		log.Println("SIP error:", err)
+	}
+	go ua.Serve()
+	log.Printf("Answering phone calls over SIP on %s.\n", ua.Addr())
+
+	registrar := os.Getenv("SIP_REGISTRAR")
+	if registrar == "" {
+		close(unregistered)
+		return ua, nil
+	}
+	go func() {
+		ua.KeepRegistered(registrar, 5*time.Minute, stop)
+		close(unregistered)
+	}()
+	return ua, nil
+}
+
+// rtpInputs are the receivers of RTP_IN_ADDR sending to the voice channel
+// of each guild, by guild ID.
+var rtpInputs = struct {
+	sync.Mutex
+	m map[string]*rtpbridge.Receiver
+}{m: map[string]*rtpbridge.Receiver{}}
+
+// phoneLines are the lines of each guild joined, by guild ID.
+var phoneLines = struct {
+	sync.Mutex
+	m map[string]*phoneLine
+}{m: map[string]*phoneLine{}}
+
+// A phoneLine connects a phone call to the voice channel of a guild.
+type phoneLine struct {
+	vc *discordgo.VoiceConnection
+
+	sync.Mutex
+	call   *sip.Call
+	sender *rtpbridge.Sender
+}
+
+// addPhoneLine adds the line of a guild's voice channel until stop is
+// closed, hanging up its call then.
+func addPhoneLine(vc *discordgo.VoiceConnection, stop <-chan struct{}) *phoneLine {
+	line := &phoneLine{vc: vc}
+	phoneLines.Lock()
+	phoneLines.m[vc.GuildID] = line
+	phoneLines.Unlock()
+	go func() {
+		<-stop
+		phoneLines.Lock()
+		if phoneLines.m[vc.GuildID] == line {
+			delete(phoneLines.m, vc.GuildID)
+		}
+		phoneLines.Unlock()
+
+		line.Lock()
+		call := line.call
+		line.Unlock()
+		if call != nil {
+			call.Hangup()
+		}
+	}()
+	return line
+}
+
+// Write sends a frame of the channel mix to the caller, if there is one.
+func (l *phoneLine) Write(pcm []int16) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.sender == nil {
+		return nil
+	}
+	return l.sender.WriteFrame(pcm)
+}
+
+// answerCall connects a call to the line of SIP_GUILD_ID, or of the only
+// guild joined, hanging up if there is none or it is in use. The caller
+// can mute and unmute themself by pressing '*'.
+func answerCall(c *sip.Call) {
+	guildID := os.Getenv("SIP_GUILD_ID")
+	phoneLines.Lock()
+	if guildID == "" && len(phoneLines.m) == 1 {
+		for id := range phoneLines.m {
+			guildID = id
+		}
+	}
+	line := phoneLines.m[guildID]
+	phoneLines.Unlock()
+	if line == nil {
+		log.Printf("No voice channel for phone call from %s; hanging up.\n", c.From)
+		// Hang up outside the SIP loop, which receives the response.
+		go c.Hangup()
+		return
+	}
+
+	if err := connectCall(line, c); err != nil {
+		log.Printf("Error connecting phone call from %s: %v\n", c.From, err)
+		go c.Hangup()
+		return
+	}
+	log.Printf("Phone call from %s (%s) joined guild %s.\n", c.From, c.Codec.Name, line.vc.GuildID)
+}
+
+// connectCall sends the audio of c to the voice channel of line, and the
+// channel mix back, until the call ends. Calls are refused while
+// RTP_IN_ADDR sends to the channel, as the two streams would interleave
+// their frames on the one voice connection.
+func connectCall(line *phoneLine, c *sip.Call) error {
+	rtpInputs.Lock()
+	rtpIn := rtpInputs.m[line.vc.GuildID] != nil
+	rtpInputs.Unlock()
+	if rtpIn {
+		return errors.New("RTP_IN_ADDR is sending to the channel")
+	}
+
+	var format rtpbridge.Format
+	switch strings.ToLower(c.Codec.Name) {
+	case "opus":
+		format = rtpbridge.Opus
+	case "pcmu":
+		format = rtpbridge.PCMU
+	case "pcma":
+		format = rtpbridge.PCMA
+	default:
+		return rtpbridge.ErrFormat
+	}
+
+	encoder, err := opus.NewEncoder(48000, 1, opus.AppVoIP)
+	if err != nil {
+		return err
+	}
+	receiver, err := rtpbridge.NewReceiver(c.RTP, format, encoder)
+	if err != nil {
+		return err
+	}
+	if c.Events != nil {
+		receiver.EventPayloadType = c.Events.PayloadType
+	}
+	receiver.OnDTMF = func(digit rune) {
+		if digit != '*' {
+			return
+		}
+		receiver.SetMute(!receiver.Muted())
+		log.Printf("Phone call from %s muted=%t.\n", c.From, receiver.Muted())
+	}
+
+	encoder, err = opus.NewEncoder(48000, 1, opus.AppVoIP)
+	if err != nil {
+		return err
+	}
+	sender, err := rtpbridge.NewSenderTo(c.RTP, c.Remote, format, encoder)
+	if err != nil {
+		return err
+	}
+	sender.SetPayloadType(c.Codec.PayloadType)
+
+	line.Lock()
+	if line.call != nil {
+		line.Unlock()
+		return errors.New("line in use")
+	}
+	line.call, line.sender = c, sender
+	line.Unlock()
+
+	go receiver.Run(line.vc, c.Done())
+	go func() {
+		<-c.Done()
+		line.Lock()
+		if line.call == c {
+			line.call, line.sender = nil, nil
+		}
+		line.Unlock()
+	}()
+	return nil
+}
+
+// A statusRoute is a handler of the status servers, for a pattern such
+// as "/metrics" on an address, which is not served if it is "".
+type statusRoute struct {
+	addr, pattern string
+	handler       http.Handler
+}
+
+// serveStatus serves each route, sharing a server between those on the
+// same address.
+func serveStatus(routes []statusRoute) []*http.Server {
+	muxes := map[string]*http.ServeMux{}
+	for _, r := range routes {
+		if r.addr == "" {
+			continue
+		}
+		if muxes[r.addr] == nil {
+			muxes[r.addr] = http.NewServeMux()
+		}
+		muxes[r.addr].Handle(r.pattern, r.handler)
+	}
+
+	var servers []*http.Server
+	for addr, mux := range muxes {
+		srv := &http.Server{Addr: addr, Handler: mux}
+		servers = append(servers, srv)
+		go func() {
+			log.Printf("Serving status on %s\n", addr)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("Error serving status:", err)
+			}
+		}()
+	}
+	return servers
+}
+
+// serveLiveStream serves the live stream of the guild in the "guild" query
+// parameter, which may be left out while only one guild is joined.
+func serveLiveStream(w http.ResponseWriter, r *http.Request) {
+	guildID := r.URL.Query().Get("guild")
+	liveStreams.Lock()
+	ids := make([]string, 0, len(liveStreams.m))
+	for id := range liveStreams.m {
+		ids = append(ids, id)
+	}
+	if guildID == "" && len(ids) == 1 {
+		guildID = ids[0]
+	}
+	srv := liveStreams.m[guildID]
+	liveStreams.Unlock()
+
+	if srv == nil {
+		sort.Strings(ids)
+		if guildID == "" && len(ids) > 1 {
+			http.Error(w, "several guilds are streaming, choose one with ?guild=: "+strings.Join(ids, ", "), http.StatusBadRequest)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	srv.ServeHTTP(w, r)
+}
+
+func receiveAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, forwarder *relay.Forwarder, audio *metrics.Audio, speaker *health.Probe, stopChan <-chan struct{}) {
 	log.Println("Starting audio reception.")
 	defer log.Println("Audio reception finished.")
 
@@ -209,6 +653,7 @@ func receiveAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan
 	speakerStream, err := portaudio.OpenDefaultStream(0, 1, 48000, len(out), out) // 0 input channels, 1 output channel
 	if err != nil {
 		log.Println("Error opening PortAudio output stream:", err)
+		speaker.Fail(err)
 		return
 	}
 	defer speakerStream.Close()
@@ -216,14 +661,17 @@ func receiveAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan
 	opusDecoder, err := opus.NewDecoder(48000, 1) // 1 channel for Discord voice
 	if err != nil {
 		log.Println("Error creating Opus decoder:", err)
+		speaker.Fail(err)
 		return
 	}
 
 	err = speakerStream.Start()
 	if err != nil {
 		log.Println("Error starting PortAudio output stream:", err)
+		speaker.Fail(err)
 		return
 	}
+	speaker.Beat()
 
 	for { // This is the main loop for receiving audio
 		log.Println("receiveAudio: Loop iteration.")
@@ -248,24 +696,45 @@ func receiveAudio(s *discordgo.Session, vc *discordgo.VoiceConnection, stopChan
 				continue
 			}
 			log.Printf("receiveAudio: Before reading from vc.OpusRecv, vc.Ready = %t\n", vc.Ready)
-			p, ok := <-vc.OpusRecv // This is a blocking call
+			var p *discordgo.Packet
+			var ok bool
+			select { // Blocks until a packet arrives or the receiver is stopped
+			case <-stopChan:
+				log.Println("Stopping audio receive goroutine (stop signal received).")
+				speakerStream.Stop()
+				return
+			case p, ok = <-vc.OpusRecv:
+			}
 			if !ok {
 				log.Println("OpusRecv channel closed, returning from receive goroutine.")
 				return // Exits here if OpusRecv channel closed
 			}
 			log.Println("Received audio packet from Discord.")
 
+			if forwarder != nil {
+				if err := forwarder.WritePacket(p); err != nil {
+					audio.DecodeErrors.Inc()
+					log.Println("Error decoding Opus data for live stream:", err)
+				}
+			}
 			_, err := opusDecoder.Decode(p.Opus, out)
+			p.Release()
 			if err != nil {
+				audio.DecodeErrors.Inc()
 				log.Println("Error decoding Opus data:", err)
 				continue
 			}
 
 			if speakerStream != nil {
 				err = speakerStream.Write()
-				if err != nil {
+				if err == portaudio.OutputUnderflowed {
+					audio.Underruns.Inc()
+				} else if err != nil {
 					log.Println("Error writing to PortAudio output stream:", err)
+					speaker.Fail(err)
+					continue
 				}
+				speaker.Beat()
 			}
 		}
 	}
@@ -0,0 +1,269 @@
+// Package relay forwards the audio of one voice channel to another.
+//
+// A Forwarder takes the packets received on one voice connection and sends
+// them on another, in one direction; two Forwarders connect a pair of
+// channels both ways. While a single user speaks their Opus packets are
+// passed straight through, and when several speak at once their audio is
+// decoded, mixed and re-encoded.
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/voicesend"
+)
+
+// Audio format of mixed audio.
+const (
+	SampleRate = 48000
+	FrameSize  = 960 // 20ms of mono audio
+)
+
+// Mode is how a Forwarder sends several speakers.
+type Mode int
+
+const (
+	// Auto passes packets through while one user speaks, and mixes
+	// while several do.
+	Auto Mode = iota
+	// Passthrough never re-encodes; while one user speaks, the others
+	// are dropped.
+	Passthrough
+	// Mix always decodes, mixes and re-encodes.
+	Mix
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Auto:
+		return "auto"
+	case Passthrough:
+		return "passthrough"
+	case Mix:
+		return "mix"
+	}
+	return "unknown"
+}
+
+const (
+	// activeWindow is how recently a speaker's last packet must have
+	// arrived for them to be speaking; Discord sends nothing in silence.
+	activeWindow = 100 * time.Millisecond
+
+	// jitterFrames of a speaker's audio are buffered before it is mixed,
+	// and maxFrames at most, dropping the oldest.
+	jitterFrames = 2
+	maxFrames    = 10
+
+	// idleSource is how long a speaker's decoder is kept after their
+	// last packet.
+	idleSource = time.Minute
+
+	// maxPassed is the number of packets waiting to be passed through
+	// beyond which new ones are dropped.
+	maxPassed = 16
+)
+
+// An OpusDecoder decodes Opus packets to mono PCM, for example
+// *opus.Decoder from gopkg.in/hraban/opus.v2 created with one channel.
+type OpusDecoder = voicesend.OpusDecoder
+
+// An OpusEncoder encodes frames of 48kHz mono PCM, for example
+// *opus.Encoder from gopkg.in/hraban/opus.v2.
+type OpusEncoder = voicesend.OpusEncoder
+
+// A Voice is where Run sends the relayed audio, such as a
+// *discordgo.VoiceConnection.
+type Voice = voicesend.Voice
+
+// A source is the audio of one speaker.
+type source struct {
+	dec     OpusDecoder
+	pcm     []int16 // decoded audio waiting to be mixed
+	mixing  bool    // whether pcm is past the jitter buffer
+	last    time.Time
+	decoded [6 * FrameSize]int16 // a packet holds at most 120ms of audio
+}
+
+// A Forwarder relays the speakers received on one voice connection to
+// another.
+type Forwarder struct {
+	// Mode is how several speakers are sent.
+	Mode Mode
+
+	// Process, if set, is applied to each speaker's decoded audio before
+	// it is mixed, for example to set their volume. Packets passed
+	// through are not decoded for it.
+	Process func(ssrc uint32, pcm []int16)
+
+	newDecoder func() (OpusDecoder, error)
+	passed     chan []byte
+
+	sync.Mutex
+	sources map[uint32]*source
+	current uint32 // SSRC being passed through
+}
+
+// NewForwarder returns a Forwarder in Auto mode, decoding each speaker
+// with a decoder from newDecoder when they are mixed.
+func NewForwarder(newDecoder func() (OpusDecoder, error)) *Forwarder {
+	return &Forwarder{
+		newDecoder: newDecoder,
+		passed:     make(chan []byte, maxPassed),
+		sources:    map[uint32]*source{},
+	}
+}
+
+// WritePacket adds a received packet to the relayed audio. The packet is
+// not retained, so it may be released afterwards.
+func (f *Forwarder) WritePacket(p *discordgo.Packet) error {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	src := f.sources[p.SSRC]
+	if src == nil {
+		src = &source{}
+		f.sources[p.SSRC] = src
+	}
+	src.last = now
+
+	active := 0
+	currentActive := false
+	for ssrc, s := range f.sources {
+		if now.Sub(s.last) < activeWindow {
+			active++
+			currentActive = currentActive || ssrc == f.current
+		} else if now.Sub(s.last) >= idleSource {
+			delete(f.sources, ssrc)
+		}
+	}
+
+	switch {
+	case f.Mode == Passthrough:
+		if currentActive && p.SSRC != f.current {
+			return nil
+		}
+		f.pass(p)
+		return nil
+	case f.Mode == Auto && active == 1:
+		// Keep the decoder's state in step in case mixing starts, and
+		// drop what is left of the mix so that it does not overlap.
+		if _, err := f.decode(src, p.Opus); err != nil {
+			return err
+		}
+		for _, s := range f.sources {
+			s.pcm, s.mixing = s.pcm[:0], false
+		}
+		f.pass(p)
+		return nil
+	}
+
+	n, err := f.decode(src, p.Opus)
+	if err != nil {
+		return err
+	}
+	if f.Process != nil {
+		f.Process(p.SSRC, src.decoded[:n])
+	}
+	src.pcm = append(src.pcm, src.decoded[:n]...)
+	if over := len(src.pcm) - maxFrames*FrameSize; over > 0 {
+		src.pcm = append(src.pcm[:0], src.pcm[over:]...)
+	}
+	return nil
+}
+
+// decode decodes a packet into src.decoded.
+func (f *Forwarder) decode(src *source, packet []byte) (int, error) {
+	if src.dec == nil {
+		dec, err := f.newDecoder()
+		if err != nil {
+			return 0, err
+		}
+		src.dec = dec
+	}
+	return src.dec.Decode(packet, src.decoded[:])
+}
+
+// pass queues a packet to be sent as it is.
+func (f *Forwarder) pass(p *discordgo.Packet) {
+	f.current = p.SSRC
+	select {
+	case f.passed <- append([]byte(nil), p.Opus...):
+	default:
+	}
+}
+
+// Mix adds the next frame of the mixed speakers to pcm, a frame of
+// FrameSize samples on its way to a voice connection, and reports whether
+// anyone was mixed. Packets passed through are not mixed, so a Forwarder
+// feeding an existing send path should be in Mix mode.
+func (f *Forwarder) Mix(pcm []int16) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	mixed := false
+	for _, src := range f.sources {
+		if !src.mixing && len(src.pcm) >= jitterFrames*FrameSize {
+			src.mixing = true
+		}
+		if !src.mixing {
+			continue
+		}
+		if len(src.pcm) < FrameSize {
+			// Wait for the jitter buffer to fill again.
+			src.mixing = false
+			continue
+		}
+		for i, s := range src.pcm[:FrameSize] {
+			v := int32(pcm[i]) + int32(s)
+			if v > 32767 {
+				v = 32767
+			} else if v < -32768 {
+				v = -32768
+			}
+			pcm[i] = int16(v)
+		}
+		src.pcm = append(src.pcm[:0], src.pcm[FrameSize:]...)
+		mixed = true
+	}
+	return mixed
+}
+
+// Run sends the relayed audio to v until stop is closed, encoding mixed
+// audio with enc. The bot is marked speaking while audio is sent; after it
+// stops a few frames of silence are sent before it is cleared, as Discord
+// recommends.
+func (f *Forwarder) Run(v Voice, enc OpusEncoder, stop <-chan struct{}) {
+	ticker := time.NewTicker(FrameSize * time.Second / SampleRate)
+	defer ticker.Stop()
+
+	pcm := make([]int16, FrameSize)
+	s := voicesend.New(v, enc)
+
+	for {
+		select {
+		case <-stop:
+			s.Stop()
+			return
+
+		case packet := <-f.passed:
+			s.Send(packet)
+
+		case <-ticker.C:
+			for i := range pcm {
+				pcm[i] = 0
+			}
+			if !f.Mix(pcm) {
+				if s.Idle(activeWindow) {
+					s.Pause()
+				}
+				continue
+			}
+			s.Encode(pcm)
+		}
+	}
+}
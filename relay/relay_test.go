@@ -0,0 +1,189 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/internal/voicetest"
+	"discord-audio-stream/voicesend"
+)
+
+func newFakeDecoder() (OpusDecoder, error) { return voicetest.Decoder{Scale: 100}, nil }
+
+func packet(ssrc uint32, b byte) *discordgo.Packet {
+	return &discordgo.Packet{SSRC: ssrc, Opus: []byte{b}}
+}
+
+// passed returns the packets queued to be passed through.
+func passed(f *Forwarder) []string {
+	var got []string
+	for {
+		select {
+		case p := <-f.passed:
+			got = append(got, string(p))
+		default:
+			return got
+		}
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	f := NewForwarder(newFakeDecoder)
+	f.Mode = Passthrough
+
+	// While SSRC 1 speaks, SSRC 2 is dropped.
+	f.WritePacket(packet(1, 'a'))
+	f.WritePacket(packet(2, 'x'))
+	f.WritePacket(packet(1, 'b'))
+	if got := passed(f); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("passed incorrect: got %q", got)
+	}
+
+	// Once SSRC 1 stops, SSRC 2 is passed.
+	time.Sleep(2 * activeWindow)
+	f.WritePacket(packet(2, 'y'))
+	f.WritePacket(packet(1, 'c'))
+	if got := passed(f); !reflect.DeepEqual(got, []string{"y"}) {
+		t.Errorf("passed incorrect: got %q", got)
+	}
+	if f.Mix(make([]int16, FrameSize)) {
+		t.Error("Mix returned true in passthrough mode")
+	}
+}
+
+func TestMix(t *testing.T) {
+	f := NewForwarder(newFakeDecoder)
+	f.Mode = Mix
+
+	if err := f.WritePacket(&discordgo.Packet{SSRC: 3}); err == nil {
+		t.Error("WritePacket of bad packet returned no error")
+	}
+
+	// Each speaker is buffered for jitterFrames before being mixed.
+	f.WritePacket(packet(1, 100))
+	f.WritePacket(packet(2, 5))
+	pcm := make([]int16, FrameSize)
+	if f.Mix(pcm) {
+		t.Error("Mix returned true before the jitter buffer filled")
+	}
+	f.WritePacket(packet(1, 200))
+	f.WritePacket(packet(2, 6))
+
+	var got []int16
+	for f.Mix(pcm) {
+		got = append(got, pcm[0])
+		for i := range pcm {
+			pcm[i] = 15000
+		}
+	}
+	// The second frame is clipped.
+	if want := []int16{10500, 32767}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mixed frames incorrect: got %v, want %v", got, want)
+	}
+	if got := passed(f); len(got) != 0 {
+		t.Errorf("passed in mix mode: got %q", got)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	f := NewForwarder(newFakeDecoder)
+	f.Mode = Mix
+	var ssrcs []uint32
+	f.Process = func(ssrc uint32, pcm []int16) {
+		ssrcs = append(ssrcs, ssrc)
+		if ssrc == 2 {
+			for i := range pcm {
+				pcm[i] = 0
+			}
+		}
+	}
+
+	// Each speaker is processed before being summed into the frame.
+	f.WritePacket(packet(1, 100))
+	f.WritePacket(packet(2, 5))
+	f.WritePacket(packet(1, 200))
+	f.WritePacket(packet(2, 6))
+	var got []int16
+	pcm := make([]int16, FrameSize)
+	for f.Mix(pcm) {
+		got = append(got, pcm[0])
+		for i := range pcm {
+			pcm[i] = 0
+		}
+	}
+	if want := []int16{10000, 20000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mixed frames incorrect: got %v, want %v", got, want)
+	}
+	if want := []uint32{1, 2, 1, 2}; !reflect.DeepEqual(ssrcs, want) {
+		t.Errorf("processed SSRCs incorrect: got %v, want %v", ssrcs, want)
+	}
+}
+
+func TestAuto(t *testing.T) {
+	f := NewForwarder(newFakeDecoder)
+
+	// One speaker is passed through.
+	f.WritePacket(packet(1, 'a'))
+	f.WritePacket(packet(1, 'b'))
+	if got := passed(f); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("passed incorrect: got %q", got)
+	}
+
+	// Two are mixed.
+	for i := 0; i < 2; i++ {
+		f.WritePacket(packet(2, 1))
+		f.WritePacket(packet(1, 2))
+	}
+	if got := passed(f); len(got) != 0 {
+		t.Errorf("passed while mixing: got %q", got)
+	}
+	pcm := make([]int16, FrameSize)
+	if !f.Mix(pcm) || pcm[0] != 300 {
+		t.Errorf("mixed frame incorrect: got %d", pcm[0])
+	}
+
+	// Back to one, the rest of the mix is dropped.
+	time.Sleep(2 * activeWindow)
+	f.WritePacket(packet(1, 'c'))
+	if got := passed(f); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("passed incorrect: got %q", got)
+	}
+	if f.Mix(pcm) {
+		t.Error("Mix returned true after mixing stopped")
+	}
+}
+
+func TestRun(t *testing.T) {
+	f := NewForwarder(newFakeDecoder)
+	f.Mode = Mix
+	v := &voicetest.Voice{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		f.Run(v, voicetest.Encoder{Scale: 100}, stop)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		f.WritePacket(packet(1, 'a'))
+	}
+	silence := string(voicesend.OpusSilence)
+	want := []string{"speaking", "a", "a", silence, silence, silence, silence, silence, "silent"}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(v.Events()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := v.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent incorrect: got %q, want %q", got, want)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after stop")
+	}
+}
@@ -0,0 +1,99 @@
+package rtpbridge
+
+// G.711 carries 8kHz audio, converted to and from the 48kHz of Discord by
+// repeating and averaging samples.
+
+// g711Ratio is the number of 48kHz samples to each 8kHz sample.
+const g711Ratio = SampleRate / 8000
+
+// ulawEncode returns the μ-law code of a sample, as in ITU-T G.711.
+func ulawEncode(v int16) byte {
+	const bias, clip = 0x84, 32635
+	s := int(v)
+	sign := 0
+	if s < 0 {
+		s, sign = -s, 0x80
+	}
+	if s > clip {
+		s = clip
+	}
+	s += bias
+	exp := 7
+	for mask := 0x4000; s&mask == 0 && exp > 0; mask >>= 1 {
+		exp--
+	}
+	mantissa := s >> uint(exp+3) & 0x0F
+	return ^byte(sign | exp<<4 | mantissa)
+}
+
+// ulawDecode returns the sample of a μ-law code.
+func ulawDecode(b byte) int16 {
+	b = ^b
+	exp := int(b>>4) & 0x07
+	s := (int(b&0x0F)<<3 + 0x84) << uint(exp)
+	s -= 0x84
+	if b&0x80 != 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
+
+// alawEncode returns the A-law code of a sample, as in ITU-T G.711.
+func alawEncode(v int16) byte {
+	s := int(v) >> 3 // A-law has 13 bits
+	sign := 0x80
+	if s < 0 {
+		s, sign = -s-1, 0
+	}
+	var b int
+	if s < 32 {
+		b = s >> 1
+	} else {
+		exp := 1
+		for s>>uint(exp+4) > 1 && exp < 7 {
+			exp++
+		}
+		b = exp<<4 | s>>uint(exp)&0x0F
+	}
+	return byte(sign|b) ^ 0x55
+}
+
+// alawDecode returns the sample of an A-law code.
+func alawDecode(b byte) int16 {
+	b ^= 0x55
+	exp := int(b>>4) & 0x07
+	s := int(b&0x0F)<<4 + 8
+	if exp > 0 {
+		s = (s + 0x100) << uint(exp-1)
+	}
+	if b&0x80 == 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
+
+// encodeG711 appends the G.711 codes of a frame of 48kHz audio to b,
+// averaging each group of samples.
+func encodeG711(b []byte, pcm []int16, encode func(int16) byte) []byte {
+	for i := 0; i+g711Ratio <= len(pcm); i += g711Ratio {
+		sum := 0
+		for _, v := range pcm[i : i+g711Ratio] {
+			sum += int(v)
+		}
+		b = append(b, encode(int16(sum/g711Ratio)))
+	}
+	return b
+}
+
+// decodeG711 appends the 48kHz audio of G.711 codes to pcm, interpolating
+// between samples from prev, the last sample of the previous packet.
+func decodeG711(pcm []int16, codes []byte, prev int16, decode func(byte) int16) ([]int16, int16) {
+	for _, c := range codes {
+		v := decode(c)
+		for i := 1; i <= g711Ratio; i++ {
+			pcm = append(pcm, int16(int(prev)+(int(v)-int(prev))*i/g711Ratio))
+		}
+		prev = v
+	}
+	return pcm, prev
+}
@@ -0,0 +1,430 @@
+package rtpbridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/voicesend"
+)
+
+const (
+	// DefaultDelay is how long received packets are held to absorb
+	// network jitter.
+	DefaultDelay = 60 * time.Millisecond
+
+	// maxDropout is the jump in sequence numbers beyond which a source
+	// is taken to have restarted, as in RFC 3550 appendix A.1.
+	maxDropout = 3000
+
+	// idleTimeout is how long after its last packet the stream is taken
+	// to have stopped.
+	idleTimeout = 200 * time.Millisecond
+
+	// queuedPackets are read ahead of the jitter buffer before new ones
+	// are dropped.
+	queuedPackets = 64
+)
+
+// A Voice is where a Receiver sends its stream, such as a
+// *discordgo.VoiceConnection.
+type Voice = voicesend.Voice
+
+// ReceiverStats are counters of a Receiver.
+type ReceiverStats struct {
+	Packets uint64 // packets played out
+	Lost    uint64 // packets never received in time
+	Late    uint64 // packets received after their turn
+	Sources uint64 // SSRCs received, including restarts
+}
+
+// A packet is a received RTP packet waiting to be played out.
+type packet struct {
+	seq       int64 // extended sequence number
+	timestamp uint32
+	payload   []byte
+}
+
+// A jitterBuffer reorders the packets of one source and releases each at
+// its playout time.
+type jitterBuffer struct {
+	delay time.Duration
+	rate  int // of RTP timestamps
+
+	started  bool
+	playing  bool // whether a packet of the source has been released
+	ssrc     uint32
+	replaced uint32    // the SSRC before the last change
+	until    time.Time // when late packets of replaced stop being dropped
+	next     int64     // extended sequence number of the next packet
+	highest  int64
+	base     time.Time // playout time of baseTS
+	baseTS   uint32
+	packets  map[int64]*packet
+	released []*packet
+
+	stats ReceiverStats
+}
+
+func newJitterBuffer(delay time.Duration, rate int) *jitterBuffer {
+	return &jitterBuffer{delay: delay, rate: rate, packets: map[int64]*packet{}}
+}
+
+// push adds a packet which arrived at now.
+func (j *jitterBuffer) push(h *discordgo.RTPHeader, payload []byte, now time.Time) {
+	if j.started && h.SSRC != j.ssrc {
+		// Packets of the previous source still arriving after a change
+		// are late and dropped, but only for the depth of the buffer, so
+		// that the source may come back.
+		if h.SSRC == j.replaced && now.Before(j.until) {
+			return
+		}
+		j.replaced, j.until = j.ssrc, now.Add(j.delay)
+		j.restart()
+	}
+
+	seq := int64(h.Sequence) + 1<<16
+	if j.started {
+		seq = j.highest + int64(int16(h.Sequence-uint16(j.highest)))
+		if d := seq - j.highest; d > maxDropout || d < -maxDropout {
+			j.restart()
+			seq = int64(h.Sequence) + 1<<16
+		}
+	}
+	if !j.started {
+		j.started, j.playing = true, false
+		j.ssrc = h.SSRC
+		j.next, j.highest = seq, seq
+		j.base, j.baseTS = now.Add(j.delay), h.Timestamp
+		j.stats.Sources++
+	}
+
+	if seq < j.next {
+		if j.playing {
+			j.stats.Late++
+			return
+		}
+		// The first packet to arrive need not be the first sent.
+		j.next = seq
+	}
+	if j.packets[seq] != nil {
+		return
+	}
+	p := &packet{seq: seq, timestamp: h.Timestamp, payload: payload}
+	j.packets[seq] = p
+	if seq > j.highest {
+		j.highest = seq
+	}
+
+	// A packet arriving after it was due, such as after a pause in the
+	// sender, reschedules the stream from now.
+	if late := now.Sub(j.playout(p)); late > 0 {
+		j.base = j.base.Add(late + j.delay)
+	}
+}
+
+// restart releases the packets waiting from the current source, in order,
+// and starts again with the next packet.
+func (j *jitterBuffer) restart() {
+	for len(j.packets) > 0 {
+		p := j.earliest()
+		delete(j.packets, p.seq)
+		j.released = append(j.released, p)
+	}
+	j.started = false
+}
+
+// earliest returns the waiting packet with the lowest sequence number.
+func (j *jitterBuffer) earliest() *packet {
+	var min *packet
+	for _, p := range j.packets {
+		if min == nil || p.seq < min.seq {
+			min = p
+		}
+	}
+	return min
+}
+
+// playout returns the time at which p is due.
+func (j *jitterBuffer) playout(p *packet) time.Time {
+	return j.base.Add(time.Duration(int32(p.timestamp-j.baseTS)) * time.Second / time.Duration(j.rate))
+}
+
+// pop returns the packets due at now, in order. A missing packet is given
+// up on once the packet after it is due.
+func (j *jitterBuffer) pop(now time.Time) []*packet {
+	out := j.released
+	j.released = nil
+	for len(j.packets) > 0 {
+		p := j.packets[j.next]
+		if p == nil {
+			p = j.earliest()
+			if now.Before(j.playout(p)) {
+				break
+			}
+			j.stats.Lost += uint64(p.seq - j.next)
+			j.next = p.seq
+		}
+		due := j.playout(p)
+		if now.Before(due) {
+			break
+		}
+		delete(j.packets, p.seq)
+		out = append(out, p)
+		j.next++
+		j.playing = true
+		j.stats.Packets++
+
+		// Timestamps are kept relative to the last packet so that they
+		// may wrap.
+		j.base, j.baseTS = due, p.timestamp
+	}
+	return out
+}
+
+// A Receiver receives an RTP stream and sends it to a voice connection.
+type Receiver struct {
+	// Delay is how long packets are held to absorb jitter.
+	Delay time.Duration
+
+	// OnSource, if set, is called when a new source starts sending.
+	OnSource func(ssrc uint32)
+
+	// EventPayloadType is the payload type of RFC 4733 telephone events
+	// in the stream, if not 0. OnDTMF, if set, is called with the digit,
+	// '*', '#' or 'A' to 'D' of each event.
+	EventPayloadType uint8
+	OnDTMF           func(digit rune)
+
+	format Format
+	enc    OpusEncoder
+	conn   net.PacketConn
+
+	mu    sync.Mutex
+	stats ReceiverStats
+	muted bool
+}
+
+// NewReceiver returns a Receiver of RTP packets in format from conn,
+// encoding formats other than Opus with enc.
+func NewReceiver(conn net.PacketConn, format Format, enc OpusEncoder) (*Receiver, error) {
+	if format != Opus && enc == nil {
+		return nil, ErrFormat
+	}
+	return &Receiver{
+		Delay:  DefaultDelay,
+		format: format,
+		enc:    enc,
+		conn:   conn,
+	}, nil
+}
+
+// Listen returns a Receiver of RTP packets in format on the UDP address
+// addr.
+func Listen(addr string, format Format, enc OpusEncoder) (*Receiver, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReceiver(conn, format, enc)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Addr returns the address the Receiver listens on.
+func (r *Receiver) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Stats returns the counters of the Receiver.
+func (r *Receiver) Stats() ReceiverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// SetMute sets whether the stream is dropped rather than sent.
+func (r *Receiver) SetMute(muted bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.muted = muted
+}
+
+// Muted reports whether the stream is muted.
+func (r *Receiver) Muted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.muted
+}
+
+// Close closes the connection of the Receiver, which stops Run.
+func (r *Receiver) Close() error {
+	return r.conn.Close()
+}
+
+// parsePacket returns the header and payload of an RTP packet, skipping
+// its header extension and padding.
+func parsePacket(b []byte) (*discordgo.RTPHeader, []byte, error) {
+	// RTCP multiplexed on the same port, as in RFC 5761.
+	if len(b) >= 2 && b[1] >= 192 && b[1] <= 223 {
+		return nil, nil, errors.New("rtcp packet")
+	}
+	h, n, err := discordgo.ParseRTPHeader(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.Extension {
+		n += int(h.ExtensionLength) * 4
+	}
+	end := len(b)
+	if h.Padding && end > n {
+		end -= int(b[end-1])
+	}
+	if n > end {
+		return nil, nil, errors.New("rtp packet too small")
+	}
+	return h, b[n:end], nil
+}
+
+// dtmfDigits are the digits of RFC 4733 events 0 to 15.
+const dtmfDigits = "0123456789*#ABCD"
+
+// comfortNoisePayloadType is the static payload type of RFC 3389 comfort
+// noise, which is dropped.
+const comfortNoisePayloadType = 13
+
+// Run sends the stream to v until stop is closed or the Receiver is
+// closed. The bot is marked speaking while the stream is sent; after it
+// stops a few frames of silence are sent before it is cleared, as Discord
+// recommends.
+func (r *Receiver) Run(v Voice, stop <-chan struct{}) {
+	type arrival struct {
+		h       *discordgo.RTPHeader
+		payload []byte
+		at      time.Time
+	}
+	arrivals := make(chan arrival, queuedPackets)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := r.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			h, payload, err := parsePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			select {
+			case arrivals <- arrival{h, append([]byte(nil), payload...), time.Now()}:
+			default:
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	jb := newJitterBuffer(r.Delay, r.format.ClockRate())
+	s := voicesend.New(v, r.enc)
+	var pcm []int16
+	var expectTS uint32 // timestamp following the last PCM packet
+	var prev int16      // last G.711 sample, interpolated from
+	var event struct {
+		seen      bool
+		ssrc      uint32
+		timestamp uint32
+	}
+
+	for {
+		select {
+		case <-stop:
+			s.Stop()
+			return
+		case <-done:
+			s.Stop()
+			return
+
+		case a := <-arrivals:
+			if r.EventPayloadType != 0 && a.h.PayloadType == r.EventPayloadType {
+				// Each event is sent several times with the same
+				// timestamp, and the first packet may be lost.
+				if len(a.payload) == 4 && a.payload[0] < 16 &&
+					!(event.seen && event.ssrc == a.h.SSRC && event.timestamp == a.h.Timestamp) {
+					event.seen, event.ssrc, event.timestamp = true, a.h.SSRC, a.h.Timestamp
+					if r.OnDTMF != nil {
+						r.OnDTMF(rune(dtmfDigits[a.payload[0]]))
+					}
+				}
+				continue
+			}
+			if a.h.PayloadType == comfortNoisePayloadType && r.format != Opus {
+				continue
+			}
+			sources := jb.stats.Sources
+			jb.push(a.h, a.payload, a.at)
+			if jb.stats.Sources != sources && r.OnSource != nil {
+				r.OnSource(a.h.SSRC)
+			}
+			continue
+
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		muted := r.Muted()
+		for _, p := range jb.pop(now) {
+			if muted {
+				pcm = pcm[:0]
+				continue
+			}
+			if r.format == Opus {
+				s.Send(p.payload)
+				continue
+			}
+
+			// Fill short gaps with silence so that the audio keeps its
+			// timing.
+			rate := r.format.ClockRate()
+			if gap := int32(p.timestamp - expectTS); len(pcm) > 0 && gap > 0 && gap < int32(rate) {
+				pcm = append(pcm, make([]int16, int(gap)*SampleRate/rate)...)
+			}
+			samples := len(p.payload)
+			switch r.format {
+			case L16:
+				samples /= 2
+				for i := 0; i+1 < len(p.payload); i += 2 {
+					pcm = append(pcm, int16(binary.BigEndian.Uint16(p.payload[i:])))
+				}
+			case PCMU:
+				pcm, prev = decodeG711(pcm, p.payload, prev, ulawDecode)
+			case PCMA:
+				pcm, prev = decodeG711(pcm, p.payload, prev, alawDecode)
+			}
+			expectTS = p.timestamp + uint32(samples)
+
+			for len(pcm) >= FrameSize {
+				s.Encode(pcm[:FrameSize])
+				pcm = append(pcm[:0], pcm[FrameSize:]...)
+			}
+		}
+
+		r.mu.Lock()
+		r.stats = jb.stats
+		r.mu.Unlock()
+
+		if s.Idle(idleTimeout) {
+			s.Pause()
+			pcm = pcm[:0]
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package rtpbridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/internal/voicetest"
+	"discord-audio-stream/voicesend"
+)
+
+// listenUDP returns a UDP connection on a free local port.
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readPacket reads an RTP packet from conn.
+func readPacket(t *testing.T, conn net.PacketConn) (*discordgo.RTPHeader, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, payload, err := parsePacket(buf[:n])
+	if err != nil {
+		t.Fatalf("parsePacket returned error: %v", err)
+	}
+	return h, payload
+}
+
+func TestSenderL16(t *testing.T) {
+	conn := listenUDP(t)
+	s, err := Dial(conn.LocalAddr().String(), L16, nil)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer s.Close()
+	s.header.Sequence = 0xFFFF
+
+	pcm := make([]int16, FrameSize)
+	pcm[0], pcm[l16Samples] = 1, -2
+	if err := s.WriteFrame(pcm); err != nil {
+		t.Fatalf("WriteFrame returned error: %v", err)
+	}
+
+	h1, p1 := readPacket(t, conn)
+	h2, p2 := readPacket(t, conn)
+	if !h1.Marker || h2.Marker || h1.PayloadType != L16.PayloadType() || h1.SSRC != s.SSRC() {
+		t.Errorf("first header incorrect: %+v", h1)
+	}
+	if h1.Sequence != 0xFFFF || h2.Sequence != 0 {
+		t.Errorf("sequence incorrect: got %d, %d, want 65535, 0", h1.Sequence, h2.Sequence)
+	}
+	if h2.Timestamp-h1.Timestamp != l16Samples {
+		t.Errorf("timestamp step incorrect: got %d, want %d", h2.Timestamp-h1.Timestamp, l16Samples)
+	}
+	if len(p1) != 2*l16Samples || int16(binary.BigEndian.Uint16(p1)) != 1 || int16(binary.BigEndian.Uint16(p2)) != -2 {
+		t.Errorf("payload incorrect: got % x..., % x...", p1[:2], p2[:2])
+	}
+}
+
+func TestSenderOpus(t *testing.T) {
+	conn := listenUDP(t)
+	s, err := Dial(conn.LocalAddr().String(), Opus, voicetest.Encoder{Scale: 100})
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer s.Close()
+
+	pcm := make([]int16, FrameSize)
+	for i := int16(1); i <= 2; i++ {
+		pcm[0] = i * 100
+		s.WriteFrame(pcm)
+	}
+	h1, p1 := readPacket(t, conn)
+	h2, p2 := readPacket(t, conn)
+	if h1.PayloadType != Opus.PayloadType() || h2.Sequence != h1.Sequence+1 || h2.Timestamp-h1.Timestamp != FrameSize {
+		t.Errorf("headers incorrect: %+v, %+v", h1, h2)
+	}
+	if !bytes.Equal(p1, []byte{1}) || !bytes.Equal(p2, []byte{2}) {
+		t.Errorf("payloads incorrect: got %v, %v", p1, p2)
+	}
+
+	sdp := string(s.SDP())
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	for _, want := range []string{
+		"c=IN IP4 127.0.0.1\r\n",
+		"m=audio " + strconv.Itoa(port) + " RTP/AVP 111\r\n",
+		"a=rtpmap:111 opus/48000/2\r\n",
+		"a=fmtp:111 sprop-stereo=0\r\n",
+	} {
+		if !strings.Contains(sdp, want) {
+			t.Errorf("SDP lacks %q:\n%s", want, sdp)
+		}
+	}
+
+	if _, err := Dial(conn.LocalAddr().String(), Opus, nil); err != ErrFormat {
+		t.Errorf("Dial without encoder returned %v, want ErrFormat", err)
+	}
+}
+
+// push adds a packet of 20ms to j.
+func push(j *jitterBuffer, ssrc uint32, seq uint16, now time.Time) {
+	h := &discordgo.RTPHeader{SSRC: ssrc, Sequence: seq, Timestamp: uint32(seq) * FrameSize}
+	j.push(h, []byte{byte(seq)}, now)
+}
+
+// seqs returns the sequence numbers of packets.
+func seqs(packets []*packet) []byte {
+	var got []byte
+	for _, p := range packets {
+		got = append(got, p.payload[0])
+	}
+	return got
+}
+
+func TestJitterBuffer(t *testing.T) {
+	start := time.Now()
+	ms := func(n int) time.Time { return start.Add(time.Duration(n) * time.Millisecond) }
+	j := newJitterBuffer(60*time.Millisecond, SampleRate)
+
+	// Packets are reordered and held for the delay.
+	push(j, 1, 10, ms(0))
+	push(j, 1, 12, ms(5))
+	push(j, 1, 11, ms(10))
+	if got := seqs(j.pop(ms(59))); len(got) != 0 {
+		t.Errorf("packets released early: %v", got)
+	}
+	if got := seqs(j.pop(ms(100))); !reflect.DeepEqual(got, []byte{10, 11, 12}) {
+		t.Errorf("packets incorrect: got %v, want [10 11 12]", got)
+	}
+
+	// A late packet is dropped, and a missing one skipped once the
+	// packet after it is due.
+	push(j, 1, 11, ms(101))
+	push(j, 1, 14, ms(110))
+	if got := seqs(j.pop(ms(120))); len(got) != 0 {
+		t.Errorf("packets released before 14 was due: %v", got)
+	}
+	if got := seqs(j.pop(ms(140))); !reflect.DeepEqual(got, []byte{14}) {
+		t.Errorf("packets incorrect: got %v, want [14]", got)
+	}
+	if j.stats.Late != 1 || j.stats.Lost != 1 {
+		t.Errorf("stats incorrect: got %+v", j.stats)
+	}
+
+	// A new SSRC releases what is left of the old one and starts again;
+	// packets of the old one are then dropped.
+	push(j, 1, 16, ms(150))
+	push(j, 2, 500, ms(150))
+	push(j, 1, 17, ms(150))
+	if got := seqs(j.pop(ms(151))); !reflect.DeepEqual(got, []byte{16}) {
+		t.Errorf("packets after SSRC change incorrect: got %v, want [16]", got)
+	}
+	if got := seqs(j.pop(ms(210))); !reflect.DeepEqual(got, []byte{byte(500 & 0xFF)}) {
+		t.Errorf("packets of new SSRC incorrect: got %v", got)
+	}
+	if j.stats.Sources != 2 {
+		t.Errorf("sources incorrect: got %d, want 2", j.stats.Sources)
+	}
+
+	// Once the delay has passed the old SSRC may come back.
+	push(j, 1, 30, ms(250))
+	if got := seqs(j.pop(ms(310))); !reflect.DeepEqual(got, []byte{30}) {
+		t.Errorf("packets of returning SSRC incorrect: got %v, want [30]", got)
+	}
+	if j.stats.Sources != 3 {
+		t.Errorf("sources incorrect: got %d, want 3", j.stats.Sources)
+	}
+}
+
+func TestJitterBufferWrap(t *testing.T) {
+	start := time.Now()
+	j := newJitterBuffer(0, SampleRate)
+
+	var want []byte
+	for i := 0; i < 4; i++ {
+		seq := uint16(0xFFFE + i)
+		h := &discordgo.RTPHeader{SSRC: 1, Sequence: seq, Timestamp: uint32(0xFFFFFC40 + i*FrameSize)}
+		j.push(h, []byte{byte(seq)}, start)
+		want = append(want, byte(seq))
+	}
+	if got := seqs(j.pop(start.Add(time.Second))); !reflect.DeepEqual(got, want) {
+		t.Errorf("packets across wrap incorrect: got %v, want %v", got, want)
+	}
+	if j.stats.Lost != 0 || j.stats.Late != 0 {
+		t.Errorf("stats incorrect: got %+v", j.stats)
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	conn := listenUDP(t)
+	r, err := NewReceiver(conn, Opus, nil)
+	if err != nil {
+		t.Fatalf("NewReceiver returned error: %v", err)
+	}
+	r.Delay = 20 * time.Millisecond
+	sources := make(chan uint32, 1)
+	r.OnSource = func(ssrc uint32) { sources <- ssrc }
+
+	v := &voicetest.Voice{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.Run(v, stop)
+		close(done)
+	}()
+
+	out, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	// Sent out of order, with RTCP and a header extension among them.
+	for _, seq := range []uint16{2, 1, 3} {
+		h := &discordgo.RTPHeader{PayloadType: Opus.PayloadType(), Sequence: seq, Timestamp: uint32(seq) * FrameSize, SSRC: 7}
+		packet := h.Append(nil)
+		if seq == 3 {
+			packet[0] |= 0x10
+			packet = append(packet, 0xBE, 0xDE, 0, 1, 0x10, 0xFF, 0, 0)
+		}
+		out.Write(append(packet, 'a'+byte(seq)))
+		if seq == 2 {
+			out.Write([]byte{0x80, 200, 0, 6})
+		}
+	}
+
+	select {
+	case ssrc := <-sources:
+		if ssrc != 7 {
+			t.Errorf("source incorrect: got %d, want 7", ssrc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("source not reported")
+	}
+	time.Sleep(idleTimeout + 200*time.Millisecond)
+	close(stop)
+	<-done
+
+	want := []string{"speaking", "b", "c", "d"}
+	for i := 0; i < voicesend.SilenceFrames; i++ {
+		want = append(want, string(voicesend.OpusSilence))
+	}
+	want = append(want, "silent")
+	if got := v.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events incorrect: got %q, want %q", got, want)
+	}
+	if s := r.Stats(); s.Packets != 3 || s.Sources != 1 {
+		t.Errorf("stats incorrect: got %+v", s)
+	}
+}
+
+func TestG711(t *testing.T) {
+	if ulawEncode(0) != 0xFF || alawEncode(0) != 0xD5 {
+		t.Errorf("codes of silence incorrect: got %#x, %#x", ulawEncode(0), alawEncode(0))
+	}
+	for _, c := range []struct {
+		name   string
+		encode func(int16) byte
+		decode func(byte) int16
+	}{
+		{"μ-law", ulawEncode, ulawDecode},
+		{"A-law", alawEncode, alawDecode},
+	} {
+		for v := -32768; v < 32768; v += 97 {
+			got := int(c.decode(c.encode(int16(v))))
+			// Codes are logarithmic, so the error grows with the
+			// sample, to a sixteenth of it.
+			if d := got - v; d*16 > abs(v)+256 || d*16 < -abs(v)-256 {
+				t.Errorf("%s of %d incorrect: got %d", c.name, v, got)
+				break
+			}
+		}
+	}
+
+	// Every code decodes to a sample which encodes to it again.
+	for b := 0; b < 256; b++ {
+		if got := ulawEncode(ulawDecode(byte(b))); got != byte(b) && b != 0x7F {
+			t.Errorf("μ-law code %#x incorrect: got %#x", b, got)
+		}
+		if got := alawEncode(alawDecode(byte(b))); got != byte(b) {
+			t.Errorf("A-law code %#x incorrect: got %#x", b, got)
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func TestReceiverPCMU(t *testing.T) {
+	conn := listenUDP(t)
+	r, err := NewReceiver(conn, PCMU, voicetest.Encoder{Scale: 100})
+	if err != nil {
+		t.Fatalf("NewReceiver returned error: %v", err)
+	}
+	r.Delay = 0
+	r.EventPayloadType = 101
+	digits := make(chan rune, 10)
+	r.OnDTMF = func(digit rune) { digits <- digit }
+
+	v := &voicetest.Voice{}
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Run(v, stop)
+
+	out, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	send := func(pt uint8, seq uint16, ts uint32, payload []byte) {
+		h := &discordgo.RTPHeader{PayloadType: pt, Sequence: seq, Timestamp: ts, SSRC: 9}
+		out.Write(append(h.Append(nil), payload...))
+	}
+
+	// Two packets of 20ms at 8kHz make two frames at 48kHz.
+	codes := bytes.Repeat([]byte{ulawEncode(5000)}, 160)
+	send(0, 1, 0, codes)
+	send(0, 2, 160, codes)
+
+	// An event is sent three times, and reported once.
+	for i := 0; i < 3; i++ {
+		send(101, uint16(3+i), 320, []byte{10, 0x80, 0, 160})
+	}
+	select {
+	case d := <-digits:
+		if d != '*' {
+			t.Errorf("digit incorrect: got %q, want '*'", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("digit not reported")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(v.Events()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := v.Events()
+	if len(got) != 3 || got[0] != "speaking" || got[2] != string([]byte{byte(ulawDecode(codes[0]) / 100)}) {
+		t.Errorf("events incorrect: got %q", got)
+	}
+	if len(digits) != 0 {
+		t.Errorf("event reported more than once")
+	}
+}
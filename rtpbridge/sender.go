@@ -0,0 +1,283 @@
+// Package rtpbridge connects voice channels to studio equipment over plain
+// RTP.
+//
+// A Sender streams the mix of a channel to a host and port as RTP Opus,
+// L16 or G.711, and describes the stream in an SDP file for the equipment
+// to receive it with. A Receiver takes an RTP stream from the equipment
+// and sends it to a voice connection, reordering packets in a jitter
+// buffer and following the stream across SSRC changes.
+package rtpbridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/voicesend"
+)
+
+// Audio format of the frames sent and received.
+const (
+	SampleRate = 48000
+	FrameSize  = 960 // 20ms of mono audio
+)
+
+// ErrFormat is returned for an unknown RTP payload format.
+var ErrFormat = errors.New("unsupported rtp format")
+
+// Format is the payload format of an RTP stream.
+type Format int
+
+const (
+	// Opus carries one 20ms Opus packet per RTP packet, as in RFC 7587.
+	Opus Format = iota
+	// L16 carries 16-bit big-endian mono PCM at 48kHz, 10ms per RTP
+	// packet to stay within a typical MTU.
+	L16
+	// PCMU carries 8kHz G.711 μ-law, 20ms per RTP packet, as telephones
+	// do.
+	PCMU
+	// PCMA carries 8kHz G.711 A-law, 20ms per RTP packet.
+	PCMA
+)
+
+func (f Format) String() string {
+	switch f {
+	case Opus:
+		return "opus"
+	case L16:
+		return "l16"
+	case PCMU:
+		return "pcmu"
+	case PCMA:
+		return "pcma"
+	}
+	return "unknown"
+}
+
+// ParseFormat returns the Format named "opus", "l16", "pcmu" or "pcma".
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "opus":
+		return Opus, nil
+	case "l16", "L16":
+		return L16, nil
+	case "pcmu", "PCMU":
+		return PCMU, nil
+	case "pcma", "PCMA":
+		return PCMA, nil
+	}
+	return 0, ErrFormat
+}
+
+// PayloadType returns the payload type of f announced in SDP files, which
+// is static for G.711 and dynamic otherwise.
+func (f Format) PayloadType() uint8 {
+	switch f {
+	case L16:
+		return 96
+	case PCMU:
+		return 0
+	case PCMA:
+		return 8
+	}
+	return 111
+}
+
+// ClockRate returns the RTP clock rate of f.
+func (f Format) ClockRate() int {
+	if f == PCMU || f == PCMA {
+		return 8000
+	}
+	return SampleRate
+}
+
+// l16Samples is the number of samples in an L16 packet.
+const l16Samples = FrameSize / 2
+
+// An OpusEncoder encodes frames of 48kHz mono PCM, for example
+// *opus.Encoder from gopkg.in/hraban/opus.v2.
+type OpusEncoder = voicesend.OpusEncoder
+
+// A Sender sends audio to an RTP receiver.
+type Sender struct {
+	format Format
+	enc    OpusEncoder
+	conn   net.Conn
+
+	header discordgo.RTPHeader
+	packet []byte
+	opus   [1000]byte
+	g711   []byte
+}
+
+// NewSender returns a Sender of RTP packets in format to conn, encoding
+// Opus with enc. The SSRC, first sequence number and timestamp are random,
+// as RFC 3550 recommends.
+func NewSender(conn net.Conn, format Format, enc OpusEncoder) (*Sender, error) {
+	if format == Opus && enc == nil {
+		return nil, ErrFormat
+	}
+	s := &Sender{
+		format: format,
+		enc:    enc,
+		conn:   conn,
+		header: discordgo.RTPHeader{
+			Marker:    true,
+			Sequence:  uint16(rand.Uint32()),
+			Timestamp: rand.Uint32(),
+			SSRC:      rand.Uint32(),
+		},
+		packet: make([]byte, 0, 1500),
+	}
+	s.header.PayloadType = format.PayloadType()
+	return s, nil
+}
+
+// Dial returns a Sender of RTP packets in format to the UDP address addr.
+func Dial(addr string, format Format, enc OpusEncoder) (*Sender, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSender(conn, format, enc)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSenderTo is like NewSender but sends from conn to addr, so that a
+// stream can be sent and received on one port, as telephones expect.
+func NewSenderTo(conn net.PacketConn, addr net.Addr, format Format, enc OpusEncoder) (*Sender, error) {
+	return NewSender(&packetConn{conn, addr}, format, enc)
+}
+
+// packetConn is a net.Conn writing to one address with a PacketConn.
+type packetConn struct {
+	net.PacketConn
+	addr net.Addr
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.addr)
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetPayloadType sets the payload type of the packets sent, for one
+// negotiated other than that of the Format.
+func (s *Sender) SetPayloadType(pt uint8) {
+	s.header.PayloadType = pt
+}
+
+// SSRC returns the synchronization source of the stream.
+func (s *Sender) SSRC() uint32 {
+	return s.header.SSRC
+}
+
+// WriteFrame sends a frame of FrameSize samples.
+func (s *Sender) WriteFrame(pcm []int16) error {
+	switch s.format {
+	case Opus:
+		n, err := s.enc.Encode(pcm, s.opus[:])
+		if err != nil {
+			return err
+		}
+		return s.write(s.opus[:n], FrameSize)
+	case PCMU:
+		return s.write(encodeG711(s.g711[:0], pcm, ulawEncode), len(pcm)/g711Ratio)
+	case PCMA:
+		return s.write(encodeG711(s.g711[:0], pcm, alawEncode), len(pcm)/g711Ratio)
+	}
+
+	for len(pcm) > 0 {
+		n := l16Samples
+		if n > len(pcm) {
+			n = len(pcm)
+		}
+		payload := make([]byte, 2*n)
+		for i, v := range pcm[:n] {
+			binary.BigEndian.PutUint16(payload[2*i:], uint16(v))
+		}
+		if err := s.write(payload, n); err != nil {
+			return err
+		}
+		pcm = pcm[n:]
+	}
+	return nil
+}
+
+// write sends a packet of the given number of samples.
+func (s *Sender) write(payload []byte, samples int) error {
+	s.packet = append(s.header.Append(s.packet[:0]), payload...)
+	s.header.Marker = false
+	s.header.Sequence++ // wraps from 0xFFFF to 0
+	s.header.Timestamp += uint32(samples)
+	_, err := s.conn.Write(s.packet)
+	return err
+}
+
+// SDP returns a session description of the stream, for the receiver to
+// be configured with.
+func (s *Sender) SDP() []byte {
+	local, _ := s.conn.LocalAddr().(*net.UDPAddr)
+	remote, _ := s.conn.RemoteAddr().(*net.UDPAddr)
+	if local == nil || remote == nil {
+		return nil
+	}
+
+	family := func(ip net.IP) string {
+		if ip.To4() == nil {
+			return "IP6"
+		}
+		return "IP4"
+	}
+	pt := s.header.PayloadType
+
+	sdp := fmt.Sprintf("v=0\r\n"+
+		"o=- %d %d IN %s %s\r\n"+
+		"s=discord-audio-stream\r\n"+
+		"c=IN %s %s\r\n"+
+		"t=0 0\r\n"+
+		"m=audio %d RTP/AVP %d\r\n",
+		s.header.SSRC, time.Now().Unix(), family(local.IP), local.IP,
+		family(remote.IP), remote.IP,
+		remote.Port, pt)
+	switch s.format {
+	case Opus:
+		// Opus is always announced with two channels; sprop-stereo
+		// tells the receiver that the stream is mono.
+		sdp += fmt.Sprintf("a=rtpmap:%d opus/%d/2\r\n"+
+			"a=fmtp:%d sprop-stereo=0\r\n"+
+			"a=ptime:20\r\n", pt, SampleRate, pt)
+	case L16:
+		sdp += fmt.Sprintf("a=rtpmap:%d L16/%d/1\r\n"+
+			"a=ptime:10\r\n", pt, SampleRate)
+	case PCMU, PCMA:
+		sdp += fmt.Sprintf("a=rtpmap:%d %s/8000\r\n"+
+			"a=ptime:20\r\n", pt, strings.ToUpper(s.format.String()))
+	}
+	sdp += fmt.Sprintf("a=ssrc:%d cname:discord-audio-stream\r\n"+
+		"a=sendonly\r\n", s.header.SSRC)
+	return []byte(sdp)
+}
+
+// Close closes the connection of the Sender.
+func (s *Sender) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,236 @@
+// Package sip is a minimal SIP user agent, so that telephone callers can
+// join a voice channel.
+//
+// A UserAgent registers with a SIP server over UDP and answers the calls
+// it receives, negotiating PCMU, PCMA or Opus audio and RFC 4733 telephone
+// events with SDP. The audio of each Call is carried over RTP on a port of
+// its own, for the rtpbridge package to send and receive.
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrMessage is returned for a malformed SIP message.
+var ErrMessage = errors.New("malformed sip message")
+
+// compactHeaders are the long forms of compact header names, from RFC 3261
+// section 7.3.3.
+var compactHeaders = map[string]string{
+	"I": "Call-Id",
+	"M": "Contact",
+	"E": "Content-Encoding",
+	"L": "Content-Length",
+	"C": "Content-Type",
+	"F": "From",
+	"S": "Subject",
+	"K": "Supported",
+	"T": "To",
+	"V": "Via",
+}
+
+// A Message is a SIP request or response.
+type Message struct {
+	// Method and URI are set for requests.
+	Method string
+	URI    string
+
+	// StatusCode and Reason are set for responses.
+	StatusCode int
+	Reason     string
+
+	// Header holds the header fields, keyed by their canonical name.
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+// IsRequest reports whether m is a request.
+func (m *Message) IsRequest() bool {
+	return m.Method != ""
+}
+
+// Get returns the first value of the header field key.
+func (m *Message) Get(key string) string {
+	return m.Header.Get(key)
+}
+
+// CSeq returns the sequence number and method of the CSeq header field.
+func (m *Message) CSeq() (int, string) {
+	f := strings.Fields(m.Get("CSeq"))
+	if len(f) != 2 {
+		return 0, ""
+	}
+	n, _ := strconv.Atoi(f[0])
+	return n, f[1]
+}
+
+// ParseMessage parses a SIP message received in a datagram.
+func ParseMessage(b []byte) (*Message, error) {
+	head, body := b, []byte(nil)
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		head, body = b[:i], b[i+4:]
+	}
+	lines := strings.Split(string(head), "\r\n")
+
+	m := &Message{Header: textproto.MIMEHeader{}}
+	start := strings.SplitN(lines[0], " ", 3)
+	if len(start) != 3 {
+		return nil, ErrMessage
+	}
+	if start[0] == "SIP/2.0" {
+		code, err := strconv.Atoi(start[1])
+		if err != nil {
+			return nil, ErrMessage
+		}
+		m.StatusCode, m.Reason = code, start[2]
+	} else {
+		if start[2] != "SIP/2.0" {
+			return nil, ErrMessage
+		}
+		m.Method, m.URI = start[0], start[1]
+	}
+
+	var last string
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		// Folded lines continue the previous field.
+		if line[0] == ' ' || line[0] == '\t' {
+			if v := m.Header[last]; len(v) > 0 {
+				v[len(v)-1] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, ErrMessage
+		}
+		key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+		if long, ok := compactHeaders[key]; ok {
+			key = long
+		}
+		value := strings.TrimSpace(line[i+1:])
+		last = key
+		// Via may hold several values, which are kept apart so that
+		// responses can echo them in order.
+		if key == "Via" {
+			for _, v := range strings.Split(value, ",") {
+				m.Header.Add(key, strings.TrimSpace(v))
+			}
+			continue
+		}
+		m.Header.Add(key, value)
+	}
+
+	if l := m.Get("Content-Length"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n > len(body) {
+			return nil, ErrMessage
+		}
+		body = body[:n]
+	}
+	if len(body) > 0 {
+		m.Body = body
+	}
+	return m, nil
+}
+
+// Bytes returns the wire format of m, with its Content-Length set.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	if m.IsRequest() {
+		fmt.Fprintf(&b, "%s %s SIP/2.0\r\n", m.Method, m.URI)
+	} else {
+		fmt.Fprintf(&b, "SIP/2.0 %d %s\r\n", m.StatusCode, m.Reason)
+	}
+
+	// Via comes first, as proxies expect; the other fields are sorted
+	// so that messages are reproducible.
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		if k != "Via" && k != "Content-Length" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	keys = append([]string{"Via"}, keys...)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+		}
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(m.Body))
+	b.Write(m.Body)
+	return b.Bytes()
+}
+
+// NewRequest returns a request of method to uri.
+func NewRequest(method, uri string) *Message {
+	return &Message{Method: method, URI: uri, Header: textproto.MIMEHeader{}}
+}
+
+// NewResponse returns a response to req, with the header fields which
+// identify its transaction.
+func NewResponse(req *Message, code int, reason string) *Message {
+	m := &Message{StatusCode: code, Reason: reason, Header: textproto.MIMEHeader{}}
+	for _, k := range []string{"Via", "From", "To", "Call-Id", "Cseq"} {
+		if v := req.Header[k]; len(v) > 0 {
+			m.Header[k] = append([]string(nil), v...)
+		}
+	}
+	return m
+}
+
+// headerParam returns the value of the parameter name of a header field
+// value such as `<sip:bot@host>;tag=1234`, or "" if it has none.
+func headerParam(value, name string) string {
+	if i := strings.LastIndexByte(value, '>'); i >= 0 {
+		value = value[i+1:]
+	}
+	for _, p := range strings.Split(value, ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if strings.EqualFold(kv[0], name) {
+			if len(kv) == 2 {
+				return kv[1]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// addressURI returns the URI of a name-addr such as
+// `"Alice" <sip:alice@host>;tag=1`.
+func addressURI(value string) string {
+	if i := strings.IndexByte(value, '<'); i >= 0 {
+		if j := strings.IndexByte(value[i:], '>'); j >= 0 {
+			return value[i+1 : i+j]
+		}
+	}
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// addressName returns the display name of a name-addr, or the user of its
+// URI if it has none.
+func addressName(value string) string {
+	if i := strings.IndexByte(value, '<'); i > 0 {
+		if name := strings.Trim(strings.TrimSpace(value[:i]), `"`); name != "" {
+			return name
+		}
+	}
+	uri := strings.TrimPrefix(strings.TrimPrefix(addressURI(value), "sips:"), "sip:")
+	if i := strings.IndexByte(uri, '@'); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
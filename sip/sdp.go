@@ -0,0 +1,185 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoCodec is returned when a call offers no audio codec in common.
+var ErrNoCodec = errors.New("no common audio codec")
+
+// A Codec is an RTP payload format of a session.
+type Codec struct {
+	PayloadType uint8
+	Name        string
+	ClockRate   int
+	Channels    int
+}
+
+// Codecs answered by a UserAgent, in order of preference.
+var (
+	Opus           = Codec{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2}
+	PCMU           = Codec{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+	PCMA           = Codec{PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1}
+	TelephoneEvent = Codec{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Channels: 1}
+)
+
+// staticCodecs are the payload types which may be offered without an
+// rtpmap attribute.
+var staticCodecs = map[uint8]Codec{0: PCMU, 8: PCMA}
+
+// A Session is the audio stream of an SDP offer or answer.
+type Session struct {
+	IP     net.IP
+	Port   int
+	Codecs []Codec
+
+	// Direction is the direction attribute, such as "sendonly", or
+	// "" for the default of "sendrecv".
+	Direction string
+}
+
+// ParseSDP parses the first audio stream of a session description.
+func ParseSDP(b []byte) (*Session, error) {
+	s := &Session{}
+	var pts []uint8
+	rtpmap := map[uint8]Codec{}
+	inAudio := false
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'c':
+			// A connection line before the first media applies to
+			// every stream, and one within the audio to it alone.
+			f := strings.Fields(value)
+			if len(f) == 3 && (s.IP == nil || inAudio) {
+				s.IP = net.ParseIP(strings.SplitN(f[2], "/", 2)[0])
+			}
+		case 'm':
+			if s.Port != 0 {
+				inAudio = false
+				continue
+			}
+			f := strings.Fields(value)
+			if len(f) < 4 || f[0] != "audio" || !strings.HasPrefix(f[2], "RTP/") {
+				continue
+			}
+			port, err := strconv.Atoi(f[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid sdp media: %q", value)
+			}
+			s.Port, inAudio = port, true
+			for _, pt := range f[3:] {
+				n, err := strconv.ParseUint(pt, 10, 7)
+				if err == nil {
+					pts = append(pts, uint8(n))
+				}
+			}
+		case 'a':
+			if !inAudio {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(value, "rtpmap:"):
+				f := strings.Fields(strings.TrimPrefix(value, "rtpmap:"))
+				if len(f) != 2 {
+					continue
+				}
+				pt, err := strconv.ParseUint(f[0], 10, 7)
+				enc := strings.Split(f[1], "/")
+				if err != nil || len(enc) < 2 {
+					continue
+				}
+				c := Codec{PayloadType: uint8(pt), Name: enc[0], Channels: 1}
+				c.ClockRate, _ = strconv.Atoi(enc[1])
+				if len(enc) > 2 {
+					c.Channels, _ = strconv.Atoi(enc[2])
+				}
+				rtpmap[c.PayloadType] = c
+			case value == "sendrecv" || value == "sendonly" || value == "recvonly" || value == "inactive":
+				s.Direction = value
+			}
+		}
+	}
+	if s.Port == 0 || s.IP == nil {
+		return nil, errors.New("sdp has no audio stream")
+	}
+
+	for _, pt := range pts {
+		if c, ok := rtpmap[pt]; ok {
+			s.Codecs = append(s.Codecs, c)
+		} else if c, ok := staticCodecs[pt]; ok {
+			s.Codecs = append(s.Codecs, c)
+		}
+	}
+	return s, nil
+}
+
+// Bytes returns the session description of s, with id as its session ID
+// and version.
+func (s *Session) Bytes(id int64) []byte {
+	family := "IP4"
+	if s.IP.To4() == nil {
+		family = "IP6"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n"+
+		"o=- %d %d IN %s %s\r\n"+
+		"s=discord-audio-stream\r\n"+
+		"c=IN %s %s\r\n"+
+		"t=0 0\r\n", id, id, family, s.IP, family, s.IP)
+	fmt.Fprintf(&b, "m=audio %d RTP/AVP", s.Port)
+	for _, c := range s.Codecs {
+		fmt.Fprintf(&b, " %d", c.PayloadType)
+	}
+	b.WriteString("\r\n")
+	for _, c := range s.Codecs {
+		if c.Channels > 1 {
+			fmt.Fprintf(&b, "a=rtpmap:%d %s/%d/%d\r\n", c.PayloadType, c.Name, c.ClockRate, c.Channels)
+		} else {
+			fmt.Fprintf(&b, "a=rtpmap:%d %s/%d\r\n", c.PayloadType, c.Name, c.ClockRate)
+		}
+		if strings.EqualFold(c.Name, TelephoneEvent.Name) {
+			fmt.Fprintf(&b, "a=fmtp:%d 0-15\r\n", c.PayloadType)
+		}
+	}
+	b.WriteString("a=ptime:20\r\n")
+	if s.Direction != "" {
+		fmt.Fprintf(&b, "a=%s\r\n", s.Direction)
+	}
+	return []byte(b.String())
+}
+
+// negotiate returns the first of the codecs supported which is offered,
+// with the payload type of the offer, and telephone events if offered.
+func negotiate(offer *Session, supported []Codec) (audio Codec, events *Codec, err error) {
+	find := func(want Codec) (Codec, bool) {
+		for _, c := range offer.Codecs {
+			if strings.EqualFold(c.Name, want.Name) && c.ClockRate == want.ClockRate {
+				return c, true
+			}
+		}
+		return Codec{}, false
+	}
+
+	found := false
+	for _, want := range supported {
+		if audio, found = find(want); found {
+			break
+		}
+	}
+	if !found {
+		return Codec{}, nil, ErrNoCodec
+	}
+	if c, ok := find(TelephoneEvent); ok {
+		events = &c
+	}
+	return audio, events, nil
+}
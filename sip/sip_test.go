@@ -0,0 +1,220 @@
+package sip
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"discord-audio-stream/sip/siptest"
+)
+
+func TestParseMessage(t *testing.T) {
+	b := []byte("INVITE sip:bot@127.0.0.1 SIP/2.0\r\n" +
+		"v: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bKa, SIP/2.0/UDP 10.0.0.2;branch=z9hG4bKb\r\n" +
+		"f: \"Alice\" <sip:alice@example.com>;tag=1\r\n" +
+		"t: <sip:bot@127.0.0.1>\r\n" +
+		"i: call-1\r\n" +
+		"CSeq: 2 INVITE\r\n" +
+		"Subject: a long\r\n" +
+		" subject\r\n" +
+		"l: 4\r\n" +
+		"\r\n" +
+		"body and more")
+
+	m, err := ParseMessage(b)
+	if err != nil {
+		t.Fatalf("ParseMessage returned error: %v", err)
+	}
+	if !m.IsRequest() || m.Method != "INVITE" || m.URI != "sip:bot@127.0.0.1" {
+		t.Errorf("request line incorrect: %+v", m)
+	}
+	if got := m.Header["Via"]; len(got) != 2 || headerParam(got[1], "branch") != "z9hG4bKb" {
+		t.Errorf("Via incorrect: got %q", got)
+	}
+	if n, method := m.CSeq(); n != 2 || method != "INVITE" {
+		t.Errorf("CSeq incorrect: got %d %s", n, method)
+	}
+	if m.Get("Call-ID") != "call-1" || m.Get("Subject") != "a long subject" || string(m.Body) != "body" {
+		t.Errorf("message incorrect: %+v", m)
+	}
+	if name := addressName(m.Get("From")); name != "Alice" {
+		t.Errorf("caller incorrect: got %q, want Alice", name)
+	}
+	if name := addressName("<sip:5551234@carrier>;tag=2"); name != "5551234" {
+		t.Errorf("caller without name incorrect: got %q, want 5551234", name)
+	}
+
+	// A response echoes the transaction, and round trips.
+	resp := NewResponse(m, 200, "OK")
+	resp.Body = []byte("x")
+	got, err := ParseMessage(resp.Bytes())
+	if err != nil {
+		t.Fatalf("ParseMessage of response returned error: %v", err)
+	}
+	if got.StatusCode != 200 || got.Reason != "OK" || !reflect.DeepEqual(got.Header["Via"], m.Header["Via"]) ||
+		got.Get("Call-ID") != "call-1" || string(got.Body) != "x" {
+		t.Errorf("response incorrect: %+v", got)
+	}
+
+	if _, err := ParseMessage([]byte("hello\r\n\r\n")); err != ErrMessage {
+		t.Errorf("ParseMessage of garbage returned %v, want ErrMessage", err)
+	}
+}
+
+func TestSDP(t *testing.T) {
+	offer, err := ParseSDP([]byte("v=0\r\n" +
+		"o=- 1 1 IN IP4 10.0.0.1\r\n" +
+		"c=IN IP4 10.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 4000 RTP/AVP 8 0 101\r\n" +
+		"a=rtpmap:101 telephone-event/8000\r\n" +
+		"m=video 4002 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n"))
+	if err != nil {
+		t.Fatalf("ParseSDP returned error: %v", err)
+	}
+	want := &Session{IP: net.ParseIP("10.0.0.1"), Port: 4000, Codecs: []Codec{PCMA, PCMU, TelephoneEvent}}
+	if !reflect.DeepEqual(offer, want) {
+		t.Errorf("session incorrect: got %+v, want %+v", offer, want)
+	}
+
+	// The first supported codec is chosen, whatever the order offered.
+	audio, events, err := negotiate(offer, []Codec{Opus, PCMU, PCMA})
+	if err != nil || audio != PCMU || events == nil || *events != TelephoneEvent {
+		t.Errorf("negotiate incorrect: got %+v, %+v, %v", audio, events, err)
+	}
+	if _, _, err := negotiate(offer, []Codec{Opus}); err != ErrNoCodec {
+		t.Errorf("negotiate without common codec returned %v, want ErrNoCodec", err)
+	}
+
+	// An answer round trips, keeping a dynamic payload type.
+	opus := Opus
+	opus.PayloadType = 109
+	answer := &Session{IP: net.ParseIP("127.0.0.1"), Port: 5000, Codecs: []Codec{opus, TelephoneEvent}}
+	got, err := ParseSDP(answer.Bytes(1))
+	if err != nil {
+		t.Fatalf("ParseSDP of answer returned error: %v", err)
+	}
+	if !reflect.DeepEqual(got, answer) {
+		t.Errorf("answer incorrect: got %+v, want %+v", got, answer)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	srv, err := siptest.NewServer(map[string]string{"bot": "secret"})
+	if err != nil {
+		t.Fatalf("NewServer returned error: %v", err)
+	}
+	defer srv.Close()
+
+	ua, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer ua.Close()
+	ua.User, ua.Password = "bot", "wrong"
+	ua.Timeout = 5 * time.Second
+	calls := make(chan *Call, 2)
+	hangups := make(chan *Call, 2)
+	ua.OnCall = func(c *Call) { calls <- c }
+	ua.OnHangup = func(c *Call) { hangups <- c }
+	go ua.Serve()
+
+	var se *StatusError
+	if err := ua.Register(srv.Addr(), time.Minute); !errors.As(err, &se) || se.StatusCode != 403 {
+		t.Errorf("Register with wrong password returned %v, want 403", err)
+	}
+	ua.Password = "secret"
+	if err := ua.Register(srv.Addr(), time.Minute); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if contact := srv.Registered("bot"); !strings.HasPrefix(contact, "sip:bot@127.0.0.1:") {
+		t.Errorf("contact incorrect: got %q", contact)
+	}
+
+	// The phone offers G.711 and telephone events; the bot prefers
+	// Opus but settles for PCMU.
+	phone, err := srv.Call("bot", siptest.PCMU, siptest.PCMA, siptest.TelephoneEvent)
+	if err != nil {
+		t.Fatalf("Call returned error: %v", err)
+	}
+	var c *Call
+	select {
+	case c = <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not answered")
+	}
+	if c.From != "Phone" || c.Codec != PCMU || c.Events == nil || c.Events.PayloadType != 101 {
+		t.Errorf("call incorrect: %+v", c)
+	}
+	if phone.PayloadType != 0 || phone.EventPayloadType != 101 {
+		t.Errorf("answer incorrect: payload types %d, %d", phone.PayloadType, phone.EventPayloadType)
+	}
+	if c.Remote.Port != phone.RTP.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("remote audio incorrect: got %v, want %v", c.Remote, phone.RTP.LocalAddr())
+	}
+
+	// Audio flows both ways.
+	phone.WriteRTP(0, []byte{0xFF, 0xFF}, 2)
+	c.RTP.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	if n, _, err := c.RTP.ReadFrom(buf); err != nil || n != 14 {
+		t.Errorf("audio from phone incorrect: got %d bytes, %v", n, err)
+	}
+	c.RTP.WriteTo([]byte{0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0xAB}, c.Remote)
+	if pt, payload, err := phone.ReadRTP(); err != nil || pt != 0 || string(payload) != "\xAB" {
+		t.Errorf("audio from bot incorrect: got %d % x, %v", pt, payload, err)
+	}
+
+	// A second caller finds the line busy.
+	var busy *siptest.StatusError
+	if _, err := srv.Call("bot", siptest.PCMU); !errors.As(err, &busy) || busy.StatusCode != 486 {
+		t.Errorf("second Call returned %v, want 486", err)
+	}
+
+	// The phone hangs up.
+	if err := phone.Hangup(); err != nil {
+		t.Errorf("Hangup returned error: %v", err)
+	}
+	select {
+	case got := <-hangups:
+		if got != c {
+			t.Errorf("hung up call incorrect: got %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hangup not reported")
+	}
+	if len(ua.Calls()) != 0 {
+		t.Errorf("calls after hangup: %d", len(ua.Calls()))
+	}
+
+	// And the bot hangs up a call of its own.
+	phone, err = srv.Call("bot", siptest.Opus)
+	if err != nil {
+		t.Fatalf("Call with Opus returned error: %v", err)
+	}
+	c = <-calls
+	if c.Codec.Name != "opus" || c.Codec.PayloadType != 109 || c.Events != nil {
+		t.Errorf("Opus call incorrect: %+v", c)
+	}
+	if err := c.Hangup(); err != nil {
+		t.Errorf("Hangup returned error: %v", err)
+	}
+	select {
+	case <-phone.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("phone not hung up")
+	}
+
+	// A call without a common codec is refused.
+	if _, err := srv.Call("bot", siptest.Codec{PayloadType: 18, Name: "G729/8000"}); !errors.As(err, &busy) || busy.StatusCode != 488 {
+		t.Errorf("Call with G.729 returned %v, want 488", err)
+	}
+
+	if err := ua.Register(srv.Addr(), 0); err != nil || srv.Registered("bot") != "" {
+		t.Errorf("unregistering failed: %v", err)
+	}
+}
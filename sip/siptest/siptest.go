@@ -0,0 +1,530 @@
+// Package siptest provides a stand-in SIP server for testing user agents
+// without a carrier.
+//
+// A Server is a registrar with digest authentication which places calls to
+// the users registered with it, as a telephone would, sending and receiving
+// their RTP audio. It speaks SIP and SDP on the wire alone, so that it
+// tests the messages a user agent sends rather than sharing its parser.
+package siptest
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout is how long the Server waits for responses.
+var Timeout = 5 * time.Second
+
+// ErrTimeout is returned when a user agent does not respond.
+var ErrTimeout = errors.New("siptest: timed out")
+
+// A message is a SIP message as received.
+type message struct {
+	method string
+	uri    string
+	status int
+	reason string
+	header map[string][]string // keyed by lower case name
+	body   string
+}
+
+func (m *message) get(key string) string {
+	if v := m.header[strings.ToLower(key)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// parse parses a SIP message, expanding the compact header names.
+func parse(b []byte) (*message, error) {
+	text := string(b)
+	head, body := text, ""
+	if i := strings.Index(text, "\r\n\r\n"); i >= 0 {
+		head, body = text[:i], text[i+4:]
+	}
+	lines := strings.Split(head, "\r\n")
+	start := strings.SplitN(lines[0], " ", 3)
+	if len(start) != 3 {
+		return nil, fmt.Errorf("siptest: malformed start line %q", lines[0])
+	}
+
+	m := &message{header: map[string][]string{}, body: body}
+	if start[0] == "SIP/2.0" {
+		m.status, _ = strconv.Atoi(start[1])
+		m.reason = start[2]
+	} else {
+		m.method, m.uri = start[0], start[1]
+	}
+	compact := map[string]string{"i": "call-id", "m": "contact", "l": "content-length", "c": "content-type", "f": "from", "t": "to", "v": "via"}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		if long, ok := compact[key]; ok {
+			key = long
+		}
+		m.header[key] = append(m.header[key], strings.TrimSpace(line[i+1:]))
+	}
+	return m, nil
+}
+
+// build returns the wire format of a message with the given start line,
+// header fields as alternating names and values, and body.
+func build(start string, body string, fields ...string) []byte {
+	var b strings.Builder
+	b.WriteString(start + "\r\n")
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&b, "%s: %s\r\n", fields[i], fields[i+1])
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return []byte(b.String())
+}
+
+// response returns the wire format of a response to req.
+func response(req *message, status int, reason, body string, fields ...string) []byte {
+	var base []string
+	for _, v := range req.header["via"] {
+		base = append(base, "Via", v)
+	}
+	to := req.get("To")
+	if !strings.Contains(to, "tag=") {
+		to += ";tag=" + randomID()
+	}
+	base = append(base, "From", req.get("From"), "To", to, "Call-ID", req.get("Call-ID"), "CSeq", req.get("CSeq"))
+	return build(fmt.Sprintf("SIP/2.0 %d %s", status, reason), body, append(base, fields...)...)
+}
+
+func randomID() string {
+	return strconv.FormatUint(rand.Uint64(), 36)
+}
+
+// param returns the value of a parameter of a header field value.
+func param(value, name string) string {
+	if i := strings.LastIndexByte(value, '>'); i >= 0 {
+		value = value[i+1:]
+	}
+	for _, p := range strings.Split(value, ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// uri returns the URI of a name-addr.
+func uri(value string) string {
+	if i := strings.IndexByte(value, '<'); i >= 0 {
+		if j := strings.IndexByte(value[i:], '>'); j >= 0 {
+			return value[i+1 : i+j]
+		}
+	}
+	return strings.SplitN(value, ";", 2)[0]
+}
+
+// A Server is a stand-in SIP registrar and telephone.
+type Server struct {
+	conn  *net.UDPConn
+	users map[string]string // password by user
+
+	sync.Mutex
+	contacts  map[string]string       // registered contact URI by user
+	addrs     map[string]*net.UDPAddr // address registered from by user
+	nonce     string
+	pending   map[string]chan *message // by Via branch
+	calls     map[string]*Call         // by Call-ID
+	closeOnce sync.Once
+}
+
+// Realm is the realm of the Server's digest challenges.
+const Realm = "siptest"
+
+// NewServer returns a Server listening on a local UDP port. The users,
+// keyed by name, must authenticate with their password when registering;
+// if users is nil anyone may register.
+func NewServer(users map[string]string) (*Server, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conn:     conn,
+		users:    users,
+		contacts: map[string]string{},
+		addrs:    map[string]*net.UDPAddr{},
+		nonce:    randomID(),
+		pending:  map[string]chan *message{},
+		calls:    map[string]*Call{},
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host and port of the Server.
+func (s *Server) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Registered returns the contact URI registered by user, or "" if it is
+// not registered.
+func (s *Server) Registered(user string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.contacts[user]
+}
+
+// Close stops the Server.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { s.conn.Close() })
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m, err := parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		if m.method == "" {
+			s.Lock()
+			ch := s.pending[param(m.get("Via"), "branch")]
+			s.Unlock()
+			if ch != nil {
+				select {
+				case ch <- m:
+				default:
+				}
+			}
+			continue
+		}
+
+		switch m.method {
+		case "REGISTER":
+			s.register(m, from)
+		case "BYE":
+			s.Lock()
+			c := s.calls[m.get("Call-ID")]
+			s.Unlock()
+			if c == nil {
+				s.conn.WriteToUDP(response(m, 481, "Call/Transaction Does Not Exist", ""), from)
+				continue
+			}
+			s.conn.WriteToUDP(response(m, 200, "OK", ""), from)
+			c.end()
+		default:
+			s.conn.WriteToUDP(response(m, 200, "OK", ""), from)
+		}
+	}
+}
+
+// digestParams matches the parameters of a digest authorization.
+var digestParams = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// register handles a REGISTER, challenging it if the Server has users.
+func (s *Server) register(m *message, from *net.UDPAddr) {
+	user := strings.TrimPrefix(uri(m.get("To")), "sip:")
+	if i := strings.IndexByte(user, '@'); i >= 0 {
+		user = user[:i]
+	}
+
+	if s.users != nil {
+		params := map[string]string{}
+		for _, p := range digestParams.FindAllStringSubmatch(m.get("Authorization"), -1) {
+			params[strings.ToLower(p[1])] = p[2] + p[3]
+		}
+		hash := func(s string) string {
+			sum := md5.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		password, ok := s.users[user]
+		ha1 := hash(user + ":" + Realm + ":" + password)
+		ha2 := hash(m.method + ":" + params["uri"])
+		want := hash(ha1 + ":" + s.nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		if params["response"] == "" {
+			challenge := fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth", algorithm=MD5`, Realm, s.nonce)
+			s.conn.WriteToUDP(response(m, 401, "Unauthorized", "", "WWW-Authenticate", challenge), from)
+			return
+		}
+		if !ok || params["username"] != user || params["response"] != want {
+			s.conn.WriteToUDP(response(m, 403, "Forbidden", ""), from)
+			return
+		}
+	}
+
+	s.Lock()
+	if m.get("Expires") == "0" {
+		delete(s.contacts, user)
+		delete(s.addrs, user)
+	} else {
+		s.contacts[user] = uri(m.get("Contact"))
+		s.addrs[user] = from
+	}
+	s.Unlock()
+	s.conn.WriteToUDP(response(m, 200, "OK", "", "Contact", m.get("Contact"), "Expires", m.get("Expires")), from)
+}
+
+// transact sends a request to addr, returning its final response.
+func (s *Server) transact(method, target string, addr *net.UDPAddr, body string, fields ...string) (*message, error) {
+	branch := "z9hG4bK" + randomID()
+	ch := make(chan *message, 8)
+	s.Lock()
+	s.pending[branch] = ch
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.pending, branch)
+		s.Unlock()
+	}()
+
+	fields = append([]string{"Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=%s", s.Addr(), branch), "Max-Forwards", "70"}, fields...)
+	if _, err := s.conn.WriteToUDP(build(method+" "+target+" SIP/2.0", body, fields...), addr); err != nil {
+		return nil, err
+	}
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case m := <-ch:
+			if m.status >= 200 {
+				return m, nil
+			}
+		case <-timeout:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// A StatusError is a call rejected by the user agent.
+type StatusError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("siptest: %d %s", e.StatusCode, e.Reason)
+}
+
+// A Codec is an RTP payload format offered in a call.
+type Codec struct {
+	PayloadType uint8
+	Name        string // such as "PCMU/8000" or "opus/48000/2"
+}
+
+// Codecs commonly offered by telephones.
+var (
+	PCMU           = Codec{0, "PCMU/8000"}
+	PCMA           = Codec{8, "PCMA/8000"}
+	Opus           = Codec{109, "opus/48000/2"}
+	TelephoneEvent = Codec{101, "telephone-event/8000"}
+)
+
+// Call calls user from the address "Phone" <sip:phone@...>, offering
+// codecs, and returns the call once answered.
+func (s *Server) Call(user string, codecs ...Codec) (*Call, error) {
+	s.Lock()
+	target, addr := s.contacts[user], s.addrs[user]
+	s.Unlock()
+	if target == "" {
+		return nil, fmt.Errorf("siptest: %s is not registered", user)
+	}
+
+	rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	port := rtp.LocalAddr().(*net.UDPAddr).Port
+	var pts, attrs string
+	for _, c := range codecs {
+		pts += " " + strconv.Itoa(int(c.PayloadType))
+		attrs += fmt.Sprintf("a=rtpmap:%d %s\r\n", c.PayloadType, c.Name)
+	}
+	offer := fmt.Sprintf("v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=siptest\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n"+
+		"m=audio %d RTP/AVP%s\r\n%sa=sendrecv\r\n", port, pts, attrs)
+
+	c := &Call{
+		ID:   randomID(),
+		RTP:  rtp,
+		srv:  s,
+		addr: addr,
+		from: fmt.Sprintf(`"Phone" <sip:phone@%s>;tag=%s`, s.Addr(), randomID()),
+		ssrc: rand.Uint32(),
+		done: make(chan struct{}),
+	}
+	s.Lock()
+	s.calls[c.ID] = c
+	s.Unlock()
+
+	resp, err := s.transact("INVITE", target, addr, offer,
+		"From", c.from, "To", "<"+target+">", "Call-ID", c.ID, "CSeq", "1 INVITE",
+		"Contact", fmt.Sprintf("<sip:phone@%s>", s.Addr()), "Content-Type", "application/sdp")
+	if err == nil && resp.status >= 300 {
+		err = &StatusError{resp.status, resp.reason}
+	}
+	if err != nil {
+		c.end()
+		return nil, err
+	}
+	c.to = resp.get("To")
+	c.target = uri(resp.get("Contact"))
+	s.conn.WriteToUDP(build("ACK "+c.target+" SIP/2.0", "",
+		"Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=z9hG4bK%s", s.Addr(), randomID()),
+		"From", c.from, "To", c.to, "Call-ID", c.ID, "CSeq", "1 ACK"), addr)
+
+	// The answer names the address of the user agent's audio and the
+	// codecs chosen.
+	c.Remote = &net.UDPAddr{}
+	for _, line := range strings.Split(resp.body, "\r\n") {
+		switch {
+		case strings.HasPrefix(line, "c=IN IP4 "):
+			c.Remote.IP = net.ParseIP(strings.TrimPrefix(line, "c=IN IP4 "))
+		case strings.HasPrefix(line, "m=audio "):
+			f := strings.Fields(line)
+			if len(f) >= 4 {
+				c.Remote.Port, _ = strconv.Atoi(f[1])
+				pt, _ := strconv.Atoi(f[3])
+				c.PayloadType = uint8(pt)
+			}
+		case strings.HasPrefix(line, "a=rtpmap:") && strings.Contains(line, "telephone-event"):
+			pt, _ := strconv.Atoi(strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))[0])
+			c.EventPayloadType = uint8(pt)
+		}
+	}
+	if c.Remote.IP == nil || c.Remote.Port == 0 {
+		c.Hangup()
+		return nil, errors.New("siptest: answer has no audio")
+	}
+	return c, nil
+}
+
+// A Call is a call placed by a Server.
+type Call struct {
+	ID string
+
+	// RTP is the connection of the telephone's audio, and Remote that of
+	// the user agent.
+	RTP    *net.UDPConn
+	Remote *net.UDPAddr
+
+	// PayloadType is that of the audio codec answered, and
+	// EventPayloadType that of telephone events, or 0 if not answered.
+	PayloadType      uint8
+	EventPayloadType uint8
+
+	srv      *Server
+	addr     *net.UDPAddr
+	from, to string
+	target   string
+
+	ssrc      uint32
+	seq       uint16
+	timestamp uint32
+
+	done    chan struct{}
+	endOnce sync.Once
+}
+
+// WriteRTP sends an RTP packet of the given payload type and duration in
+// timestamp units.
+func (c *Call) WriteRTP(pt uint8, payload []byte, samples uint32) error {
+	b := make([]byte, 12, 12+len(payload))
+	b[0], b[1] = 0x80, pt
+	binary.BigEndian.PutUint16(b[2:], c.seq)
+	binary.BigEndian.PutUint32(b[4:], c.timestamp)
+	binary.BigEndian.PutUint32(b[8:], c.ssrc)
+	c.seq++
+	c.timestamp += samples
+	_, err := c.RTP.WriteToUDP(append(b, payload...), c.Remote)
+	return err
+}
+
+// SendDTMF sends a digit as an RFC 4733 telephone event, three times as
+// telephones do.
+func (c *Call) SendDTMF(digit rune) error {
+	event := strings.IndexRune("0123456789*#ABCD", digit)
+	if event < 0 || c.EventPayloadType == 0 {
+		return fmt.Errorf("siptest: cannot send DTMF %q", digit)
+	}
+	for i := 0; i < 3; i++ {
+		b := make([]byte, 12+4)
+		b[0], b[1] = 0x80, c.EventPayloadType
+		binary.BigEndian.PutUint16(b[2:], c.seq)
+		binary.BigEndian.PutUint32(b[4:], c.timestamp)
+		binary.BigEndian.PutUint32(b[8:], c.ssrc)
+		b[12], b[13] = byte(event), 0x80|10 // end of event, volume
+		binary.BigEndian.PutUint16(b[14:], 800)
+		c.seq++
+		if _, err := c.RTP.WriteToUDP(b, c.Remote); err != nil {
+			return err
+		}
+	}
+	c.timestamp += 800
+	return nil
+}
+
+// ReadRTP returns the payload type and payload of the next RTP packet from
+// the user agent.
+func (c *Call) ReadRTP() (uint8, []byte, error) {
+	c.RTP.SetReadDeadline(time.Now().Add(Timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.RTP.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 12 || buf[0]>>6 != 2 {
+			continue
+		}
+		start := 12 + 4*int(buf[0]&0x0F)
+		if buf[0]&0x10 != 0 && n >= start+4 {
+			start += 4 + 4*int(binary.BigEndian.Uint16(buf[start+2:]))
+		}
+		if start > n {
+			continue
+		}
+		return buf[1] & 0x7F, append([]byte(nil), buf[start:n]...), nil
+	}
+}
+
+// Done returns a channel which is closed when the call ends.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Hangup ends the call with a BYE.
+func (c *Call) Hangup() error {
+	c.end()
+	resp, err := c.srv.transact("BYE", c.target, c.addr, "",
+		"From", c.from, "To", c.to, "Call-ID", c.ID, "CSeq", "2 BYE")
+	if err != nil {
+		return err
+	}
+	if resp.status >= 300 {
+		return &StatusError{resp.status, resp.reason}
+	}
+	return nil
+}
+
+func (c *Call) end() {
+	c.endOnce.Do(func() {
+		c.srv.Lock()
+		delete(c.srv.calls, c.ID)
+		c.srv.Unlock()
+		close(c.done)
+		c.RTP.Close()
+	})
+}
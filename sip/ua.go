@@ -0,0 +1,600 @@
+package sip
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// t1 and t2 are the retransmission intervals of RFC 3261 section
+	// 17: requests are resent after t1, doubling up to t2.
+	t1 = 500 * time.Millisecond
+	t2 = 4 * time.Second
+
+	// defaultTimeout is how long a request is retransmitted without a
+	// final response, timer F of RFC 3261.
+	defaultTimeout = 64 * t1
+
+	userAgent = "discord-audio-stream"
+	allow     = "INVITE, ACK, BYE, CANCEL, OPTIONS"
+)
+
+var (
+	// ErrTimeout is returned when a request receives no final response.
+	ErrTimeout = errors.New("sip transaction timed out")
+
+	// ErrClosed is returned by the methods of a closed UserAgent.
+	ErrClosed = errors.New("sip user agent closed")
+)
+
+// A StatusError is a final response other than success.
+type StatusError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sip: %d %s", e.StatusCode, e.Reason)
+}
+
+// A UserAgent registers with a SIP server and answers calls.
+type UserAgent struct {
+	// User is the user part of the address registered, and Password the
+	// password for digest authentication.
+	User     string
+	Password string
+
+	// Host is the address advertised to the server and callers, by
+	// default that of the interface routing to them.
+	Host string
+
+	// Codecs are the audio codecs answered, in order of preference.
+	Codecs []Codec
+
+	// MaxCalls is the number of calls answered at once; callers beyond
+	// it are told the line is busy.
+	MaxCalls int
+
+	// Timeout is how long requests are retransmitted without a final
+	// response.
+	Timeout time.Duration
+
+	// OnCall, if set, is called when a call is answered, and OnHangup
+	// when it ends. They are called from the loop receiving requests,
+	// and so must not block.
+	OnCall   func(c *Call)
+	OnHangup func(c *Call)
+
+	// OnError, if set, is called with errors handling requests.
+	OnError func(err error)
+
+	conn   *net.UDPConn
+	tag    string
+	callID string // of registrations
+	closed chan struct{}
+
+	sync.Mutex
+	cseq    int // of registrations
+	calls   map[string]*Call
+	pending map[string]chan *Message // by Via branch
+}
+
+// Listen returns a UserAgent receiving SIP over UDP on addr, such as
+// ":5060". Serve must be called to handle what it receives.
+func Listen(addr string) (*UserAgent, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return nil, err
+	}
+	return &UserAgent{
+		Codecs:   []Codec{Opus, PCMU, PCMA},
+		MaxCalls: 1,
+		Timeout:  defaultTimeout,
+		conn:     conn,
+		tag:      randomID(),
+		callID:   randomID(),
+		closed:   make(chan struct{}),
+		calls:    map[string]*Call{},
+		pending:  map[string]chan *Message{},
+	}, nil
+}
+
+// randomID returns a random token for tags, branches and Call-IDs.
+func randomID() string {
+	return strconv.FormatUint(rand.Uint64(), 36)
+}
+
+// Addr returns the address the UserAgent receives on.
+func (ua *UserAgent) Addr() *net.UDPAddr {
+	return ua.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// localIP returns the IP to advertise to to.
+func (ua *UserAgent) localIP(to *net.UDPAddr) net.IP {
+	if ip := net.ParseIP(ua.Host); ip != nil {
+		return ip
+	}
+	if ip := ua.Addr().IP; !ip.IsUnspecified() {
+		return ip
+	}
+	if c, err := net.DialUDP("udp", nil, to); err == nil {
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).IP
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// hostPort returns the address of the UserAgent advertised to to.
+func (ua *UserAgent) hostPort(to *net.UDPAddr) string {
+	return net.JoinHostPort(ua.localIP(to).String(), strconv.Itoa(ua.Addr().Port))
+}
+
+// contact returns the Contact header field advertised to to.
+func (ua *UserAgent) contact(to *net.UDPAddr) string {
+	return fmt.Sprintf("<sip:%s@%s>", ua.User, ua.hostPort(to))
+}
+
+// send writes a message to addr.
+func (ua *UserAgent) send(m *Message, addr *net.UDPAddr) error {
+	m.Header.Set("User-Agent", userAgent)
+	_, err := ua.conn.WriteToUDP(m.Bytes(), addr)
+	return err
+}
+
+// transact sends a request to addr until it receives a final response.
+func (ua *UserAgent) transact(req *Message, addr *net.UDPAddr) (*Message, error) {
+	branch := "z9hG4bK" + randomID()
+	req.Header.Set("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=%s;rport", ua.hostPort(addr), branch))
+	req.Header.Set("Max-Forwards", "70")
+
+	responses := make(chan *Message, 4)
+	ua.Lock()
+	ua.pending[branch] = responses
+	ua.Unlock()
+	defer func() {
+		ua.Lock()
+		delete(ua.pending, branch)
+		ua.Unlock()
+	}()
+
+	if err := ua.send(req, addr); err != nil {
+		return nil, err
+	}
+	interval := t1
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	timeout := time.NewTimer(ua.Timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case resp := <-responses:
+			if resp.StatusCode >= 200 {
+				return resp, nil
+			}
+			// A provisional response slows retransmission to t2.
+			interval = t2
+		case <-retransmit.C:
+			ua.send(req, addr)
+			if interval *= 2; interval > t2 {
+				interval = t2
+			}
+			retransmit.Reset(interval)
+		case <-timeout.C:
+			return nil, ErrTimeout
+		case <-ua.closed:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// Register registers the User with the registrar at addr, such as
+// "sip.example.com:5060", for expires, or unregisters it if expires is 0.
+func (ua *UserAgent) Register(addr string, expires time.Duration) error {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	domain := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		domain = host
+	}
+	aor := fmt.Sprintf("<sip:%s@%s>", ua.User, domain)
+
+	var auth, challenge string
+	for {
+		ua.Lock()
+		ua.cseq++
+		cseq := ua.cseq
+		ua.Unlock()
+
+		req := NewRequest("REGISTER", "sip:"+domain)
+		req.Header.Set("From", aor+";tag="+ua.tag)
+		req.Header.Set("To", aor)
+		req.Header.Set("Call-Id", ua.callID)
+		req.Header.Set("Cseq", fmt.Sprintf("%d REGISTER", cseq))
+		req.Header.Set("Contact", ua.contact(to))
+		req.Header.Set("Expires", strconv.Itoa(int(expires/time.Second)))
+		if auth != "" {
+			req.Header.Set(auth, ua.authorization(challenge, req))
+		}
+		resp, err := ua.transact(req, to)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case (resp.StatusCode == 401 || resp.StatusCode == 407) && auth == "":
+			// Answer the challenge once; a second means the password
+			// is wrong.
+			auth, challenge = "Authorization", resp.Get("Www-Authenticate")
+			if resp.StatusCode == 407 {
+				auth, challenge = "Proxy-Authorization", resp.Get("Proxy-Authenticate")
+			}
+		default:
+			return &StatusError{resp.StatusCode, resp.Reason}
+		}
+	}
+}
+
+// KeepRegistered registers with the registrar at addr until stop is
+// closed, renewing the registration before it expires and retrying after
+// failures, and then unregisters.
+func (ua *UserAgent) KeepRegistered(addr string, expires time.Duration, stop <-chan struct{}) {
+	for {
+		wait := expires / 2
+		if err := ua.Register(addr, expires); err != nil {
+			if ua.OnError != nil {
+				ua.OnError(fmt.Errorf("registering with %s: %w", addr, err))
+			}
+			wait = 30 * time.Second
+		}
+		select {
+		case <-stop:
+			ua.Register(addr, 0)
+			return
+		case <-ua.closed:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// digestParams matches the parameters of a digest challenge.
+var digestParams = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// authorization returns the digest authorization of req for a challenge,
+// as in RFC 2617.
+func (ua *UserAgent) authorization(challenge string, req *Message) string {
+	params := map[string]string{}
+	for _, m := range digestParams.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2] + m[3]
+	}
+	hash := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+	ha1 := hash(ua.User + ":" + realm + ":" + ua.Password)
+	ha2 := hash(req.Method + ":" + req.URI)
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5`,
+		ua.User, realm, nonce, req.URI)
+	if qop := params["qop"]; qop != "" {
+		// Only auth is supported, which servers always offer.
+		cnonce, nc := randomID(), "00000001"
+		auth += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+			nc, cnonce, hash(ha1+":"+nonce+":"+nc+":"+cnonce+":auth:"+ha2))
+	} else {
+		auth += fmt.Sprintf(`, response="%s"`, hash(ha1+":"+nonce+":"+ha2))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth
+}
+
+// Calls returns the calls in progress.
+func (ua *UserAgent) Calls() []*Call {
+	ua.Lock()
+	defer ua.Unlock()
+	calls := make([]*Call, 0, len(ua.calls))
+	for _, c := range ua.calls {
+		calls = append(calls, c)
+	}
+	return calls
+}
+
+// Serve handles the messages received until the UserAgent is closed.
+func (ua *UserAgent) Serve() error {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := ua.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ua.closed:
+				return ErrClosed
+			default:
+			}
+			return err
+		}
+		// Blank lines are sent to keep NAT bindings open.
+		if strings.TrimSpace(string(buf[:n])) == "" {
+			continue
+		}
+		m, err := ParseMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			if ua.OnError != nil {
+				ua.OnError(fmt.Errorf("message from %s: %w", from, err))
+			}
+			continue
+		}
+		if m.IsRequest() {
+			ua.handleRequest(m, from)
+			continue
+		}
+
+		branch := headerParam(m.Get("Via"), "branch")
+		ua.Lock()
+		responses := ua.pending[branch]
+		ua.Unlock()
+		if responses != nil {
+			select {
+			case responses <- m:
+			default:
+			}
+		}
+	}
+}
+
+// handleRequest answers a request received from addr.
+func (ua *UserAgent) handleRequest(req *Message, addr *net.UDPAddr) {
+	id := req.Get("Call-Id")
+	ua.Lock()
+	c := ua.calls[id]
+	ua.Unlock()
+
+	switch req.Method {
+	case "INVITE":
+		if c != nil {
+			// A retransmission, or a re-INVITE such as for hold,
+			// which is answered with the same session.
+			ua.send(c.answer(req), addr)
+			return
+		}
+		ua.send(NewResponse(req, 100, "Trying"), addr)
+		ua.invite(req, addr)
+
+	case "ACK":
+		if c != nil {
+			c.ackOnce.Do(func() { close(c.acked) })
+		}
+
+	case "BYE":
+		if c == nil {
+			ua.send(NewResponse(req, 481, "Call/Transaction Does Not Exist"), addr)
+			return
+		}
+		ua.send(NewResponse(req, 200, "OK"), addr)
+		c.end()
+
+	case "CANCEL":
+		// Calls are answered at once, so there is nothing left to
+		// cancel; the caller hangs up with a BYE instead.
+		ua.send(NewResponse(req, 200, "OK"), addr)
+
+	case "OPTIONS":
+		resp := NewResponse(req, 200, "OK")
+		resp.Header.Set("Allow", allow)
+		ua.send(resp, addr)
+
+	default:
+		resp := NewResponse(req, 405, "Method Not Allowed")
+		resp.Header.Set("Allow", allow)
+		ua.send(resp, addr)
+	}
+}
+
+// invite answers a new call.
+func (ua *UserAgent) invite(req *Message, addr *net.UDPAddr) {
+	reject := func(code int, reason string) {
+		resp := NewResponse(req, code, reason)
+		resp.Header.Set("To", resp.Get("To")+";tag="+randomID())
+		ua.send(resp, addr)
+	}
+
+	ua.Lock()
+	busy := len(ua.calls) >= ua.MaxCalls
+	ua.Unlock()
+	if busy {
+		reject(486, "Busy Here")
+		return
+	}
+
+	offer, err := ParseSDP(req.Body)
+	if err != nil {
+		reject(488, "Not Acceptable Here")
+		return
+	}
+	audio, events, err := negotiate(offer, ua.Codecs)
+	if err != nil {
+		reject(488, "Not Acceptable Here")
+		return
+	}
+
+	rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ua.Addr().IP})
+	if err != nil {
+		reject(500, "Server Internal Error")
+		if ua.OnError != nil {
+			ua.OnError(err)
+		}
+		return
+	}
+
+	c := &Call{
+		ID:     req.Get("Call-Id"),
+		From:   addressName(req.Get("From")),
+		Codec:  audio,
+		Events: events,
+		RTP:    rtp,
+		Remote: &net.UDPAddr{IP: offer.IP, Port: offer.Port},
+		ua:     ua,
+		addr:   addr,
+		tag:    randomID(),
+		acked:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	c.remoteURI = addressURI(req.Get("Contact"))
+	if c.remoteURI == "" {
+		c.remoteURI = addressURI(req.Get("From"))
+	}
+	c.from, c.to = req.Get("From"), req.Get("To")+";tag="+c.tag
+	answer := &Session{IP: ua.localIP(addr), Port: rtp.LocalAddr().(*net.UDPAddr).Port, Codecs: []Codec{audio}}
+	if events != nil {
+		answer.Codecs = append(answer.Codecs, *events)
+	}
+	c.sdp = answer.Bytes(time.Now().Unix())
+
+	ua.Lock()
+	ua.calls[c.ID] = c
+	ua.Unlock()
+
+	ok := c.answer(req)
+	ua.send(ok, addr)
+	go c.retransmit(ok)
+	if ua.OnCall != nil {
+		ua.OnCall(c)
+	}
+}
+
+// Close hangs up the calls in progress and stops the UserAgent.
+func (ua *UserAgent) Close() error {
+	for _, c := range ua.Calls() {
+		c.Hangup()
+	}
+	close(ua.closed)
+	return ua.conn.Close()
+}
+
+// A Call is a call answered by a UserAgent.
+type Call struct {
+	// ID is the Call-ID of the call, and From the display name or user
+	// of the caller.
+	ID   string
+	From string
+
+	// Codec is the audio codec negotiated, and Events that of telephone
+	// events, or nil if the caller does not send them.
+	Codec  Codec
+	Events *Codec
+
+	// RTP is the connection to send and receive the audio on, and
+	// Remote the address of the caller's audio.
+	RTP    *net.UDPConn
+	Remote *net.UDPAddr
+
+	ua        *UserAgent
+	addr      *net.UDPAddr // of the caller's signalling
+	tag       string
+	from, to  string // header fields of the INVITE, with our tag added to To
+	remoteURI string
+	sdp       []byte
+
+	acked   chan struct{}
+	ackOnce sync.Once
+	done    chan struct{}
+	endOnce sync.Once
+}
+
+// answer returns the 200 OK answering the INVITE req.
+func (c *Call) answer(req *Message) *Message {
+	resp := NewResponse(req, 200, "OK")
+	resp.Header.Set("To", c.to)
+	resp.Header.Set("Contact", c.ua.contact(c.addr))
+	resp.Header.Set("Allow", allow)
+	resp.Header.Set("Content-Type", "application/sdp")
+	resp.Body = c.sdp
+	return resp
+}
+
+// retransmit resends the 200 OK of the call until it is acknowledged, and
+// hangs up if it never is.
+func (c *Call) retransmit(ok *Message) {
+	interval := t1
+	timeout := time.After(c.ua.Timeout)
+	for {
+		select {
+		case <-c.acked:
+			return
+		case <-c.done:
+			return
+		case <-timeout:
+			c.Hangup()
+			return
+		case <-time.After(interval):
+			c.ua.send(ok, c.addr)
+			if interval *= 2; interval > t2 {
+				interval = t2
+			}
+		}
+	}
+}
+
+// Done returns a channel which is closed when the call ends.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Hangup ends the call, telling the caller with a BYE.
+func (c *Call) Hangup() error {
+	if !c.end() {
+		return nil
+	}
+
+	// The BYE is the only request sent within the call.
+	req := NewRequest("BYE", c.remoteURI)
+	req.Header.Set("From", c.to)
+	req.Header.Set("To", c.from)
+	req.Header.Set("Call-Id", c.ID)
+	req.Header.Set("Cseq", "1 BYE")
+	resp, err := c.ua.transact(req, c.addr)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return &StatusError{resp.StatusCode, resp.Reason}
+	}
+	return nil
+}
+
+// end ends the call, closing its audio connection, and reports whether it
+// was still in progress.
+func (c *Call) end() bool {
+	ended := false
+	c.endOnce.Do(func() {
+		ended = true
+		c.ua.Lock()
+		delete(c.ua.calls, c.ID)
+		c.ua.Unlock()
+		close(c.done)
+		c.RTP.Close()
+		if c.ua.OnHangup != nil {
+			c.ua.OnHangup(c)
+		}
+	})
+	return ended
+}
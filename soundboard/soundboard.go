@@ -0,0 +1,204 @@
+// Package soundboard plays sound files over a live microphone feed.
+//
+// Sounds are read from a directory of DCA, Ogg Opus and WAV files and
+// decoded to 48kHz mono PCM, which a Player mixes into each microphone
+// frame before it is encoded.
+package soundboard
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"discord-audio-stream/catalog"
+	"discord-audio-stream/voicesend"
+)
+
+// Audio format of the frames produced by sources and mixed by a Player.
+const (
+	SampleRate = 48000
+	FrameSize  = 960 // 20ms of mono audio
+)
+
+// Errors returned when opening sounds.
+var (
+	ErrUnknownSound = errors.New("unknown sound")
+	ErrFormat       = errors.New("unsupported sound file")
+)
+
+// extensions are the file extensions of sounds, in order of preference
+// when several files share a name.
+var extensions = []string{".dca", ".opus", ".ogg", ".wav"}
+
+// An OpusDecoder decodes Opus packets to mono PCM, for example
+// *opus.Decoder from gopkg.in/hraban/opus.v2 created with one channel.
+type OpusDecoder = voicesend.OpusDecoder
+
+// A Library is a directory of sound files, named by their file name
+// without the extension.
+type Library struct {
+	Dir string
+
+	// NewDecoder returns a decoder for each DCA and Ogg Opus sound played.
+	NewDecoder func() (OpusDecoder, error)
+}
+
+// Names returns the sorted names of the sounds in the library.
+func (l *Library) Names() ([]string, error) {
+	return catalog.Names(l.Dir, extensions)
+}
+
+// Match returns up to max sound names containing query, ignoring case,
+// with those starting with it first.
+func (l *Library) Match(query string, max int) []string {
+	names, err := l.Names()
+	if err != nil {
+		return nil
+	}
+	return catalog.Match(names, query, max)
+}
+
+// Open opens the named sound. The format is detected from the file's
+// contents, so a DCA file holding Ogg Opus is still played.
+func (l *Library) Open(name string) (Source, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, ErrUnknownSound
+	}
+
+	path := ""
+	for _, ext := range extensions {
+		for _, e := range []string{ext, strings.ToUpper(ext)} {
+			p := filepath.Join(l.Dir, name+e)
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+				path = p
+				break
+			}
+		}
+		if path != "" {
+			break
+		}
+	}
+	if path == "" {
+		return nil, ErrUnknownSound
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := newSource(f, l.NewDecoder)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// Mode selects how a Player combines sounds with the microphone.
+type Mode int
+
+// Player modes.
+const (
+	// Mix adds sounds to the microphone at full volume.
+	Mix Mode = iota
+
+	// Duck lowers the microphone to DuckGain while a sound plays.
+	Duck
+)
+
+// A Player mixes one sound at a time into the microphone feed.
+type Player struct {
+	Mode Mode
+
+	// DuckGain is the microphone gain, from 0 to 1, while a sound plays in
+	// Duck mode.
+	DuckGain float64
+
+	sync.Mutex
+	current Source
+	micGain float64
+	frame   [FrameSize]int16
+}
+
+// NewPlayer returns a Player with a DuckGain of 0.3.
+func NewPlayer(mode Mode) *Player {
+	return &Player{Mode: mode, DuckGain: 0.3, micGain: 1}
+}
+
+// Play starts playing src, stopping any sound already playing. The player
+// closes src once it has finished.
+func (p *Player) Play(src Source) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current != nil {
+		p.current.Close()
+	}
+	p.current = src
+}
+
+// Stop stops the sound playing, if any.
+func (p *Player) Stop() {
+	p.Play(nil)
+}
+
+// Playing reports whether a sound is playing.
+func (p *Player) Playing() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.current != nil
+}
+
+// Mix adds the next frame of the playing sound to a frame of microphone
+// audio, which must be FrameSize samples long. The microphone gain is ramped
+// across the frame when ducking starts or stops, to avoid clicks.
+func (p *Player) Mix(mic []int16) {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(mic) != FrameSize {
+		return
+	}
+
+	playing := false
+	if p.current != nil {
+		if err := p.current.ReadFrame(p.frame[:]); err != nil {
+			p.current.Close()
+			p.current = nil
+		} else {
+			playing = true
+		}
+	}
+
+	target := 1.0
+	if playing && p.Mode == Duck {
+		target = p.DuckGain
+	}
+	if !playing && p.micGain == target {
+		return
+	}
+
+	for i, s := range mic {
+		gain := p.micGain + (target-p.micGain)*float64(i)/FrameSize
+		v := float64(s) * gain
+		if playing {
+			v += float64(p.frame[i])
+		}
+		mic[i] = clamp16(v)
+	}
+	p.micGain = target
+}
+
+// clamp16 converts a sample to int16, saturating.
+func clamp16(v float64) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
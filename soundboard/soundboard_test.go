@@ -0,0 +1,225 @@
+package soundboard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"discord-audio-stream/internal/voicetest"
+	"discord-audio-stream/oggopus"
+)
+
+func newFakeDecoder() (OpusDecoder, error) { return voicetest.Decoder{Scale: 1}, nil }
+
+func dcaFrames(packets ...[]byte) []byte {
+	var b bytes.Buffer
+	for _, p := range packets {
+		binary.Write(&b, binary.LittleEndian, int16(len(p)))
+		b.Write(p)
+	}
+	return b.Bytes()
+}
+
+// oggFile returns an Ogg Opus file holding packets.
+func oggFile(preSkip uint16, packets ...[]byte) []byte {
+	var b bytes.Buffer
+	w, _ := oggopus.NewWriter(&b, 1234, oggopus.Head{Channels: 1, PreSkip: preSkip}, oggopus.Tags{Vendor: "test"})
+	for _, p := range packets {
+		w.WritePacket(p)
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+func wavFile(rate, channels int, samples ...int16) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+2*len(samples)))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, []uint32{16})
+	binary.Write(&b, binary.LittleEndian, []uint16{1, uint16(channels)})
+	binary.Write(&b, binary.LittleEndian, []uint32{uint32(rate), uint32(rate * channels * 2)})
+	binary.Write(&b, binary.LittleEndian, []uint16{uint16(channels * 2), 16})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(2*len(samples)))
+	binary.Write(&b, binary.LittleEndian, samples)
+	return b.Bytes()
+}
+
+// readFrames returns the first sample of each frame of src.
+func readFrames(t *testing.T, src Source) []int16 {
+	t.Helper()
+
+	var got []int16
+	pcm := make([]int16, FrameSize)
+	for {
+		err := src.ReadFrame(pcm)
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("ReadFrame returned error: %v", err)
+		}
+		got = append(got, pcm[0])
+	}
+}
+
+func TestSourceFormats(t *testing.T) {
+	long := bytes.Repeat([]byte{4}, 300)
+
+	dca1 := append([]byte("DCA1"), 2, 0, 0, 0, '{', '}')
+	tests := []struct {
+		name string
+		data []byte
+		want []int16
+	}{
+		{"DCA0", dcaFrames([]byte{1}, []byte{2}, []byte{3}), []int16{1, 2, 3}},
+		{"DCA1", append(dca1, dcaFrames([]byte{5}, []byte{6})...), []int16{5, 6}},
+		{"Ogg", oggFile(960, []byte{1}, []byte{2}, long, []byte{3, 1}), []int16{2, 4, 3}},
+		{"WAV", wavFile(48000, 1, make([]int16, 1000)...), []int16{0, 0}},
+	}
+
+	for _, tt := range tests {
+		src, err := newSource(ioutil.NopCloser(bytes.NewReader(tt.data)), newFakeDecoder)
+		if err != nil {
+			t.Errorf("%s: newSource returned error: %v", tt.name, err)
+			continue
+		}
+		if got := readFrames(t, src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s frames incorrect: got %v, want %v", tt.name, got, tt.want)
+		}
+		src.Close()
+	}
+}
+
+func TestWAVResample(t *testing.T) {
+	// 10ms of stereo at 24kHz, mixed down and upsampled to 480 samples.
+	samples := make([]int16, 480)
+	for i := 0; i < 240; i++ {
+		samples[2*i] = int16(i * 10)
+		samples[2*i+1] = int16(i * 30)
+	}
+	src, err := newSource(ioutil.NopCloser(bytes.NewReader(wavFile(24000, 2, samples...))), nil)
+	if err != nil {
+		t.Fatalf("newSource returned error: %v", err)
+	}
+
+	pcm := make([]int16, FrameSize)
+	if err := src.ReadFrame(pcm); err != nil {
+		t.Fatalf("ReadFrame returned error: %v", err)
+	}
+	if pcm[2] != 20 || pcm[3] != 30 || pcm[479] != 239*20 || pcm[480] != 0 {
+		t.Errorf("resampled audio incorrect: %v %v %v %v", pcm[2], pcm[3], pcm[479], pcm[480])
+	}
+	if err := src.ReadFrame(pcm); err != io.EOF {
+		t.Errorf("ReadFrame after end error incorrect: got %v, want EOF", err)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soundboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"airhorn.dca": dcaFrames([]byte{1}),
+		"Bell.wav":    wavFile(48000, 1, 1, 2, 3),
+		"bee.opus":    nil,
+		"notes.txt":   nil,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "sub.wav"), 0755)
+
+	l := &Library{Dir: dir, NewDecoder: newFakeDecoder}
+	names, err := l.Names()
+	if want := []string{"Bell", "airhorn", "bee"}; err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("Names incorrect: got %v, %v, want %v", names, err, want)
+	}
+	if got, want := l.Match("b", 25), []string{"Bell", "bee"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Match incorrect: got %v, want %v", got, want)
+	}
+	if got, want := l.Match("EE", 1), []string{"bee"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Match incorrect: got %v, want %v", got, want)
+	}
+
+	src, err := l.Open("airhorn")
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if got := readFrames(t, src); !reflect.DeepEqual(got, []int16{1}) {
+		t.Errorf("airhorn frames incorrect: %v", got)
+	}
+	src.Close()
+
+	for _, name := range []string{"missing", "notes", "sub", "../airhorn", ""} {
+		if _, err := l.Open(name); err != ErrUnknownSound {
+			t.Errorf("Open(%q) error incorrect: got %v, want %v", name, err, ErrUnknownSound)
+		}
+	}
+}
+
+func TestPlayer(t *testing.T) {
+	frame := func(v int16) []int16 {
+		pcm := make([]int16, FrameSize)
+		for i := range pcm {
+			pcm[i] = v
+		}
+		return pcm
+	}
+	sound := func() Source {
+		src, _ := newSource(ioutil.NopCloser(bytes.NewReader(dcaFrames([]byte{100}, []byte{100}))), newFakeDecoder)
+		return src
+	}
+
+	p := NewPlayer(Mix)
+	mic := frame(1000)
+	p.Mix(mic)
+	if mic[0] != 1000 || p.Playing() {
+		t.Errorf("idle mix incorrect: got %d", mic[0])
+	}
+
+	p.Play(sound())
+	p.Mix(mic)
+	if mic[0] != 1100 || mic[FrameSize-1] != 1100 {
+		t.Errorf("mix incorrect: got %d", mic[0])
+	}
+
+	p = NewPlayer(Duck)
+	p.Play(sound())
+	want := []struct{ first, last int16 }{
+		{1100, 400}, // ramping down to DuckGain
+		{400, 400},
+		{300, 999}, // ramping back up once the sound ends
+		{1000, 1000},
+	}
+	for i, w := range want {
+		mic := frame(1000)
+		p.Mix(mic)
+		if mic[0] != w.first || mic[FrameSize-1] != w.last {
+			t.Errorf("duck frame %d incorrect: got %d..%d, want %d..%d", i, mic[0], mic[FrameSize-1], w.first, w.last)
+		}
+	}
+	if p.Playing() {
+		t.Error("Playing after sound ended")
+	}
+
+	// Clipping saturates.
+	p = NewPlayer(Mix)
+	p.Play(sound())
+	mic = frame(32700)
+	p.Mix(mic)
+	if mic[0] != 32767 {
+		t.Errorf("clipped mix incorrect: got %d", mic[0])
+	}
+}
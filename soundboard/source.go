@@ -0,0 +1,273 @@
+package soundboard
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"discord-audio-stream/dca"
+	"discord-audio-stream/oggopus"
+)
+
+// A Source produces the audio of a sound as frames of 48kHz mono PCM.
+type Source interface {
+	// ReadFrame fills pcm with the next FrameSize samples, padding the last
+	// frame with silence. It returns io.EOF once the sound has ended.
+	ReadFrame(pcm []int16) error
+	Close() error
+}
+
+// maxWAVSize limits the size of WAV files, which are read into memory.
+const maxWAVSize = 64 << 20
+
+// maxOpusFrameSize is the number of samples in the longest Opus packet,
+// 120ms.
+const maxOpusFrameSize = 5760
+
+// newSource returns a Source reading r, detecting its format.
+func newSource(r io.ReadCloser, newDecoder func() (OpusDecoder, error)) (Source, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	var packets packetReader
+	switch string(magic) {
+	case "RIFF":
+		src, err := readWAV(br)
+		if err != nil {
+			return nil, err
+		}
+		r.Close()
+		return src, nil
+	case "OggS":
+		or, err := oggopus.NewReader(br)
+		if err != nil {
+			return nil, ErrFormat
+		}
+		packets = &oggReader{Reader: or, preSkip: int(or.Head.PreSkip)}
+	default:
+		dr, err := dca.NewReader(br)
+		if err != nil {
+			return nil, ErrFormat
+		}
+		packets = dcaReader{dr}
+	}
+
+	if newDecoder == nil {
+		return nil, ErrFormat
+	}
+	dec, err := newDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	return &opusSource{packets: packets, dec: dec, c: r}, nil
+}
+
+// A packetReader returns the Opus packets of a file in order.
+type packetReader interface {
+	next() ([]byte, error)
+}
+
+// opusSource decodes a file of Opus packets.
+type opusSource struct {
+	packets packetReader
+	dec     OpusDecoder
+	c       io.Closer
+	decoded [maxOpusFrameSize]int16
+	pending []int16
+	eof     bool
+}
+
+// ReadFrame implements Source.
+func (s *opusSource) ReadFrame(pcm []int16) error {
+	for len(s.pending) < FrameSize && !s.eof {
+		packet, err := s.packets.next()
+		if err != nil {
+			s.eof = true
+			break
+		}
+
+		n, err := s.dec.Decode(packet, s.decoded[:])
+		if err != nil {
+			continue
+		}
+
+		// pre-skip drops the encoder delay from the start of Ogg streams.
+		samples := s.decoded[:n]
+		if o, ok := s.packets.(*oggReader); ok && o.preSkip > 0 {
+			skip := o.preSkip
+			if skip > len(samples) {
+				skip = len(samples)
+			}
+			samples = samples[skip:]
+			o.preSkip -= skip
+		}
+		s.pending = append(s.pending, samples...)
+	}
+
+	if len(s.pending) == 0 {
+		return io.EOF
+	}
+
+	n := copy(pcm[:FrameSize], s.pending)
+	for i := n; i < FrameSize; i++ {
+		pcm[i] = 0
+	}
+	s.pending = s.pending[:copy(s.pending, s.pending[n:])]
+	return nil
+}
+
+// Close implements Source.
+func (s *opusSource) Close() error {
+	return s.c.Close()
+}
+
+// dcaReader reads the frames of a DCA file.
+type dcaReader struct {
+	*dca.Reader
+}
+
+func (d dcaReader) next() ([]byte, error) {
+	return d.ReadFrame()
+}
+
+// oggReader reads the Opus packets of an Ogg Opus file.
+type oggReader struct {
+	*oggopus.Reader
+	preSkip int // samples still to drop
+}
+
+func (o *oggReader) next() ([]byte, error) {
+	return o.ReadPacket()
+}
+
+// NewPCMSource returns a Source playing mono PCM samples recorded at rate,
+// resampled to SampleRate.
+func NewPCMSource(samples []int16, rate int) Source {
+	return &wavSource{samples: samples, step: float64(rate) / SampleRate}
+}
+
+// ReadWAV reads a 16-bit PCM WAV file into a Source, mixed down to mono
+// and resampled to SampleRate.
+func ReadWAV(r io.Reader) (Source, error) {
+	src, err := readWAV(r)
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// wavSource plays PCM audio from a WAV file, mixed down to mono and
+// resampled to SampleRate.
+type wavSource struct {
+	samples []int16
+	step    float64
+	pos     float64
+}
+
+// readWAV reads a 16-bit PCM WAV file.
+func readWAV(r io.Reader) (*wavSource, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[8:]) != "WAVE" {
+		return nil, ErrFormat
+	}
+
+	var format struct {
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}
+	haveFormat := false
+
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return nil, ErrFormat
+		}
+		size := int64(chunk.Size) + int64(chunk.Size&1)
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			if chunk.Size < 16 {
+				return nil, ErrFormat
+			}
+			if err := binary.Read(r, binary.LittleEndian, &format); err != nil {
+				return nil, ErrFormat
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, size-16); err != nil {
+				return nil, ErrFormat
+			}
+			haveFormat = true
+
+		case "data":
+			if !haveFormat || format.Format != 1 || format.BitsPerSample != 16 || format.Channels == 0 || format.SampleRate == 0 {
+				return nil, ErrFormat
+			}
+			// Encoders writing to a pipe can't fill in the size, and
+			// leave a placeholder; the data then runs to the end.
+			size := int64(chunk.Size)
+			if size > maxWAVSize+1 {
+				size = maxWAVSize + 1
+			}
+			data, _ := ioutil.ReadAll(io.LimitReader(r, size))
+			if len(data) > maxWAVSize {
+				return nil, ErrFormat
+			}
+
+			channels := int(format.Channels)
+			frames := len(data) / (2 * channels)
+			samples := make([]int16, frames)
+			for i := range samples {
+				sum := 0
+				for c := 0; c < channels; c++ {
+					sum += int(int16(binary.LittleEndian.Uint16(data[(i*channels+c)*2:])))
+				}
+				samples[i] = int16(sum / channels)
+			}
+
+			return &wavSource{
+				samples: samples,
+				step:    float64(format.SampleRate) / SampleRate,
+			}, nil
+
+		default:
+			if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+				return nil, ErrFormat
+			}
+		}
+	}
+}
+
+// ReadFrame implements Source, interpolating linearly between samples.
+func (w *wavSource) ReadFrame(pcm []int16) error {
+	if int(w.pos) >= len(w.samples) {
+		return io.EOF
+	}
+
+	for i := range pcm[:FrameSize] {
+		j := int(w.pos)
+		if j >= len(w.samples) {
+			pcm[i] = 0
+			continue
+		}
+		s := float64(w.samples[j])
+		if j+1 < len(w.samples) {
+			s += (float64(w.samples[j+1]) - s) * (w.pos - float64(j))
+		}
+		pcm[i] = int16(s)
+		w.pos += w.step
+	}
+	return nil
+}
+
+// Close implements Source.
+func (w *wavSource) Close() error {
+	return nil
+}
@@ -0,0 +1,277 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/voicesend"
+)
+
+// maxQueued is the number of utterances waiting to be transcribed beyond
+// which new ones are dropped.
+const maxQueued = 32
+
+// idleSpeaker is how long a speaker's decoder is kept after their last
+// packet.
+const idleSpeaker = 5 * time.Minute
+
+// ErrDropped is reported for an utterance dropped because too many were
+// waiting to be transcribed.
+var ErrDropped = errors.New("transcription queue full")
+
+// An OpusDecoder decodes Opus packets to mono PCM, for example
+// *opus.Decoder from gopkg.in/hraban/opus.v2 created with one channel.
+type OpusDecoder = voicesend.OpusDecoder
+
+// A speaker is the decoding and segmenting state of one SSRC.
+type speaker struct {
+	dec  OpusDecoder
+	seg  segmenter
+	last time.Time // arrival of the last packet
+}
+
+// A Pipeline transcribes the utterances of each speaker in a voice
+// channel, one at a time in the order they ended.
+type Pipeline struct {
+	// VAD splits each speaker's audio into utterances.
+	VAD VAD
+
+	// Timeout limits the transcription of each utterance.
+	Timeout time.Duration
+
+	// OnTranscript, if set, is called with each transcript.
+	OnTranscript func(t *Transcript)
+
+	// OnError, if set, is called when audio can't be decoded, or an
+	// utterance can't be transcribed.
+	OnError func(err error)
+
+	transcriber Transcriber
+	newDecoder  func() (OpusDecoder, error)
+	utterances  chan *utterance
+	stop        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+
+	sync.Mutex
+	closed   bool
+	users    map[uint32]string
+	speakers map[uint32]*speaker
+}
+
+// NewPipeline returns a Pipeline transcribing with t, decoding each
+// speaker's packets with a decoder from newDecoder. Close stops it.
+func NewPipeline(t Transcriber, newDecoder func() (OpusDecoder, error)) *Pipeline {
+	p := &Pipeline{
+		VAD:         DefaultVAD,
+		Timeout:     time.Minute,
+		transcriber: t,
+		newDecoder:  newDecoder,
+		utterances:  make(chan *utterance, maxQueued),
+		stop:        make(chan struct{}),
+		users:       map[uint32]string{},
+		speakers:    map[uint32]*speaker{},
+	}
+	p.wg.Add(2)
+	go p.transcribe()
+	go p.expire()
+	return p
+}
+
+// SetUser records the user speaking with ssrc.
+func (p *Pipeline) SetUser(ssrc uint32, userID string) {
+	p.Lock()
+	defer p.Unlock()
+	p.users[ssrc] = userID
+}
+
+// SpeakingUpdate records the user of an SSRC. It can be added as a
+// handler of a voice connection.
+func (p *Pipeline) SpeakingUpdate(vc *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+	p.SetUser(uint32(vs.SSRC), vs.UserID)
+}
+
+// WritePacket adds a received packet to its speaker's audio. The packet
+// is not retained, so it may be released afterwards.
+func (p *Pipeline) WritePacket(pkt *discordgo.Packet) {
+	u, err := p.writePacket(pkt, time.Now())
+	if err == nil && u != nil {
+		err = p.queue(u)
+	}
+	if err != nil {
+		p.error(err)
+	}
+}
+
+func (p *Pipeline) writePacket(pkt *discordgo.Packet, now time.Time) (*utterance, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil, nil
+	}
+
+	sp := p.speakers[pkt.SSRC]
+	if sp == nil {
+		dec, err := p.newDecoder()
+		if err != nil {
+			return nil, err
+		}
+		sp = &speaker{dec: dec}
+		p.speakers[pkt.SSRC] = sp
+	}
+	sp.last = now
+
+	// A packet holds at most 120ms of audio.
+	var pcm [6 * FrameSize]int16
+	n, err := sp.dec.Decode(pkt.Opus, pcm[:])
+	if err != nil {
+		return nil, fmt.Errorf("SSRC %d: %v", pkt.SSRC, err)
+	}
+	u := sp.seg.frame(&p.VAD, pcm[:n], now)
+	if u != nil {
+		u.ssrc, u.userID = pkt.SSRC, p.users[pkt.SSRC]
+	}
+	return u, nil
+}
+
+// queue adds u to the utterances waiting to be transcribed.
+func (p *Pipeline) queue(u *utterance) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil
+	}
+	select {
+	case p.utterances <- u:
+		return nil
+	default:
+		return fmt.Errorf("SSRC %d: %v", u.ssrc, ErrDropped)
+	}
+}
+
+func (p *Pipeline) error(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+// expire ends the utterances of speakers whose packets have stopped, as
+// Discord sends nothing while a user is silent, and forgets idle
+// speakers.
+func (p *Pipeline) expire() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			for _, u := range p.flush(func(sp *speaker) bool {
+				return now.Sub(sp.last) >= p.VAD.Hangover
+			}) {
+				if err := p.queue(u); err != nil {
+					p.error(err)
+				}
+			}
+			p.Lock()
+			for ssrc, sp := range p.speakers {
+				if now.Sub(sp.last) >= idleSpeaker {
+					delete(p.speakers, ssrc)
+				}
+			}
+			p.Unlock()
+		}
+	}
+}
+
+// flush ends the utterances of the speakers for which end returns true.
+func (p *Pipeline) flush(end func(*speaker) bool) []*utterance {
+	p.Lock()
+	defer p.Unlock()
+	var us []*utterance
+	for ssrc, sp := range p.speakers {
+		if !sp.seg.active() || !end(sp) {
+			continue
+		}
+		if u := sp.seg.flush(&p.VAD); u != nil {
+			u.ssrc, u.userID = ssrc, p.users[ssrc]
+			us = append(us, u)
+		}
+	}
+	return us
+}
+
+// transcribe transcribes queued utterances until they are closed.
+func (p *Pipeline) transcribe() {
+	defer p.wg.Done()
+	for u := range p.utterances {
+		ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+		text, err := p.transcriber.Transcribe(ctx, u.pcm)
+		cancel()
+		if err != nil {
+			p.error(fmt.Errorf("SSRC %d: %v", u.ssrc, err))
+			continue
+		}
+
+		// whisper.cpp marks audio without words, like [BLANK_AUDIO].
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			continue
+		}
+		if p.OnTranscript != nil {
+			p.OnTranscript(&Transcript{UserID: u.userID, SSRC: u.ssrc, Start: u.start, End: u.end, Text: text})
+		}
+	}
+}
+
+// Close ends every speaker's utterance and waits for the queued ones to
+// be transcribed. Packets written afterwards are ignored.
+func (p *Pipeline) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		us := p.flush(func(*speaker) bool { return true })
+		var errs []error
+		p.Lock()
+		p.closed = true
+		for _, u := range us {
+			select {
+			case p.utterances <- u:
+			default:
+				errs = append(errs, fmt.Errorf("SSRC %d: %v", u.ssrc, ErrDropped))
+			}
+		}
+		close(p.utterances)
+		p.Unlock()
+		for _, err := range errs {
+			p.error(err)
+		}
+		p.wg.Wait()
+	})
+}
+
+// A Log writes transcripts as JSON lines.
+type Log struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+// NewLog returns a Log writing to w.
+func NewLog(w io.Writer) *Log {
+	return &Log{enc: json.NewEncoder(w)}
+}
+
+// Write writes t as a line of JSON.
+func (l *Log) Write(t *Transcript) error {
+	l.Lock()
+	defer l.Unlock()
+	return l.enc.Encode(t)
+}
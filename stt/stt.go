@@ -0,0 +1,162 @@
+// Package stt transcribes what each speaker in a voice channel says.
+//
+// A Pipeline decodes the received packets of each SSRC, splits the audio
+// into utterances with a voice activity detector and passes them to a
+// Transcriber, such as a local whisper.cpp binary run by a Command. The
+// resulting Transcripts carry the speaker's user ID and the time of the
+// utterance.
+package stt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Audio format of decoded speech.
+const (
+	SampleRate = 48000
+	FrameSize  = 960 // 20ms of mono audio
+)
+
+// A Transcriber turns speech into text.
+type Transcriber interface {
+	// Transcribe returns the text spoken in pcm, 48kHz mono audio.
+	Transcribe(ctx context.Context, pcm []int16) (string, error)
+}
+
+// A Transcript is the text of an utterance.
+type Transcript struct {
+	UserID string    `json:"user_id,omitempty"` // empty if the SSRC's user is unknown
+	SSRC   uint32    `json:"ssrc"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Text   string    `json:"text"`
+}
+
+// Message formats the transcript for a text channel, mentioning the
+// speaker.
+func (t *Transcript) Message() string {
+	who := fmt.Sprintf("SSRC %d", t.SSRC)
+	if t.UserID != "" {
+		who = "<@" + t.UserID + ">"
+	}
+	return fmt.Sprintf("`%s` %s: %s", t.Start.Format("15:04:05"), who, t.Text)
+}
+
+// whisperRate is the sample rate whisper.cpp expects.
+const whisperRate = 16000
+
+// A Command transcribes speech with a local whisper.cpp-style program. The
+// speech is written to a temporary 16kHz WAV file, whose name is appended
+// to Args after "-f", and the text is read from the program's standard
+// output.
+type Command struct {
+	Path string
+	Args []string
+}
+
+// Whisper returns a Command running whisper.cpp's whisper-cli, or an older
+// build's main, with a model file, without timestamps or progress output.
+func Whisper(path, model string) *Command {
+	return &Command{Path: path, Args: []string{"-m", model, "-nt", "-np"}}
+}
+
+// ParseCommand returns the Command of a command line such as
+// "whisper-cli -m ggml-base.en.bin -nt -np -l en". The words are split on
+// white space, without quoting.
+func ParseCommand(line string) (*Command, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil, errors.New("empty STT command")
+	}
+	return &Command{Path: args[0], Args: args[1:]}, nil
+}
+
+// Transcribe implements Transcriber.
+func (c *Command) Transcribe(ctx context.Context, pcm []int16) (string, error) {
+	f, err := ioutil.TempFile("", "stt-*.wav")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(wavFile(downsample(pcm, SampleRate/whisperRate), whisperRate))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Path, append(append([]string(nil), c.Args...), "-f", f.Name())...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %v: %s", c.Path, err, lastLine(msg))
+		}
+		return "", fmt.Errorf("%s: %v", c.Path, err)
+	}
+
+	return strings.Join(strings.Fields(stdout.String()), " "), nil
+}
+
+// lastLine returns the last line of s, where programs usually report why
+// they failed.
+func lastLine(s string) string {
+	return s[strings.LastIndexByte(s, '\n')+1:]
+}
+
+// downsample reduces the rate of pcm by factor, averaging each group of
+// samples.
+func downsample(pcm []int16, factor int) []int16 {
+	out := make([]int16, len(pcm)/factor)
+	for i := range out {
+		sum := 0
+		for _, s := range pcm[i*factor : (i+1)*factor] {
+			sum += int(s)
+		}
+		out[i] = int16(sum / factor)
+	}
+	return out
+}
+
+// wavFile returns a 16-bit mono PCM WAV file.
+func wavFile(pcm []int16, rate int) []byte {
+	var b bytes.Buffer
+	size := uint32(2 * len(pcm))
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, 36+size)
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, []uint32{16})
+	binary.Write(&b, binary.LittleEndian, []uint16{1, 1}) // PCM, mono
+	binary.Write(&b, binary.LittleEndian, []uint32{uint32(rate), uint32(rate * 2)})
+	binary.Write(&b, binary.LittleEndian, []uint16{2, 16})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, size)
+	binary.Write(&b, binary.LittleEndian, pcm)
+	return b.Bytes()
+}
+
+// Fake is a Transcriber for tests. It returns the result of Func, or a
+// description of the speech's length if Func is nil.
+type Fake struct {
+	Func func(pcm []int16) (string, error)
+}
+
+// Transcribe implements Transcriber.
+func (f *Fake) Transcribe(ctx context.Context, pcm []int16) (string, error) {
+	if f.Func != nil {
+		return f.Func(pcm)
+	}
+	return fmt.Sprintf("%dms of speech", len(pcm)*1000/SampleRate), nil
+}
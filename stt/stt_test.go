@@ -0,0 +1,251 @@
+package stt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"discord-audio-stream/internal/voicetest"
+)
+
+// frame returns a frame of FrameSize samples of level.
+func frame(level int16) []int16 {
+	pcm := make([]int16, FrameSize)
+	for i := range pcm {
+		pcm[i] = level
+	}
+	return pcm
+}
+
+func TestSegmenter(t *testing.T) {
+	v := DefaultVAD
+	v.Hangover = 100 * time.Millisecond // 5 frames
+	v.MinSpeech = 60 * time.Millisecond // 3 frames
+	v.PreRoll = 40 * time.Millisecond   // 2 frames
+	v.MaxUtterance = time.Second
+
+	var s segmenter
+	at := time.Unix(1000, 0)
+	var got []*utterance
+	feed := func(level int16, frames int) {
+		for i := 0; i < frames; i++ {
+			if u := s.frame(&v, frame(level), at); u != nil {
+				got = append(got, u)
+			}
+			at = at.Add(20 * time.Millisecond)
+		}
+	}
+
+	// Silence, then 10 frames of speech with a short pause, then a long
+	// pause.
+	feed(10, 10)
+	feed(2000, 4)
+	feed(0, 2)
+	feed(2000, 4)
+	feed(0, 10)
+	if len(got) != 1 {
+		t.Fatalf("utterances incorrect: got %d, want 1", len(got))
+	}
+	u := got[0]
+	if want := time.Unix(1000, 0).Add(160 * time.Millisecond); !u.start.Equal(want) {
+		t.Errorf("start incorrect: got %v, want %v", u.start, want)
+	}
+	if want := time.Unix(1000, 0).Add(400 * time.Millisecond); !u.end.Equal(want) {
+		t.Errorf("end incorrect: got %v, want %v", u.end, want)
+	}
+	if want := 12 * FrameSize; len(u.pcm) != want {
+		t.Errorf("length incorrect: got %d, want %d", len(u.pcm), want)
+	}
+	if u.pcm[0] != 10 || u.pcm[2*FrameSize] != 2000 {
+		t.Errorf("pre-roll incorrect: got %d, %d", u.pcm[0], u.pcm[2*FrameSize])
+	}
+
+	// A click is dropped.
+	got = nil
+	feed(2000, 2)
+	feed(0, 10)
+	if len(got) != 0 {
+		t.Errorf("click not dropped: got %d utterances", len(got))
+	}
+
+	// Long speech is split.
+	feed(2000, 120)
+	if len(got) != 2 {
+		t.Errorf("long speech incorrect: got %d utterances, want 2", len(got))
+	}
+	if u := s.flush(&v); u == nil || len(u.pcm) != 22*FrameSize {
+		t.Errorf("flushed utterance incorrect: got %+v", u)
+	}
+}
+
+func newFakeDecoder() (OpusDecoder, error) { return voicetest.Decoder{Scale: 100}, nil }
+
+func TestPipeline(t *testing.T) {
+	var mu sync.Mutex
+	var transcripts []*Transcript
+	var errs []error
+	fake := &Fake{Func: func(pcm []int16) (string, error) {
+		if pcm[len(pcm)-1] == 900 {
+			return "", errors.New("failed")
+		}
+		if pcm[len(pcm)-1] == 800 {
+			return "[BLANK_AUDIO]", nil
+		}
+		return strings.Repeat("x", len(pcm)/FrameSize), nil
+	}}
+	p := NewPipeline(fake, newFakeDecoder)
+	p.OnTranscript = func(t *Transcript) {
+		mu.Lock()
+		defer mu.Unlock()
+		transcripts = append(transcripts, t)
+	}
+	p.OnError = func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+	p.SpeakingUpdate(nil, &discordgo.VoiceSpeakingUpdate{UserID: "42", SSRC: 1, Speaking: true})
+
+	write := func(ssrc uint32, level byte, packets int) {
+		for i := 0; i < packets; i++ {
+			p.WritePacket(&discordgo.Packet{SSRC: ssrc, Opus: []byte{level}})
+		}
+	}
+
+	// SSRC 1 stops sending, which ends its utterance after the hangover;
+	// SSRC 2's is ended by silence.
+	write(1, 20, 20)
+	write(2, 20, 15)
+	write(2, 0, 40)
+	write(3, 9, 20)
+	write(6, 8, 20)
+	p.WritePacket(&discordgo.Packet{SSRC: 4})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(transcripts)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Close()
+	p.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	got := map[uint32]Transcript{}
+	for _, tr := range transcripts {
+		got[tr.SSRC] = *tr
+	}
+	if tr := got[1]; tr.UserID != "42" || tr.Text != strings.Repeat("x", 20) {
+		t.Errorf("SSRC 1 transcript incorrect: got %+v", tr)
+	}
+	if tr := got[2]; tr.UserID != "" || tr.Text != strings.Repeat("x", 15) || !tr.End.After(tr.Start) {
+		t.Errorf("SSRC 2 transcript incorrect: got %+v", tr)
+	}
+	if len(transcripts) != 2 {
+		t.Errorf("transcripts incorrect: got %d, want 2", len(transcripts))
+	}
+	if len(errs) != 2 {
+		t.Errorf("errors incorrect: got %v, want decoding and transcription errors", errs)
+	}
+
+	// Packets after Close are ignored.
+	write(5, 20, 100)
+}
+
+func TestLog(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLog(&b)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tr := &Transcript{UserID: "42", SSRC: 1, Start: start, End: start.Add(time.Second), Text: "hello"}
+	if err := l.Write(tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(&Transcript{SSRC: 2, Start: start, End: start, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines incorrect: got %q", lines)
+	}
+	want := `{"user_id":"42","ssrc":1,"start":"2024-01-02T03:04:05Z","end":"2024-01-02T03:04:06Z","text":"hello"}`
+	if lines[0] != want {
+		t.Errorf("line incorrect: got %s, want %s", lines[0], want)
+	}
+	var got Transcript
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil || got.UserID != "" || got.Text != "hi" {
+		t.Errorf("line incorrect: got %+v, %v", got, err)
+	}
+
+	if msg, want := tr.Message(), "`03:04:05` <@42>: hello"; msg != want {
+		t.Errorf("Message incorrect: got %q, want %q", msg, want)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	got, err := ParseCommand(" whisper-cli -m ggml-base.en.bin -nt ")
+	want := &Command{Path: "whisper-cli", Args: []string{"-m", "ggml-base.en.bin", "-nt"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCommand incorrect: got %+v, %v, want %+v", got, err, want)
+	}
+	if _, err := ParseCommand("  "); err == nil {
+		t.Error("ParseCommand of empty line returned no error")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "stt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The script copies the WAV file it is given and prints some text.
+	script := filepath.Join(dir, "whisper")
+	copied := filepath.Join(dir, "copy.wav")
+	body := "#!/bin/sh\nwhile [ \"$1\" != -f ]; do shift; done\ncp \"$2\" " + copied + "\necho\necho '  hello'\necho 'world  '\n"
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Command{Path: script, Args: []string{"-m", "model"}}
+	text, err := c.Transcribe(context.Background(), frame(300))
+	if err != nil {
+		t.Fatalf("Transcribe returned error: %v", err)
+	}
+	if text != "hello world" {
+		t.Errorf("text incorrect: got %q, want %q", text, "hello world")
+	}
+	wav, err := ioutil.ReadFile(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 44 + 2*FrameSize/3; len(wav) != want || string(wav[:4]) != "RIFF" || wav[24] != 0x80 || wav[25] != 0x3E {
+		t.Errorf("WAV file incorrect: got %d bytes, header % x", len(wav), wav[:28])
+	}
+
+	c = &Command{Path: filepath.Join(dir, "missing")}
+	if _, err := c.Transcribe(context.Background(), frame(0)); err == nil {
+		t.Error("Transcribe with missing command returned no error")
+	}
+}
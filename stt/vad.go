@@ -0,0 +1,129 @@
+package stt
+
+import (
+	"math"
+	"time"
+)
+
+// A VAD decides where a speaker's utterances start and end, from the
+// loudness of each frame of their audio.
+type VAD struct {
+	// Threshold is the RMS level, out of 32767, above which a frame is
+	// speech.
+	Threshold float64
+
+	// MinSpeech is the least speech in an utterance; shorter ones, such
+	// as coughs and clicks, are dropped.
+	MinSpeech time.Duration
+
+	// Hangover is the silence which ends an utterance.
+	Hangover time.Duration
+
+	// MaxUtterance limits the length of an utterance; longer speech is
+	// split.
+	MaxUtterance time.Duration
+
+	// PreRoll is the audio kept before the first loud frame, so that
+	// quiet starts of words are not cut off.
+	PreRoll time.Duration
+}
+
+// DefaultVAD suits speech picked up by a headset or desk microphone.
+var DefaultVAD = VAD{
+	Threshold:    500,
+	MinSpeech:    250 * time.Millisecond,
+	Hangover:     700 * time.Millisecond,
+	MaxUtterance: 30 * time.Second,
+	PreRoll:      200 * time.Millisecond,
+}
+
+// samples returns the number of samples in d.
+func samples(d time.Duration) int {
+	return int(d * SampleRate / time.Second)
+}
+
+// duration returns the length of n samples.
+func duration(n int) time.Duration {
+	return time.Duration(n) * time.Second / SampleRate
+}
+
+// rms returns the root mean square level of pcm.
+func rms(pcm []int16) float64 {
+	if len(pcm) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+// An utterance is a speaker's audio between two pauses.
+type utterance struct {
+	ssrc       uint32
+	userID     string
+	start, end time.Time
+	pcm        []int16
+}
+
+// A segmenter splits one speaker's audio into utterances.
+type segmenter struct {
+	preRoll []int16 // recent audio before an utterance
+	pcm     []int16 // the utterance so far
+	start   time.Time
+	speech  int // samples of speech in pcm
+	silence int // samples of silence ending pcm
+}
+
+// active reports whether an utterance has started.
+func (s *segmenter) active() bool {
+	return s.pcm != nil
+}
+
+// frame adds a frame of audio received at now, returning the utterance it
+// ends, if any. Utterances are timed from the arrival of their first frame
+// and the length of their audio, as packets may arrive in bursts.
+func (s *segmenter) frame(v *VAD, pcm []int16, now time.Time) *utterance {
+	loud := rms(pcm) >= v.Threshold
+	if !s.active() {
+		if !loud {
+			s.preRoll = append(s.preRoll, pcm...)
+			if n := samples(v.PreRoll); len(s.preRoll) > n {
+				s.preRoll = append(s.preRoll[:0], s.preRoll[len(s.preRoll)-n:]...)
+			}
+			return nil
+		}
+		s.pcm = append([]int16{}, s.preRoll...)
+		s.preRoll = s.preRoll[:0]
+		s.start = now.Add(-duration(len(s.pcm)))
+		s.speech, s.silence = 0, 0
+	}
+
+	s.pcm = append(s.pcm, pcm...)
+	if loud {
+		s.speech += len(pcm)
+		s.silence = 0
+	} else {
+		s.silence += len(pcm)
+	}
+
+	if s.silence >= samples(v.Hangover) || len(s.pcm) >= samples(v.MaxUtterance) {
+		return s.flush(v)
+	}
+	return nil
+}
+
+// flush ends the current utterance, returning it unless it held too
+// little speech.
+func (s *segmenter) flush(v *VAD) *utterance {
+	if !s.active() {
+		return nil
+	}
+	pcm := s.pcm[:len(s.pcm)-s.silence]
+	s.pcm = nil
+	if s.speech < samples(v.MinSpeech) {
+		return nil
+	}
+	return &utterance{start: s.start, end: s.start.Add(duration(len(pcm))), pcm: pcm}
+}
@@ -0,0 +1,121 @@
+package tts
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"discord-audio-stream/soundboard"
+)
+
+// maxPending is the number of announcements waiting to be synthesized
+// beyond which new ones are dropped.
+const maxPending = 16
+
+// An Announcer speaks queued announcements one at a time, synthesizing
+// them in the background in the order they were made.
+type Announcer struct {
+	// Player mixes the speech into each frame; it ducks the microphone
+	// by default.
+	Player *soundboard.Player
+
+	// Timeout limits the synthesis of each announcement.
+	Timeout time.Duration
+
+	// OnError, if set, is called when an announcement can't be
+	// synthesized.
+	OnError func(text string, err error)
+
+	synth     Synthesizer
+	texts     chan string
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sync.Mutex
+	ready [][]int16
+}
+
+// NewAnnouncer returns an Announcer speaking with s. Close stops it.
+func NewAnnouncer(s Synthesizer) *Announcer {
+	a := &Announcer{
+		Player:  soundboard.NewPlayer(soundboard.Duck),
+		Timeout: 30 * time.Second,
+		synth:   s,
+		texts:   make(chan string, maxPending),
+		done:    make(chan struct{}),
+	}
+	go a.synthesize()
+	return a
+}
+
+// Announce queues text to be spoken. It reports false if too many
+// announcements are waiting, and the text was dropped.
+func (a *Announcer) Announce(text string) bool {
+	select {
+	case <-a.done:
+		return false
+	default:
+	}
+
+	select {
+	case a.texts <- text:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops synthesizing announcements. Those already synthesized are
+// still played.
+func (a *Announcer) Close() {
+	a.closeOnce.Do(func() { close(a.done) })
+}
+
+// synthesize turns queued texts into speech until Close.
+func (a *Announcer) synthesize() {
+	for {
+		var text string
+		select {
+		case <-a.done:
+			return
+		case text = <-a.texts:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+		pcm, err := a.synth.Synthesize(ctx, text)
+		cancel()
+		if err != nil {
+			if a.OnError != nil {
+				a.OnError(text, err)
+			}
+			continue
+		}
+
+		a.Lock()
+		a.ready = append(a.ready, pcm)
+		a.Unlock()
+	}
+}
+
+// Mix adds the next frame of speech to pcm, a frame of FrameSize samples
+// on its way to the voice connection, and reports whether it held any.
+// The caller's send path is responsible for the speaking state.
+func (a *Announcer) Mix(pcm []int16) bool {
+	a.Lock()
+	if !a.Player.Playing() && len(a.ready) > 0 {
+		a.Player.Play(soundboard.NewPCMSource(a.ready[0], SampleRate))
+		a.ready[0] = nil
+		a.ready = a.ready[1:]
+	}
+	a.Unlock()
+
+	a.Player.Mix(pcm)
+	return a.Player.Playing()
+}
+
+// Pending reports whether speech is playing or ready to play.
+func (a *Announcer) Pending() bool {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.ready) > 0 || a.Player.Playing()
+}
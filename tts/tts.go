@@ -0,0 +1,116 @@
+// Package tts speaks short announcements into a voice channel.
+//
+// Speech comes from a Synthesizer, such as a local espeak-ng or piper
+// binary run by a Command, and is queued by an Announcer, which mixes it
+// into the bot's send path.
+package tts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"discord-audio-stream/soundboard"
+)
+
+// Audio format of synthesized speech.
+const (
+	SampleRate = soundboard.SampleRate
+	FrameSize  = soundboard.FrameSize // 20ms of mono audio
+)
+
+// maxSpeech limits the length of synthesized speech, in samples.
+const maxSpeech = 60 * SampleRate
+
+// ErrTooLong is returned for speech longer than a minute.
+var ErrTooLong = errors.New("speech too long")
+
+// A Synthesizer turns text into speech.
+type Synthesizer interface {
+	// Synthesize returns text spoken as 48kHz mono PCM.
+	Synthesize(ctx context.Context, text string) ([]int16, error)
+}
+
+// A Command synthesizes speech with a local program, which reads the text
+// on its standard input and writes a 16-bit PCM WAV file to its standard
+// output. The WAV file is mixed down to mono and resampled to SampleRate.
+type Command struct {
+	Path string
+	Args []string
+}
+
+// Espeak returns a Command running espeak-ng with the given voice, or its
+// default voice if empty.
+func Espeak(voice string) *Command {
+	c := &Command{Path: "espeak-ng", Args: []string{"--stdin", "--stdout"}}
+	if voice != "" {
+		c.Args = append(c.Args, "-v", voice)
+	}
+	return c
+}
+
+// Piper returns a Command running piper with the given voice model file.
+func Piper(model string) *Command {
+	return &Command{Path: "piper", Args: []string{"--model", model, "--output_file", "-"}}
+}
+
+// ParseCommand returns the Command of a command line such as
+// "espeak-ng --stdout -v en". The words are split on white space, without
+// quoting. espeak-ng and piper are given the arguments they need if only
+// their name is given.
+func ParseCommand(line string) (*Command, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil, errors.New("empty TTS command")
+	}
+	if len(args) == 1 {
+		switch args[0] {
+		case "espeak-ng", "espeak":
+			c := Espeak("")
+			c.Path = args[0]
+			return c, nil
+		}
+	}
+	return &Command{Path: args[0], Args: args[1:]}, nil
+}
+
+// Synthesize implements Synthesizer.
+func (c *Command) Synthesize(ctx context.Context, text string) ([]int16, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", c.Path, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", c.Path, err)
+	}
+
+	src, err := soundboard.ReadWAV(&stdout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Path, err)
+	}
+	defer src.Close()
+
+	var pcm []int16
+	frame := make([]int16, FrameSize)
+	for {
+		err := src.ReadFrame(frame)
+		if err == io.EOF {
+			return pcm, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(pcm) >= maxSpeech {
+			return nil, ErrTooLong
+		}
+		pcm = append(pcm, frame...)
+	}
+}
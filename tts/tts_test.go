@@ -0,0 +1,152 @@
+package tts
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSynth speaks each text as 1.5 frames of its first byte, failing on
+// "fail".
+type fakeSynth struct{}
+
+func (fakeSynth) Synthesize(ctx context.Context, text string) ([]int16, error) {
+	if text == "fail" {
+		return nil, errors.New("failed")
+	}
+	pcm := make([]int16, FrameSize*3/2)
+	for i := range pcm {
+		pcm[i] = int16(text[0])
+	}
+	return pcm, nil
+}
+
+func wavFile(rate int, samples ...int16) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(0xFFFFFFFF)) // streamed
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, []uint32{16})
+	binary.Write(&b, binary.LittleEndian, []uint16{1, 1})
+	binary.Write(&b, binary.LittleEndian, []uint32{uint32(rate), uint32(rate * 2)})
+	binary.Write(&b, binary.LittleEndian, []uint16{2, 16})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(0xFFFFFFFF))
+	binary.Write(&b, binary.LittleEndian, samples)
+	return b.Bytes()
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want *Command
+	}{
+		{"espeak-ng", &Command{Path: "espeak-ng", Args: []string{"--stdin", "--stdout"}}},
+		{" piper --model en.onnx --output_file - ", &Command{Path: "piper", Args: []string{"--model", "en.onnx", "--output_file", "-"}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCommand(tt.line)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCommand(%q) incorrect: got %+v, %v, want %+v", tt.line, got, err, tt.want)
+		}
+	}
+	if _, err := ParseCommand("  "); err == nil {
+		t.Error("ParseCommand of empty line returned no error")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat not found")
+	}
+	dir, err := ioutil.TempDir("", "tts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 24kHz speech from a program writing to a pipe.
+	name := filepath.Join(dir, "speech.wav")
+	if err := ioutil.WriteFile(name, wavFile(24000, make([]int16, 720)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Command{Path: "cat", Args: []string{name}}
+	pcm, err := c.Synthesize(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("Synthesize returned error: %v", err)
+	}
+	if len(pcm) != 2*FrameSize {
+		t.Errorf("speech length incorrect: got %d, want %d", len(pcm), 2*FrameSize)
+	}
+
+	c = &Command{Path: "cat", Args: []string{filepath.Join(dir, "missing")}}
+	if _, err := c.Synthesize(context.Background(), "hello"); err == nil {
+		t.Error("Synthesize with failing command returned no error")
+	}
+}
+
+// mixFrames mixes frames of silence until the announcer has nothing more
+// to play, returning the first sample of each.
+func mixFrames(t *testing.T, a *Announcer, want int) []int16 {
+	t.Helper()
+	var got []int16
+	pcm := make([]int16, FrameSize)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got) < want && time.Now().Before(deadline) {
+		for i := range pcm {
+			pcm[i] = 0
+		}
+		if a.Mix(pcm) {
+			got = append(got, pcm[0])
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return got
+}
+
+func TestAnnouncerMix(t *testing.T) {
+	a := NewAnnouncer(fakeSynth{})
+	defer a.Close()
+	errs := make(chan string, 1)
+	a.OnError = func(text string, err error) { errs <- text }
+
+	a.Announce("a")
+	a.Announce("fail")
+	a.Announce("b")
+
+	// Each announcement takes two frames, in order.
+	if got := mixFrames(t, a, 4); !reflect.DeepEqual(got, []int16{'a', 'a', 'b', 'b'}) {
+		t.Errorf("mixed frames incorrect: got %v", got)
+	}
+	if text := <-errs; text != "fail" {
+		t.Errorf("OnError text incorrect: got %q, want fail", text)
+	}
+
+	// The microphone is ducked under speech.
+	a.Announce("c")
+	mic := make([]int16, FrameSize)
+	for i := range mic {
+		mic[i] = 1000
+	}
+	for !a.Mix(mic) {
+		time.Sleep(time.Millisecond)
+	}
+	if mic[FrameSize-1] >= 1000 {
+		t.Errorf("microphone not ducked: got %d", mic[FrameSize-1])
+	}
+
+	// Nothing is queued after Close.
+	a.Close()
+	if a.Announce("d") {
+		t.Error("Announce after Close returned true")
+	}
+}
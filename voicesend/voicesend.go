@@ -0,0 +1,125 @@
+// Package voicesend sends a stream of Opus frames to a voice connection.
+//
+// A Sender marks the bot speaking when it sends a frame. When the stream
+// pauses, it sends a few frames of silence before clearing speaking, as
+// Discord recommends, so that the receivers' decoders do not interpolate
+// past the end of the audio.
+//
+// The package also declares the Opus encoder and decoder interfaces that
+// the audio packages share, so that each is defined once.
+package voicesend
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// SilenceFrames is the number of frames of silence sent when the stream
+// pauses.
+const SilenceFrames = 5
+
+// OpusSilence is an Opus frame of silence.
+var OpusSilence = []byte{0xF8, 0xFF, 0xFE}
+
+// sendTimeout is how long a frame may wait to be queued on the voice
+// connection before it is dropped.
+const sendTimeout = time.Second
+
+// A Voice is where a Sender sends its frames, such as a
+// *discordgo.VoiceConnection.
+type Voice interface {
+	Speaking(b bool) error
+	SendOpus(frame []byte, deadline time.Time) error
+	SendStats() discordgo.VoiceSendStats
+}
+
+// An OpusEncoder encodes frames of 48kHz mono PCM, for example
+// *opus.Encoder from gopkg.in/hraban/opus.v2.
+type OpusEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+}
+
+// An OpusDecoder decodes Opus packets to mono PCM, for example
+// *opus.Decoder from gopkg.in/hraban/opus.v2 created with one channel.
+type OpusDecoder interface {
+	Decode(data []byte, pcm []int16) (int, error)
+}
+
+// A Sender sends frames to a Voice from a single goroutine.
+type Sender struct {
+	v        Voice
+	enc      OpusEncoder
+	speaking bool
+	lastSent time.Time
+
+	// Frames stay queued on OpusSend until sent, so encoded frames rotate
+	// through enough buffers to cover the queue plus the frame being sent.
+	bufs [][1000]byte
+	next int
+}
+
+// New returns a Sender sending to v, encoding PCM with enc.
+func New(v Voice, enc OpusEncoder) *Sender {
+	return &Sender{v: v, enc: enc}
+}
+
+// Send sends an Opus frame, marking the bot speaking first if needed. The
+// send queue paces the frames; a frame which can't be queued within a
+// second is dropped.
+func (s *Sender) Send(frame []byte) {
+	if !s.speaking {
+		s.v.Speaking(true)
+		s.speaking = true
+	}
+	s.v.SendOpus(frame, time.Now().Add(sendTimeout))
+	s.lastSent = time.Now()
+}
+
+// Encode encodes a frame of PCM and sends it.
+func (s *Sender) Encode(pcm []int16) error {
+	if n := s.v.SendStats().Capacity + 2; len(s.bufs) < n {
+		s.bufs = append(s.bufs, make([][1000]byte, n-len(s.bufs))...)
+	}
+	buf := s.bufs[s.next][:]
+	s.next = (s.next + 1) % len(s.bufs)
+	n, err := s.enc.Encode(pcm, buf)
+	if err != nil {
+		return err
+	}
+	s.Send(buf[:n])
+	return nil
+}
+
+// Speaking reports whether the bot is marked speaking.
+func (s *Sender) Speaking() bool {
+	return s.speaking
+}
+
+// Idle reports whether the bot is marked speaking but nothing has been
+// sent for d.
+func (s *Sender) Idle(d time.Duration) bool {
+	return s.speaking && time.Since(s.lastSent) >= d
+}
+
+// Pause sends SilenceFrames frames of silence and clears speaking, if the
+// bot is speaking.
+func (s *Sender) Pause() {
+	if !s.speaking {
+		return
+	}
+	for i := 0; i < SilenceFrames; i++ {
+		s.v.SendOpus(OpusSilence, time.Now().Add(sendTimeout))
+	}
+	s.v.Speaking(false)
+	s.speaking = false
+}
+
+// Stop clears speaking without sending silence, when sending stops for
+// good.
+func (s *Sender) Stop() {
+	if s.speaking {
+		s.v.Speaking(false)
+		s.speaking = false
+	}
+}
@@ -0,0 +1,82 @@
+package voicesend
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"discord-audio-stream/internal/voicetest"
+)
+
+// fakeEncoder encodes a frame as its first sample, failing on negative
+// ones.
+type fakeEncoder struct{}
+
+func (fakeEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	if pcm[0] < 0 {
+		return 0, errors.New("negative sample")
+	}
+	data[0] = byte(pcm[0])
+	return 1, nil
+}
+
+func TestSender(t *testing.T) {
+	v := &voicetest.Voice{}
+	s := New(v, fakeEncoder{})
+
+	// Pausing before anything is sent does nothing.
+	s.Pause()
+	if s.Speaking() || s.Idle(0) {
+		t.Error("Sender speaking before sending")
+	}
+
+	s.Send([]byte("a"))
+	if err := s.Encode([]int16{'b'}); err != nil {
+		t.Errorf("Encode returned error: %v", err)
+	}
+	if err := s.Encode([]int16{-1}); err == nil {
+		t.Error("Encode of failing frame returned nil error")
+	}
+	if !s.Speaking() || s.Idle(time.Hour) || !s.Idle(0) {
+		t.Errorf("Speaking/Idle incorrect: %t, %t, %t", s.Speaking(), s.Idle(time.Hour), s.Idle(0))
+	}
+	s.Pause()
+	s.Send([]byte("c"))
+	s.Stop()
+	s.Stop()
+
+	silence := string(OpusSilence)
+	want := []string{"speaking", "a", "b", silence, silence, silence, silence, silence, "silent", "speaking", "c", "silent"}
+	if got := v.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events incorrect: got %q, want %q", got, want)
+	}
+}
+
+// queueVoice keeps the frames sent, as OpusSend does until they are sent.
+type queueVoice struct {
+	voicetest.Voice
+	frames [][]byte
+}
+
+func (v *queueVoice) SendOpus(frame []byte, deadline time.Time) error {
+	v.frames = append(v.frames, frame)
+	return nil
+}
+
+func TestSenderBuffers(t *testing.T) {
+	v := &queueVoice{}
+	s := New(v, fakeEncoder{})
+
+	// Frames still queued, plus the one being sent, are not overwritten
+	// by the frames encoded after them.
+	for i := int16(1); i <= 10; i++ {
+		s.Encode([]int16{i})
+	}
+	queued := v.SendStats().Capacity + 1
+	for i, f := range v.frames[len(v.frames)-queued:] {
+		if want := byte(10 - queued + 1 + i); f[0] != want {
+			t.Errorf("queued frame %d incorrect: got %d, want %d", i, f[0], want)
+		}
+	}
+}